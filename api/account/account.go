@@ -2,25 +2,65 @@ package account
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/lib/pq"
 
+	"github.com/jchorl/financejc/api/exchange"
 	"github.com/jchorl/financejc/api/util"
 	"github.com/jchorl/financejc/constants"
 )
 
+// OpeningDate is the sql expression for the date an account's opening balance counts from.
+// Opening balances without a date count from before every transaction.
+const OpeningDate = "COALESCE(a.opening_date, '-infinity'::date)"
+
 // Account is a user's bank account
 type Account struct {
-	ID          int     `json:"id,omitempty"`
-	Name        string  `json:"name"`
-	Currency    string  `json:"currency"`
-	User        uint    `json:"user"`
+	ID             int        `json:"id,omitempty"`
+	Name           string     `json:"name"`
+	Currency       string     `json:"currency"`
+	User           uint       `json:"user"`
+	Type           string     `json:"type"`
+	OpeningBalance int        `json:"openingBalance"`
+	OpeningDate    *time.Time `json:"openingDate,omitempty"`
+	Institution    string     `json:"institution,omitempty"`
+	MaskedNumber   string     `json:"maskedNumber,omitempty"`
+	Closed         bool       `json:"closed"`
+	HoldingsValue  int        `json:"holdingsValue"`
+
+	// FutureValue includes every transaction, including future ones, and the market value of securities held
 	FutureValue float64 `json:"futureValue"`
+
+	// ConvertedFutureValue is the future value in the user's home currency, if a conversion was requested
+	ConvertedFutureValue *int `json:"convertedFutureValue,omitempty"`
+}
+
+type accountDB struct {
+	ID             int
+	Name           string
+	Currency       string
+	User           uint
+	Type           string
+	OpeningBalance int
+	OpeningDate    pq.NullTime
+	Institution    sql.NullString
+	MaskedNumber   sql.NullString
+	Closed         bool
 }
 
-// Get fetches all accounts of a user
-func Get(c context.Context) ([]*Account, error) {
+// Get fetches the open accounts of a user, or all of them if includeClosed is set.
+// If convert is a conversion mode, future values are also converted to the user's home currency.
+func Get(c context.Context, convert string, includeClosed bool) ([]*Account, error) {
+	if !exchange.ValidMode(convert) {
+		return nil, constants.ErrBadRequest
+	}
+
 	userID, err := util.UserIDFromContext(c)
 	if err != nil {
 		return nil, err
@@ -32,7 +72,7 @@ func Get(c context.Context) ([]*Account, error) {
 	}
 
 	accounts := []*Account{}
-	rows, err := db.Query("SELECT a.id, a.name, a.currency, a.user_id, COALESCE(SUM(t.amount), 0) FROM accounts a LEFT JOIN transactions t on t.account_id=a.id WHERE a.user_id = $1 GROUP BY a.id", userID)
+	rows, err := db.Query("SELECT a.id, a.name, a.currency, a.user_id, a.type, a.opening_balance, a.opening_date, a.institution, a.masked_number, a.closed, a.opening_balance + COALESCE(SUM(t.amount), 0), holdings_value(a.id, CURRENT_DATE) FROM accounts a LEFT JOIN transactions t on t.account_id=a.id WHERE a.user_id = $1 AND (NOT a.closed OR $2) GROUP BY a.id", userID, includeClosed)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error":  err,
@@ -43,8 +83,9 @@ func Get(c context.Context) ([]*Account, error) {
 	defer rows.Close()
 
 	for rows.Next() {
-		var account Account
-		if err := rows.Scan(&account.ID, &account.Name, &account.Currency, &account.User, &account.FutureValue); err != nil {
+		var adb accountDB
+		var futureValue, holdingsValue float64
+		if err := rows.Scan(&adb.ID, &adb.Name, &adb.Currency, &adb.User, &adb.Type, &adb.OpeningBalance, &adb.OpeningDate, &adb.Institution, &adb.MaskedNumber, &adb.Closed, &futureValue, &holdingsValue); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error":  err,
 				"userId": userID,
@@ -52,6 +93,9 @@ func Get(c context.Context) ([]*Account, error) {
 			return nil, err
 		}
 
+		account := fromDB(adb)
+		account.HoldingsValue = int(math.Round(holdingsValue))
+		account.FutureValue = futureValue + float64(account.HoldingsValue)
 		accounts = append(accounts, &account)
 	}
 	if err := rows.Err(); err != nil {
@@ -62,34 +106,110 @@ func Get(c context.Context) ([]*Account, error) {
 		return nil, err
 	}
 
+	if convert == "" {
+		return accounts, nil
+	}
+
+	converted, err := convertedValues(c, convert)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, account := range accounts {
+		value := converted[account.ID]
+		account.ConvertedFutureValue = &value
+	}
+
 	return accounts, nil
 }
 
+// convertedValues sums the opening balance, transactions and holdings of each of the user's accounts in the user's home currency
+func convertedValues(c context.Context, convert string) (map[int]int, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	homeCurrency, err := exchange.HomeCurrency(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rate := fmt.Sprintf("fx_rate(a.currency, $2, %s, a.user_id)", exchange.RateDate(convert, "t.occurred"))
+	openingRate := fmt.Sprintf("fx_rate(a.currency, $2, %s, a.user_id)", exchange.RateDate(convert, OpeningDate))
+	// securities are valued at today's prices, so they are always converted at today's rate
+	holdings := "holdings_value(a.id, CURRENT_DATE) * fx_rate(a.currency, $2, CURRENT_DATE, a.user_id)"
+	rows, err := db.Query(fmt.Sprintf("SELECT a.id, a.currency, COALESCE(a.opening_balance * %[2]s, 0) + COALESCE(SUM(t.amount * %[1]s), 0) + COALESCE(%[3]s, 0), COUNT(t.id) FILTER (WHERE %[1]s IS NULL) + CASE WHEN a.opening_balance != 0 AND %[2]s IS NULL THEN 1 ELSE 0 END FROM accounts a LEFT JOIN transactions t on t.account_id=a.id WHERE a.user_id = $1 GROUP BY a.id", rate, openingRate, holdings), userID, homeCurrency)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch converted account values")
+		return nil, err
+	}
+	defer rows.Close()
+
+	converted := map[int]int{}
+	for rows.Next() {
+		var id, missing int
+		var currency string
+		var value float64
+		if err := rows.Scan(&id, &currency, &value, &missing); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"userId": userID,
+			}).Error("failed to scan into converted account value")
+			return nil, err
+		}
+
+		if missing > 0 {
+			logrus.WithFields(logrus.Fields{
+				"accountId": id,
+				"currency":  currency,
+				"home":      homeCurrency,
+			}).Error("no exchange rate to convert account value")
+			return nil, constants.ErrMissingExchangeRate
+		}
+
+		converted[id] = exchange.Rescale(value, currency, homeCurrency)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to get converted account values from rows")
+		return nil, err
+	}
+
+	return converted, nil
+}
+
 // BatchImport batch imports accounts
 func BatchImport(c context.Context, accounts []Account) error {
 	if !util.IsAdminRequest(c) {
 		return constants.ErrForbidden
 	}
 
-	db, err := util.SQLDBFromContext(c)
-	if err != nil {
-		return err
-	}
-
-	txn, err := db.Begin()
+	txn, commit, err := util.TxFromContext(c)
 	if err != nil {
 		logrus.WithError(err).Error("unable to begin transaction when batch inserting accounts")
 		return err
 	}
 
-	stmt, err := txn.Prepare(pq.CopyIn("accounts", "id", "name", "currency", "user_id"))
+	stmt, err := txn.Prepare(pq.CopyIn("accounts", "id", "name", "currency", "user_id", "type", "opening_balance", "opening_date", "institution", "masked_number", "closed"))
 	if err != nil {
 		logrus.WithError(err).Error("unable to begin copy in when batch inserting accounts")
 		return err
 	}
 
 	for _, account := range accounts {
-		_, err = stmt.Exec(account.ID, account.Name, account.Currency, account.User)
+		adb := toDB(account)
+		_, err = stmt.Exec(adb.ID, adb.Name, adb.Currency, adb.User, adb.Type, adb.OpeningBalance, adb.OpeningDate, adb.Institution, adb.MaskedNumber, adb.Closed)
 		if err != nil {
 			logrus.WithError(err).Error("unable to exec transaction copy when batch inserting accounts")
 			return err
@@ -108,7 +228,7 @@ func BatchImport(c context.Context, accounts []Account) error {
 		return err
 	}
 
-	err = txn.Commit()
+	err = commit()
 	if err != nil {
 		logrus.WithError(err).Error("unable to commit account copy when batch inserting accounts")
 		return err
@@ -129,7 +249,7 @@ func GetAll(c context.Context) ([]Account, error) {
 	}
 
 	accounts := []Account{}
-	rows, err := db.Query("SELECT id, name, currency, user_id FROM accounts")
+	rows, err := db.Query("SELECT id, name, currency, user_id, type, opening_balance, opening_date, institution, masked_number, closed FROM accounts")
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error": err,
@@ -139,15 +259,15 @@ func GetAll(c context.Context) ([]Account, error) {
 	defer rows.Close()
 
 	for rows.Next() {
-		var account Account
-		if err := rows.Scan(&account.ID, &account.Name, &account.Currency, &account.User); err != nil {
+		var adb accountDB
+		if err := rows.Scan(&adb.ID, &adb.Name, &adb.Currency, &adb.User, &adb.Type, &adb.OpeningBalance, &adb.OpeningDate, &adb.Institution, &adb.MaskedNumber, &adb.Closed); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
 			}).Error("failed to scan into account")
 			return nil, err
 		}
 
-		accounts = append(accounts, account)
+		accounts = append(accounts, fromDB(adb))
 	}
 	if err := rows.Err(); err != nil {
 		logrus.WithFields(logrus.Fields{
@@ -159,6 +279,52 @@ func GetAll(c context.Context) ([]Account, error) {
 	return accounts, nil
 }
 
+// GetAllForUser queries for all accounts of the user in the context, without computing their values
+func GetAllForUser(c context.Context) ([]Account, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := []Account{}
+	rows, err := db.Query("SELECT id, name, currency, user_id, type, opening_balance, opening_date, institution, masked_number, closed FROM accounts WHERE user_id = $1", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch all accounts for user")
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var adb accountDB
+		if err := rows.Scan(&adb.ID, &adb.Name, &adb.Currency, &adb.User, &adb.Type, &adb.OpeningBalance, &adb.OpeningDate, &adb.Institution, &adb.MaskedNumber, &adb.Closed); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"userId": userID,
+			}).Error("failed to scan into account")
+			return nil, err
+		}
+
+		accounts = append(accounts, fromDB(adb))
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to get all accounts for user from rows")
+		return nil, err
+	}
+
+	return accounts, nil
+}
+
 // New creates a new account
 func New(c context.Context, account *Account) (*Account, error) {
 	userID, err := util.UserIDFromContext(c)
@@ -173,13 +339,13 @@ func New(c context.Context, account *Account) (*Account, error) {
 
 	account.User = userID
 
-	_, valid := constants.CurrencyInfo[account.Currency]
-	if !valid {
-		return nil, constants.ErrInvalidCurrency
+	if err := validate(account); err != nil {
+		return nil, err
 	}
 
+	adb := toDB(*account)
 	var id int
-	err = db.QueryRow("INSERT INTO accounts(name, currency, user_id) VALUES($1, $2, $3) RETURNING id", account.Name, account.Currency, account.User).Scan(&id)
+	err = db.QueryRow("INSERT INTO accounts(name, currency, user_id, type, opening_balance, opening_date, institution, masked_number, closed) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id", adb.Name, adb.Currency, adb.User, adb.Type, adb.OpeningBalance, adb.OpeningDate, adb.Institution, adb.MaskedNumber, adb.Closed).Scan(&id)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"Error":   err,
@@ -188,11 +354,12 @@ func New(c context.Context, account *Account) (*Account, error) {
 		return nil, err
 	}
 
-	account.ID = id
-	return account, nil
+	created := fromDB(*adb)
+	created.ID = id
+	return &created, nil
 }
 
-// Update updates an account
+// Update updates an account. Closing an account hides it from Get but keeps its history in reports.
 func Update(c context.Context, account *Account) (*Account, error) {
 	valid, err := util.UserOwnsAccount(c, account.ID)
 	if err != nil || !valid {
@@ -204,12 +371,12 @@ func Update(c context.Context, account *Account) (*Account, error) {
 		return nil, err
 	}
 
-	_, valid = constants.CurrencyInfo[account.Currency]
-	if !valid {
-		return nil, constants.ErrInvalidCurrency
+	if err := validate(account); err != nil {
+		return nil, err
 	}
 
-	_, err = db.Exec("UPDATE accounts SET name = $1, currency = $2 WHERE id = $3", account.Name, account.Currency, account.ID)
+	adb := toDB(*account)
+	_, err = db.Exec("UPDATE accounts SET name = $1, currency = $2, type = $3, opening_balance = $4, opening_date = $5, institution = $6, masked_number = $7, closed = $8 WHERE id = $9", adb.Name, adb.Currency, adb.Type, adb.OpeningBalance, adb.OpeningDate, adb.Institution, adb.MaskedNumber, adb.Closed, adb.ID)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error":   err,
@@ -218,7 +385,9 @@ func Update(c context.Context, account *Account) (*Account, error) {
 		return nil, err
 	}
 
-	return account, nil
+	updated := fromDB(*adb)
+	updated.User = account.User
+	return &updated, nil
 }
 
 // Delete deletes an account
@@ -244,3 +413,83 @@ func Delete(c context.Context, accountID int) error {
 
 	return nil
 }
+
+func validate(account *Account) error {
+	if _, valid := constants.CurrencyInfo[account.Currency]; !valid {
+		return constants.ErrInvalidCurrency
+	}
+
+	// accounts from before types existed are checking accounts
+	if account.Type == "" {
+		account.Type = constants.AccountChecking
+	}
+	if _, valid := constants.AccountTypes[account.Type]; !valid {
+		return constants.ErrBadRequest
+	}
+
+	return nil
+}
+
+// maskNumber keeps only the last four characters of an account number, so that full numbers are never stored
+func maskNumber(number string) string {
+	number = strings.Map(func(r rune) rune {
+		if r == ' ' || r == '-' {
+			return -1
+		}
+		return r
+	}, number)
+
+	if number == "" || strings.HasPrefix(number, "*") {
+		return number
+	}
+
+	if len(number) > 4 {
+		number = number[len(number)-4:]
+	}
+	return "****" + number
+}
+
+func toDB(account Account) *accountDB {
+	accountType := account.Type
+	if accountType == "" {
+		accountType = constants.AccountChecking
+	}
+
+	openingDate := pq.NullTime{}
+	if account.OpeningDate != nil {
+		openingDate = pq.NullTime{Time: *account.OpeningDate, Valid: true}
+	}
+
+	return &accountDB{
+		ID:             account.ID,
+		Name:           account.Name,
+		Currency:       account.Currency,
+		User:           account.User,
+		Type:           accountType,
+		OpeningBalance: account.OpeningBalance,
+		OpeningDate:    openingDate,
+		Institution:    util.ToNullStringNonEmpty(account.Institution),
+		MaskedNumber:   util.ToNullStringNonEmpty(maskNumber(account.MaskedNumber)),
+		Closed:         account.Closed,
+	}
+}
+
+func fromDB(account accountDB) Account {
+	var openingDate *time.Time
+	if account.OpeningDate.Valid {
+		openingDate = &account.OpeningDate.Time
+	}
+
+	return Account{
+		ID:             account.ID,
+		Name:           account.Name,
+		Currency:       account.Currency,
+		User:           account.User,
+		Type:           account.Type,
+		OpeningBalance: account.OpeningBalance,
+		OpeningDate:    openingDate,
+		Institution:    util.FromNullStringNonEmpty(account.Institution),
+		MaskedNumber:   util.FromNullStringNonEmpty(account.MaskedNumber),
+		Closed:         account.Closed,
+	}
+}
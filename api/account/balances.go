@@ -0,0 +1,101 @@
+package account
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// Balance is an account's balance at the end of a period, along with the money that moved in and out of it during the period.
+// The balance includes the market value of the securities held at the end of the period.
+type Balance struct {
+	Start         time.Time `json:"start"`
+	End           time.Time `json:"end"`
+	Balance       int       `json:"balance"`
+	HoldingsValue int       `json:"holdingsValue"`
+	Inflows       int       `json:"inflows"`
+	Outflows      int       `json:"outflows"`
+}
+
+// GetBalances computes the balance of an account at the end of every period in a date range.
+// Transactions dated after today are left out unless includeFuture is set.
+func GetBalances(c context.Context, accountID int, start, end time.Time, granularity string, includeFuture bool) ([]Balance, error) {
+	valid, err := util.UserOwnsAccount(c, accountID)
+	if err != nil || !valid {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	periods, err := util.PeriodSeries(granularity, start, end, "$2", "$3")
+	if err != nil {
+		return nil, err
+	}
+
+	// the opening balance counts towards the balance but is not money moving in or out of the account
+	query := fmt.Sprintf(`WITH periods AS (%s),
+movements AS (
+	SELECT t.occurred, t.amount, false AS opening FROM transactions t WHERE t.account_id = $1 AND (t.occurred <= CURRENT_DATE OR $4)
+	UNION ALL
+	SELECT %s, a.opening_balance, true FROM accounts a WHERE a.id = $1 AND a.opening_balance != 0
+),
+flows AS (
+	SELECT p.period_start, p.period_end,
+		COALESCE(SUM(m.amount) FILTER (WHERE NOT m.opening AND m.amount > 0), 0) AS inflows,
+		-COALESCE(SUM(m.amount) FILTER (WHERE NOT m.opening AND m.amount < 0), 0) AS outflows,
+		COALESCE(SUM(m.amount), 0) AS net
+	FROM periods p LEFT JOIN movements m ON m.occurred BETWEEN p.period_start AND p.period_end
+	GROUP BY p.period_start, p.period_end
+)
+SELECT period_start, period_end, (SELECT COALESCE(SUM(amount), 0) FROM movements WHERE occurred < $2::date) + SUM(net) OVER (ORDER BY period_start), holdings_value($1, period_end), inflows, outflows
+FROM flows
+ORDER BY period_start`, periods, OpeningDate)
+
+	rows, err := db.Query(query, accountID, start, end, includeFuture)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":       err,
+			"accountId":   accountID,
+			"start":       start,
+			"end":         end,
+			"granularity": granularity,
+		}).Error("failed to query account balances")
+		return nil, err
+	}
+	defer rows.Close()
+
+	balances := []Balance{}
+	for rows.Next() {
+		var balance Balance
+		var holdingsValue float64
+		if err := rows.Scan(&balance.Start, &balance.End, &balance.Balance, &holdingsValue, &balance.Inflows, &balance.Outflows); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":     err,
+				"accountId": accountID,
+			}).Error("failed to scan into account balance")
+			return nil, err
+		}
+
+		balance.HoldingsValue = int(math.Round(holdingsValue))
+		balance.Balance += balance.HoldingsValue
+		balances = append(balances, balance)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"accountId": accountID,
+		}).Error("failed to get account balances from rows")
+		return nil, err
+	}
+
+	return balances, nil
+}
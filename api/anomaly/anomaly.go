@@ -0,0 +1,196 @@
+package anomaly
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// Anomaly is a transaction that looks off compared to the user's history, such as a duplicate charge or an
+// unusually large amount, along with an explanation of why. Anomalies need review until they are dismissed.
+type Anomaly struct {
+	ID            int       `json:"id,omitempty"`
+	User          uint      `json:"user"`
+	TransactionID int       `json:"transactionId"`
+	Kind          string    `json:"kind"`
+	Explanation   string    `json:"explanation"`
+	Detected      time.Time `json:"detected"`
+	Dismissed     bool      `json:"dismissed"`
+}
+
+// Get fetches the anomalies of the user in the context that need review, or every one of them if includeDismissed is set
+func Get(c context.Context, includeDismissed bool) ([]Anomaly, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, transaction_id, kind, explanation, detected, dismissed FROM anomalies WHERE user_id = $1 AND (NOT dismissed OR $2) ORDER BY detected DESC, id DESC", userID, includeDismissed)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch anomalies")
+		return nil, err
+	}
+
+	return scanAnomalies(rows)
+}
+
+// GetAll queries for all anomalies
+func GetAll(c context.Context) ([]Anomaly, error) {
+	if !util.IsAdminRequest(c) {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, transaction_id, kind, explanation, detected, dismissed FROM anomalies")
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch all anomalies")
+		return nil, err
+	}
+
+	return scanAnomalies(rows)
+}
+
+// Dismiss marks an anomaly as reviewed, or as needing review again if dismissed is false
+func Dismiss(c context.Context, anomalyID int, dismissed bool) error {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec("UPDATE anomalies SET dismissed = $1 WHERE id = $2 AND user_id = $3", dismissed, anomalyID, userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"anomalyId": anomalyID,
+		}).Error("could not dismiss anomaly")
+		return err
+	}
+
+	if updated, err := res.RowsAffected(); err != nil || updated == 0 {
+		return constants.ErrForbidden
+	}
+
+	return nil
+}
+
+// BatchImport batch imports anomalies
+func BatchImport(c context.Context, anomalies []Anomaly) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when batch inserting anomalies")
+		return err
+	}
+
+	stmt, err := txn.Prepare(pq.CopyIn("anomalies", "id", "user_id", "transaction_id", "kind", "explanation", "detected", "dismissed"))
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin copy in when batch inserting anomalies")
+		return err
+	}
+
+	for _, anomaly := range anomalies {
+		_, err = stmt.Exec(anomaly.ID, anomaly.User, anomaly.TransactionID, anomaly.Kind, anomaly.Explanation, anomaly.Detected, anomaly.Dismissed)
+		if err != nil {
+			logrus.WithError(err).Error("unable to exec anomaly copy when batch inserting anomalies")
+			return err
+		}
+	}
+
+	_, err = stmt.Exec()
+	if err != nil {
+		logrus.WithError(err).Error("unable to exec batch anomaly copy when batch inserting anomalies")
+		return err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		logrus.WithError(err).Error("unable to close anomaly copy when batch inserting anomalies")
+		return err
+	}
+
+	err = commit()
+	if err != nil {
+		logrus.WithError(err).Error("unable to commit anomaly copy when batch inserting anomalies")
+		return err
+	}
+
+	return nil
+}
+
+// ImportForUser creates anomalies for the user in the context, mapping the exported transaction ids to the imported ones
+func ImportForUser(c context.Context, anomalies []Anomaly, transactionIDs map[int]int) error {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	for _, anomaly := range anomalies {
+		transactionID, ok := transactionIDs[anomaly.TransactionID]
+		if !ok {
+			return constants.ErrBadRequest
+		}
+
+		_, err := db.Exec("INSERT INTO anomalies(user_id, transaction_id, kind, explanation, detected, dismissed) VALUES($1, $2, $3, $4, $5, $6)", userID, transactionID, anomaly.Kind, anomaly.Explanation, anomaly.Detected, anomaly.Dismissed)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":   err,
+				"anomaly": anomaly,
+			}).Error("failed to import anomaly")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scanAnomalies(rows *sql.Rows) ([]Anomaly, error) {
+	defer rows.Close()
+
+	anomalies := []Anomaly{}
+	for rows.Next() {
+		var anomaly Anomaly
+		if err := rows.Scan(&anomaly.ID, &anomaly.User, &anomaly.TransactionID, &anomaly.Kind, &anomaly.Explanation, &anomaly.Detected, &anomaly.Dismissed); err != nil {
+			logrus.WithError(err).Error("failed to scan into anomaly")
+			return nil, err
+		}
+
+		anomalies = append(anomalies, anomaly)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get anomalies from rows")
+		return nil, err
+	}
+
+	return anomalies, nil
+}
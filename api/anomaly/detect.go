@@ -0,0 +1,310 @@
+package anomaly
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// notTransfer is the sql condition that a transaction t is not either side of a transfer
+const notTransfer = "t.related_transaction_id IS NULL AND NOT EXISTS (SELECT 1 FROM transactions r WHERE r.related_transaction_id = t.id)"
+
+// candidate is a recent transaction being checked for anomalies
+type candidate struct {
+	ID        int
+	User      uint
+	AccountID int
+	Currency  string
+	Name      string
+	Category  string
+	Occurred  time.Time
+	Amount    int
+}
+
+// finding is an anomaly found in a candidate, before it is stored
+type finding struct {
+	Kind        string
+	Explanation string
+}
+
+// Detect checks the transactions of every user that were added since it last ran for anomalies, and stores what it finds.
+// Transactions are picked by id rather than date, so backdated and imported transactions are checked too. The first run
+// starts from the transactions of the last few days. Each transaction is compared to the charges that came before it,
+// so findings only depend on the user's own history. Anomalies that were already found, including dismissed ones, are left alone.
+func Detect(c context.Context) error {
+	logrus.Debug("running anomaly detection")
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	after, err := lastChecked(db, today.AddDate(0, 0, -constants.AnomalyLookbackDays))
+	if err != nil {
+		return err
+	}
+
+	// transactions added while checking are left for the next run
+	var newest int
+	if err := db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM transactions").Scan(&newest); err != nil {
+		logrus.WithError(err).Error("failed to fetch newest transaction to check for anomalies")
+		return err
+	}
+
+	candidates, err := getCandidates(db, after, newest)
+	if err != nil {
+		return err
+	}
+
+	logrus.Debugf("checking %d transactions for anomalies", len(candidates))
+
+	for _, t := range candidates {
+		duplicateOf, err := getDuplicateOf(db, t)
+		if err != nil {
+			return err
+		}
+
+		payeeHistory, err := getHistory(db, t, "t.name", t.Name)
+		if err != nil {
+			return err
+		}
+
+		var categoryHistory []int
+		if t.Category != "" {
+			categoryHistory, err = getHistory(db, t, "t.category", t.Category)
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, f := range detect(t, duplicateOf, payeeHistory, categoryHistory) {
+			_, err := db.Exec("INSERT INTO anomalies(user_id, transaction_id, kind, explanation, detected) VALUES($1, $2, $3, $4, $5) ON CONFLICT (transaction_id, kind) DO NOTHING", t.User, t.ID, f.Kind, f.Explanation, today)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error":       err,
+					"transaction": t,
+					"kind":        f.Kind,
+				}).Error("failed to insert anomaly")
+				return err
+			}
+		}
+	}
+
+	_, err = db.Exec("INSERT INTO anomaly_checks(last_transaction_id) VALUES($1) ON CONFLICT (id) DO UPDATE SET last_transaction_id = EXCLUDED.last_transaction_id", newest)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"newest": newest,
+		}).Error("failed to record the last transaction checked for anomalies")
+		return err
+	}
+
+	return nil
+}
+
+// lastChecked returns the id of the last transaction checked for anomalies. Before anything has been checked,
+// it is the id just before the oldest transaction since a date.
+func lastChecked(db util.DB, since time.Time) (int, error) {
+	var last int
+	err := db.QueryRow("SELECT last_transaction_id FROM anomaly_checks").Scan(&last)
+	if err == nil {
+		return last, nil
+	}
+	if err != sql.ErrNoRows {
+		logrus.WithError(err).Error("failed to fetch the last transaction checked for anomalies")
+		return 0, err
+	}
+
+	err = db.QueryRow("SELECT COALESCE(MIN(id) - 1, MAX(id), 0) FROM transactions WHERE occurred > $1::date", since).Scan(&last)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"since": since,
+		}).Error("failed to fetch the first transaction to check for anomalies")
+		return 0, err
+	}
+
+	return last, nil
+}
+
+// detect finds the anomalies in a transaction. duplicateOf is the date of an earlier transaction it duplicates, if any,
+// and the histories are the amounts of the charges before it to the same payee and category, newest first.
+func detect(t candidate, duplicateOf *time.Time, payeeHistory, categoryHistory []int) []finding {
+	findings := []finding{}
+	if duplicateOf != nil {
+		findings = append(findings, finding{
+			Kind:        constants.AnomalyDuplicate,
+			Explanation: fmt.Sprintf("Same amount and payee as a transaction on %s in the same account", duplicateOf.Format("2006-01-02")),
+		})
+	}
+
+	// only money going out is compared to what was spent before
+	if t.Amount >= 0 {
+		return findings
+	}
+	spent := -t.Amount
+
+	if usual, ok := priceIncrease(spent, payeeHistory); ok {
+		findings = append(findings, finding{
+			Kind:        constants.AnomalyPriceIncrease,
+			Explanation: fmt.Sprintf("Charged %s by %s, up from %s for each of the last %d charges", util.FormatAmount(spent, t.Currency), t.Name, util.FormatAmount(usual, t.Currency), constants.AnomalyPriceRuns),
+		})
+	} else if mean, stddev, ok := unusual(spent, payeeHistory); ok {
+		findings = append(findings, finding{
+			Kind:        constants.AnomalyUnusualPayee,
+			Explanation: fmt.Sprintf("Spent %s at %s, usually %s give or take %s", util.FormatAmount(spent, t.Currency), t.Name, util.FormatAmount(int(math.Round(mean)), t.Currency), util.FormatAmount(int(math.Round(stddev)), t.Currency)),
+		})
+	}
+
+	if mean, stddev, ok := unusual(spent, categoryHistory); ok {
+		findings = append(findings, finding{
+			Kind:        constants.AnomalyUnusualCategory,
+			Explanation: fmt.Sprintf("Spent %s on %s, usually %s give or take %s", util.FormatAmount(spent, t.Currency), t.Category, util.FormatAmount(int(math.Round(mean)), t.Currency), util.FormatAmount(int(math.Round(stddev)), t.Currency)),
+		})
+	}
+
+	return findings
+}
+
+// priceIncrease checks whether an amount spent is more than the same amount spent on each of the last few charges,
+// returning that usual amount
+func priceIncrease(spent int, history []int) (int, bool) {
+	if len(history) < constants.AnomalyPriceRuns {
+		return 0, false
+	}
+
+	usual := -history[0]
+	for _, amount := range history[1:constants.AnomalyPriceRuns] {
+		if -amount != usual {
+			return 0, false
+		}
+	}
+
+	return usual, spent > usual
+}
+
+// unusual checks whether an amount spent is too far above the average of the charges before it,
+// returning the average and standard deviation of those charges
+func unusual(spent int, history []int) (float64, float64, bool) {
+	if len(history) < constants.AnomalyMinHistory {
+		return 0, 0, false
+	}
+
+	var sum float64
+	for _, amount := range history {
+		sum += float64(-amount)
+	}
+	mean := sum / float64(len(history))
+
+	var squares float64
+	for _, amount := range history {
+		squares += math.Pow(float64(-amount)-mean, 2)
+	}
+	stddev := math.Sqrt(squares / float64(len(history)))
+
+	// charges that never vary are left to the price increase check
+	if stddev == 0 {
+		return mean, stddev, false
+	}
+
+	return mean, stddev, float64(spent)-mean > constants.AnomalyStdDevs*stddev
+}
+
+// getCandidates fetches every transaction after one id up to and including another that is not a transfer
+func getCandidates(db util.DB, after, upTo int) ([]candidate, error) {
+	rows, err := db.Query(`SELECT t.id, a.user_id, t.account_id, a.currency, t.name, COALESCE(t.category, ''), t.occurred, t.amount
+FROM transactions t JOIN accounts a ON a.id = t.account_id
+WHERE t.id > $1 AND t.id <= $2 AND `+notTransfer+`
+ORDER BY t.id`, after, upTo)
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch transactions to check for anomalies")
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := []candidate{}
+	for rows.Next() {
+		var t candidate
+		if err := rows.Scan(&t.ID, &t.User, &t.AccountID, &t.Currency, &t.Name, &t.Category, &t.Occurred, &t.Amount); err != nil {
+			logrus.WithError(err).Error("failed to scan into transaction to check for anomalies")
+			return nil, err
+		}
+
+		candidates = append(candidates, t)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get transactions to check for anomalies from rows")
+		return nil, err
+	}
+
+	return candidates, nil
+}
+
+// getDuplicateOf returns the date of an earlier transaction with the same amount and payee in the same account
+// a few days either side of a transaction. Only the later of the two is a duplicate.
+func getDuplicateOf(db util.DB, t candidate) (*time.Time, error) {
+	var occurred time.Time
+	err := db.QueryRow(`SELECT t.occurred FROM transactions t
+WHERE t.account_id = $1 AND t.amount = $2 AND t.name = $3 AND t.id < $4 AND t.occurred BETWEEN $5::date - $6::integer AND $5::date + $6::integer AND `+notTransfer+`
+ORDER BY abs(t.occurred - $5::date)
+LIMIT 1`, t.AccountID, t.Amount, t.Name, t.ID, t.Occurred, constants.AnomalyDuplicateDays).Scan(&occurred)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":       err,
+			"transaction": t,
+		}).Error("failed to check for duplicate transactions")
+		return nil, err
+	}
+
+	return &occurred, nil
+}
+
+// getHistory fetches the amounts of the charges in the same currency before a transaction that have the same value
+// of a column, newest first
+func getHistory(db util.DB, t candidate, column, value string) ([]int, error) {
+	// the column is never user input, so it is safe to build into the query
+	rows, err := db.Query(fmt.Sprintf(`SELECT t.amount FROM transactions t JOIN accounts a ON a.id = t.account_id
+WHERE a.user_id = $1 AND a.currency = $2 AND %s = $3 AND t.amount < 0
+	AND (t.occurred < $4::date OR (t.occurred = $4::date AND t.id < $5)) AND t.occurred >= $4::date - $6::integer AND `+notTransfer+`
+ORDER BY t.occurred DESC, t.id DESC`, column), t.User, t.Currency, value, t.Occurred, t.ID, constants.AnomalyHistoryDays)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":       err,
+			"transaction": t,
+			"column":      column,
+		}).Error("failed to fetch history to check for anomalies")
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []int{}
+	for rows.Next() {
+		var amount int
+		if err := rows.Scan(&amount); err != nil {
+			logrus.WithError(err).Error("failed to scan into history to check for anomalies")
+			return nil, err
+		}
+
+		history = append(history, amount)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get history to check for anomalies from rows")
+		return nil, err
+	}
+
+	return history, nil
+}
@@ -0,0 +1,49 @@
+// +build integration
+
+package anomaly
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/financejc/constants"
+)
+
+func kinds(findings []finding) []string {
+	k := []string{}
+	for _, f := range findings {
+		k = append(k, f.Kind)
+	}
+	return k
+}
+
+func TestDetect(t *testing.T) {
+	occurred := time.Date(2017, time.March, 4, 0, 0, 0, 0, time.UTC)
+	streaming := candidate{Name: "Streaming", Category: "Entertainment", Currency: "USD", Occurred: occurred, Amount: -1299}
+
+	findings := detect(streaming, nil, []int{-999, -999, -999, -899}, nil)
+	require.Equal(t, []string{constants.AnomalyPriceIncrease}, kinds(findings))
+	require.Equal(t, "Charged 12.99 by Streaming, up from 9.99 for each of the last 3 charges", findings[0].Explanation)
+
+	require.Empty(t, detect(streaming, nil, []int{-999, -1299, -999}, nil), "Charges that already varied should not be a price increase")
+	require.Empty(t, detect(streaming, nil, []int{-1299, -1299, -1299}, nil), "The same price should not be an increase")
+
+	groceries := candidate{Name: "Grocer", Category: "Food/Groceries", Currency: "USD", Occurred: occurred, Amount: -40000}
+	history := []int{-8000, -9000, -10000, -11000, -12000}
+	findings = detect(groceries, nil, history, history)
+	require.Equal(t, []string{constants.AnomalyUnusualPayee, constants.AnomalyUnusualCategory}, kinds(findings))
+	require.Equal(t, "Spent 400.00 at Grocer, usually 100.00 give or take 14.14", findings[0].Explanation)
+
+	groceries.Amount = -13000
+	require.Empty(t, detect(groceries, nil, history, history), "Amounts within the usual spread should not be unusual")
+	groceries.Amount = -40000
+	require.Empty(t, detect(groceries, nil, history[:4], nil), "Too little history should not be judged")
+
+	duplicateOf := occurred.AddDate(0, 0, -1)
+	refund := candidate{Name: "Grocer", Currency: "USD", Occurred: occurred, Amount: 40000}
+	findings = detect(refund, &duplicateOf, history, history)
+	require.Equal(t, []string{constants.AnomalyDuplicate}, kinds(findings), "Money coming in should only be checked for duplicates")
+	require.Equal(t, "Same amount and payee as a transaction on 2017-03-03 in the same account", findings[0].Explanation)
+}
@@ -0,0 +1,134 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// Actions that are recorded in the audit log
+const (
+	ActionUserDeleted = "userDeleted"
+)
+
+// Entry is a row of the audit log
+type Entry struct {
+	ID       int       `json:"id"`
+	User     uint      `json:"user"`
+	Action   string    `json:"action"`
+	Detail   string    `json:"detail,omitempty"`
+	Occurred time.Time `json:"occurred"`
+}
+
+// Record adds an entry to the audit log. The user id is kept even though the user
+// may no longer exist, e.g. after they have deleted their account.
+func Record(c context.Context, userID uint, action, detail string) error {
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO audit_log(user_id, action, detail) VALUES($1, $2, $3)", userID, action, util.ToNullStringNonEmpty(detail))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+			"action": action,
+			"detail": detail,
+		}).Error("failed to insert audit log row")
+		return err
+	}
+
+	return nil
+}
+
+// GetAll queries for the whole audit log
+func GetAll(c context.Context) ([]Entry, error) {
+	if !util.IsAdminRequest(c) {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, action, detail, occurred FROM audit_log")
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch audit log")
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []Entry{}
+	for rows.Next() {
+		var entry Entry
+		var detail sql.NullString
+		if err := rows.Scan(&entry.ID, &entry.User, &entry.Action, &detail, &entry.Occurred); err != nil {
+			logrus.WithError(err).Error("failed to scan into audit log entry")
+			return nil, err
+		}
+		entry.Detail = util.FromNullStringNonEmpty(detail)
+
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get audit log entries from rows")
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// BatchImport batch imports audit log entries
+func BatchImport(c context.Context, entries []Entry) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when batch inserting audit log")
+		return err
+	}
+
+	stmt, err := txn.Prepare(pq.CopyIn("audit_log", "id", "user_id", "action", "detail", "occurred"))
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin copy in when batch inserting audit log")
+		return err
+	}
+
+	for _, entry := range entries {
+		_, err = stmt.Exec(entry.ID, entry.User, entry.Action, util.ToNullStringNonEmpty(entry.Detail), entry.Occurred)
+		if err != nil {
+			logrus.WithError(err).Error("unable to exec audit log copy when batch inserting audit log")
+			return err
+		}
+	}
+
+	_, err = stmt.Exec()
+	if err != nil {
+		logrus.WithError(err).Error("unable to exec batch audit log copy when batch inserting audit log")
+		return err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		logrus.WithError(err).Error("unable to close audit log copy when batch inserting audit log")
+		return err
+	}
+
+	err = commit()
+	if err != nil {
+		logrus.WithError(err).Error("unable to commit audit log copy when batch inserting audit log")
+		return err
+	}
+
+	return nil
+}
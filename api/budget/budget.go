@@ -0,0 +1,377 @@
+package budget
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+
+	"github.com/jchorl/financejc/api/exchange"
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+const upsertQuery = "INSERT INTO budgets(user_id, category, month, amount, rollover) VALUES($1, $2, $3, $4, $5) ON CONFLICT (user_id, category, month) DO UPDATE SET amount = EXCLUDED.amount, rollover = EXCLUDED.rollover RETURNING id"
+
+// Budget is the amount a user plans to spend in a category in a month, in minor units of their home currency.
+// A budget for a category also covers its subcategories. If rollover is set, whatever is left over or
+// overspent at the end of the month is carried into the next month's budget for the category.
+type Budget struct {
+	ID       int       `json:"id,omitempty"`
+	User     uint      `json:"user"`
+	Category string    `json:"category"`
+	Month    time.Time `json:"month"`
+	Amount   int       `json:"amount"`
+	Rollover bool      `json:"rollover"`
+}
+
+// Get fetches the budgets of the user in the context for the month containing a date
+func Get(c context.Context, month time.Time) ([]Budget, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, category, month, amount, rollover FROM budgets WHERE user_id = $1 AND month = $2 ORDER BY category", userID, monthOf(month))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+			"month":  month,
+		}).Error("failed to fetch budgets")
+		return nil, err
+	}
+
+	return scanBudgets(rows)
+}
+
+// GetAll queries for all budgets
+func GetAll(c context.Context) ([]Budget, error) {
+	if !util.IsAdminRequest(c) {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, category, month, amount, rollover FROM budgets")
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch all budgets")
+		return nil, err
+	}
+
+	return scanBudgets(rows)
+}
+
+// GetAllForUser queries for all budgets of the user in the context
+func GetAllForUser(c context.Context) ([]Budget, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, category, month, amount, rollover FROM budgets WHERE user_id = $1", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch budgets for user")
+		return nil, err
+	}
+
+	return scanBudgets(rows)
+}
+
+// Set sets the budget of a category in a month, replacing any budget already set for the category that month
+func Set(c context.Context, budget *Budget) (*Budget, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	budget.User = userID
+	if err := validate(budget); err != nil {
+		return nil, err
+	}
+
+	if err := upsert(db, budget); err != nil {
+		return nil, err
+	}
+
+	return budget, nil
+}
+
+// Delete deletes a budget
+func Delete(c context.Context, budgetID int) error {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec("DELETE FROM budgets WHERE id = $1 AND user_id = $2", budgetID, userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":    err,
+			"budgetId": budgetID,
+		}).Error("could not delete budget")
+		return err
+	}
+
+	if deleted, err := res.RowsAffected(); err != nil || deleted == 0 {
+		return constants.ErrForbidden
+	}
+
+	return nil
+}
+
+// CopyPreviousMonth copies the budgets of the month before a month into it. Categories that are already
+// budgeted in the month are left alone. It returns the budgets of the month.
+func CopyPreviousMonth(c context.Context, month time.Time) ([]Budget, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	month = monthOf(month)
+	_, err = db.Exec("INSERT INTO budgets(user_id, category, month, amount, rollover) SELECT user_id, category, $2, amount, rollover FROM budgets WHERE user_id = $1 AND month = $3 ON CONFLICT (user_id, category, month) DO NOTHING", userID, month, month.AddDate(0, -1, 0))
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+			"month":  month,
+		}).Error("failed to copy budgets from previous month")
+		return nil, err
+	}
+
+	return Get(c, month)
+}
+
+// SetFromAverage budgets every category that was spent in during the months before a month at the
+// average spent per month, replacing any budgets already set for those categories. months must be 3, 6 or 12.
+// Since a budget covers its subcategories, categories above those spent in are budgeted for all they cover.
+// It returns the budgets of the month.
+func SetFromAverage(c context.Context, month time.Time, months int) ([]Budget, error) {
+	if months != 3 && months != 6 && months != 12 {
+		return nil, constants.ErrBadRequest
+	}
+
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	homeCurrency, err := exchange.HomeCurrency(c)
+	if err != nil {
+		return nil, err
+	}
+
+	month = monthOf(month)
+	spent, err := spending(c, homeCurrency, month.AddDate(0, -months, 0), month)
+	if err != nil {
+		return nil, err
+	}
+
+	totals := map[string]int{}
+	for _, categories := range spent {
+		for category, amount := range categories {
+			totals[category] += amount
+		}
+	}
+	totals = withAncestors(totals)
+
+	existing, err := Get(c, month)
+	if err != nil {
+		return nil, err
+	}
+	rollover := map[string]bool{}
+	for _, budget := range existing {
+		rollover[budget.Category] = budget.Rollover
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when setting budgets from average")
+		return nil, err
+	}
+
+	for category, total := range totals {
+		// categories that brought in more than was spent are income, which is not budgeted
+		if total <= 0 {
+			continue
+		}
+
+		budget := Budget{
+			User:     userID,
+			Category: category,
+			Month:    month,
+			Amount:   (total + months/2) / months,
+			Rollover: rollover[category],
+		}
+		if err := upsert(txn, &budget); err != nil {
+			util.RollbackIfOwned(c, txn)
+			return nil, err
+		}
+	}
+
+	if err := commit(); err != nil {
+		logrus.WithError(err).Error("unable to commit setting budgets from average")
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	return Get(c, month)
+}
+
+// BatchImport batch imports budgets
+func BatchImport(c context.Context, budgets []Budget) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when batch inserting budgets")
+		return err
+	}
+
+	stmt, err := txn.Prepare(pq.CopyIn("budgets", "id", "user_id", "category", "month", "amount", "rollover"))
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin copy in when batch inserting budgets")
+		return err
+	}
+
+	for _, budget := range budgets {
+		_, err = stmt.Exec(budget.ID, budget.User, budget.Category, budget.Month, budget.Amount, budget.Rollover)
+		if err != nil {
+			logrus.WithError(err).Error("unable to exec budget copy when batch inserting budgets")
+			return err
+		}
+	}
+
+	_, err = stmt.Exec()
+	if err != nil {
+		logrus.WithError(err).Error("unable to exec batch budget copy when batch inserting budgets")
+		return err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		logrus.WithError(err).Error("unable to close budget copy when batch inserting budgets")
+		return err
+	}
+
+	err = commit()
+	if err != nil {
+		logrus.WithError(err).Error("unable to commit budget copy when batch inserting budgets")
+		return err
+	}
+
+	return nil
+}
+
+// ImportForUser sets budgets for the user in the context, replacing budgets already set for the same category and month
+func ImportForUser(c context.Context, budgets []Budget) error {
+	for _, budget := range budgets {
+		budget.ID = 0
+		if _, err := Set(c, &budget); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// monthOf returns the first day of the month containing a date
+// withAncestors adds what was spent in each category to every category above it, since budgets cover subcategories
+func withAncestors(totals map[string]int) map[string]int {
+	rolled := map[string]int{}
+	for category, amount := range totals {
+		for {
+			rolled[category] += amount
+			parent := strings.LastIndex(category, "/")
+			if parent < 0 {
+				break
+			}
+			category = category[:parent]
+		}
+	}
+
+	return rolled
+}
+
+func monthOf(date time.Time) time.Time {
+	return time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+func validate(budget *Budget) error {
+	if budget.Category == "" || budget.Amount < 0 || budget.Month.IsZero() {
+		return constants.ErrBadRequest
+	}
+
+	budget.Month = monthOf(budget.Month)
+	return nil
+}
+
+func upsert(db util.DB, budget *Budget) error {
+	err := db.QueryRow(upsertQuery, budget.User, budget.Category, budget.Month, budget.Amount, budget.Rollover).Scan(&budget.ID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"budget": budget,
+		}).Error("failed to upsert budget")
+		return err
+	}
+
+	return nil
+}
+
+func scanBudgets(rows *sql.Rows) ([]Budget, error) {
+	defer rows.Close()
+
+	budgets := []Budget{}
+	for rows.Next() {
+		var budget Budget
+		if err := rows.Scan(&budget.ID, &budget.User, &budget.Category, &budget.Month, &budget.Amount, &budget.Rollover); err != nil {
+			logrus.WithError(err).Error("failed to scan into budget")
+			return nil, err
+		}
+
+		budgets = append(budgets, budget)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get budgets from rows")
+		return nil, err
+	}
+
+	return budgets, nil
+}
@@ -0,0 +1,26 @@
+// +build integration
+
+package budget
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithAncestors(t *testing.T) {
+	rolled := withAncestors(map[string]int{
+		"Food":                    1000,
+		"Food/Groceries":          30000,
+		"Food/Restaurants/Coffee": 2000,
+		"Rent":                    150000,
+	})
+
+	require.Equal(t, map[string]int{
+		"Food":                    33000,
+		"Food/Groceries":          30000,
+		"Food/Restaurants":        2000,
+		"Food/Restaurants/Coffee": 2000,
+		"Rent":                    150000,
+	}, rolled, "Categories should be budgeted for all of their subcategories")
+}
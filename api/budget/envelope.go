@@ -0,0 +1,642 @@
+package budget
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+
+	"github.com/jchorl/financejc/api/exchange"
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+const (
+	assignQuery = "INSERT INTO envelope_assignments(user_id, category, month, amount) VALUES($1, $2, $3, $4) ON CONFLICT (user_id, category, month) DO UPDATE SET amount = EXCLUDED.amount RETURNING id"
+	fundQuery   = "INSERT INTO envelope_assignments(user_id, category, month, amount) VALUES($1, $2, $3, $4) ON CONFLICT (user_id, category, month) DO UPDATE SET amount = envelope_assignments.amount + EXCLUDED.amount"
+)
+
+// Assignment is the amount of income, in minor units of the user's home currency, assigned to a category's envelope in a month
+type Assignment struct {
+	ID       int       `json:"id,omitempty"`
+	User     uint      `json:"user"`
+	Category string    `json:"category"`
+	Month    time.Time `json:"month"`
+	Amount   int       `json:"amount"`
+}
+
+// Move moves money that was assigned to one envelope in a month to another
+type Move struct {
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Month  time.Time `json:"month"`
+	Amount int       `json:"amount"`
+}
+
+// IncomeCategory is a category whose transactions fund the pool of money a user assigns to envelopes.
+// It also covers its subcategories.
+type IncomeCategory struct {
+	User     uint   `json:"user"`
+	Category string `json:"category"`
+}
+
+// Envelopes is the state of every envelope of a user in a month, in their home currency.
+// Income is what came into income categories during the month, and AvailableToAssign is all income
+// so far that has not been assigned to an envelope. Envelopes that were overspent last month start the
+// month empty, and what they were overspent by comes out of the money available to assign instead.
+type Envelopes struct {
+	Month              time.Time  `json:"month"`
+	Currency           string     `json:"currency"`
+	Income             int        `json:"income"`
+	Assigned           int        `json:"assigned"`
+	OverspentLastMonth int        `json:"overspentLastMonth"`
+	AvailableToAssign  int        `json:"availableToAssign"`
+	Envelopes          []Envelope `json:"envelopes"`
+}
+
+// Envelope is the state of a category's envelope in a month. Available is what is carried from last month, plus what was
+// assigned, less what was spent. It is negative if the envelope is overspent.
+type Envelope struct {
+	Category  string `json:"category"`
+	Carried   int    `json:"carried"`
+	Assigned  int    `json:"assigned"`
+	Spent     int    `json:"spent"`
+	Available int    `json:"available"`
+}
+
+// GetEnvelopes fetches the state of the envelopes of the user in the context in the month containing a date
+func GetEnvelopes(c context.Context, month time.Time) (Envelopes, error) {
+	if err := requireEnvelopeMode(c); err != nil {
+		return Envelopes{}, err
+	}
+
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return Envelopes{}, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return Envelopes{}, err
+	}
+
+	homeCurrency, err := exchange.HomeCurrency(c)
+	if err != nil {
+		return Envelopes{}, err
+	}
+
+	// envelopes carry their balances forever, so the state is built up from the user's first transaction or assignment
+	month = monthOf(month)
+	first := month
+	var firstActivity pq.NullTime
+	err = db.QueryRow(`SELECT LEAST(
+(SELECT MIN(month) FROM envelope_assignments WHERE user_id = $1),
+(SELECT MIN(t.occurred) FROM transactions t JOIN accounts a ON a.id = t.account_id WHERE a.user_id = $1))`, userID).Scan(&firstActivity)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to find first envelope activity")
+		return Envelopes{}, err
+	}
+	if firstActivity.Valid && firstActivity.Time.Before(first) {
+		first = monthOf(firstActivity.Time)
+	}
+
+	rows, err := db.Query("SELECT id, user_id, category, month, amount FROM envelope_assignments WHERE user_id = $1 AND month <= $2", userID, month)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch envelope assignments")
+		return Envelopes{}, err
+	}
+
+	assignments, err := scanAssignments(rows)
+	if err != nil {
+		return Envelopes{}, err
+	}
+
+	assigned := map[time.Time]map[string]int{}
+	for _, assignment := range assignments {
+		assignmentMonth := monthOf(assignment.Month)
+		if _, ok := assigned[assignmentMonth]; !ok {
+			assigned[assignmentMonth] = map[string]int{}
+		}
+		assigned[assignmentMonth][assignment.Category] = assignment.Amount
+	}
+
+	incomeCategories, err := GetIncomeCategories(c)
+	if err != nil {
+		return Envelopes{}, err
+	}
+
+	spent, err := spending(c, homeCurrency, first, month.AddDate(0, 1, 0))
+	if err != nil {
+		return Envelopes{}, err
+	}
+
+	envelopes := fill(first, month, assigned, spent, incomeCategories)
+	envelopes.Currency = homeCurrency
+	return envelopes, nil
+}
+
+// Assign sets the amount assigned to a category's envelope in a month. It returns the state of the envelopes that month.
+func Assign(c context.Context, assignment *Assignment) (Envelopes, error) {
+	if err := requireEnvelopeMode(c); err != nil {
+		return Envelopes{}, err
+	}
+
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return Envelopes{}, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return Envelopes{}, err
+	}
+
+	if err := validateEnvelope(c, assignment.Category, assignment.Month); err != nil {
+		return Envelopes{}, err
+	}
+
+	assignment.User = userID
+	assignment.Month = monthOf(assignment.Month)
+	err = db.QueryRow(assignQuery, assignment.User, assignment.Category, assignment.Month, assignment.Amount).Scan(&assignment.ID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":      err,
+			"assignment": assignment,
+		}).Error("failed to assign to envelope")
+		return Envelopes{}, err
+	}
+
+	return GetEnvelopes(c, assignment.Month)
+}
+
+// MoveBetweenEnvelopes moves money assigned to one envelope in a month to another. It returns the state of the envelopes that month.
+func MoveBetweenEnvelopes(c context.Context, move Move) (Envelopes, error) {
+	if err := requireEnvelopeMode(c); err != nil {
+		return Envelopes{}, err
+	}
+
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return Envelopes{}, err
+	}
+
+	if move.Amount <= 0 || move.From == move.To {
+		return Envelopes{}, constants.ErrBadRequest
+	}
+	if err := validateEnvelope(c, move.From, move.Month); err != nil {
+		return Envelopes{}, err
+	}
+	if err := validateEnvelope(c, move.To, move.Month); err != nil {
+		return Envelopes{}, err
+	}
+
+	month := monthOf(move.Month)
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when moving between envelopes")
+		return Envelopes{}, err
+	}
+
+	for category, amount := range map[string]int{move.From: -move.Amount, move.To: move.Amount} {
+		if _, err := txn.Exec(fundQuery, userID, category, month, amount); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"move":  move,
+			}).Error("failed to move between envelopes")
+			util.RollbackIfOwned(c, txn)
+			return Envelopes{}, err
+		}
+	}
+
+	if err := commit(); err != nil {
+		logrus.WithError(err).Error("unable to commit moving between envelopes")
+		util.RollbackIfOwned(c, txn)
+		return Envelopes{}, err
+	}
+
+	return GetEnvelopes(c, month)
+}
+
+// GetIncomeCategories fetches the income categories of the user in the context
+func GetIncomeCategories(c context.Context) ([]string, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT user_id, category FROM income_categories WHERE user_id = $1 ORDER BY category", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch income categories")
+		return nil, err
+	}
+
+	incomeCategories, err := scanIncomeCategories(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	categories := []string{}
+	for _, incomeCategory := range incomeCategories {
+		categories = append(categories, incomeCategory.Category)
+	}
+
+	return categories, nil
+}
+
+// SetIncomeCategories replaces the income categories of the user in the context
+func SetIncomeCategories(c context.Context, categories []string) ([]string, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, category := range categories {
+		if category == "" {
+			return nil, constants.ErrBadRequest
+		}
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when setting income categories")
+		return nil, err
+	}
+
+	if _, err := txn.Exec("DELETE FROM income_categories WHERE user_id = $1", userID); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to clear income categories")
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	for _, category := range categories {
+		if _, err := txn.Exec("INSERT INTO income_categories(user_id, category) VALUES($1, $2) ON CONFLICT DO NOTHING", userID, category); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"userId":   userID,
+				"category": category,
+			}).Error("failed to insert income category")
+			util.RollbackIfOwned(c, txn)
+			return nil, err
+		}
+	}
+
+	if err := commit(); err != nil {
+		logrus.WithError(err).Error("unable to commit setting income categories")
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	return GetIncomeCategories(c)
+}
+
+// GetAllAssignments queries for all envelope assignments
+func GetAllAssignments(c context.Context) ([]Assignment, error) {
+	if !util.IsAdminRequest(c) {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, category, month, amount FROM envelope_assignments")
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch all envelope assignments")
+		return nil, err
+	}
+
+	return scanAssignments(rows)
+}
+
+// GetAllAssignmentsForUser queries for all envelope assignments of the user in the context
+func GetAllAssignmentsForUser(c context.Context) ([]Assignment, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, category, month, amount FROM envelope_assignments WHERE user_id = $1", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch envelope assignments for user")
+		return nil, err
+	}
+
+	return scanAssignments(rows)
+}
+
+// GetAllIncomeCategories queries for the income categories of all users
+func GetAllIncomeCategories(c context.Context) ([]IncomeCategory, error) {
+	if !util.IsAdminRequest(c) {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT user_id, category FROM income_categories")
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch all income categories")
+		return nil, err
+	}
+
+	return scanIncomeCategories(rows)
+}
+
+// BatchImportEnvelopes batch imports envelope assignments and income categories
+func BatchImportEnvelopes(c context.Context, assignments []Assignment, incomeCategories []IncomeCategory) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when batch inserting envelopes")
+		return err
+	}
+
+	stmt, err := txn.Prepare(pq.CopyIn("envelope_assignments", "id", "user_id", "category", "month", "amount"))
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin copy in when batch inserting envelope assignments")
+		return err
+	}
+
+	for _, assignment := range assignments {
+		_, err = stmt.Exec(assignment.ID, assignment.User, assignment.Category, assignment.Month, assignment.Amount)
+		if err != nil {
+			logrus.WithError(err).Error("unable to exec envelope assignment copy when batch inserting envelope assignments")
+			return err
+		}
+	}
+
+	_, err = stmt.Exec()
+	if err != nil {
+		logrus.WithError(err).Error("unable to exec batch envelope assignment copy when batch inserting envelope assignments")
+		return err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		logrus.WithError(err).Error("unable to close envelope assignment copy when batch inserting envelope assignments")
+		return err
+	}
+
+	stmt, err = txn.Prepare(pq.CopyIn("income_categories", "user_id", "category"))
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin copy in when batch inserting income categories")
+		return err
+	}
+
+	for _, incomeCategory := range incomeCategories {
+		_, err = stmt.Exec(incomeCategory.User, incomeCategory.Category)
+		if err != nil {
+			logrus.WithError(err).Error("unable to exec income category copy when batch inserting income categories")
+			return err
+		}
+	}
+
+	_, err = stmt.Exec()
+	if err != nil {
+		logrus.WithError(err).Error("unable to exec batch income category copy when batch inserting income categories")
+		return err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		logrus.WithError(err).Error("unable to close income category copy when batch inserting income categories")
+		return err
+	}
+
+	err = commit()
+	if err != nil {
+		logrus.WithError(err).Error("unable to commit envelope copy when batch inserting envelopes")
+		return err
+	}
+
+	return nil
+}
+
+// ImportEnvelopesForUser imports envelope assignments and income categories for the user in the context,
+// adding to any already assigned to the same envelope in the same month
+func ImportEnvelopesForUser(c context.Context, assignments []Assignment, incomeCategories []string) error {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	for _, assignment := range assignments {
+		if _, err := db.Exec(fundQuery, userID, assignment.Category, monthOf(assignment.Month), assignment.Amount); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":      err,
+				"assignment": assignment,
+			}).Error("failed to import envelope assignment")
+			return err
+		}
+	}
+
+	for _, category := range incomeCategories {
+		if _, err := db.Exec("INSERT INTO income_categories(user_id, category) VALUES($1, $2) ON CONFLICT DO NOTHING", userID, category); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"category": category,
+			}).Error("failed to import income category")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fill works out the state of envelopes in a month from what was assigned and spent in each month since the first
+func fill(first, month time.Time, assigned map[time.Time]map[string]int, spent map[time.Time]map[string]int, incomeCategories []string) Envelopes {
+	var envelopes Envelopes
+	pool := 0
+	overspent := 0
+	carried := map[string]int{}
+	for current := first; !current.After(month); current = current.AddDate(0, 1, 0) {
+		envelopes = Envelopes{
+			Month:              current,
+			OverspentLastMonth: overspent,
+			Envelopes:          []Envelope{},
+		}
+
+		byCategory := map[string]*Envelope{}
+		envelope := func(category string) *Envelope {
+			if _, ok := byCategory[category]; !ok {
+				byCategory[category] = &Envelope{Category: category}
+			}
+			return byCategory[category]
+		}
+
+		for category, amount := range carried {
+			envelope(category).Carried = amount
+		}
+		for category, amount := range assigned[current] {
+			envelope(category).Assigned = amount
+			envelopes.Assigned += amount
+		}
+		for category, amount := range spent[current] {
+			if isIncome(category, incomeCategories) {
+				envelopes.Income -= amount
+				continue
+			}
+			envelope(category).Spent = amount
+		}
+
+		pool += envelopes.Income - envelopes.Assigned - overspent
+		envelopes.AvailableToAssign = pool
+
+		overspent = 0
+		carried = map[string]int{}
+		for category, e := range byCategory {
+			e.Available = e.Carried + e.Assigned - e.Spent
+			if e.Available < 0 {
+				overspent -= e.Available
+			} else if e.Available > 0 {
+				carried[category] = e.Available
+			}
+
+			envelopes.Envelopes = append(envelopes.Envelopes, *e)
+		}
+	}
+
+	sort.Slice(envelopes.Envelopes, func(i, j int) bool {
+		return envelopes.Envelopes[i].Category < envelopes.Envelopes[j].Category
+	})
+
+	return envelopes
+}
+
+func isIncome(category string, incomeCategories []string) bool {
+	for _, incomeCategory := range incomeCategories {
+		if covers(incomeCategory, category) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// requireEnvelopeMode checks that the user in the context budgets with envelopes
+func requireEnvelopeMode(c context.Context) error {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	var mode string
+	err = db.QueryRow("SELECT budget_mode FROM users WHERE id = $1", userID).Scan(&mode)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to select budget mode of user")
+		return err
+	}
+
+	if mode != constants.BudgetModeEnvelope {
+		return constants.ErrBadRequest
+	}
+
+	return nil
+}
+
+// validateEnvelope checks that money can be assigned to a category in a month, i.e. it is not an income category
+func validateEnvelope(c context.Context, category string, month time.Time) error {
+	if category == "" || month.IsZero() {
+		return constants.ErrBadRequest
+	}
+
+	incomeCategories, err := GetIncomeCategories(c)
+	if err != nil {
+		return err
+	}
+
+	if isIncome(category, incomeCategories) {
+		return constants.ErrBadRequest
+	}
+
+	return nil
+}
+
+func scanAssignments(rows *sql.Rows) ([]Assignment, error) {
+	defer rows.Close()
+
+	assignments := []Assignment{}
+	for rows.Next() {
+		var assignment Assignment
+		if err := rows.Scan(&assignment.ID, &assignment.User, &assignment.Category, &assignment.Month, &assignment.Amount); err != nil {
+			logrus.WithError(err).Error("failed to scan into envelope assignment")
+			return nil, err
+		}
+
+		assignments = append(assignments, assignment)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get envelope assignments from rows")
+		return nil, err
+	}
+
+	return assignments, nil
+}
+
+func scanIncomeCategories(rows *sql.Rows) ([]IncomeCategory, error) {
+	defer rows.Close()
+
+	incomeCategories := []IncomeCategory{}
+	for rows.Next() {
+		var incomeCategory IncomeCategory
+		if err := rows.Scan(&incomeCategory.User, &incomeCategory.Category); err != nil {
+			logrus.WithError(err).Error("failed to scan into income category")
+			return nil, err
+		}
+
+		incomeCategories = append(incomeCategories, incomeCategory)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get income categories from rows")
+		return nil, err
+	}
+
+	return incomeCategories, nil
+}
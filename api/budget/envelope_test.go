@@ -0,0 +1,44 @@
+// +build integration
+
+package budget
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFill(t *testing.T) {
+	january := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	february := january.AddDate(0, 1, 0)
+	march := february.AddDate(0, 1, 0)
+	incomeCategories := []string{"Income"}
+	assigned := map[time.Time]map[string]int{
+		january:  {"Food": 30000, "Rent": 100000},
+		february: {"Food": 30000},
+	}
+	spent := map[time.Time]map[string]int{
+		january:  {"Income/Salary": -200000, "Food": 20000, "Rent": 100000},
+		february: {"Food": 45000, "Fun": 5000},
+	}
+
+	envelopes := fill(january, january, assigned, spent, incomeCategories)
+	require.Equal(t, 200000, envelopes.Income, "Subcategories of income categories should be income")
+	require.Equal(t, 70000, envelopes.AvailableToAssign)
+	require.Len(t, envelopes.Envelopes, 2)
+	require.Equal(t, 10000, envelopes.Envelopes[0].Available)
+
+	envelopes = fill(january, february, assigned, spent, incomeCategories)
+	require.Equal(t, 40000, envelopes.AvailableToAssign)
+	food := envelopes.Envelopes[0]
+	require.Equal(t, "Food", food.Category)
+	require.Equal(t, 10000, food.Carried, "Leftover money should carry into the next month")
+	require.Equal(t, -5000, food.Available)
+	require.Equal(t, -5000, envelopes.Envelopes[1].Available, "Spending without assigning should overspend")
+
+	envelopes = fill(january, march, assigned, spent, incomeCategories)
+	require.Equal(t, 10000, envelopes.OverspentLastMonth)
+	require.Equal(t, 30000, envelopes.AvailableToAssign, "Overspending should come out of the money available to assign")
+	require.Empty(t, envelopes.Envelopes, "Overspent envelopes should start the month empty")
+}
@@ -0,0 +1,273 @@
+package budget
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+
+	"github.com/jchorl/financejc/api/exchange"
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// Report is how a user did against their budgets in each month of a period, in their home currency
+type Report struct {
+	Currency string        `json:"currency"`
+	Months   []MonthReport `json:"months"`
+}
+
+// MonthReport is the budgeted, actual and remaining amounts of every budgeted category in a month.
+// Unbudgeted is what was spent in categories without a budget.
+type MonthReport struct {
+	Month      time.Time        `json:"month"`
+	Categories []CategoryReport `json:"categories"`
+	Budgeted   int              `json:"budgeted"`
+	Actual     int              `json:"actual"`
+	Remaining  int              `json:"remaining"`
+	Unbudgeted int              `json:"unbudgeted"`
+}
+
+// CategoryReport is the budget of a category in a month, what was carried over from the month before,
+// what was spent, and what is left
+type CategoryReport struct {
+	Category   string `json:"category"`
+	Budgeted   int    `json:"budgeted"`
+	RolledOver int    `json:"rolledOver"`
+	Actual     int    `json:"actual"`
+	Remaining  int    `json:"remaining"`
+}
+
+// GetReport compares budgets to spending in every month from the month containing start to the month containing end
+func GetReport(c context.Context, start, end time.Time) (Report, error) {
+	start, end = monthOf(start), monthOf(end)
+	if end.Before(start) || end.After(start.AddDate(0, constants.MaxReportPeriods, 0)) {
+		return Report{}, constants.ErrBadRequest
+	}
+
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return Report{}, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return Report{}, err
+	}
+
+	homeCurrency, err := exchange.HomeCurrency(c)
+	if err != nil {
+		return Report{}, err
+	}
+
+	// rollovers can be carried from any earlier month, so the months are computed from the first budget onwards
+	first := start
+	var firstBudget pq.NullTime
+	if err := db.QueryRow("SELECT MIN(month) FROM budgets WHERE user_id = $1", userID).Scan(&firstBudget); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to find first budget")
+		return Report{}, err
+	}
+	if firstBudget.Valid && firstBudget.Time.Before(first) {
+		first = monthOf(firstBudget.Time)
+	}
+
+	rows, err := db.Query("SELECT id, user_id, category, month, amount, rollover FROM budgets WHERE user_id = $1 AND month >= $2 AND month <= $3", userID, first, end)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch budgets for report")
+		return Report{}, err
+	}
+
+	budgets, err := scanBudgets(rows)
+	if err != nil {
+		return Report{}, err
+	}
+
+	budgetsByMonth := map[time.Time][]Budget{}
+	for _, budget := range budgets {
+		month := monthOf(budget.Month)
+		budgetsByMonth[month] = append(budgetsByMonth[month], budget)
+	}
+
+	spent, err := spending(c, homeCurrency, first, end.AddDate(0, 1, 0))
+	if err != nil {
+		return Report{}, err
+	}
+
+	report := Report{
+		Currency: homeCurrency,
+		Months:   []MonthReport{},
+	}
+	carried := map[string]int{}
+	for month := first; !month.After(end); month = month.AddDate(0, 1, 0) {
+		monthReport, carry := compare(month, budgetsByMonth[month], spent[month], carried)
+		carried = carry
+		if !month.Before(start) {
+			report.Months = append(report.Months, monthReport)
+		}
+	}
+
+	return report, nil
+}
+
+// compare compares a month's budgets, along with what was carried into the month, to what was spent in each category.
+// It also returns what the month carries into the next month.
+func compare(month time.Time, budgets []Budget, spent map[string]int, carried map[string]int) (MonthReport, map[string]int) {
+	report := MonthReport{
+		Month:      month,
+		Categories: []CategoryReport{},
+	}
+	carry := map[string]int{}
+
+	byCategory := map[string]CategoryReport{}
+	for _, budget := range budgets {
+		byCategory[budget.Category] = CategoryReport{Category: budget.Category, Budgeted: budget.Amount}
+	}
+	// a category that carried an amount into the month is reported even without a budget in the month,
+	// but only rollover budgets carry what is left into the next month
+	for category, amount := range carried {
+		if amount == 0 {
+			continue
+		}
+		if _, ok := byCategory[category]; !ok {
+			byCategory[category] = CategoryReport{Category: category}
+		}
+	}
+
+	budgeted := map[string]bool{}
+	for category, categoryReport := range byCategory {
+		categoryReport.RolledOver = carried[category]
+		for spentCategory, amount := range spent {
+			if covers(category, spentCategory) {
+				categoryReport.Actual += amount
+				budgeted[spentCategory] = true
+			}
+		}
+		categoryReport.Remaining = categoryReport.Budgeted + categoryReport.RolledOver - categoryReport.Actual
+		byCategory[category] = categoryReport
+
+		report.Categories = append(report.Categories, categoryReport)
+	}
+
+	// subcategories are already counted by the categories above them, so they are left out of the month totals
+	for category, categoryReport := range byCategory {
+		if coveredByAncestor(category, byCategory) {
+			continue
+		}
+
+		report.Budgeted += categoryReport.Budgeted
+		report.Actual += categoryReport.Actual
+		report.Remaining += categoryReport.Remaining
+	}
+
+	for _, budget := range budgets {
+		if budget.Rollover {
+			carry[budget.Category] = byCategory[budget.Category].Remaining
+		}
+	}
+
+	for category, amount := range spent {
+		if !budgeted[category] && amount > 0 {
+			report.Unbudgeted += amount
+		}
+	}
+
+	sort.Slice(report.Categories, func(i, j int) bool {
+		return report.Categories[i].Category < report.Categories[j].Category
+	})
+
+	return report, carry
+}
+
+// covers checks whether a budget for a category covers spending in another category, i.e. it is the category or a subcategory
+func covers(budgetCategory, category string) bool {
+	return category == budgetCategory || strings.HasPrefix(category, budgetCategory+"/")
+}
+
+// coveredByAncestor checks whether another reported category covers a category
+func coveredByAncestor(category string, byCategory map[string]CategoryReport) bool {
+	for other := range byCategory {
+		if other != category && covers(other, category) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// spending sums what the user in the context spent in each category in each month of a date range, including start
+// and excluding end, converted to their home currency at the rate on the date of each transaction.
+// Money coming into a category counts against what was spent, and transfers between accounts are left out.
+func spending(c context.Context, homeCurrency string, start, end time.Time) (map[time.Time]map[string]int, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT date_trunc('month', t.occurred)::date, t.category, a.currency, SUM(t.amount * fx_rate(a.currency, $2, t.occurred, a.user_id)), COUNT(*) FILTER (WHERE fx_rate(a.currency, $2, t.occurred, a.user_id) IS NULL)
+FROM transactions t JOIN accounts a ON a.id = t.account_id
+WHERE a.user_id = $1 AND t.occurred >= $3::date AND t.occurred < $4::date AND t.category IS NOT NULL AND t.category != ''
+	AND t.related_transaction_id IS NULL AND NOT EXISTS (SELECT 1 FROM transactions r WHERE r.related_transaction_id = t.id)
+GROUP BY 1, 2, 3`, userID, homeCurrency, start, end)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch spending by category")
+		return nil, err
+	}
+	defer rows.Close()
+
+	spent := map[time.Time]map[string]int{}
+	for rows.Next() {
+		var month time.Time
+		var category, currency string
+		var amount sql.NullFloat64
+		var missing int
+		if err := rows.Scan(&month, &category, &currency, &amount, &missing); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"userId": userID,
+			}).Error("failed to scan into spending by category")
+			return nil, err
+		}
+
+		if missing > 0 {
+			logrus.WithFields(logrus.Fields{
+				"currency": currency,
+				"home":     homeCurrency,
+				"month":    month,
+			}).Error("no exchange rate to convert spending")
+			return nil, constants.ErrMissingExchangeRate
+		}
+
+		month = monthOf(month)
+		if _, ok := spent[month]; !ok {
+			spent[month] = map[string]int{}
+		}
+		spent[month][category] -= exchange.Rescale(amount.Float64, currency, homeCurrency)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to get spending by category from rows")
+		return nil, err
+	}
+
+	return spent, nil
+}
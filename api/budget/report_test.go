@@ -0,0 +1,63 @@
+// +build integration
+
+package budget
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompare(t *testing.T) {
+	january := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	budgets := []Budget{
+		{Category: "Food", Month: january, Amount: 30000, Rollover: true},
+		{Category: "Fun", Month: january, Amount: 10000},
+	}
+	spent := map[string]int{
+		"Food":           5000,
+		"Food/Groceries": 20000,
+		"Fun":            15000,
+		"Rent":           100000,
+		"Salary":         -500000,
+	}
+
+	report, carry := compare(january, budgets, spent, map[string]int{})
+	require.Len(t, report.Categories, 2)
+	require.Equal(t, "Food", report.Categories[0].Category)
+	require.Equal(t, 25000, report.Categories[0].Actual, "Budget should cover subcategories")
+	require.Equal(t, 5000, report.Categories[0].Remaining)
+	require.Equal(t, -5000, report.Categories[1].Remaining, "Overspending should leave a negative remainder")
+	require.Equal(t, 100000, report.Unbudgeted, "Income should not count as unbudgeted spending")
+	require.Equal(t, map[string]int{"Food": 5000}, carry, "Only rollover budgets should carry")
+
+	february := january.AddDate(0, 1, 0)
+	report, carry = compare(february, nil, map[string]int{"Food": 8000}, carry)
+	require.Len(t, report.Categories, 1, "Carried amounts should show without a budget")
+	require.Equal(t, 5000, report.Categories[0].RolledOver)
+	require.Equal(t, -3000, report.Categories[0].Remaining)
+	require.Empty(t, carry, "Months without a rollover budget should not carry")
+}
+
+func TestCompareNestedBudgets(t *testing.T) {
+	january := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	budgets := []Budget{
+		{Category: "Food", Month: january, Amount: 50000},
+		{Category: "Food/Groceries", Month: january, Amount: 20000},
+		{Category: "Fun", Month: january, Amount: 10000},
+	}
+	spent := map[string]int{
+		"Food/Groceries":   25000,
+		"Food/Restaurants": 10000,
+		"Fun":              5000,
+	}
+
+	report, _ := compare(january, budgets, spent, map[string]int{})
+	require.Len(t, report.Categories, 3)
+	require.Equal(t, 35000, report.Categories[0].Actual)
+	require.Equal(t, 25000, report.Categories[1].Actual)
+	require.Equal(t, 60000, report.Budgeted, "Subcategory budgets should not count twice in the month totals")
+	require.Equal(t, 40000, report.Actual, "Subcategory spending should not count twice in the month totals")
+	require.Equal(t, 20000, report.Remaining)
+}
@@ -0,0 +1,180 @@
+package exchange
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// ecbEnvelope is the layout of the ECB reference rate xml files, e.g. eurofxref-hist.xml.
+// Each day is a Cube with a time attribute, containing a Cube per currency.
+type ecbEnvelope struct {
+	Days []struct {
+		Time  string `xml:"time,attr"`
+		Rates []struct {
+			Currency string  `xml:"currency,attr"`
+			Rate     float64 `xml:"rate,attr"`
+		} `xml:"Cube"`
+	} `xml:"Cube>Cube"`
+}
+
+// Import imports a file of ECB reference rates, in either the xml format or the csv format
+// with a Date column followed by a column per currency. Rates for currencies that are not
+// supported are skipped. It returns the number of rates imported.
+func Import(c context.Context, r io.Reader) (int, error) {
+	if !util.IsAdminRequest(c) {
+		return 0, constants.ErrForbidden
+	}
+
+	rates, err := parseECB(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := upsertAll(c, rates); err != nil {
+		return 0, err
+	}
+
+	return len(rates), nil
+}
+
+// ImportOverrides imports a file of rates in the same formats as Import, as overrides of the user in the context
+func ImportOverrides(c context.Context, r io.Reader) (int, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return 0, err
+	}
+
+	rates, err := parseECB(r)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range rates {
+		rates[i].User = userID
+	}
+
+	if err := upsertAll(c, rates); err != nil {
+		return 0, err
+	}
+
+	return len(rates), nil
+}
+
+func parseECB(r io.Reader) ([]Rate, error) {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		logrus.WithError(err).Error("unable to read exchange rate file")
+		return nil, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("<")) {
+		return parseECBXML(content)
+	}
+	return parseECBCSV(content)
+}
+
+func parseECBXML(content []byte) ([]Rate, error) {
+	envelope := ecbEnvelope{}
+	if err := xml.Unmarshal(content, &envelope); err != nil {
+		logrus.WithError(err).Error("unable to decode exchange rate xml")
+		return nil, constants.ErrBadRequest
+	}
+
+	rates := []Rate{}
+	for _, day := range envelope.Days {
+		date, err := time.Parse("2006-01-02", day.Time)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"date":  day.Time,
+			}).Error("unable to parse date in exchange rate xml")
+			return nil, constants.ErrBadRequest
+		}
+
+		for _, r := range day.Rates {
+			rate := Rate{Currency: r.Currency, Date: date, Rate: r.Rate}
+			if validate(rate) == nil {
+				rates = append(rates, rate)
+			}
+		}
+	}
+
+	return rates, nil
+}
+
+func parseECBCSV(content []byte) ([]Rate, error) {
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.TrimLeadingSpace = true
+	// the ecb files end every line with a trailing comma, and currencies come and go, so rows vary in length
+	reader.FieldsPerRecord = -1
+
+	records, err := reader.ReadAll()
+	if err != nil {
+		logrus.WithError(err).Error("unable to read exchange rate csv")
+		return nil, constants.ErrBadRequest
+	}
+
+	if len(records) == 0 || len(records[0]) == 0 || !strings.EqualFold(strings.TrimSpace(records[0][0]), "date") {
+		logrus.Error("exchange rate csv does not start with a date column")
+		return nil, constants.ErrBadRequest
+	}
+	header := records[0]
+
+	rates := []Rate{}
+	for _, record := range records[1:] {
+		date, err := parseCSVDate(record[0])
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"date":  record[0],
+			}).Error("unable to parse date in exchange rate csv")
+			return nil, constants.ErrBadRequest
+		}
+
+		for i := 1; i < len(record) && i < len(header); i++ {
+			value := strings.TrimSpace(record[i])
+			if value == "" || value == "N/A" {
+				continue
+			}
+
+			r, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": err,
+					"rate":  value,
+				}).Error("unable to parse rate in exchange rate csv")
+				return nil, constants.ErrBadRequest
+			}
+
+			rate := Rate{Currency: strings.TrimSpace(header[i]), Date: date, Rate: r}
+			if validate(rate) == nil {
+				rates = append(rates, rate)
+			}
+		}
+	}
+
+	return rates, nil
+}
+
+// parseCSVDate parses dates in the iso format of the historical files or the "02 January 2006" format of the daily file
+func parseCSVDate(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	date, err := time.Parse("2006-01-02", value)
+	if err == nil {
+		return date, nil
+	}
+
+	return time.Parse("02 January 2006", value)
+}
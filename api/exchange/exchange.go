@@ -0,0 +1,371 @@
+package exchange
+
+import (
+	"context"
+	"database/sql"
+	"math"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+const upsertQuery = "INSERT INTO exchange_rates(user_id, currency, effective, rate) VALUES($1, $2, $3, $4) ON CONFLICT ((COALESCE(user_id, 0)), currency, effective) DO UPDATE SET rate = EXCLUDED.rate"
+
+// Rate is the number of units of a currency that one unit of the base currency bought from a date onwards.
+// Rates without a user are shared by everyone. A user's own rates override the shared rates in their conversions.
+type Rate struct {
+	User     uint      `json:"user,omitempty"`
+	Currency string    `json:"currency"`
+	Date     time.Time `json:"date"`
+	Rate     float64   `json:"rate"`
+}
+
+// Get fetches the shared rate history of a currency, newest first.
+// If no currency is given, the latest rate of every currency is returned instead.
+func Get(c context.Context, currency string) ([]Rate, error) {
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows *sql.Rows
+	if currency == "" {
+		rows, err = db.Query("SELECT DISTINCT ON (currency) user_id, currency, effective, rate FROM exchange_rates WHERE user_id IS NULL ORDER BY currency, effective DESC")
+	} else {
+		rows, err = db.Query("SELECT user_id, currency, effective, rate FROM exchange_rates WHERE user_id IS NULL AND currency = $1 ORDER BY effective DESC", currency)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":    err,
+			"currency": currency,
+		}).Error("failed to fetch exchange rates")
+		return nil, err
+	}
+
+	return scanRates(rows)
+}
+
+// GetOverrides fetches the rates of the user in the context, newest first, optionally only those of a currency
+func GetOverrides(c context.Context, currency string) ([]Rate, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT user_id, currency, effective, rate FROM exchange_rates WHERE user_id = $1 AND ($2 = '' OR currency = $2) ORDER BY effective DESC, currency", userID, currency)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":    err,
+			"userId":   userID,
+			"currency": currency,
+		}).Error("failed to fetch exchange rate overrides")
+		return nil, err
+	}
+
+	return scanRates(rows)
+}
+
+// GetAll queries for all exchange rates
+func GetAll(c context.Context) ([]Rate, error) {
+	if !util.IsAdminRequest(c) {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT user_id, currency, effective, rate FROM exchange_rates")
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch all exchange rates")
+		return nil, err
+	}
+
+	return scanRates(rows)
+}
+
+// New sets the shared rate of a currency from a date, replacing any shared rate already set for that date.
+// Shared rates are used in every user's conversions, so only the admin can set them. Users override them with NewOverride.
+func New(c context.Context, rate Rate) (Rate, error) {
+	if !util.IsAdminRequest(c) {
+		return Rate{}, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return Rate{}, err
+	}
+
+	rate.User = 0
+	if err := validate(rate); err != nil {
+		return Rate{}, err
+	}
+
+	if err := upsert(db, rate); err != nil {
+		return Rate{}, err
+	}
+
+	return rate, nil
+}
+
+// NewOverride sets the rate of a currency from a date for the user in the context, replacing any of their own
+// rates already set for that date. It is used in place of the shared rates in the user's conversions.
+func NewOverride(c context.Context, rate Rate) (Rate, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return Rate{}, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return Rate{}, err
+	}
+
+	rate.User = userID
+	if err := validate(rate); err != nil {
+		return Rate{}, err
+	}
+
+	if err := upsert(db, rate); err != nil {
+		return Rate{}, err
+	}
+
+	return rate, nil
+}
+
+// DeleteOverride deletes a rate of the user in the context, so the shared rates are used again
+func DeleteOverride(c context.Context, currency string, date time.Time) error {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec("DELETE FROM exchange_rates WHERE user_id = $1 AND currency = $2 AND effective = $3", userID, currency, date)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":    err,
+			"currency": currency,
+			"date":     date,
+		}).Error("could not delete exchange rate override")
+		return err
+	}
+
+	if deleted, err := res.RowsAffected(); err != nil || deleted == 0 {
+		return constants.ErrForbidden
+	}
+
+	return nil
+}
+
+// BatchImport batch imports exchange rates
+func BatchImport(c context.Context, rates []Rate) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	return upsertAll(c, rates)
+}
+
+// ImportForUser sets exported rates as overrides of the user in the context
+func ImportForUser(c context.Context, rates []Rate) error {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	for i := range rates {
+		rates[i].User = userID
+	}
+
+	return upsertAll(c, rates)
+}
+
+// HomeCurrency returns the currency that the user in the context reports in
+func HomeCurrency(c context.Context) (string, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return "", err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return "", err
+	}
+
+	var currency string
+	err = db.QueryRow("SELECT home_currency FROM users WHERE id = $1", userID).Scan(&currency)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to select home currency of user")
+		return "", err
+	}
+
+	return currency, nil
+}
+
+// ValidMode checks whether mode is a supported conversion mode. The empty mode means no conversion.
+func ValidMode(mode string) bool {
+	return mode == "" || mode == constants.ConvertTransactionDate || mode == constants.ConvertLatest
+}
+
+// RateDate returns the sql expression for the date to look up rates on in a conversion mode,
+// given the sql expression for the date of the amount being converted
+func RateDate(mode, dateExpr string) string {
+	if mode == constants.ConvertLatest {
+		return "CURRENT_DATE"
+	}
+	return dateExpr
+}
+
+// Convert converts an amount in minor units of one currency to minor units of another, using the rates on a date
+func Convert(c context.Context, amount int, from, to string, on time.Time) (int, error) {
+	if from == to {
+		return amount, nil
+	}
+
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return 0, err
+	}
+
+	var rate sql.NullFloat64
+	err = db.QueryRow("SELECT fx_rate($1, $2, $3, $4)", from, to, on, userID).Scan(&rate)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"from":  from,
+			"to":    to,
+			"on":    on,
+		}).Error("failed to look up exchange rate")
+		return 0, err
+	}
+
+	if !rate.Valid {
+		logrus.WithFields(logrus.Fields{
+			"from": from,
+			"to":   to,
+			"on":   on,
+		}).Error("no exchange rate to convert amount")
+		return 0, constants.ErrMissingExchangeRate
+	}
+
+	return Rescale(float64(amount)*rate.Float64, from, to), nil
+}
+
+// Rescale rounds an amount that has been multiplied by an exchange rate to minor units of the target currency.
+// The amount is still scaled by the decimal digits of the source currency, e.g. yen converted to dollars
+// needs multiplying by 100 to be in cents.
+func Rescale(amount float64, from, to string) int {
+	digits := constants.CurrencyInfo[to].DigitsAfterDecimal - constants.CurrencyInfo[from].DigitsAfterDecimal
+	return int(math.Round(amount * math.Pow10(digits)))
+}
+
+func validate(rate Rate) error {
+	if _, valid := constants.CurrencyInfo[rate.Currency]; !valid || rate.Currency == constants.ExchangeRateBase {
+		return constants.ErrInvalidCurrency
+	}
+
+	if rate.Rate <= 0 || rate.Date.IsZero() {
+		return constants.ErrBadRequest
+	}
+
+	return nil
+}
+
+func upsert(db util.DB, rate Rate) error {
+	_, err := db.Exec(upsertQuery, util.ToNullIntNonZero(int(rate.User)), rate.Currency, rate.Date, rate.Rate)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"rate":  rate,
+		}).Error("failed to upsert exchange rate")
+		return err
+	}
+
+	return nil
+}
+
+// upsertAll sets many rates in one transaction
+func upsertAll(c context.Context, rates []Rate) error {
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when inserting exchange rates")
+		return err
+	}
+
+	stmt, err := txn.Prepare(upsertQuery)
+	if err != nil {
+		logrus.WithError(err).Error("unable to prepare statement when inserting exchange rates")
+		util.RollbackIfOwned(c, txn)
+		return err
+	}
+
+	for _, rate := range rates {
+		if _, err := stmt.Exec(util.ToNullIntNonZero(int(rate.User)), rate.Currency, rate.Date, rate.Rate); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"rate":  rate,
+			}).Error("unable to exec statement when inserting exchange rates")
+			util.RollbackIfOwned(c, txn)
+			return err
+		}
+	}
+
+	if err := stmt.Close(); err != nil {
+		logrus.WithError(err).Error("unable to close statement when inserting exchange rates")
+		util.RollbackIfOwned(c, txn)
+		return err
+	}
+
+	if err := commit(); err != nil {
+		logrus.WithError(err).Error("unable to commit when inserting exchange rates")
+		util.RollbackIfOwned(c, txn)
+		return err
+	}
+
+	return nil
+}
+
+func scanRates(rows *sql.Rows) ([]Rate, error) {
+	defer rows.Close()
+
+	rates := []Rate{}
+	for rows.Next() {
+		var rate Rate
+		var userID sql.NullInt64
+		if err := rows.Scan(&userID, &rate.Currency, &rate.Date, &rate.Rate); err != nil {
+			logrus.WithError(err).Error("failed to scan into exchange rate")
+			return nil, err
+		}
+		rate.User = uint(util.FromNullIntNonZero(userID))
+
+		rates = append(rates, rate)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get exchange rates from rows")
+		return nil, err
+	}
+
+	return rates, nil
+}
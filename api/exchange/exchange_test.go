@@ -0,0 +1,44 @@
+// +build integration
+
+package exchange_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/financejc/api/exchange"
+	"github.com/jchorl/financejc/integration"
+)
+
+func TestConvertPrefersOverrides(t *testing.T) {
+	db := integration.FreshDB(t)
+	es := integration.ESConn(t)
+	ctx := integration.ContextWithUserDBES(integration.NewUser(t, integration.ContextWithUserDBES(0, db, es)), db, es)
+	otherCtx := integration.ContextWithUserDBES(integration.NewUser(t, integration.ContextWithUserDBES(0, db, es)), db, es)
+
+	january := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	_, err := db.Exec("INSERT INTO exchange_rates(currency, effective, rate) VALUES('USD', $1, 1.1)", january)
+	require.NoError(t, err, "unable to insert shared exchange rate")
+
+	_, err = exchange.NewOverride(ctx, exchange.Rate{Currency: "USD", Date: january, Rate: 1.25})
+	require.NoError(t, err, "unable to set exchange rate override")
+
+	converted, err := exchange.Convert(ctx, 1000, "EUR", "USD", january.AddDate(0, 1, 0))
+	require.NoError(t, err)
+	require.Equal(t, 1250, converted, "Users should convert at their own rates")
+
+	converted, err = exchange.Convert(otherCtx, 1000, "EUR", "USD", january.AddDate(0, 1, 0))
+	require.NoError(t, err)
+	require.Equal(t, 1100, converted, "Other users should still convert at the shared rates")
+
+	shared, err := exchange.Get(ctx, "USD")
+	require.NoError(t, err)
+	require.Len(t, shared, 1, "Overrides should not be listed with the shared rates")
+
+	require.NoError(t, exchange.DeleteOverride(ctx, "USD", january))
+	converted, err = exchange.Convert(ctx, 1000, "EUR", "USD", january.AddDate(0, 1, 0))
+	require.NoError(t, err)
+	require.Equal(t, 1100, converted, "Deleting an override should go back to the shared rates")
+}
@@ -0,0 +1,344 @@
+package goal
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// Goal is an amount a user is saving towards by a target date. Progress is tracked either by the balance of
+// an account, in the account's currency, or by the money put into a category (and its subcategories) since the
+// start date, in the user's home currency.
+type Goal struct {
+	ID           int       `json:"id,omitempty"`
+	User         uint      `json:"user"`
+	Name         string    `json:"name"`
+	TargetAmount int       `json:"targetAmount"`
+	TargetDate   time.Time `json:"targetDate"`
+	StartDate    time.Time `json:"startDate"`
+	AccountID    int       `json:"accountId,omitempty"`
+	Category     string    `json:"category,omitempty"`
+}
+
+type goalDB struct {
+	ID           int
+	User         uint
+	Name         string
+	TargetAmount int
+	TargetDate   time.Time
+	StartDate    time.Time
+	AccountID    sql.NullInt64
+	Category     sql.NullString
+}
+
+// Get fetches the goals of the user in the context
+func Get(c context.Context) ([]Goal, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, name, target_amount, target_date, start_date, account_id, category FROM goals WHERE user_id = $1 ORDER BY target_date, id", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch goals")
+		return nil, err
+	}
+
+	return scanGoals(rows)
+}
+
+// GetAll queries for all goals
+func GetAll(c context.Context) ([]Goal, error) {
+	if !util.IsAdminRequest(c) {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, name, target_amount, target_date, start_date, account_id, category FROM goals")
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch all goals")
+		return nil, err
+	}
+
+	return scanGoals(rows)
+}
+
+// New creates a new goal. The start date defaults to today.
+func New(c context.Context, goal *Goal) (*Goal, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	goal.User = userID
+	if goal.StartDate.IsZero() {
+		goal.StartDate = time.Now()
+	}
+	if err := validate(c, goal); err != nil {
+		return nil, err
+	}
+
+	gdb := toDB(*goal)
+	err = db.QueryRow("INSERT INTO goals(user_id, name, target_amount, target_date, start_date, account_id, category) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id", gdb.User, gdb.Name, gdb.TargetAmount, gdb.TargetDate, gdb.StartDate, gdb.AccountID, gdb.Category).Scan(&goal.ID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"goal":  goal,
+		}).Error("failed to insert goal")
+		return nil, err
+	}
+
+	return goal, nil
+}
+
+// Update updates a goal
+func Update(c context.Context, goal *Goal) (*Goal, error) {
+	existing, err := getOwned(c, goal.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	goal.User = existing.User
+	if goal.StartDate.IsZero() {
+		goal.StartDate = existing.StartDate
+	}
+	if err := validate(c, goal); err != nil {
+		return nil, err
+	}
+
+	gdb := toDB(*goal)
+	_, err = db.Exec("UPDATE goals SET name = $1, target_amount = $2, target_date = $3, start_date = $4, account_id = $5, category = $6 WHERE id = $7", gdb.Name, gdb.TargetAmount, gdb.TargetDate, gdb.StartDate, gdb.AccountID, gdb.Category, gdb.ID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"goal":  goal,
+		}).Error("failed to update goal")
+		return nil, err
+	}
+
+	return goal, nil
+}
+
+// Delete deletes a goal
+func Delete(c context.Context, goalID int) error {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec("DELETE FROM goals WHERE id = $1 AND user_id = $2", goalID, userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"goalId": goalID,
+		}).Error("could not delete goal")
+		return err
+	}
+
+	if deleted, err := res.RowsAffected(); err != nil || deleted == 0 {
+		return constants.ErrForbidden
+	}
+
+	return nil
+}
+
+// BatchImport batch imports goals
+func BatchImport(c context.Context, goals []Goal) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when batch inserting goals")
+		return err
+	}
+
+	stmt, err := txn.Prepare(pq.CopyIn("goals", "id", "user_id", "name", "target_amount", "target_date", "start_date", "account_id", "category"))
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin copy in when batch inserting goals")
+		return err
+	}
+
+	for _, goal := range goals {
+		gdb := toDB(goal)
+		_, err = stmt.Exec(gdb.ID, gdb.User, gdb.Name, gdb.TargetAmount, gdb.TargetDate, gdb.StartDate, gdb.AccountID, gdb.Category)
+		if err != nil {
+			logrus.WithError(err).Error("unable to exec goal copy when batch inserting goals")
+			return err
+		}
+	}
+
+	_, err = stmt.Exec()
+	if err != nil {
+		logrus.WithError(err).Error("unable to exec batch goal copy when batch inserting goals")
+		return err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		logrus.WithError(err).Error("unable to close goal copy when batch inserting goals")
+		return err
+	}
+
+	err = commit()
+	if err != nil {
+		logrus.WithError(err).Error("unable to commit goal copy when batch inserting goals")
+		return err
+	}
+
+	return nil
+}
+
+// ImportForUser creates goals for the user in the context, mapping the exported account ids to the imported ones
+func ImportForUser(c context.Context, goals []Goal, accountIDs map[int]int) error {
+	for _, goal := range goals {
+		goal.ID = 0
+		if goal.AccountID != 0 {
+			accountID, ok := accountIDs[goal.AccountID]
+			if !ok {
+				return constants.ErrBadRequest
+			}
+			goal.AccountID = accountID
+		}
+
+		if _, err := New(c, &goal); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// getOwned fetches a goal, checking that it belongs to the user in the context
+func getOwned(c context.Context, goalID int) (Goal, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return Goal{}, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return Goal{}, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, name, target_amount, target_date, start_date, account_id, category FROM goals WHERE id = $1 AND user_id = $2", goalID, userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"goalId": goalID,
+		}).Error("failed to fetch goal")
+		return Goal{}, err
+	}
+
+	goals, err := scanGoals(rows)
+	if err != nil {
+		return Goal{}, err
+	}
+
+	if len(goals) == 0 {
+		return Goal{}, constants.ErrForbidden
+	}
+
+	return goals[0], nil
+}
+
+func validate(c context.Context, goal *Goal) error {
+	if goal.Name == "" || goal.TargetAmount <= 0 || goal.TargetDate.IsZero() || goal.TargetDate.Before(goal.StartDate) {
+		return constants.ErrBadRequest
+	}
+
+	// goals are tracked by exactly one of an account or a category
+	if (goal.AccountID == 0) == (goal.Category == "") {
+		return constants.ErrBadRequest
+	}
+
+	if goal.AccountID != 0 {
+		valid, err := util.UserOwnsAccount(c, goal.AccountID)
+		if err != nil || !valid {
+			return constants.ErrForbidden
+		}
+	}
+
+	return nil
+}
+
+func scanGoals(rows *sql.Rows) ([]Goal, error) {
+	defer rows.Close()
+
+	goals := []Goal{}
+	for rows.Next() {
+		var gdb goalDB
+		if err := rows.Scan(&gdb.ID, &gdb.User, &gdb.Name, &gdb.TargetAmount, &gdb.TargetDate, &gdb.StartDate, &gdb.AccountID, &gdb.Category); err != nil {
+			logrus.WithError(err).Error("failed to scan into goal")
+			return nil, err
+		}
+
+		goals = append(goals, fromDB(gdb))
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get goals from rows")
+		return nil, err
+	}
+
+	return goals, nil
+}
+
+func toDB(goal Goal) *goalDB {
+	return &goalDB{
+		ID:           goal.ID,
+		User:         goal.User,
+		Name:         goal.Name,
+		TargetAmount: goal.TargetAmount,
+		TargetDate:   goal.TargetDate,
+		StartDate:    goal.StartDate,
+		AccountID:    util.ToNullIntNonZero(goal.AccountID),
+		Category:     util.ToNullStringNonEmpty(goal.Category),
+	}
+}
+
+func fromDB(goal goalDB) Goal {
+	return Goal{
+		ID:           goal.ID,
+		User:         goal.User,
+		Name:         goal.Name,
+		TargetAmount: goal.TargetAmount,
+		TargetDate:   goal.TargetDate,
+		StartDate:    goal.StartDate,
+		AccountID:    util.FromNullIntNonZero(goal.AccountID),
+		Category:     util.FromNullStringNonEmpty(goal.Category),
+	}
+}
@@ -0,0 +1,225 @@
+package goal
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/api/account"
+	"github.com/jchorl/financejc/api/exchange"
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// Progress is how far along a goal is. RequiredMonthly is what needs to be put towards the goal each month to reach
+// the target by the target date, and RecentMonthly is what was put towards it per month recently. The goal is on track
+// if it has been reached or recent contributions keep up with what is required. ProjectedDate is when the goal will be
+// reached if recent contributions keep up, and is left out if they would never reach it.
+type Progress struct {
+	Goal            Goal       `json:"goal"`
+	Currency        string     `json:"currency"`
+	Current         int        `json:"current"`
+	Remaining       int        `json:"remaining"`
+	MonthsLeft      int        `json:"monthsLeft"`
+	RequiredMonthly int        `json:"requiredMonthly"`
+	RecentMonthly   int        `json:"recentMonthly"`
+	OnTrack         bool       `json:"onTrack"`
+	ProjectedDate   *time.Time `json:"projectedDate,omitempty"`
+}
+
+// GetProgress computes the progress of a goal as of today
+func GetProgress(c context.Context, goalID int) (Progress, error) {
+	goal, err := getOwned(c, goalID)
+	if err != nil {
+		return Progress{}, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return Progress{}, err
+	}
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	windowStart := today.AddDate(0, -constants.GoalRecentMonths, 0)
+	if goal.StartDate.After(windowStart) {
+		windowStart = goal.StartDate
+	}
+
+	var currency string
+	var current, recent int
+	if goal.AccountID != 0 {
+		var before int
+		currency, before, err = accountBalance(db, goal.AccountID, windowStart)
+		if err != nil {
+			return Progress{}, err
+		}
+
+		_, current, err = accountBalance(db, goal.AccountID, today)
+		if err != nil {
+			return Progress{}, err
+		}
+		recent = current - before
+	} else {
+		currency, err = exchange.HomeCurrency(c)
+		if err != nil {
+			return Progress{}, err
+		}
+
+		current, err = contributions(c, currency, goal.Category, goal.StartDate, today)
+		if err != nil {
+			return Progress{}, err
+		}
+
+		recent, err = contributions(c, currency, goal.Category, windowStart, today)
+		if err != nil {
+			return Progress{}, err
+		}
+	}
+
+	progress := compute(goal, current, recent, windowStart, today)
+	progress.Currency = currency
+	return progress, nil
+}
+
+// compute works out the progress of a goal on a date from the amount saved so far and the amount saved since the start of the recent window
+func compute(goal Goal, current, recent int, windowStart, today time.Time) Progress {
+	progress := Progress{
+		Goal:       goal,
+		Current:    current,
+		MonthsLeft: monthsBetween(today, goal.TargetDate),
+	}
+
+	if current < goal.TargetAmount {
+		progress.Remaining = goal.TargetAmount - current
+	}
+
+	if progress.Remaining > 0 {
+		if progress.MonthsLeft > 0 {
+			progress.RequiredMonthly = (progress.Remaining + progress.MonthsLeft - 1) / progress.MonthsLeft
+		} else {
+			progress.RequiredMonthly = progress.Remaining
+		}
+	}
+
+	// a window shorter than a month counts as a month, so one early contribution does not look like a monthly habit
+	windowMonths := today.Sub(windowStart).Hours() / 24 / (365.25 / 12)
+	if windowMonths < 1 {
+		windowMonths = 1
+	}
+	progress.RecentMonthly = int(math.Round(float64(recent) / windowMonths))
+
+	progress.OnTrack = progress.Remaining == 0 || (progress.MonthsLeft > 0 && progress.RecentMonthly >= progress.RequiredMonthly)
+
+	if progress.Remaining == 0 {
+		progress.ProjectedDate = &today
+	} else if progress.RecentMonthly > 0 {
+		projected := today.AddDate(0, (progress.Remaining+progress.RecentMonthly-1)/progress.RecentMonthly, 0)
+		progress.ProjectedDate = &projected
+	}
+
+	return progress
+}
+
+// monthsBetween counts the monthly contributions that can be made from a date, inclusive, until a later date
+func monthsBetween(from, to time.Time) int {
+	if !to.After(from) {
+		return 0
+	}
+
+	months := (to.Year()-from.Year())*12 + int(to.Month()-from.Month())
+	if to.Day() > from.Day() {
+		months++
+	}
+
+	return months
+}
+
+// accountBalance returns the currency of an account and its balance, including holdings, at the end of a date
+func accountBalance(db util.DB, accountID int, date time.Time) (string, int, error) {
+	var currency string
+	var balance float64
+	err := db.QueryRow(fmt.Sprintf(`SELECT a.currency, CASE WHEN %s <= $2::date THEN a.opening_balance ELSE 0 END
+	+ (SELECT COALESCE(SUM(t.amount), 0) FROM transactions t WHERE t.account_id = a.id AND t.occurred <= $2::date)
+	+ holdings_value(a.id, $2::date)
+FROM accounts a WHERE a.id = $1`, account.OpeningDate), accountID, date).Scan(&currency, &balance)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"accountId": accountID,
+			"date":      date,
+		}).Error("failed to query account balance for goal")
+		return "", 0, err
+	}
+
+	return currency, int(math.Round(balance)), nil
+}
+
+// contributions sums the money the user in the context put into a category and its subcategories between two dates, inclusive,
+// converted to their home currency at the rate on the date of each transaction. Transfers count once, from the account the money left.
+// Either side of a transfer can point at the other, so the side the money arrived in is left out whichever side holds the link.
+func contributions(c context.Context, homeCurrency, category string, start, end time.Time) (int, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.Query(`SELECT a.currency, -SUM(t.amount * fx_rate(a.currency, $2, t.occurred, a.user_id)), COUNT(*) FILTER (WHERE fx_rate(a.currency, $2, t.occurred, a.user_id) IS NULL)
+FROM transactions t JOIN accounts a ON a.id = t.account_id
+WHERE a.user_id = $1 AND (t.category = $3 OR left(t.category, length($3) + 1) = $3 || '/') AND t.occurred >= $4::date AND t.occurred <= $5::date
+	AND (t.amount < 0 OR (t.related_transaction_id IS NULL AND NOT EXISTS (SELECT 1 FROM transactions r WHERE r.related_transaction_id = t.id)))
+GROUP BY a.currency`, userID, homeCurrency, category, start, end)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":    err,
+			"userId":   userID,
+			"category": category,
+		}).Error("failed to query contributions to goal")
+		return 0, err
+	}
+	defer rows.Close()
+
+	total := 0
+	for rows.Next() {
+		var currency string
+		var amount sql.NullFloat64
+		var missing int
+		if err := rows.Scan(&currency, &amount, &missing); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"userId":   userID,
+				"category": category,
+			}).Error("failed to scan into contributions to goal")
+			return 0, err
+		}
+
+		if missing > 0 {
+			logrus.WithFields(logrus.Fields{
+				"currency": currency,
+				"home":     homeCurrency,
+			}).Error("no exchange rate to convert contributions to goal")
+			return 0, constants.ErrMissingExchangeRate
+		}
+
+		total += exchange.Rescale(amount.Float64, currency, homeCurrency)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":    err,
+			"userId":   userID,
+			"category": category,
+		}).Error("failed to get contributions to goal from rows")
+		return 0, err
+	}
+
+	return total, nil
+}
@@ -0,0 +1,44 @@
+// +build integration
+
+package goal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompute(t *testing.T) {
+	today := time.Date(2017, time.March, 15, 0, 0, 0, 0, time.UTC)
+	goal := Goal{
+		TargetAmount: 1000000,
+		TargetDate:   time.Date(2017, time.December, 31, 0, 0, 0, 0, time.UTC),
+		StartDate:    time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	progress := compute(goal, 400000, 240000, today.AddDate(0, -3, 0), today)
+	require.Equal(t, 600000, progress.Remaining)
+	require.Equal(t, 10, progress.MonthsLeft, "Contributions can be made in March through December")
+	require.Equal(t, 60000, progress.RequiredMonthly)
+	require.True(t, progress.OnTrack)
+	require.Equal(t, time.Date(2017, time.November, 15, 0, 0, 0, 0, time.UTC), *progress.ProjectedDate)
+
+	progress = compute(goal, 400000, 30000, today.AddDate(0, -3, 0), today)
+	require.False(t, progress.OnTrack, "Contributions below what is required should be behind")
+
+	progress = compute(goal, 400000, 0, today.AddDate(0, -3, 0), today)
+	require.Nil(t, progress.ProjectedDate, "Goals without contributions should never be reached")
+
+	// a goal started a week ago should not extrapolate a week of contributions
+	progress = compute(goal, 50000, 50000, today.AddDate(0, 0, -7), today)
+	require.Equal(t, 50000, progress.RecentMonthly)
+
+	progress = compute(goal, 1200000, 0, today.AddDate(0, -3, 0), today)
+	require.Equal(t, 0, progress.Remaining)
+	require.True(t, progress.OnTrack, "Reached goals should be on track")
+
+	progress = compute(goal, 400000, 150000, today.AddDate(0, -3, 0), goal.TargetDate.AddDate(0, 0, 1))
+	require.Equal(t, 600000, progress.RequiredMonthly, "Overdue goals need the rest right away")
+	require.False(t, progress.OnTrack)
+}
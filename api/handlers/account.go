@@ -2,16 +2,19 @@ package handlers
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/labstack/echo"
 
 	"github.com/jchorl/financejc/api/account"
+	"github.com/jchorl/financejc/constants"
 )
 
-// GetAccounts fetches accounts
+// GetAccounts fetches accounts, optionally converting their values with the convert query param.
+// Closed accounts are only included if the includeClosed query param is true.
 func GetAccounts(c echo.Context) error {
-	accounts, err := account.Get(toContext(c))
+	accounts, err := account.Get(toContext(c), c.QueryParam("convert"), c.QueryParam("includeClosed") == "true")
 	if err != nil {
 		return writeError(c, err)
 	}
@@ -69,3 +72,35 @@ func DeleteAccount(c echo.Context) error {
 
 	return c.NoContent(http.StatusNoContent)
 }
+
+// GetAccountBalances fetches the balance history of an account over the date range in the start and end
+// query params, which default to the last year, at the granularity in the granularity query param.
+// Future transactions are only included if the includeFuture query param is true.
+func GetAccountBalances(c echo.Context) error {
+	accountID, err := idFromParam(c, "accountId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	end, err := dateFromQueryParam(c, "end", time.Now())
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	start, err := dateFromQueryParam(c, "start", end.AddDate(-1, 0, 0))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	granularity := c.QueryParam("granularity")
+	if granularity == "" {
+		granularity = constants.GranularityMonthly
+	}
+
+	balances, err := account.GetBalances(toContext(c), accountID, start, end, granularity, c.QueryParam("includeFuture") == "true")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, balances)
+}
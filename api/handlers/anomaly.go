@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+
+	"github.com/jchorl/financejc/api/anomaly"
+)
+
+// GetAnomalies fetches the anomalies of the logged in user that need review, or all of them if the all query param is true
+func GetAnomalies(c echo.Context) error {
+	anomalies, err := anomaly.Get(toContext(c), c.QueryParam("all") == "true")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, anomalies)
+}
+
+// DismissAnomaly marks an anomaly as reviewed
+func DismissAnomaly(c echo.Context) error {
+	anomalyID, err := idFromParam(c, "anomalyId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	if err := anomaly.Dismiss(toContext(c), anomalyID, true); err != nil {
+		return writeError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RestoreAnomaly puts a dismissed anomaly back up for review
+func RestoreAnomaly(c echo.Context) error {
+	anomalyID, err := idFromParam(c, "anomalyId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	if err := anomaly.Dismiss(toContext(c), anomalyID, false); err != nil {
+		return writeError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+
+	"github.com/jchorl/financejc/api/budget"
+	"github.com/jchorl/financejc/constants"
+)
+
+// GetBudgets fetches the budgets for the month containing the date in the month query param, which defaults to this month
+func GetBudgets(c echo.Context) error {
+	month, err := dateFromQueryParam(c, "month", time.Now())
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	budgets, err := budget.Get(toContext(c), month)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, budgets)
+}
+
+// SetBudget sets the budget of a category in a month
+func SetBudget(c echo.Context) error {
+	b := new(budget.Budget)
+	if err := c.Bind(b); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("unable to parse request to set budget")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	b, err := budget.Set(toContext(c), b)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, b)
+}
+
+// DeleteBudget deletes a budget
+func DeleteBudget(c echo.Context) error {
+	budgetID, err := idFromParam(c, "budgetId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	if err := budget.Delete(toContext(c), budgetID); err != nil {
+		return writeError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// CopyBudgets copies last month's budgets into the month containing the date in the month query param,
+// which defaults to this month
+func CopyBudgets(c echo.Context) error {
+	month, err := dateFromQueryParam(c, "month", time.Now())
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	budgets, err := budget.CopyPreviousMonth(toContext(c), month)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, budgets)
+}
+
+// AverageBudgets sets the budgets of the month in the month query param from the average spent per month
+// over the number of months before it in the months query param, which defaults to 3
+func AverageBudgets(c echo.Context) error {
+	month, err := dateFromQueryParam(c, "month", time.Now())
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	months, err := intFromQueryParam(c, "months", 3)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	budgets, err := budget.SetFromAverage(toContext(c), month, months)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, budgets)
+}
+
+// GetBudgetReport compares budgets to spending in each month between the start and end query params,
+// which default to this month
+func GetBudgetReport(c echo.Context) error {
+	end, err := dateFromQueryParam(c, "end", time.Now())
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	start, err := dateFromQueryParam(c, "start", end)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	report, err := budget.GetReport(toContext(c), start, end)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// GetEnvelopes fetches the state of the envelopes in the month containing the date in the month query param,
+// which defaults to this month
+func GetEnvelopes(c echo.Context) error {
+	month, err := dateFromQueryParam(c, "month", time.Now())
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	envelopes, err := budget.GetEnvelopes(toContext(c), month)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, envelopes)
+}
+
+// AssignToEnvelope sets the amount assigned to an envelope in a month
+func AssignToEnvelope(c echo.Context) error {
+	assignment := new(budget.Assignment)
+	if err := c.Bind(assignment); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("unable to parse request to assign to envelope")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	envelopes, err := budget.Assign(toContext(c), assignment)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, envelopes)
+}
+
+// MoveBetweenEnvelopes moves money assigned to one envelope to another
+func MoveBetweenEnvelopes(c echo.Context) error {
+	move := budget.Move{}
+	if err := c.Bind(&move); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("unable to parse request to move between envelopes")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	envelopes, err := budget.MoveBetweenEnvelopes(toContext(c), move)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, envelopes)
+}
+
+// GetIncomeCategories fetches the categories that fund envelopes
+func GetIncomeCategories(c echo.Context) error {
+	categories, err := budget.GetIncomeCategories(toContext(c))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, categories)
+}
+
+// SetIncomeCategories replaces the categories that fund envelopes
+func SetIncomeCategories(c echo.Context) error {
+	categories := []string{}
+	if err := c.Bind(&categories); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("unable to parse request to set income categories")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	categories, err := budget.SetIncomeCategories(toContext(c), categories)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, categories)
+}
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+
+	"github.com/jchorl/financejc/api/exchange"
+	"github.com/jchorl/financejc/constants"
+)
+
+// GetExchangeRates fetches the rate history of the currency query param, or the latest rates if it is not set
+func GetExchangeRates(c echo.Context) error {
+	rates, err := exchange.Get(toContext(c), c.QueryParam("currency"))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, rates)
+}
+
+// NewExchangeRate sets an exchange rate manually
+func NewExchangeRate(c echo.Context) error {
+	rate := exchange.Rate{}
+	if err := c.Bind(&rate); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("error parsing request to create exchange rate")
+		return writeError(c, err)
+	}
+
+	rate, err := exchange.New(toContext(c), rate)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, rate)
+}
+
+// ImportExchangeRates imports an uploaded file of ECB reference rates
+func ImportExchangeRates(c echo.Context) error {
+	return importExchangeRates(c, exchange.Import)
+}
+
+// GetExchangeRateOverrides fetches the user's own rates, optionally only those of the currency query param
+func GetExchangeRateOverrides(c echo.Context) error {
+	rates, err := exchange.GetOverrides(toContext(c), c.QueryParam("currency"))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, rates)
+}
+
+// NewExchangeRateOverride sets a rate that the user's conversions use in place of the shared rates
+func NewExchangeRateOverride(c echo.Context) error {
+	rate := exchange.Rate{}
+	if err := c.Bind(&rate); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("error parsing request to create exchange rate override")
+		return writeError(c, err)
+	}
+
+	rate, err := exchange.NewOverride(toContext(c), rate)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, rate)
+}
+
+// DeleteExchangeRateOverride deletes the user's rate of the currency query param on the date query param
+func DeleteExchangeRateOverride(c echo.Context) error {
+	date, err := dateFromQueryParam(c, "date", time.Time{})
+	if err != nil {
+		return writeError(c, err)
+	}
+	if date.IsZero() {
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	if err := exchange.DeleteOverride(toContext(c), c.QueryParam("currency"), date); err != nil {
+		return writeError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ImportExchangeRateOverrides imports an uploaded file of rates in the ECB formats as the user's own rates
+func ImportExchangeRateOverrides(c echo.Context) error {
+	return importExchangeRates(c, exchange.ImportOverrides)
+}
+
+func importExchangeRates(c echo.Context, importRates func(context.Context, io.Reader) (int, error)) error {
+	file, err := c.FormFile("file")
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("could not get file from context for exchange rate import")
+		return writeError(c, err)
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("could not open uploaded file for exchange rate import")
+		return writeError(c, err)
+	}
+	defer src.Close()
+
+	imported, err := importRates(toContext(c), src)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]int{"imported": imported})
+}
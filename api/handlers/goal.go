@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+
+	"github.com/jchorl/financejc/api/goal"
+	"github.com/jchorl/financejc/constants"
+)
+
+// GetGoals fetches all goals of the logged in user
+func GetGoals(c echo.Context) error {
+	goals, err := goal.Get(toContext(c))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, goals)
+}
+
+// NewGoal creates a new goal
+func NewGoal(c echo.Context) error {
+	g := new(goal.Goal)
+	if err := c.Bind(g); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("unable to parse request to create goal")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	g, err := goal.New(toContext(c), g)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, g)
+}
+
+// UpdateGoal updates a goal
+func UpdateGoal(c echo.Context) error {
+	g := new(goal.Goal)
+	if err := c.Bind(g); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("unable to parse request to update goal")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	g, err := goal.Update(toContext(c), g)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, g)
+}
+
+// DeleteGoal deletes a goal
+func DeleteGoal(c echo.Context) error {
+	goalID, err := idFromParam(c, "goalId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	if err := goal.Delete(toContext(c), goalID); err != nil {
+		return writeError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetGoalProgress fetches the progress of a goal
+func GetGoalProgress(c echo.Context) error {
+	goalID, err := idFromParam(c, "goalId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	progress, err := goal.GetProgress(toContext(c), goalID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, progress)
+}
@@ -20,11 +20,19 @@ func Init(api *echo.Group) {
 	api.POST("/auth/logout", Logout)
 
 	api.GET("/currencies", GetCurrencies)
+	api.GET("/exchangeRates", GetExchangeRates, jwtMiddleware)
+	api.POST("/exchangeRates", NewExchangeRate, jwtMiddleware)
+	api.POST("/exchangeRates/import", ImportExchangeRates, jwtMiddleware)
+	api.GET("/exchangeRates/overrides", GetExchangeRateOverrides, jwtMiddleware)
+	api.POST("/exchangeRates/overrides", NewExchangeRateOverride, jwtMiddleware)
+	api.DELETE("/exchangeRates/overrides", DeleteExchangeRateOverride, jwtMiddleware)
+	api.POST("/exchangeRates/overrides/import", ImportExchangeRateOverrides, jwtMiddleware)
 
 	api.GET("/account", GetAccounts, jwtMiddleware)
 	api.POST("/account", NewAccount, jwtMiddleware)
 	api.PUT("/account", UpdateAccount, jwtMiddleware)
 	api.DELETE("/account/:accountId", DeleteAccount, jwtMiddleware)
+	api.GET("/account/:accountId/balances", GetAccountBalances, jwtMiddleware)
 
 	api.GET("/summary", GetSummary, jwtMiddleware)
 	api.GET("/search", Search, jwtMiddleware)
@@ -41,14 +49,94 @@ func Init(api *echo.Group) {
 	api.PUT("/template", UpdateTemplate, jwtMiddleware)
 	api.DELETE("/transaction/:transactionId", DeleteTransaction, jwtMiddleware)
 	api.DELETE("/recurringTransaction/:recurringTransactionId", DeleteRecurringTransaction, jwtMiddleware)
+	api.POST("/recurringTransaction/:recurringTransactionId/rrule", ConvertRecurringTransactionToRRule, jwtMiddleware)
+	api.GET("/recurringTransaction/:recurringTransactionId/exceptions", GetRecurringExceptions, jwtMiddleware)
+	api.POST("/recurringTransaction/:recurringTransactionId/exceptions", NewRecurringException, jwtMiddleware)
+	api.DELETE("/recurringException/:recurringExceptionId", DeleteRecurringException, jwtMiddleware)
 	api.DELETE("/template/:templateId", DeleteTemplate, jwtMiddleware)
 	api.GET("/transaction/pushAllToES", PushAllToES, jwtMiddleware)
 	api.GET("/transaction/genRecurring", GenRecurringTransactions, jwtMiddleware)
+	api.GET("/recurringTransactions/proposals", GetRecurringProposals, jwtMiddleware)
+	api.POST("/recurringTransactions/proposals", AcceptRecurringProposal, jwtMiddleware)
+
+	api.GET("/account/:accountId/loan", GetLoan, jwtMiddleware)
+	api.POST("/account/:accountId/loan", NewLoan, jwtMiddleware)
+	api.DELETE("/account/:accountId/loan", DeleteLoan, jwtMiddleware)
+	api.GET("/account/:accountId/amortization", GetAmortization, jwtMiddleware)
+
+	api.GET("/securities", GetSecurities, jwtMiddleware)
+	api.POST("/securities", NewSecurity, jwtMiddleware)
+	api.PUT("/security", UpdateSecurity, jwtMiddleware)
+	api.GET("/security/:securityId/prices", GetSecurityPrices, jwtMiddleware)
+	api.POST("/security/:securityId/prices", NewSecurityPrice, jwtMiddleware)
+	api.POST("/securities/prices/import", ImportSecurityPrices, jwtMiddleware)
+	api.GET("/account/:accountId/investmentTransactions", GetInvestmentTransactions, jwtMiddleware)
+	api.POST("/account/:accountId/investmentTransactions", NewInvestmentTransaction, jwtMiddleware)
+	api.DELETE("/investmentTransaction/:investmentTransactionId", DeleteInvestmentTransaction, jwtMiddleware)
+	api.GET("/account/:accountId/holdings", GetHoldings, jwtMiddleware)
+	api.GET("/account/:accountId/lots", GetLots, jwtMiddleware)
+
+	api.GET("/budgets", GetBudgets, jwtMiddleware)
+	api.POST("/budgets", SetBudget, jwtMiddleware)
+	api.DELETE("/budget/:budgetId", DeleteBudget, jwtMiddleware)
+	api.POST("/budgets/copy", CopyBudgets, jwtMiddleware)
+	api.POST("/budgets/average", AverageBudgets, jwtMiddleware)
+	api.GET("/envelopes", GetEnvelopes, jwtMiddleware)
+	api.POST("/envelopes", AssignToEnvelope, jwtMiddleware)
+	api.POST("/envelopes/move", MoveBetweenEnvelopes, jwtMiddleware)
+	api.GET("/envelopes/incomeCategories", GetIncomeCategories, jwtMiddleware)
+	api.PUT("/envelopes/incomeCategories", SetIncomeCategories, jwtMiddleware)
+
+	api.GET("/goals", GetGoals, jwtMiddleware)
+	api.POST("/goals", NewGoal, jwtMiddleware)
+	api.PUT("/goal", UpdateGoal, jwtMiddleware)
+	api.DELETE("/goal/:goalId", DeleteGoal, jwtMiddleware)
+	api.GET("/goal/:goalId/progress", GetGoalProgress, jwtMiddleware)
+
+	api.GET("/anomalies", GetAnomalies, jwtMiddleware)
+	api.POST("/anomaly/:anomalyId/dismiss", DismissAnomaly, jwtMiddleware)
+	api.DELETE("/anomaly/:anomalyId/dismiss", RestoreAnomaly, jwtMiddleware)
+
+	api.GET("/taxLines", GetTaxLines, jwtMiddleware)
+	api.POST("/taxLines", NewTaxLine, jwtMiddleware)
+	api.PUT("/taxLine", UpdateTaxLine, jwtMiddleware)
+	api.DELETE("/taxLine/:taxLineId", DeleteTaxLine, jwtMiddleware)
+
+	api.GET("/holidays", GetHolidays, jwtMiddleware)
+	api.POST("/holidays", NewHoliday, jwtMiddleware)
+	api.POST("/holidays/import", ImportHolidays, jwtMiddleware)
+	api.DELETE("/holiday/:holidayId", DeleteHoliday, jwtMiddleware)
+
+	api.GET("/reports/netWorth", GetNetWorth, jwtMiddleware)
+	api.GET("/reports/capitalGains", GetCapitalGains, jwtMiddleware)
+	api.GET("/reports/spending", GetSpending, jwtMiddleware)
+	api.GET("/reports/comparison", GetComparison, jwtMiddleware)
+	api.GET("/reports/forecast", GetForecast, jwtMiddleware)
+	api.GET("/reports/budget", GetBudgetReport, jwtMiddleware)
+	api.GET("/reports/tax", GetTaxSummary, jwtMiddleware)
 
 	api.GET("/user", GetUser, jwtMiddleware)
+	api.PUT("/user", UpdateUser, jwtMiddleware)
+	api.GET("/user/export", ExportUser, jwtMiddleware)
+	api.POST("/user/import", ImportUser, jwtMiddleware)
+	api.DELETE("/user", DeleteUser, jwtMiddleware)
 
 	api.POST("/import", Transfer, jwtMiddleware)
 	api.GET("/exportAll", Export, jwtMiddleware)
 	api.POST("/importAll", Import, jwtMiddleware)
 	api.GET("/backupToGCS", BackupToGCS, jwtMiddleware)
+
+	api.GET("/jobs", GetJobs, jwtMiddleware)
+	api.GET("/jobs/:jobId", GetJob, jwtMiddleware)
+	api.GET("/jobs/:jobId/result", GetJobResult, jwtMiddleware)
+	api.POST("/jobs/import", StartImportJob, jwtMiddleware)
+	api.POST("/jobs/exportAll", StartExportJob, jwtMiddleware)
+	api.POST("/jobs/userExport", StartUserExportJob, jwtMiddleware)
+	api.POST("/jobs/pushAllToES", StartReindexJob, jwtMiddleware)
+	api.POST("/jobs/backupToGCS", StartBackupJob, jwtMiddleware)
+
+	api.GET("/backups", ListBackups, jwtMiddleware)
+	api.GET("/backups/drill", BackupDrill, jwtMiddleware)
+	api.GET("/backups/:name/verify", VerifyBackup, jwtMiddleware)
+	api.POST("/backups/:name/restore", RestoreBackup, jwtMiddleware)
 }
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+
+	"github.com/jchorl/financejc/api/holiday"
+	"github.com/jchorl/financejc/constants"
+)
+
+// GetHolidays fetches all holidays of the logged in user
+func GetHolidays(c echo.Context) error {
+	holidays, err := holiday.Get(toContext(c))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, holidays)
+}
+
+// NewHoliday adds a holiday
+func NewHoliday(c echo.Context) error {
+	h := new(holiday.Holiday)
+	if err := c.Bind(h); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("unable to parse request to create holiday")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	h, err := holiday.New(toContext(c), h)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, h)
+}
+
+// DeleteHoliday deletes a holiday
+func DeleteHoliday(c echo.Context) error {
+	holidayID, err := idFromParam(c, "holidayId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	if err := holiday.Delete(toContext(c), holidayID); err != nil {
+		return writeError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ImportHolidays imports the holidays in an uploaded iCalendar file
+func ImportHolidays(c echo.Context) error {
+	file, err := c.FormFile("file")
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("could not get file from context for holiday import")
+		return writeError(c, err)
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("could not open uploaded file for holiday import")
+		return writeError(c, err)
+	}
+	defer src.Close()
+
+	imported, err := holiday.Import(toContext(c), src)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]int{"imported": imported})
+}
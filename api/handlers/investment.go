@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+
+	"github.com/jchorl/financejc/api/investment"
+	"github.com/jchorl/financejc/constants"
+)
+
+// GetSecurities fetches all securities of a user
+func GetSecurities(c echo.Context) error {
+	securities, err := investment.GetSecurities(toContext(c))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, securities)
+}
+
+// NewSecurity creates a new security
+func NewSecurity(c echo.Context) error {
+	security := new(investment.Security)
+	if err := c.Bind(security); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("error parsing request to create security")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	security, err := investment.NewSecurity(toContext(c), security)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, security)
+}
+
+// UpdateSecurity updates a security
+func UpdateSecurity(c echo.Context) error {
+	security := new(investment.Security)
+	if err := c.Bind(security); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("error parsing request to update security")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	security, err := investment.UpdateSecurity(toContext(c), security)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, security)
+}
+
+// GetSecurityPrices fetches the price history of a security
+func GetSecurityPrices(c echo.Context) error {
+	securityID, err := idFromParam(c, "securityId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	prices, err := investment.GetPrices(toContext(c), securityID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, prices)
+}
+
+// NewSecurityPrice sets the price of a security manually
+func NewSecurityPrice(c echo.Context) error {
+	price := investment.Price{}
+	if err := c.Bind(&price); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("error parsing request to create security price")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	securityID, err := idFromParam(c, "securityId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	price.SecurityID = securityID
+	price, err = investment.NewPrice(toContext(c), price)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, price)
+}
+
+// ImportSecurityPrices imports an uploaded csv of security prices
+func ImportSecurityPrices(c echo.Context) error {
+	file, err := c.FormFile("file")
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("could not get file from context for security price import")
+		return writeError(c, err)
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("could not open uploaded file for security price import")
+		return writeError(c, err)
+	}
+	defer src.Close()
+
+	imported, err := investment.ImportPrices(toContext(c), src)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]int{"imported": imported})
+}
+
+// GetInvestmentTransactions fetches the investment transactions of an account
+func GetInvestmentTransactions(c echo.Context) error {
+	accountID, err := idFromParam(c, "accountId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	transactions, err := investment.Get(toContext(c), accountID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, transactions)
+}
+
+// NewInvestmentTransaction records a buy, sale, dividend, split or reinvestment in an account
+func NewInvestmentTransaction(c echo.Context) error {
+	t := new(investment.Transaction)
+	if err := c.Bind(t); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("unable to parse request to create investment transaction")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	accountID, err := idFromParam(c, "accountId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	t.AccountID = accountID
+	t, err = investment.New(toContext(c), t)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, t)
+}
+
+// DeleteInvestmentTransaction deletes an investment transaction
+func DeleteInvestmentTransaction(c echo.Context) error {
+	id, err := idFromParam(c, "investmentTransactionId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	if err := investment.Delete(toContext(c), id); err != nil {
+		return writeError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetHoldings fetches the securities currently held in an account
+func GetHoldings(c echo.Context) error {
+	accountID, err := idFromParam(c, "accountId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	holdings, err := investment.GetHoldings(toContext(c), accountID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, holdings)
+}
+
+// GetLots fetches the lots of an account
+func GetLots(c echo.Context) error {
+	accountID, err := idFromParam(c, "accountId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	lots, err := investment.GetLots(toContext(c), accountID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, lots)
+}
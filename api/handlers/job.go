@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+
+	"github.com/jchorl/financejc/api/job"
+	"github.com/jchorl/financejc/api/transaction"
+	"github.com/jchorl/financejc/api/transfer/batchTransfer"
+	"github.com/jchorl/financejc/api/transfer/userTransfer"
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// StartImportJob starts a background job that imports an uploaded QIF file
+func StartImportJob(c echo.Context) error {
+	file, err := c.FormFile("file")
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("could not get file from context for import job")
+		return writeError(c, err)
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("could not open uploaded file for import job")
+		return writeError(c, err)
+	}
+	defer src.Close()
+
+	// the upload goes away with the request, so hold on to it for the job
+	content, err := ioutil.ReadAll(src)
+	if err != nil {
+		logrus.WithError(err).Error("could not read uploaded file for import job")
+		return writeError(c, err)
+	}
+
+	return startJob(c, job.KindImport, func(ctx context.Context) (*job.Result, error) {
+		return nil, userTransfer.Import(ctx, job.NewProgressReader(ctx, bytes.NewReader(content), len(content)))
+	})
+}
+
+// StartExportJob starts a background job that exports all system data
+func StartExportJob(c echo.Context) error {
+	return startAdminJob(c, job.KindExport, func(ctx context.Context) (*job.Result, error) {
+		results, err := batchTransfer.Export(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return &job.Result{Content: []byte(results), ContentType: echo.MIMEApplicationJSONCharsetUTF8}, nil
+	})
+}
+
+// StartUserExportJob starts a background job that exports all data of the logged in user
+func StartUserExportJob(c echo.Context) error {
+	return startJob(c, job.KindUserExport, func(ctx context.Context) (*job.Result, error) {
+		results, err := userTransfer.Export(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return &job.Result{Content: []byte(results), ContentType: echo.MIMEApplicationJSONCharsetUTF8}, nil
+	})
+}
+
+// StartReindexJob starts a background job that destroys the elasticsearch index and repushes all transactions
+func StartReindexJob(c echo.Context) error {
+	return startAdminJob(c, job.KindReindex, func(ctx context.Context) (*job.Result, error) {
+		return nil, transaction.PushAllToES(ctx)
+	})
+}
+
+// StartBackupJob starts a background job that backs up all data to GCS
+func StartBackupJob(c echo.Context) error {
+	return startAdminJob(c, job.KindBackup, func(ctx context.Context) (*job.Result, error) {
+		return nil, batchTransfer.BackupToGCS(ctx)
+	})
+}
+
+// GetJobs fetches all jobs of the logged in user
+func GetJobs(c echo.Context) error {
+	jobs, err := job.GetAll(toContext(c))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, jobs)
+}
+
+// GetJob fetches the status and progress of a job
+func GetJob(c echo.Context) error {
+	jobID, err := idFromParam(c, "jobId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	j, err := job.Get(toContext(c), jobID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, j)
+}
+
+// GetJobResult downloads the result of a finished job
+func GetJobResult(c echo.Context) error {
+	jobID, err := idFromParam(c, "jobId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	result, err := job.GetResult(toContext(c), jobID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=\"financejc-job-"+strconv.Itoa(jobID)+"\"")
+	return c.Blob(http.StatusOK, result.ContentType, result.Content)
+}
+
+func startAdminJob(c echo.Context, kind string, fn job.Func) error {
+	if !util.IsAdminRequest(toContext(c)) {
+		return writeError(c, constants.ErrForbidden)
+	}
+
+	return startJob(c, kind, fn)
+}
+
+func startJob(c echo.Context, kind string, fn job.Func) error {
+	j, err := job.Start(toContext(c), kind, fn)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	c.Response().Header().Set(echo.HeaderLocation, "/api/jobs/"+strconv.Itoa(j.ID))
+	return c.JSON(http.StatusAccepted, j)
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+
+	"github.com/jchorl/financejc/api/transaction"
+	"github.com/jchorl/financejc/constants"
+)
+
+// GetLoan fetches the terms of a loan account
+func GetLoan(c echo.Context) error {
+	accountID, err := idFromParam(c, "accountId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	loan, err := transaction.GetLoan(toContext(c), accountID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, loan)
+}
+
+// NewLoan sets the terms of a loan account and schedules its payments
+func NewLoan(c echo.Context) error {
+	loan := new(transaction.Loan)
+	if err := c.Bind(loan); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("unable to parse request to create loan")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	accountID, err := idFromParam(c, "accountId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	loan.AccountID = accountID
+	loan, err = transaction.NewLoan(toContext(c), loan)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, loan)
+}
+
+// DeleteLoan deletes the terms of a loan account and stops its payments
+func DeleteLoan(c echo.Context) error {
+	accountID, err := idFromParam(c, "accountId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	if err := transaction.DeleteLoan(toContext(c), accountID); err != nil {
+		return writeError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetAmortization fetches the amortization schedule of a loan account
+func GetAmortization(c echo.Context) error {
+	accountID, err := idFromParam(c, "accountId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	amortization, err := transaction.GetAmortization(toContext(c), accountID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, amortization)
+}
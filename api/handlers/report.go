@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+
+	"github.com/jchorl/financejc/api/report"
+	"github.com/jchorl/financejc/constants"
+)
+
+// GetNetWorth fetches net worth over the date range in the start and end query params,
+// which default to the last year, at the granularity in the granularity query param
+func GetNetWorth(c echo.Context) error {
+	now := time.Now()
+	end, err := dateFromQueryParam(c, "end", now)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	start, err := dateFromQueryParam(c, "start", end.AddDate(-1, 0, 0))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	granularity := c.QueryParam("granularity")
+	if granularity == "" {
+		granularity = constants.GranularityMonthly
+	}
+
+	netWorth, err := report.GetNetWorth(toContext(c), start, end, granularity, c.QueryParam("convert"))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, netWorth)
+}
+
+// GetSpending fetches the money that came in and went out in each period between the start and end query params,
+// which default to the last year, grouped by the groupBy query param, which defaults to category.
+// Only the accounts in the accountIds query param are counted, if it is set, and transfers are left out unless the
+// includeTransfers query param is true.
+func GetSpending(c echo.Context) error {
+	now := time.Now()
+	end, err := dateFromQueryParam(c, "end", now)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	start, err := dateFromQueryParam(c, "start", end.AddDate(-1, 0, 0))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	granularity := c.QueryParam("granularity")
+	if granularity == "" {
+		granularity = constants.GranularityMonthly
+	}
+
+	groupBy := c.QueryParam("groupBy")
+	if groupBy == "" {
+		groupBy = constants.GroupByCategory
+	}
+
+	filter, err := reportFilter(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	spending, err := report.GetSpending(toContext(c), start, end, granularity, groupBy, filter)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, spending)
+}
+
+// GetComparison compares spending by category between the period in the start and end query params, which defaults
+// to this month so far, and the period in the previousStart and previousEnd query params, which defaults to the same
+// dates a year earlier. It takes the same accountIds and includeTransfers query params as the spending report.
+func GetComparison(c echo.Context) error {
+	now := time.Now()
+	end, err := dateFromQueryParam(c, "end", now)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	start, err := dateFromQueryParam(c, "start", time.Date(end.Year(), end.Month(), 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	previousEnd, err := dateFromQueryParam(c, "previousEnd", end.AddDate(-1, 0, 0))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	previousStart, err := dateFromQueryParam(c, "previousStart", start.AddDate(-1, 0, 0))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	filter, err := reportFilter(c)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	comparison, err := report.GetComparison(toContext(c), report.Period{Start: start, End: end}, report.Period{Start: previousStart, End: previousEnd}, filter)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, comparison)
+}
+
+// GetCapitalGains fetches realized gains for the tax year in the year query param, or every year if it is not set,
+// and current unrealized gains, optionally only for the account in the accountId query param.
+// If the format query param is csv, the realized gains are downloaded as a csv instead.
+func GetCapitalGains(c echo.Context) error {
+	year, err := intFromQueryParam(c, "year", 0)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	accountID, err := intFromQueryParam(c, "accountId", 0)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	gains, err := report.GetCapitalGains(toContext(c), year, accountID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	if c.QueryParam("format") != "csv" {
+		return c.JSON(http.StatusOK, gains)
+	}
+
+	encoded, err := report.CapitalGainsCSV(gains)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	filename := "capital-gains.csv"
+	if year != 0 {
+		filename = fmt.Sprintf("capital-gains-%d.csv", year)
+	}
+	c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=\""+filename+"\"")
+	return c.Blob(http.StatusOK, "text/csv", encoded)
+}
+
+// reportFilter parses the accountIds and includeTransfers query params that narrow down a report
+func reportFilter(c echo.Context) (report.Filter, error) {
+	accountIDs, err := intsFromQueryParam(c, "accountIds")
+	if err != nil {
+		return report.Filter{}, err
+	}
+
+	return report.Filter{
+		AccountIDs:       accountIDs,
+		IncludeTransfers: c.QueryParam("includeTransfers") == "true",
+	}, nil
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/labstack/echo"
+
+	"github.com/jchorl/financejc/api/report"
+	"github.com/jchorl/financejc/api/tax"
+	"github.com/jchorl/financejc/constants"
+)
+
+// GetTaxLines fetches all tax lines of the logged in user
+func GetTaxLines(c echo.Context) error {
+	lines, err := tax.Get(toContext(c))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, lines)
+}
+
+// NewTaxLine creates a new tax line
+func NewTaxLine(c echo.Context) error {
+	line := new(tax.Line)
+	if err := c.Bind(line); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("unable to parse request to create tax line")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	line, err := tax.New(toContext(c), line)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, line)
+}
+
+// UpdateTaxLine updates a tax line
+func UpdateTaxLine(c echo.Context) error {
+	line := new(tax.Line)
+	if err := c.Bind(line); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("unable to parse request to update tax line")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	line, err := tax.Update(toContext(c), line)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, line)
+}
+
+// DeleteTaxLine deletes a tax line
+func DeleteTaxLine(c echo.Context) error {
+	lineID, err := idFromParam(c, "taxLineId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	if err := tax.Delete(toContext(c), lineID); err != nil {
+		return writeError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// GetTaxSummary fetches the totals of each tax line for the tax year in the year query param, defaulting to the
+// current tax year. If the format query param is csv or pdf, the summary is downloaded in that format instead.
+func GetTaxSummary(c echo.Context) error {
+	year, err := intFromQueryParam(c, "year", 0)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	summary, err := report.GetTaxSummary(toContext(c), year)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	var encoded []byte
+	var contentType string
+	switch c.QueryParam("format") {
+	case "csv":
+		encoded, err = report.TaxSummaryCSV(summary)
+		if err != nil {
+			return writeError(c, err)
+		}
+		contentType = "text/csv"
+	case "pdf":
+		encoded = report.TaxSummaryPDF(summary)
+		contentType = "application/pdf"
+	default:
+		return c.JSON(http.StatusOK, summary)
+	}
+
+	filename := fmt.Sprintf("tax-summary-%d.%s", summary.Year, c.QueryParam("format"))
+	c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=\""+filename+"\"")
+	return c.Blob(http.StatusOK, contentType, encoded)
+}
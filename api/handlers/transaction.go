@@ -27,7 +27,7 @@ func GetTransactions(c echo.Context) error {
 	return writePaginatedEntity(c, transactions)
 }
 
-// GetSummary fetches all transactions since a given timestamp
+// GetSummary fetches all transactions since a given timestamp, optionally converting their amounts with the convert query param
 func GetSummary(c echo.Context) error {
 	sinceStr := c.QueryParam("since")
 	since, err := time.Parse(time.RFC3339, sinceStr)
@@ -41,7 +41,7 @@ func GetSummary(c echo.Context) error {
 		return constants.ErrBadRequest
 	}
 
-	transactions, err := transaction.Summary(toContext(c), since)
+	transactions, err := transaction.Summary(toContext(c), since, c.QueryParam("convert"))
 	if err != nil {
 		return writeError(c, err)
 	}
@@ -129,6 +129,35 @@ func NewRecurringTransaction(c echo.Context) error {
 	return c.JSON(http.StatusOK, tr)
 }
 
+// GetRecurringProposals fetches recurring transactions inferred from the logged in user's past transactions
+func GetRecurringProposals(c echo.Context) error {
+	proposals, err := transaction.GetProposals(toContext(c))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, proposals)
+}
+
+// AcceptRecurringProposal creates the recurring transaction of a proposal and links the transactions it matched to it
+func AcceptRecurringProposal(c echo.Context) error {
+	proposal := new(transaction.Proposal)
+	if err := c.Bind(proposal); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("unable to parse request to accept recurring transaction proposal")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	tr, err := transaction.AcceptProposal(toContext(c), *proposal)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, tr)
+}
+
 // NewTemplate creates a new template
 func NewTemplate(c echo.Context) error {
 	tr := new(transaction.Template)
@@ -297,3 +326,93 @@ func GenRecurringTransactions(ctx echo.Context) error {
 
 	return ctx.NoContent(http.StatusNoContent)
 }
+
+// GetForecast projects the balance of every account on each day for the number of days in the days query param,
+// which defaults to 90, flagging balances below the threshold query param
+func GetForecast(c echo.Context) error {
+	days, err := intFromQueryParam(c, "days", 90)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	threshold, err := intFromQueryParam(c, "threshold", 0)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	forecast, err := transaction.GetForecast(toContext(c), days, threshold)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, forecast)
+}
+
+// ConvertRecurringTransactionToRRule switches the schedule of a recurring transaction to the equivalent rrule
+func ConvertRecurringTransactionToRRule(c echo.Context) error {
+	recurringTransactionID, err := idFromParam(c, "recurringTransactionId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	tr, err := transaction.ConvertToRRule(toContext(c), recurringTransactionID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, tr)
+}
+
+// GetRecurringExceptions fetches the exceptions of a recurring transaction
+func GetRecurringExceptions(c echo.Context) error {
+	recurringTransactionID, err := idFromParam(c, "recurringTransactionId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	exceptions, err := transaction.GetExceptions(toContext(c), recurringTransactionID)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, exceptions)
+}
+
+// NewRecurringException skips, moves or changes a single upcoming run of a recurring transaction
+func NewRecurringException(c echo.Context) error {
+	exception := new(transaction.RecurringException)
+	if err := c.Bind(exception); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("unable to parse request to create recurring exception")
+		return writeError(c, constants.ErrBadRequest)
+	}
+
+	recurringTransactionID, err := idFromParam(c, "recurringTransactionId")
+	if err != nil {
+		return writeError(c, err)
+	}
+	exception.RecurringTransactionID = recurringTransactionID
+
+	exception, err = transaction.NewException(toContext(c), exception)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, exception)
+}
+
+// DeleteRecurringException deletes a recurring exception
+func DeleteRecurringException(c echo.Context) error {
+	exceptionID, err := idFromParam(c, "recurringExceptionId")
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	if err := transaction.DeleteException(toContext(c), exceptionID); err != nil {
+		return writeError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
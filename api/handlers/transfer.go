@@ -72,3 +72,42 @@ func BackupToGCS(c echo.Context) error {
 
 	return c.NoContent(http.StatusNoContent)
 }
+
+// ListBackups lists the backups that can be restored
+func ListBackups(c echo.Context) error {
+	backups, err := batchTransfer.ListBackups(toContext(c))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, backups)
+}
+
+// RestoreBackup restores a backup into an empty database
+func RestoreBackup(c echo.Context) error {
+	if err := batchTransfer.Restore(toContext(c), c.Param("name")); err != nil {
+		return writeError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// VerifyBackup test restores a backup into a scratch schema and reports any problems
+func VerifyBackup(c echo.Context) error {
+	verification, err := batchTransfer.VerifyBackup(toContext(c), c.Param("name"))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, verification)
+}
+
+// BackupDrill verifies that the latest backup restores cleanly
+func BackupDrill(c echo.Context) error {
+	verification, err := batchTransfer.BackupDrill(toContext(c))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, verification)
+}
@@ -1,10 +1,14 @@
 package handlers
 
 import (
+	"io/ioutil"
 	"net/http"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/labstack/echo"
 
+	"github.com/jchorl/financejc/api/transfer/userTransfer"
 	"github.com/jchorl/financejc/api/user"
 )
 
@@ -16,3 +20,58 @@ func GetUser(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, user)
 }
+
+// UpdateUser updates the settings of the logged in user
+func UpdateUser(c echo.Context) error {
+	u := user.User{}
+	if err := c.Bind(&u); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"context": c,
+		}).Error("error parsing request to update user")
+		return writeError(c, err)
+	}
+
+	u, err := user.Update(toContext(c), u)
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	return c.JSON(http.StatusOK, u)
+}
+
+// ExportUser exports all data of the logged in user
+func ExportUser(c echo.Context) error {
+	results, err := userTransfer.Export(toContext(c))
+	if err != nil {
+		return writeError(c, err)
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, "attachment; filename=\"financejc-export-"+time.Now().Format("20060102")+".json\"")
+	return c.Blob(http.StatusOK, echo.MIMEApplicationJSONCharsetUTF8, []byte(results))
+}
+
+// ImportUser imports an export of a user's data under the logged in user
+func ImportUser(c echo.Context) error {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		logrus.WithError(err).Error("unable to read body of request")
+		return writeError(c, err)
+	}
+
+	if err := userTransfer.ImportData(toContext(c), string(body)); err != nil {
+		return writeError(c, err)
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// DeleteUser deletes the logged in user and all of their data, then logs them out.
+// The user's email must be passed in the confirm query param.
+func DeleteUser(c echo.Context) error {
+	if err := userTransfer.Delete(toContext(c), c.QueryParam("confirm")); err != nil {
+		return writeError(c, err)
+	}
+
+	return Logout(c)
+}
@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/dgrijalva/jwt-go"
@@ -41,6 +43,8 @@ func writeError(c echo.Context, err error) error {
 		return c.String(http.StatusForbidden, err.Error())
 	case constants.ErrBadRequest:
 		return c.String(http.StatusBadRequest, err.Error())
+	case constants.ErrMissingExchangeRate:
+		return c.String(http.StatusUnprocessableEntity, err.Error())
 	default:
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
@@ -62,6 +66,70 @@ func idFromParam(c echo.Context, paramName string) (int, error) {
 	return id, nil
 }
 
+// dateFromQueryParam parses a YYYY-MM-DD date query param, returning def if the param is not set
+func dateFromQueryParam(c echo.Context, paramName string, def time.Time) (time.Time, error) {
+	dateStr := c.QueryParam(paramName)
+	if dateStr == "" {
+		return def, nil
+	}
+
+	date, err := time.Parse("2006-01-02", dateStr)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"dateStr":   dateStr,
+			"paramName": paramName,
+		}).Error("unable to parse date query param")
+		return time.Time{}, constants.ErrBadRequest
+	}
+
+	return date, nil
+}
+
+// intFromQueryParam parses an integer query param, returning def if the param is not set
+func intFromQueryParam(c echo.Context, paramName string, def int) (int, error) {
+	intStr := c.QueryParam(paramName)
+	if intStr == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(intStr)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"intStr":    intStr,
+			"paramName": paramName,
+		}).Error("unable to parse integer query param")
+		return 0, constants.ErrBadRequest
+	}
+
+	return i, nil
+}
+
+// intsFromQueryParam parses a comma separated list of integers from a query param, returning nil if the param is not set
+func intsFromQueryParam(c echo.Context, paramName string) ([]int, error) {
+	intsStr := c.QueryParam(paramName)
+	if intsStr == "" {
+		return nil, nil
+	}
+
+	ints := []int{}
+	for _, intStr := range strings.Split(intsStr, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(intStr))
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":     err,
+				"intsStr":   intsStr,
+				"paramName": paramName,
+			}).Error("unable to parse integer list query param")
+			return nil, constants.ErrBadRequest
+		}
+		ints = append(ints, i)
+	}
+
+	return ints, nil
+}
+
 // toContext is supposed to take a context/middleware injected value
 // from whatever web framework is being used and convert it to a
 // Go context.Context that everything below the handlers can understand.
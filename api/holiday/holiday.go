@@ -0,0 +1,336 @@
+package holiday
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// maxAdjustDays is how far a date is moved looking for a business day before giving up, in case every day is a holiday
+const maxAdjustDays = 366
+
+// Holiday is a day that a user's bank is closed on, so scheduled transactions that fall on it post on another day
+type Holiday struct {
+	ID   int       `json:"id,omitempty"`
+	User uint      `json:"user"`
+	Date time.Time `json:"date"`
+	Name string    `json:"name"`
+}
+
+// Calendar is the set of holidays of a user, keyed by date. Weekends are never business days either.
+// A nil calendar has no holidays.
+type Calendar map[string]bool
+
+// Get fetches the holidays of the user in the context, in date order
+func Get(c context.Context) ([]Holiday, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, date, name FROM holidays WHERE user_id = $1 ORDER BY date", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch holidays")
+		return nil, err
+	}
+
+	return scanHolidays(rows)
+}
+
+// GetAll queries for all holidays
+func GetAll(c context.Context) ([]Holiday, error) {
+	if !util.IsAdminRequest(c) {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, date, name FROM holidays")
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch all holidays")
+		return nil, err
+	}
+
+	return scanHolidays(rows)
+}
+
+// New adds a holiday for the user in the context, renaming the holiday already on that date if there is one
+func New(c context.Context, holiday *Holiday) (*Holiday, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	holiday.User = userID
+	if holiday.Name == "" || holiday.Date.IsZero() {
+		return nil, constants.ErrBadRequest
+	}
+
+	if err := upsert(db, holiday); err != nil {
+		return nil, err
+	}
+
+	return holiday, nil
+}
+
+// Delete deletes a holiday
+func Delete(c context.Context, holidayID int) error {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec("DELETE FROM holidays WHERE id = $1 AND user_id = $2", holidayID, userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"holidayId": holidayID,
+		}).Error("could not delete holiday")
+		return err
+	}
+
+	if deleted, err := res.RowsAffected(); err != nil || deleted == 0 {
+		return constants.ErrForbidden
+	}
+
+	return nil
+}
+
+// BatchImport batch imports holidays
+func BatchImport(c context.Context, holidays []Holiday) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when batch inserting holidays")
+		return err
+	}
+
+	stmt, err := txn.Prepare(pq.CopyIn("holidays", "id", "user_id", "date", "name"))
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin copy in when batch inserting holidays")
+		return err
+	}
+
+	for _, holiday := range holidays {
+		_, err = stmt.Exec(holiday.ID, holiday.User, holiday.Date, holiday.Name)
+		if err != nil {
+			logrus.WithError(err).Error("unable to exec holiday copy when batch inserting holidays")
+			return err
+		}
+	}
+
+	_, err = stmt.Exec()
+	if err != nil {
+		logrus.WithError(err).Error("unable to exec batch holiday copy when batch inserting holidays")
+		return err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		logrus.WithError(err).Error("unable to close holiday copy when batch inserting holidays")
+		return err
+	}
+
+	err = commit()
+	if err != nil {
+		logrus.WithError(err).Error("unable to commit holiday copy when batch inserting holidays")
+		return err
+	}
+
+	return nil
+}
+
+// ImportForUser adds holidays for the user in the context, renaming any that are already on the same dates
+func ImportForUser(c context.Context, holidays []Holiday) error {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	for _, holiday := range holidays {
+		holiday.User = userID
+		if err := upsert(db, &holiday); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CalendarForUser fetches the holidays of the user in the context as a calendar
+func CalendarForUser(c context.Context) (Calendar, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT date FROM holidays WHERE user_id = $1", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch holiday calendar")
+		return nil, err
+	}
+
+	return scanCalendar(rows)
+}
+
+// CalendarForAccount fetches the holidays of the user that owns an account as a calendar
+func CalendarForAccount(db util.DB, accountID int) (Calendar, error) {
+	rows, err := db.Query("SELECT h.date FROM holidays h JOIN accounts a ON a.user_id = h.user_id WHERE a.id = $1", accountID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"accountId": accountID,
+		}).Error("failed to fetch holiday calendar of account")
+		return nil, err
+	}
+
+	return scanCalendar(rows)
+}
+
+// IsBusinessDay checks whether a date is neither a weekend nor a holiday
+func (cal Calendar) IsBusinessDay(date time.Time) bool {
+	if date.Weekday() == time.Saturday || date.Weekday() == time.Sunday {
+		return false
+	}
+
+	return !cal[date.Format("2006-01-02")]
+}
+
+// Adjust moves a date that is not a business day to a business day by an adjustment policy. Modified following moves
+// it to the next business day, unless that is in the next month, in which case it moves to the previous one instead.
+func (cal Calendar) Adjust(date time.Time, adjustment string) time.Time {
+	switch adjustment {
+	case constants.AdjustPreceding:
+		return cal.step(date, -1)
+	case constants.AdjustFollowing:
+		return cal.step(date, 1)
+	case constants.AdjustModifiedFollowing:
+		following := cal.step(date, 1)
+		if following.Month() != date.Month() {
+			return cal.step(date, -1)
+		}
+		return following
+	}
+
+	return date
+}
+
+// ValidAdjustment checks whether adjustment is a supported business day adjustment. The empty adjustment means none.
+func ValidAdjustment(adjustment string) bool {
+	switch adjustment {
+	case "", constants.AdjustNone, constants.AdjustPreceding, constants.AdjustFollowing, constants.AdjustModifiedFollowing:
+		return true
+	}
+
+	return false
+}
+
+// step moves a date a day at a time in a direction until it is a business day
+func (cal Calendar) step(date time.Time, direction int) time.Time {
+	for i := 0; i < maxAdjustDays; i++ {
+		adjusted := date.AddDate(0, 0, direction*i)
+		if cal.IsBusinessDay(adjusted) {
+			return adjusted
+		}
+	}
+
+	return date
+}
+
+func upsert(db util.DB, holiday *Holiday) error {
+	err := db.QueryRow("INSERT INTO holidays(user_id, date, name) VALUES($1, $2, $3) ON CONFLICT (user_id, date) DO UPDATE SET name = EXCLUDED.name RETURNING id", holiday.User, holiday.Date, holiday.Name).Scan(&holiday.ID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":   err,
+			"holiday": holiday,
+		}).Error("failed to upsert holiday")
+		return err
+	}
+
+	return nil
+}
+
+func scanHolidays(rows *sql.Rows) ([]Holiday, error) {
+	defer rows.Close()
+
+	holidays := []Holiday{}
+	for rows.Next() {
+		var holiday Holiday
+		if err := rows.Scan(&holiday.ID, &holiday.User, &holiday.Date, &holiday.Name); err != nil {
+			logrus.WithError(err).Error("failed to scan into holiday")
+			return nil, err
+		}
+
+		holidays = append(holidays, holiday)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get holidays from rows")
+		return nil, err
+	}
+
+	return holidays, nil
+}
+
+func scanCalendar(rows *sql.Rows) (Calendar, error) {
+	defer rows.Close()
+
+	cal := Calendar{}
+	for rows.Next() {
+		var date time.Time
+		if err := rows.Scan(&date); err != nil {
+			logrus.WithError(err).Error("failed to scan into holiday calendar")
+			return nil, err
+		}
+
+		cal[date.Format("2006-01-02")] = true
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get holiday calendar from rows")
+		return nil, err
+	}
+
+	return cal, nil
+}
@@ -0,0 +1,69 @@
+// +build integration
+
+package holiday
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/financejc/constants"
+)
+
+func date(month time.Month, day int) time.Time {
+	return time.Date(2017, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestAdjust(t *testing.T) {
+	// friday the 30th of june is a holiday, and the 1st of july is a saturday
+	cal := Calendar{"2017-06-30": true}
+
+	require.Equal(t, date(time.June, 29), cal.Adjust(date(time.July, 1), constants.AdjustPreceding))
+	require.Equal(t, date(time.July, 3), cal.Adjust(date(time.July, 1), constants.AdjustFollowing))
+	require.Equal(t, date(time.July, 3), cal.Adjust(date(time.June, 30), constants.AdjustFollowing))
+	require.Equal(t, date(time.June, 29), cal.Adjust(date(time.June, 30), constants.AdjustModifiedFollowing), "Moving forward would change the month, so it should move back instead")
+	require.Equal(t, date(time.July, 3), cal.Adjust(date(time.July, 1), constants.AdjustModifiedFollowing))
+	require.Equal(t, date(time.July, 1), cal.Adjust(date(time.July, 1), constants.AdjustNone))
+	require.Equal(t, date(time.July, 4), cal.Adjust(date(time.July, 4), constants.AdjustPreceding), "Business days should not move")
+
+	var none Calendar
+	require.Equal(t, date(time.June, 30), none.Adjust(date(time.July, 1), constants.AdjustPreceding), "A calendar without holidays still skips weekends")
+}
+
+func TestParseICal(t *testing.T) {
+	ics := strings.Join([]string{
+		"BEGIN:VCALENDAR",
+		"BEGIN:VEVENT",
+		"DTSTART;VALUE=DATE:20171225",
+		"DTEND;VALUE=DATE:20171227",
+		"SUMMARY:Christmas Day and Boxing",
+		"  Day",
+		"END:VEVENT",
+		"BEGIN:VEVENT",
+		"DTSTART;VALUE=DATE:20170101",
+		"RRULE:FREQ=YEARLY;COUNT=3",
+		"SUMMARY:New Year\\, observed",
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}, "\r\n")
+
+	events, err := parseICal(strings.NewReader(ics))
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, "Christmas Day and Boxing Day", events[0].Summary, "Folded lines should be unfolded")
+
+	holidays, err := expandEvents(events, 1)
+	require.NoError(t, err)
+	require.Equal(t, []Holiday{
+		{User: 1, Date: date(time.December, 25), Name: "Christmas Day and Boxing Day"},
+		{User: 1, Date: date(time.December, 26), Name: "Christmas Day and Boxing Day"},
+		{User: 1, Date: date(time.January, 1), Name: "New Year, observed"},
+		{User: 1, Date: time.Date(2018, time.January, 1, 0, 0, 0, 0, time.UTC), Name: "New Year, observed"},
+		{User: 1, Date: time.Date(2019, time.January, 1, 0, 0, 0, 0, time.UTC), Name: "New Year, observed"},
+	}, holidays)
+
+	_, err = parseICal(strings.NewReader("BEGIN:VEVENT\r\nSUMMARY:No date\r\nEND:VEVENT"))
+	require.Equal(t, constants.ErrBadRequest, err)
+}
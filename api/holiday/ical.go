@@ -0,0 +1,187 @@
+package holiday
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/api/rrule"
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// maxNameLength is the longest holiday name that is stored
+const maxNameLength = 100
+
+// event is a VEVENT of an iCalendar file. End is exclusive and is the zero time if the event has none.
+type event struct {
+	Summary string
+	Start   time.Time
+	End     time.Time
+	RRule   string
+}
+
+// Import adds the holidays in an iCalendar file, such as a bank holiday calendar, for the user in the context.
+// Every day an event covers is a holiday, and recurring events are added for constants.HolidayRecurYears years
+// unless they end sooner. It returns the number of holidays imported.
+func Import(c context.Context, r io.Reader) (int, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return 0, err
+	}
+
+	events, err := parseICal(r)
+	if err != nil {
+		return 0, err
+	}
+
+	holidays, err := expandEvents(events, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when importing holidays")
+		return 0, err
+	}
+
+	for i := range holidays {
+		if err := upsert(txn, &holidays[i]); err != nil {
+			util.RollbackIfOwned(c, txn)
+			return 0, err
+		}
+	}
+
+	if err := commit(); err != nil {
+		logrus.WithError(err).Error("unable to commit importing holidays")
+		util.RollbackIfOwned(c, txn)
+		return 0, err
+	}
+
+	return len(holidays), nil
+}
+
+// parseICal reads the events of an iCalendar file. Only the summary, start, end and recurrence rule of each are kept.
+func parseICal(r io.Reader) ([]event, error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+
+		// long lines are folded onto lines that start with whitespace
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		logrus.WithError(err).Error("unable to read icalendar file")
+		return nil, err
+	}
+
+	events := []event{}
+	var current *event
+	for _, line := range lines {
+		colon := strings.Index(line, ":")
+		if colon < 0 {
+			continue
+		}
+
+		// properties can have parameters after a semicolon, e.g. DTSTART;VALUE=DATE:20170101
+		name := strings.ToUpper(strings.SplitN(line[:colon], ";", 2)[0])
+		value := line[colon+1:]
+
+		switch {
+		case name == "BEGIN" && value == "VEVENT":
+			current = &event{}
+		case name == "END" && value == "VEVENT":
+			if current == nil || current.Start.IsZero() {
+				return nil, constants.ErrBadRequest
+			}
+			events = append(events, *current)
+			current = nil
+		case current == nil:
+		case name == "SUMMARY":
+			current.Summary = unescapeText(value)
+		case name == "RRULE":
+			current.RRule = value
+		case name == "DTSTART", name == "DTEND":
+			date, err := parseICalDate(value)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": err,
+					"line":  line,
+				}).Error("unable to parse date of icalendar event")
+				return nil, constants.ErrBadRequest
+			}
+
+			if name == "DTSTART" {
+				current.Start = date
+			} else {
+				current.End = date
+			}
+		}
+	}
+
+	return events, nil
+}
+
+// expandEvents turns events into a holiday for every day they cover
+func expandEvents(events []event, userID uint) ([]Holiday, error) {
+	holidays := []Holiday{}
+	for _, e := range events {
+		days := 1
+		if e.End.After(e.Start) {
+			days = int(e.End.Sub(e.Start).Hours() / 24)
+		}
+
+		starts := []time.Time{e.Start}
+		if e.RRule != "" {
+			rule, err := rrule.Parse(e.RRule)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": err,
+					"event": e,
+				}).Error("unable to parse recurrence rule of icalendar event")
+				return nil, constants.ErrBadRequest
+			}
+			starts = rule.Between(e.Start, e.Start, e.Start.AddDate(constants.HolidayRecurYears, 0, 0))
+		}
+
+		name := e.Summary
+		if name == "" {
+			name = "Holiday"
+		}
+		if runes := []rune(name); len(runes) > maxNameLength {
+			name = string(runes[:maxNameLength])
+		}
+
+		for _, start := range starts {
+			for day := 0; day < days; day++ {
+				holidays = append(holidays, Holiday{User: userID, Date: start.AddDate(0, 0, day), Name: name})
+			}
+		}
+	}
+
+	return holidays, nil
+}
+
+// parseICalDate parses a date, or the date of a date-time, e.g. 20170101 or 20170101T000000Z
+func parseICalDate(value string) (time.Time, error) {
+	if len(value) > 8 {
+		value = value[:8]
+	}
+
+	return time.Parse("20060102", value)
+}
+
+// unescapeText unescapes the commas, semicolons, newlines and backslashes of a text value
+func unescapeText(value string) string {
+	return strings.NewReplacer(`\,`, ",", `\;`, ";", `\n`, " ", `\N`, " ", `\\`, `\`).Replace(value)
+}
@@ -0,0 +1,784 @@
+package investment
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+
+	"github.com/jchorl/financejc/api/transaction"
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// Transaction is a buy, sale, dividend, split or reinvestment of a security in an account.
+// Quantities are units of the security, except for splits where the quantity is the number of
+// new units per old unit. Prices are per unit in minor units, and fees and amounts are in minor units.
+// The amount is the cash paid for a buy, the cash received for a sale or dividend, and the dividend
+// that was reinvested for a reinvestment. Buys, sales and dividends move cash in the account through
+// a linked transaction.
+type Transaction struct {
+	ID            int            `json:"id,omitempty"`
+	AccountID     int            `json:"accountId"`
+	SecurityID    int            `json:"securityId"`
+	Date          time.Time      `json:"date"`
+	Action        string         `json:"action"`
+	Quantity      float64        `json:"quantity"`
+	Price         float64        `json:"price"`
+	Fees          int            `json:"fees"`
+	Amount        int            `json:"amount"`
+	LotMethod     string         `json:"lotMethod,omitempty"`
+	Lots          []LotSelection `json:"lots,omitempty"`
+	TransactionID int            `json:"transactionId,omitempty"`
+}
+
+// LotSelection is a quantity to sell from a lot when a sale uses specific identification
+type LotSelection struct {
+	LotID    int     `json:"lotId"`
+	Quantity float64 `json:"quantity"`
+}
+
+// Holding is the quantity of a security held in an account, along with its cost and value
+type Holding struct {
+	Security    Security `json:"security"`
+	Quantity    float64  `json:"quantity"`
+	CostBasis   int      `json:"costBasis"`
+	Price       float64  `json:"price"`
+	MarketValue int      `json:"marketValue"`
+}
+
+type transactionDB struct {
+	ID            int
+	AccountID     int
+	SecurityID    int
+	Occurred      time.Time
+	Action        string
+	Quantity      float64
+	Price         float64
+	Fees          int
+	Amount        int
+	LotMethod     sql.NullString
+	TransactionID sql.NullInt64
+}
+
+// Get fetches the investment transactions of an account, newest first
+func Get(c context.Context, accountID int) ([]Transaction, error) {
+	valid, err := util.UserOwnsAccount(c, accountID)
+	if err != nil || !valid {
+		return nil, constants.ErrForbidden
+	}
+
+	return query(c, "it.account_id = $1 ORDER BY it.occurred DESC, it.id DESC", accountID)
+}
+
+// GetAll queries for all investment transactions
+func GetAll(c context.Context) ([]Transaction, error) {
+	if !util.IsAdminRequest(c) {
+		return nil, constants.ErrForbidden
+	}
+
+	return query(c, "TRUE")
+}
+
+// GetAllForUser queries for all investment transactions of the user in the context
+func GetAllForUser(c context.Context) ([]Transaction, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return query(c, "a.user_id = $1", userID)
+}
+
+// New records an investment transaction, creating its cash transaction and rebuilding the lots of the security
+func New(c context.Context, t *Transaction) (*Transaction, error) {
+	security, err := validate(c, t)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := query(c, "it.account_id = $1 AND it.security_id = $2", t.AccountID, t.SecurityID)
+	if err != nil {
+		return nil, err
+	}
+
+	// check that the lots still work out before writing anything, e.g. that a sale does not sell more than is held.
+	// The new transaction sorts after existing transactions on the same day, as its id will be larger.
+	candidate := *t
+	candidate.ID = math.MaxInt32
+	if _, _, _, err := computeLots(append(existing, candidate)); err != nil {
+		return nil, err
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when creating investment transaction")
+		return nil, err
+	}
+	ctx := context.WithValue(c, constants.CtxDB, txn)
+
+	if t.Action == constants.InvestmentBuy || t.Action == constants.InvestmentSell || t.Action == constants.InvestmentDividend {
+		amount := t.Amount
+		if t.Action == constants.InvestmentBuy {
+			amount = -amount
+		}
+
+		cash, err := transaction.New(ctx, &transaction.Transaction{
+			Name:      fmt.Sprintf("%s %s", strings.Title(t.Action), security.Symbol),
+			Date:      t.Date,
+			Category:  "Investments/" + strings.Title(t.Action),
+			Amount:    amount,
+			AccountID: t.AccountID,
+		})
+		if err != nil {
+			util.RollbackIfOwned(c, txn)
+			return nil, err
+		}
+		t.TransactionID = cash.ID
+	}
+
+	if err := insert(ctx, t); err != nil {
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	if err := rebuildLots(ctx, t.AccountID, t.SecurityID); err != nil {
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	if err := commit(); err != nil {
+		logrus.WithError(err).Error("unable to commit creating investment transaction")
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Delete deletes an investment transaction along with its cash transaction, and rebuilds the lots of the security.
+// Lots that later sales sell from cannot be deleted.
+func Delete(c context.Context, id int) error {
+	transactions, err := query(c, "it.id = $1", id)
+	if err != nil {
+		return err
+	}
+	if len(transactions) == 0 {
+		return constants.ErrForbidden
+	}
+
+	t := transactions[0]
+	valid, err := util.UserOwnsAccount(c, t.AccountID)
+	if err != nil || !valid {
+		return constants.ErrForbidden
+	}
+
+	existing, err := query(c, "it.account_id = $1 AND it.security_id = $2 AND it.id != $3", t.AccountID, t.SecurityID, id)
+	if err != nil {
+		return err
+	}
+	if _, _, _, err := computeLots(existing); err != nil {
+		return err
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when deleting investment transaction")
+		return err
+	}
+	ctx := context.WithValue(c, constants.CtxDB, txn)
+
+	for _, statement := range []string{
+		"DELETE FROM lot_selections WHERE sale_id = $1",
+		"DELETE FROM investment_transactions WHERE id = $1",
+	} {
+		if _, err := txn.Exec(statement, id); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"id":    id,
+			}).Error("could not delete investment transaction")
+			util.RollbackIfOwned(c, txn)
+			return err
+		}
+	}
+
+	if err := rebuildLots(ctx, t.AccountID, t.SecurityID); err != nil {
+		util.RollbackIfOwned(c, txn)
+		return err
+	}
+
+	if t.TransactionID != 0 {
+		if err := transaction.Delete(ctx, t.TransactionID); err != nil {
+			util.RollbackIfOwned(c, txn)
+			return err
+		}
+	}
+
+	if err := commit(); err != nil {
+		logrus.WithError(err).Error("unable to commit deleting investment transaction")
+		util.RollbackIfOwned(c, txn)
+		return err
+	}
+
+	return nil
+}
+
+// GetHoldings fetches the securities currently held in an account
+func GetHoldings(c context.Context, accountID int) ([]Holding, error) {
+	valid, err := util.UserOwnsAccount(c, accountID)
+	if err != nil || !valid {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT s.id, s.user_id, s.symbol, s.name, s.currency, SUM(l.remaining), SUM(l.remaining_cost), COALESCE(security_price(s.id, CURRENT_DATE), 0) FROM lots l JOIN securities s ON s.id = l.security_id WHERE l.account_id = $1 GROUP BY s.id HAVING SUM(l.remaining) > $2 ORDER BY s.symbol", accountID, epsilon)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"accountId": accountID,
+		}).Error("failed to fetch holdings")
+		return nil, err
+	}
+	defer rows.Close()
+
+	holdings := []Holding{}
+	for rows.Next() {
+		var h Holding
+		if err := rows.Scan(&h.Security.ID, &h.Security.User, &h.Security.Symbol, &h.Security.Name, &h.Security.Currency, &h.Quantity, &h.CostBasis, &h.Price); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":     err,
+				"accountId": accountID,
+			}).Error("failed to scan into holding")
+			return nil, err
+		}
+
+		h.MarketValue = int(math.Round(h.Quantity * h.Price))
+		holdings = append(holdings, h)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"accountId": accountID,
+		}).Error("failed to get holdings from rows")
+		return nil, err
+	}
+
+	return holdings, nil
+}
+
+// GetLots fetches every lot of an account, including lots that have been sold, oldest first
+func GetLots(c context.Context, accountID int) ([]Lot, error) {
+	valid, err := util.UserOwnsAccount(c, accountID)
+	if err != nil || !valid {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, account_id, security_id, acquired, quantity, remaining, cost, remaining_cost FROM lots WHERE account_id = $1 ORDER BY acquired, id", accountID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"accountId": accountID,
+		}).Error("failed to fetch lots")
+		return nil, err
+	}
+	defer rows.Close()
+
+	lots := []Lot{}
+	for rows.Next() {
+		var lot Lot
+		if err := rows.Scan(&lot.ID, &lot.AccountID, &lot.SecurityID, &lot.Acquired, &lot.Quantity, &lot.Remaining, &lot.Cost, &lot.RemainingCost); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":     err,
+				"accountId": accountID,
+			}).Error("failed to scan into lot")
+			return nil, err
+		}
+
+		lots = append(lots, lot)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"accountId": accountID,
+		}).Error("failed to get lots from rows")
+		return nil, err
+	}
+
+	return lots, nil
+}
+
+// BatchImport batch imports investment transactions and their lot selections. Lots are not imported,
+// so call RebuildAllLots once everything has been imported.
+func BatchImport(c context.Context, transactions []Transaction) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when batch inserting investment transactions")
+		return err
+	}
+
+	stmt, err := txn.Prepare(pq.CopyIn("investment_transactions", "id", "account_id", "security_id", "occurred", "action", "quantity", "price", "fees", "amount", "lot_method", "transaction_id"))
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin copy in when batch inserting investment transactions")
+		return err
+	}
+
+	for _, t := range transactions {
+		tdb := toDB(t)
+		_, err = stmt.Exec(tdb.ID, tdb.AccountID, tdb.SecurityID, tdb.Occurred, tdb.Action, tdb.Quantity, tdb.Price, tdb.Fees, tdb.Amount, tdb.LotMethod, tdb.TransactionID)
+		if err != nil {
+			logrus.WithError(err).Error("unable to exec investment transaction copy when batch inserting investment transactions")
+			return err
+		}
+	}
+
+	if _, err = stmt.Exec(); err != nil {
+		logrus.WithError(err).Error("unable to exec batch investment transaction copy when batch inserting investment transactions")
+		return err
+	}
+
+	if err = stmt.Close(); err != nil {
+		logrus.WithError(err).Error("unable to close investment transaction copy when batch inserting investment transactions")
+		return err
+	}
+
+	for _, t := range transactions {
+		if err := insertSelections(txn, t.ID, t.Lots); err != nil {
+			return err
+		}
+	}
+
+	if err = commit(); err != nil {
+		logrus.WithError(err).Error("unable to commit investment transaction copy when batch inserting investment transactions")
+		return err
+	}
+
+	return nil
+}
+
+// ImportForUser inserts securities, prices and investment transactions under the user in the context, giving them
+// fresh ids. Securities are merged with the user's existing securities by symbol. accountIDs and transactionIDs map
+// the ids in the import to the ids of the user's accounts and cash transactions.
+func ImportForUser(c context.Context, securities []Security, prices []Price, transactions []Transaction, accountIDs, transactionIDs map[int]int) error {
+	securityIDs := map[int]int{}
+	for _, s := range securities {
+		security, err := FindOrCreateSecurity(c, s.Symbol, s.Name, s.Currency)
+		if err != nil {
+			return err
+		}
+		securityIDs[s.ID] = security.ID
+	}
+
+	mappedPrices := []Price{}
+	for _, price := range prices {
+		securityID, ok := securityIDs[price.SecurityID]
+		if !ok {
+			logrus.WithField("price", price).Error("imported price belongs to a security that is not in the import")
+			return constants.ErrBadRequest
+		}
+		price.SecurityID = securityID
+		mappedPrices = append(mappedPrices, price)
+	}
+	if err := upsertPrices(c, mappedPrices); err != nil {
+		return err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	type pair struct{ accountID, securityID int }
+	pairs := map[pair]bool{}
+	investmentIDs := map[int]int{}
+	mapped := []Transaction{}
+	for _, t := range transactions {
+		accountID, accountOK := accountIDs[t.AccountID]
+		securityID, securityOK := securityIDs[t.SecurityID]
+		if !accountOK || !securityOK {
+			logrus.WithField("transaction", t).Error("imported investment transaction belongs to an account or security that is not in the import")
+			return constants.ErrBadRequest
+		}
+
+		importedID := t.ID
+		t.AccountID = accountID
+		t.SecurityID = securityID
+		t.TransactionID = transactionIDs[t.TransactionID]
+		if err := insert(c, &t); err != nil {
+			return err
+		}
+		investmentIDs[importedID] = t.ID
+		pairs[pair{accountID, securityID}] = true
+		mapped = append(mapped, t)
+	}
+
+	// lot selections can only be linked once every investment transaction has its fresh id
+	for _, t := range mapped {
+		for i := range t.Lots {
+			lotID, ok := investmentIDs[t.Lots[i].LotID]
+			if !ok {
+				logrus.WithField("transaction", t).Error("imported sale sells from a lot that is not in the import")
+				return constants.ErrBadRequest
+			}
+			t.Lots[i].LotID = lotID
+		}
+		if err := insertSelections(db, t.ID, t.Lots); err != nil {
+			return err
+		}
+	}
+
+	for p := range pairs {
+		if err := rebuildLots(c, p.accountID, p.securityID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RebuildAllLots rebuilds the lots of every account and security
+func RebuildAllLots(c context.Context) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query("SELECT DISTINCT account_id, security_id FROM investment_transactions")
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch accounts and securities to rebuild lots for")
+		return err
+	}
+	defer rows.Close()
+
+	type pair struct{ accountID, securityID int }
+	pairs := []pair{}
+	for rows.Next() {
+		var p pair
+		if err := rows.Scan(&p.accountID, &p.securityID); err != nil {
+			logrus.WithError(err).Error("failed to scan account and security to rebuild lots for")
+			return err
+		}
+		pairs = append(pairs, p)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get accounts and securities to rebuild lots for from rows")
+		return err
+	}
+
+	for _, p := range pairs {
+		if err := rebuildLots(c, p.accountID, p.securityID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebuildLots replaces the lots and disposals of an account and security with ones computed from its investment transactions
+func rebuildLots(c context.Context, accountID, securityID int) error {
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	transactions, err := query(c, "it.account_id = $1 AND it.security_id = $2", accountID, securityID)
+	if err != nil {
+		return err
+	}
+
+	lots, disposals, deltas, err := computeLots(transactions)
+	if err != nil {
+		return err
+	}
+
+	exec := func(query string, args ...interface{}) error {
+		if _, err := db.Exec(query, args...); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":      err,
+				"accountId":  accountID,
+				"securityId": securityID,
+				"query":      query,
+			}).Error("failed to rebuild lots")
+			return err
+		}
+		return nil
+	}
+
+	if err := exec("DELETE FROM lot_disposals WHERE lot_id IN (SELECT id FROM lots WHERE account_id = $1 AND security_id = $2)", accountID, securityID); err != nil {
+		return err
+	}
+
+	if err := exec("DELETE FROM lots WHERE account_id = $1 AND security_id = $2", accountID, securityID); err != nil {
+		return err
+	}
+
+	for _, lot := range lots {
+		if err := exec("INSERT INTO lots(id, account_id, security_id, acquired, quantity, remaining, cost, remaining_cost) VALUES($1, $2, $3, $4, $5, $6, $7, $8)", lot.ID, lot.AccountID, lot.SecurityID, lot.Acquired, lot.Quantity, lot.Remaining, lot.Cost, lot.RemainingCost); err != nil {
+			return err
+		}
+	}
+
+	for _, d := range disposals {
+		if err := exec("INSERT INTO lot_disposals(sale_id, lot_id, quantity, cost, proceeds) VALUES($1, $2, $3, $4, $5)", d.SaleID, d.LotID, d.Quantity, d.Cost, d.Proceeds); err != nil {
+			return err
+		}
+	}
+
+	for id, delta := range deltas {
+		if err := exec("UPDATE investment_transactions SET quantity_delta = $1 WHERE id = $2", delta, id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// query fetches investment transactions, along with their lot selections, matching a where clause on the
+// investment_transactions table aliased as it joined with the accounts table aliased as a
+func query(c context.Context, where string, args ...interface{}) ([]Transaction, error) {
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT it.id, it.account_id, it.security_id, it.occurred, it.action, it.quantity, it.price, it.fees, it.amount, it.lot_method, it.transaction_id FROM investment_transactions it JOIN accounts a ON a.id = it.account_id WHERE "+where, args...)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"where": where,
+		}).Error("failed to fetch investment transactions")
+		return nil, err
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	indexes := map[int]int{}
+	for rows.Next() {
+		var tdb transactionDB
+		if err := rows.Scan(&tdb.ID, &tdb.AccountID, &tdb.SecurityID, &tdb.Occurred, &tdb.Action, &tdb.Quantity, &tdb.Price, &tdb.Fees, &tdb.Amount, &tdb.LotMethod, &tdb.TransactionID); err != nil {
+			logrus.WithError(err).Error("failed to scan into investment transaction")
+			return nil, err
+		}
+
+		indexes[tdb.ID] = len(transactions)
+		transactions = append(transactions, fromDB(tdb))
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get investment transactions from rows")
+		return nil, err
+	}
+
+	if len(transactions) == 0 {
+		return transactions, nil
+	}
+
+	ids := []int64{}
+	for id := range indexes {
+		ids = append(ids, int64(id))
+	}
+
+	selections, err := db.Query("SELECT sale_id, lot_id, quantity FROM lot_selections WHERE sale_id = ANY($1)", pq.Array(ids))
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch lot selections")
+		return nil, err
+	}
+	defer selections.Close()
+
+	for selections.Next() {
+		var saleID int
+		var selection LotSelection
+		if err := selections.Scan(&saleID, &selection.LotID, &selection.Quantity); err != nil {
+			logrus.WithError(err).Error("failed to scan into lot selection")
+			return nil, err
+		}
+
+		t := &transactions[indexes[saleID]]
+		t.Lots = append(t.Lots, selection)
+	}
+	if err := selections.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get lot selections from rows")
+		return nil, err
+	}
+
+	return transactions, nil
+}
+
+func insert(c context.Context, t *Transaction) error {
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	tdb := toDB(*t)
+	var id int
+	err = db.QueryRow("INSERT INTO investment_transactions(account_id, security_id, occurred, action, quantity, price, fees, amount, lot_method, transaction_id) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id", tdb.AccountID, tdb.SecurityID, tdb.Occurred, tdb.Action, tdb.Quantity, tdb.Price, tdb.Fees, tdb.Amount, tdb.LotMethod, tdb.TransactionID).Scan(&id)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":       err,
+			"transaction": t,
+		}).Error("failed to insert investment transaction row")
+		return err
+	}
+	t.ID = id
+
+	return insertSelections(db, t.ID, t.Lots)
+}
+
+func insertSelections(db util.DB, saleID int, selections []LotSelection) error {
+	for _, selection := range selections {
+		_, err := db.Exec("INSERT INTO lot_selections(sale_id, lot_id, quantity) VALUES($1, $2, $3)", saleID, selection.LotID, selection.Quantity)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":     err,
+				"saleId":    saleID,
+				"selection": selection,
+			}).Error("failed to insert lot selection row")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validate checks an investment transaction and fills in the amounts that are derived from the quantity and price.
+// It returns the security being traded.
+func validate(c context.Context, t *Transaction) (*Security, error) {
+	valid, err := util.UserOwnsAccount(c, t.AccountID)
+	if err != nil || !valid {
+		return nil, constants.ErrForbidden
+	}
+
+	valid, err = userOwnsSecurity(c, t.SecurityID)
+	if err != nil || !valid {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	security := Security{}
+	var accountCurrency string
+	err = db.QueryRow("SELECT s.id, s.user_id, s.symbol, s.name, s.currency, a.currency FROM securities s, accounts a WHERE s.id = $1 AND a.id = $2", t.SecurityID, t.AccountID).Scan(&security.ID, &security.User, &security.Symbol, &security.Name, &security.Currency, &accountCurrency)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":       err,
+			"transaction": t,
+		}).Error("failed to select security and account of investment transaction")
+		return nil, err
+	}
+
+	// holdings are valued in the account's currency
+	if security.Currency != accountCurrency {
+		return nil, constants.ErrInvalidCurrency
+	}
+
+	if t.Fees < 0 || t.Price < 0 {
+		return nil, constants.ErrBadRequest
+	}
+
+	if t.Action != constants.InvestmentSell {
+		if t.LotMethod != "" || len(t.Lots) > 0 {
+			return nil, constants.ErrBadRequest
+		}
+	}
+
+	switch t.Action {
+	case constants.InvestmentBuy:
+		if t.Quantity <= 0 {
+			return nil, constants.ErrBadRequest
+		}
+		t.Amount = int(math.Round(t.Quantity*t.Price)) + t.Fees
+	case constants.InvestmentSell:
+		if t.Quantity <= 0 {
+			return nil, constants.ErrBadRequest
+		}
+		t.Amount = int(math.Round(t.Quantity*t.Price)) - t.Fees
+		if t.LotMethod == "" {
+			t.LotMethod = constants.LotsFIFO
+		}
+		if t.LotMethod != constants.LotsFIFO && t.LotMethod != constants.LotsSpecificID {
+			return nil, constants.ErrBadRequest
+		}
+		if t.LotMethod == constants.LotsFIFO && len(t.Lots) > 0 {
+			return nil, constants.ErrBadRequest
+		}
+	case constants.InvestmentDividend:
+		if t.Amount == 0 {
+			return nil, constants.ErrBadRequest
+		}
+		t.Quantity = 0
+		t.Price = 0
+	case constants.InvestmentReinvest:
+		if t.Quantity <= 0 || t.Amount <= 0 {
+			return nil, constants.ErrBadRequest
+		}
+		if t.Price == 0 {
+			t.Price = float64(t.Amount) / t.Quantity
+		}
+	case constants.InvestmentSplit:
+		if t.Quantity <= 0 {
+			return nil, constants.ErrBadRequest
+		}
+		t.Price = 0
+		t.Amount = 0
+	default:
+		return nil, constants.ErrBadRequest
+	}
+
+	return &security, nil
+}
+
+func toDB(t Transaction) *transactionDB {
+	return &transactionDB{
+		ID:            t.ID,
+		AccountID:     t.AccountID,
+		SecurityID:    t.SecurityID,
+		Occurred:      t.Date,
+		Action:        t.Action,
+		Quantity:      t.Quantity,
+		Price:         t.Price,
+		Fees:          t.Fees,
+		Amount:        t.Amount,
+		LotMethod:     util.ToNullStringNonEmpty(t.LotMethod),
+		TransactionID: util.ToNullIntNonZero(t.TransactionID),
+	}
+}
+
+func fromDB(t transactionDB) Transaction {
+	return Transaction{
+		ID:            t.ID,
+		AccountID:     t.AccountID,
+		SecurityID:    t.SecurityID,
+		Date:          t.Occurred,
+		Action:        t.Action,
+		Quantity:      t.Quantity,
+		Price:         t.Price,
+		Fees:          t.Fees,
+		Amount:        t.Amount,
+		LotMethod:     util.FromNullStringNonEmpty(t.LotMethod),
+		TransactionID: util.FromNullIntNonZero(t.TransactionID),
+	}
+}
@@ -0,0 +1,179 @@
+package investment
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/constants"
+)
+
+// quantities are floats, so anything closer than this is considered equal
+const epsilon = 1e-9
+
+// Lot is a quantity of a security acquired by a single buy or reinvestment, along with what it cost.
+// Quantities are adjusted for splits.
+type Lot struct {
+	ID            int       `json:"id"`
+	AccountID     int       `json:"accountId"`
+	SecurityID    int       `json:"securityId"`
+	Acquired      time.Time `json:"acquired"`
+	Quantity      float64   `json:"quantity"`
+	Remaining     float64   `json:"remaining"`
+	Cost          int       `json:"cost"`
+	RemainingCost int       `json:"remainingCost"`
+}
+
+// Disposal is the part of a lot that a sale sold
+type Disposal struct {
+	SaleID   int     `json:"saleId"`
+	LotID    int     `json:"lotId"`
+	Quantity float64 `json:"quantity"`
+	Cost     int     `json:"cost"`
+	Proceeds int     `json:"proceeds"`
+}
+
+// computeLots replays the investment transactions of a single account and security in date order,
+// opening lots on buys and reinvestments, disposing of them on sales and adjusting them on splits.
+// It also returns the change in quantity held caused by each transaction.
+func computeLots(transactions []Transaction) ([]*Lot, []Disposal, map[int]float64, error) {
+	sorted := append([]Transaction{}, transactions...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Date.Equal(sorted[j].Date) {
+			return sorted[i].ID < sorted[j].ID
+		}
+		return sorted[i].Date.Before(sorted[j].Date)
+	})
+
+	lots := []*Lot{}
+	byID := map[int]*Lot{}
+	disposals := []Disposal{}
+	deltas := map[int]float64{}
+
+	for _, t := range sorted {
+		switch t.Action {
+		case constants.InvestmentBuy, constants.InvestmentReinvest:
+			lot := &Lot{
+				ID:            t.ID,
+				AccountID:     t.AccountID,
+				SecurityID:    t.SecurityID,
+				Acquired:      t.Date,
+				Quantity:      t.Quantity,
+				Remaining:     t.Quantity,
+				Cost:          t.Amount,
+				RemainingCost: t.Amount,
+			}
+			lots = append(lots, lot)
+			byID[lot.ID] = lot
+			deltas[t.ID] = t.Quantity
+
+		case constants.InvestmentSell:
+			sold, err := dispose(t, lots, byID)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			disposals = append(disposals, sold...)
+			deltas[t.ID] = -t.Quantity
+
+		case constants.InvestmentSplit:
+			held := 0.0
+			for _, lot := range lots {
+				held += lot.Remaining
+				lot.Quantity *= t.Quantity
+				lot.Remaining *= t.Quantity
+			}
+			deltas[t.ID] = held * (t.Quantity - 1)
+
+		case constants.InvestmentDividend:
+			deltas[t.ID] = 0
+		}
+	}
+
+	return lots, disposals, deltas, nil
+}
+
+// dispose sells the quantity of a sale from lots, first in first out unless the sale selects specific lots
+func dispose(sale Transaction, lots []*Lot, byID map[int]*Lot) ([]Disposal, error) {
+	type take struct {
+		lot      *Lot
+		quantity float64
+	}
+
+	takes := []take{}
+	if sale.LotMethod == constants.LotsSpecificID {
+		// a lot can be selected more than once, so what is left of it is what the earlier selections have not taken
+		selected := map[int]float64{}
+		for _, selection := range sale.Lots {
+			lot, ok := byID[selection.LotID]
+			if !ok || selection.Quantity <= 0 || selection.Quantity > lot.Remaining-selected[lot.ID]+epsilon {
+				logrus.WithFields(logrus.Fields{
+					"saleId":    sale.ID,
+					"selection": selection,
+				}).Error("sale selects a lot that does not exist or does not hold enough")
+				return nil, constants.ErrBadRequest
+			}
+			quantity := math.Min(selection.Quantity, lot.Remaining-selected[lot.ID])
+			takes = append(takes, take{lot, quantity})
+			selected[lot.ID] += quantity
+		}
+	} else {
+		left := sale.Quantity
+		for _, lot := range lots {
+			if left <= epsilon {
+				break
+			}
+			if lot.Remaining <= epsilon {
+				continue
+			}
+			quantity := math.Min(left, lot.Remaining)
+			takes = append(takes, take{lot, quantity})
+			left -= quantity
+		}
+	}
+
+	total := 0.0
+	for _, t := range takes {
+		total += t.quantity
+	}
+	if math.Abs(total-sale.Quantity) > epsilon {
+		logrus.WithFields(logrus.Fields{
+			"saleId":   sale.ID,
+			"quantity": sale.Quantity,
+			"held":     total,
+		}).Error("sale sells a different quantity than is available in its lots")
+		return nil, constants.ErrBadRequest
+	}
+
+	disposals := []Disposal{}
+	proceedsLeft := sale.Amount
+	for i, t := range takes {
+		cost := t.lot.RemainingCost
+		if t.quantity < t.lot.Remaining-epsilon {
+			cost = int(math.Round(float64(t.lot.RemainingCost) * t.quantity / t.lot.Remaining))
+		}
+		t.lot.Remaining -= t.quantity
+		t.lot.RemainingCost -= cost
+		if t.lot.Remaining < epsilon {
+			t.lot.Remaining = 0
+		}
+
+		// the last lot gets whatever is left so that the proceeds add up exactly
+		proceeds := proceedsLeft
+		if i < len(takes)-1 {
+			proceeds = int(math.Round(float64(sale.Amount) * t.quantity / sale.Quantity))
+		}
+		proceedsLeft -= proceeds
+
+		disposals = append(disposals, Disposal{
+			SaleID:   sale.ID,
+			LotID:    t.lot.ID,
+			Quantity: t.quantity,
+			Cost:     cost,
+			Proceeds: proceeds,
+		})
+	}
+
+	return disposals, nil
+}
@@ -0,0 +1,86 @@
+// +build integration
+
+package investment
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/financejc/constants"
+)
+
+func day(d int) time.Time {
+	return time.Date(2017, time.January, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestComputeLotsFIFO(t *testing.T) {
+	lots, disposals, deltas, err := computeLots([]Transaction{
+		{ID: 4, Date: day(10), Action: constants.InvestmentSell, Quantity: 15, Amount: 3000, LotMethod: constants.LotsFIFO},
+		{ID: 1, Date: day(1), Action: constants.InvestmentBuy, Quantity: 10, Amount: 1000},
+		{ID: 2, Date: day(2), Action: constants.InvestmentBuy, Quantity: 10, Amount: 1500},
+		{ID: 3, Date: day(5), Action: constants.InvestmentDividend, Amount: 50},
+	})
+	require.NoError(t, err)
+
+	require.Len(t, lots, 2)
+	require.InDelta(t, 0, lots[0].Remaining, epsilon)
+	require.Equal(t, 0, lots[0].RemainingCost)
+	require.InDelta(t, 5, lots[1].Remaining, epsilon)
+	require.Equal(t, 750, lots[1].RemainingCost)
+
+	require.Equal(t, []Disposal{
+		{SaleID: 4, LotID: 1, Quantity: 10, Cost: 1000, Proceeds: 2000},
+		{SaleID: 4, LotID: 2, Quantity: 5, Cost: 750, Proceeds: 1000},
+	}, disposals)
+
+	require.InDelta(t, -15, deltas[4], epsilon)
+	require.InDelta(t, 0, deltas[3], epsilon)
+}
+
+func TestComputeLotsSpecificIDAndSplit(t *testing.T) {
+	lots, disposals, deltas, err := computeLots([]Transaction{
+		{ID: 1, Date: day(1), Action: constants.InvestmentBuy, Quantity: 10, Amount: 1000},
+		{ID: 2, Date: day(2), Action: constants.InvestmentReinvest, Quantity: 10, Amount: 2000},
+		{ID: 3, Date: day(3), Action: constants.InvestmentSplit, Quantity: 2},
+		{ID: 4, Date: day(4), Action: constants.InvestmentSell, Quantity: 10, Amount: 1500, LotMethod: constants.LotsSpecificID, Lots: []LotSelection{{LotID: 2, Quantity: 10}}},
+	})
+	require.NoError(t, err)
+
+	// the split doubles every lot but leaves its cost alone
+	require.InDelta(t, 20, lots[0].Quantity, epsilon)
+	require.InDelta(t, 20, lots[0].Remaining, epsilon)
+	require.Equal(t, 1000, lots[0].RemainingCost)
+	require.InDelta(t, 10, lots[1].Remaining, epsilon)
+	require.Equal(t, 1000, lots[1].RemainingCost)
+
+	require.Equal(t, []Disposal{{SaleID: 4, LotID: 2, Quantity: 10, Cost: 1000, Proceeds: 1500}}, disposals)
+	require.InDelta(t, 20, deltas[3], epsilon)
+}
+
+func TestComputeLotsOversold(t *testing.T) {
+	_, _, _, err := computeLots([]Transaction{
+		{ID: 1, Date: day(1), Action: constants.InvestmentBuy, Quantity: 10, Amount: 1000},
+		{ID: 2, Date: day(2), Action: constants.InvestmentSell, Quantity: 11, Amount: 1100, LotMethod: constants.LotsFIFO},
+	})
+	require.Equal(t, constants.ErrBadRequest, err)
+}
+
+func TestComputeLotsSpecificIDSelectedTwice(t *testing.T) {
+	_, _, _, err := computeLots([]Transaction{
+		{ID: 1, Date: day(1), Action: constants.InvestmentBuy, Quantity: 10, Amount: 1000},
+		{ID: 2, Date: day(2), Action: constants.InvestmentBuy, Quantity: 10, Amount: 2000},
+		{ID: 3, Date: day(3), Action: constants.InvestmentSell, Quantity: 16, Amount: 1600, LotMethod: constants.LotsSpecificID, Lots: []LotSelection{{LotID: 1, Quantity: 8}, {LotID: 1, Quantity: 8}}},
+	})
+	require.Equal(t, constants.ErrBadRequest, err, "selecting a lot twice should not sell more than it holds")
+
+	lots, disposals, _, err := computeLots([]Transaction{
+		{ID: 1, Date: day(1), Action: constants.InvestmentBuy, Quantity: 10, Amount: 1000},
+		{ID: 2, Date: day(2), Action: constants.InvestmentSell, Quantity: 10, Amount: 1500, LotMethod: constants.LotsSpecificID, Lots: []LotSelection{{LotID: 1, Quantity: 4}, {LotID: 1, Quantity: 6}}},
+	})
+	require.NoError(t, err)
+	require.InDelta(t, 0, lots[0].Remaining, epsilon)
+	require.Equal(t, 0, lots[0].RemainingCost)
+	require.Equal(t, []Disposal{{SaleID: 2, LotID: 1, Quantity: 4, Cost: 400, Proceeds: 600}, {SaleID: 2, LotID: 1, Quantity: 6, Cost: 600, Proceeds: 900}}, disposals)
+}
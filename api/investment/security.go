@@ -0,0 +1,499 @@
+package investment
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// Security is a stock, fund or other holding that can be bought and sold in investment accounts
+type Security struct {
+	ID       int    `json:"id,omitempty"`
+	User     uint   `json:"user"`
+	Symbol   string `json:"symbol"`
+	Name     string `json:"name"`
+	Currency string `json:"currency"`
+}
+
+// Price is the price of one unit of a security from a date onwards, in minor units of the security's currency
+type Price struct {
+	SecurityID int       `json:"securityId"`
+	Date       time.Time `json:"date"`
+	Price      float64   `json:"price"`
+}
+
+// GetSecurities fetches all securities of a user
+func GetSecurities(c context.Context) ([]Security, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, symbol, name, currency FROM securities WHERE user_id = $1 ORDER BY symbol", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch securities")
+		return nil, err
+	}
+
+	return scanSecurities(rows)
+}
+
+// GetAllSecurities queries for all securities
+func GetAllSecurities(c context.Context) ([]Security, error) {
+	if !util.IsAdminRequest(c) {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, symbol, name, currency FROM securities")
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch all securities")
+		return nil, err
+	}
+
+	return scanSecurities(rows)
+}
+
+// NewSecurity creates a new security
+func NewSecurity(c context.Context, security *Security) (*Security, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	security.User = userID
+	if err := validateSecurity(security); err != nil {
+		return nil, err
+	}
+
+	var id int
+	err = db.QueryRow("INSERT INTO securities(user_id, symbol, name, currency) VALUES($1, $2, $3, $4) RETURNING id", security.User, security.Symbol, security.Name, security.Currency).Scan(&id)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":    err,
+			"security": security,
+		}).Error("failed to insert security row")
+		return nil, err
+	}
+
+	security.ID = id
+	return security, nil
+}
+
+// UpdateSecurity updates a security
+func UpdateSecurity(c context.Context, security *Security) (*Security, error) {
+	valid, err := userOwnsSecurity(c, security.ID)
+	if err != nil || !valid {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateSecurity(security); err != nil {
+		return nil, err
+	}
+
+	_, err = db.Exec("UPDATE securities SET symbol = $1, name = $2, currency = $3 WHERE id = $4", security.Symbol, security.Name, security.Currency, security.ID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":    err,
+			"security": security,
+		}).Error("failed to update security row")
+		return nil, err
+	}
+
+	return security, nil
+}
+
+// FindOrCreateSecurity finds the user's security with a symbol, otherwise it creates one
+func FindOrCreateSecurity(c context.Context, symbol, name, currency string) (*Security, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	security := Security{}
+	err = db.QueryRow("SELECT id, user_id, symbol, name, currency FROM securities WHERE user_id = $1 AND symbol = $2", userID, symbol).Scan(&security.ID, &security.User, &security.Symbol, &security.Name, &security.Currency)
+	if err == nil {
+		return &security, nil
+	} else if err != sql.ErrNoRows {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"symbol": symbol,
+		}).Error("failed to select security by symbol")
+		return nil, err
+	}
+
+	return NewSecurity(c, &Security{
+		Symbol:   symbol,
+		Name:     name,
+		Currency: currency,
+	})
+}
+
+// BatchImportSecurities batch imports securities
+func BatchImportSecurities(c context.Context, securities []Security) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when batch inserting securities")
+		return err
+	}
+
+	stmt, err := txn.Prepare(pq.CopyIn("securities", "id", "user_id", "symbol", "name", "currency"))
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin copy in when batch inserting securities")
+		return err
+	}
+
+	for _, security := range securities {
+		_, err = stmt.Exec(security.ID, security.User, security.Symbol, security.Name, security.Currency)
+		if err != nil {
+			logrus.WithError(err).Error("unable to exec security copy when batch inserting securities")
+			return err
+		}
+	}
+
+	_, err = stmt.Exec()
+	if err != nil {
+		logrus.WithError(err).Error("unable to exec batch security copy when batch inserting securities")
+		return err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		logrus.WithError(err).Error("unable to close security copy when batch inserting securities")
+		return err
+	}
+
+	err = commit()
+	if err != nil {
+		logrus.WithError(err).Error("unable to commit security copy when batch inserting securities")
+		return err
+	}
+
+	return nil
+}
+
+// GetPrices fetches the price history of a security, newest first
+func GetPrices(c context.Context, securityID int) ([]Price, error) {
+	valid, err := userOwnsSecurity(c, securityID)
+	if err != nil || !valid {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT security_id, effective, price FROM security_prices WHERE security_id = $1 ORDER BY effective DESC", securityID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":      err,
+			"securityId": securityID,
+		}).Error("failed to fetch security prices")
+		return nil, err
+	}
+
+	return scanPrices(rows)
+}
+
+// GetAllPrices queries for all security prices
+func GetAllPrices(c context.Context) ([]Price, error) {
+	if !util.IsAdminRequest(c) {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT security_id, effective, price FROM security_prices")
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch all security prices")
+		return nil, err
+	}
+
+	return scanPrices(rows)
+}
+
+// GetPricesForUser queries for the prices of all securities of the user in the context
+func GetPricesForUser(c context.Context) ([]Price, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT p.security_id, p.effective, p.price FROM security_prices p JOIN securities s ON p.security_id = s.id WHERE s.user_id = $1", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch security prices for user")
+		return nil, err
+	}
+
+	return scanPrices(rows)
+}
+
+// NewPrice sets the price of a security from a date, replacing any price already set for that date
+func NewPrice(c context.Context, price Price) (Price, error) {
+	valid, err := userOwnsSecurity(c, price.SecurityID)
+	if err != nil || !valid {
+		return Price{}, constants.ErrForbidden
+	}
+
+	if price.Price <= 0 || price.Date.IsZero() {
+		return Price{}, constants.ErrBadRequest
+	}
+
+	if err := upsertPrices(c, []Price{price}); err != nil {
+		return Price{}, err
+	}
+
+	return price, nil
+}
+
+// BatchImportPrices batch imports security prices
+func BatchImportPrices(c context.Context, prices []Price) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	return upsertPrices(c, prices)
+}
+
+// ImportPrices imports a csv of prices with symbol, date (YYYY-MM-DD) and price columns, with prices
+// in major units, e.g. dollars. A header row is optional. Rows for symbols that are not one of the
+// user's securities are skipped. It returns the number of prices imported.
+func ImportPrices(c context.Context, r io.Reader) (int, error) {
+	securities, err := GetSecurities(c)
+	if err != nil {
+		return 0, err
+	}
+
+	bySymbol := map[string]Security{}
+	for _, security := range securities {
+		bySymbol[strings.ToUpper(security.Symbol)] = security
+	}
+
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		logrus.WithError(err).Error("unable to read price csv")
+		return 0, constants.ErrBadRequest
+	}
+
+	prices := []Price{}
+	for i, record := range records {
+		if len(record) < 3 {
+			logrus.WithField("record", record).Error("price csv row does not have symbol, date and price columns")
+			return 0, constants.ErrBadRequest
+		}
+
+		date, err := time.Parse("2006-01-02", strings.TrimSpace(record[1]))
+		if err != nil && i == 0 {
+			// header row
+			continue
+		} else if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"record": record,
+			}).Error("unable to parse date in price csv")
+			return 0, constants.ErrBadRequest
+		}
+
+		value, err := strconv.ParseFloat(strings.TrimSpace(record[2]), 64)
+		if err != nil || value <= 0 {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"record": record,
+			}).Error("unable to parse price in price csv")
+			return 0, constants.ErrBadRequest
+		}
+
+		security, ok := bySymbol[strings.ToUpper(strings.TrimSpace(record[0]))]
+		if !ok {
+			continue
+		}
+
+		prices = append(prices, Price{
+			SecurityID: security.ID,
+			Date:       date,
+			Price:      value * math.Pow10(constants.CurrencyInfo[security.Currency].DigitsAfterDecimal),
+		})
+	}
+
+	if err := upsertPrices(c, prices); err != nil {
+		return 0, err
+	}
+
+	return len(prices), nil
+}
+
+func upsertPrices(c context.Context, prices []Price) error {
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when inserting security prices")
+		return err
+	}
+
+	stmt, err := txn.Prepare("INSERT INTO security_prices(security_id, effective, price) VALUES($1, $2, $3) ON CONFLICT (security_id, effective) DO UPDATE SET price = EXCLUDED.price")
+	if err != nil {
+		logrus.WithError(err).Error("unable to prepare statement when inserting security prices")
+		return err
+	}
+
+	for _, price := range prices {
+		if _, err := stmt.Exec(price.SecurityID, price.Date, price.Price); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"price": price,
+			}).Error("unable to exec statement when inserting security prices")
+			return err
+		}
+	}
+
+	if err := stmt.Close(); err != nil {
+		logrus.WithError(err).Error("unable to close statement when inserting security prices")
+		return err
+	}
+
+	if err := commit(); err != nil {
+		logrus.WithError(err).Error("unable to commit when inserting security prices")
+		return err
+	}
+
+	return nil
+}
+
+func userOwnsSecurity(c context.Context, securityID int) (bool, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return false, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return false, err
+	}
+
+	var owner uint
+	err = db.QueryRow("SELECT user_id FROM securities WHERE id = $1", securityID).Scan(&owner)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":    err,
+			"userId":   userID,
+			"security": securityID,
+		}).Error("error checking owner of security")
+		return false, err
+	}
+
+	return owner == userID, nil
+}
+
+func validateSecurity(security *Security) error {
+	if _, valid := constants.CurrencyInfo[security.Currency]; !valid {
+		return constants.ErrInvalidCurrency
+	}
+
+	security.Symbol = strings.TrimSpace(security.Symbol)
+	if security.Symbol == "" {
+		return constants.ErrBadRequest
+	}
+
+	if security.Name == "" {
+		security.Name = security.Symbol
+	}
+
+	return nil
+}
+
+func scanSecurities(rows *sql.Rows) ([]Security, error) {
+	defer rows.Close()
+
+	securities := []Security{}
+	for rows.Next() {
+		var security Security
+		if err := rows.Scan(&security.ID, &security.User, &security.Symbol, &security.Name, &security.Currency); err != nil {
+			logrus.WithError(err).Error("failed to scan into security")
+			return nil, err
+		}
+
+		securities = append(securities, security)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get securities from rows")
+		return nil, err
+	}
+
+	return securities, nil
+}
+
+func scanPrices(rows *sql.Rows) ([]Price, error) {
+	defer rows.Close()
+
+	prices := []Price{}
+	for rows.Next() {
+		var price Price
+		if err := rows.Scan(&price.SecurityID, &price.Date, &price.Price); err != nil {
+			logrus.WithError(err).Error("failed to scan into security price")
+			return nil, err
+		}
+
+		prices = append(prices, price)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get security prices from rows")
+		return nil, err
+	}
+
+	return prices, nil
+}
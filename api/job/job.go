@@ -0,0 +1,352 @@
+package job
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// Kinds of jobs
+const (
+	KindImport     = "import"
+	KindExport     = "export"
+	KindUserExport = "userExport"
+	KindReindex    = "reindex"
+	KindBackup     = "backup"
+)
+
+// Statuses of jobs
+const (
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// minimum time between progress updates being written to the db
+const progressInterval = time.Second
+
+// how long finished jobs and their results are kept around
+const retention = time.Hour * 24 * 7
+
+// processStart is used to find jobs that were running when the server last stopped
+var processStart = time.Now()
+
+// Job is a long running task that runs in the background while clients poll for its progress
+type Job struct {
+	ID        int       `json:"id"`
+	User      uint      `json:"user"`
+	Kind      string    `json:"kind"`
+	Status    string    `json:"status"`
+	Done      int       `json:"done"`
+	Total     int       `json:"total"`
+	Error     string    `json:"error,omitempty"`
+	HasResult bool      `json:"hasResult"`
+	Created   time.Time `json:"created"`
+	Updated   time.Time `json:"updated"`
+}
+
+// Result is the downloadable output of a job
+type Result struct {
+	Content     []byte
+	ContentType string
+}
+
+// Func does the work of a job. It can report progress with Progress and returns the result of the job, if any.
+type Func func(c context.Context) (*Result, error)
+
+type jobDB struct {
+	ID        int
+	User      uint
+	Kind      string
+	Status    string
+	Done      int
+	Total     int
+	Error     sql.NullString
+	HasResult bool
+	Created   time.Time
+	Updated   time.Time
+}
+
+// progressReporter writes progress of a job to the db. It holds its own *sql.DB
+// because the job may replace the db in its context with a *sql.Tx.
+type progressReporter struct {
+	sync.Mutex
+	db         *sql.DB
+	jobID      int
+	lastUpdate time.Time
+}
+
+// Start records a new job for the user in the context and runs fn in the background
+func Start(c context.Context, kind string, fn Func) (*Job, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.SQLDBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	jdb := jobDB{
+		User:   userID,
+		Kind:   kind,
+		Status: StatusRunning,
+	}
+	err = db.QueryRow("INSERT INTO jobs(user_id, kind, status) VALUES($1, $2, $3) RETURNING id, created, updated", jdb.User, jdb.Kind, jdb.Status).Scan(&jdb.ID, &jdb.Created, &jdb.Updated)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+			"kind":   kind,
+		}).Error("failed to insert job row")
+		return nil, err
+	}
+
+	reporter := &progressReporter{
+		db:    db,
+		jobID: jdb.ID,
+	}
+	go run(context.WithValue(c, constants.CtxJob, reporter), db, jdb.ID, fn)
+
+	job := fromDB(jdb)
+	return &job, nil
+}
+
+func run(c context.Context, db *sql.DB, jobID int, fn Func) {
+	var result *Result
+	var err error
+	func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("job panicked: %v", r)
+			}
+		}()
+		result, err = fn(c)
+	}()
+
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"jobId": jobID,
+		}).Error("job failed")
+		_, err = db.Exec("UPDATE jobs SET status = $1, error = $2, updated = now() WHERE id = $3", StatusFailed, err.Error(), jobID)
+	} else if result != nil {
+		_, err = db.Exec("UPDATE jobs SET status = $1, result = $2, result_type = $3, done = GREATEST(done, total), updated = now() WHERE id = $4", StatusSucceeded, result.Content, result.ContentType, jobID)
+	} else {
+		_, err = db.Exec("UPDATE jobs SET status = $1, done = GREATEST(done, total), updated = now() WHERE id = $2", StatusSucceeded, jobID)
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"jobId": jobID,
+		}).Error("failed to record the outcome of a job")
+	}
+}
+
+// Progress records how far along the job running in the context is. A total of 0 means the total is unknown.
+// It does nothing when the context is not running a job.
+func Progress(c context.Context, done, total int) {
+	reporter, ok := c.Value(constants.CtxJob).(*progressReporter)
+	if !ok {
+		return
+	}
+
+	reporter.Lock()
+	defer reporter.Unlock()
+
+	if time.Since(reporter.lastUpdate) < progressInterval && done != total {
+		return
+	}
+	reporter.lastUpdate = time.Now()
+
+	_, err := reporter.db.Exec("UPDATE jobs SET done = $1, total = $2, updated = now() WHERE id = $3", done, total, reporter.jobID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"jobId": reporter.jobID,
+		}).Error("failed to record progress of a job")
+	}
+}
+
+// progressReader reports progress of a job as it is read
+type progressReader struct {
+	io.Reader
+	c     context.Context
+	read  int
+	total int
+}
+
+// NewProgressReader wraps r so that progress of the job running in the context is reported as bytes are read from it
+func NewProgressReader(c context.Context, r io.Reader, size int) io.Reader {
+	return &progressReader{
+		Reader: r,
+		c:      c,
+		total:  size,
+	}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.read += n
+	Progress(r.c, r.read, r.total)
+	return n, err
+}
+
+// Get fetches a job of the user in the context
+func Get(c context.Context, jobID int) (*Job, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	var jdb jobDB
+	err = db.QueryRow("SELECT id, user_id, kind, status, done, total, error, result IS NOT NULL, created, updated FROM jobs WHERE id = $1", jobID).Scan(&jdb.ID, &jdb.User, &jdb.Kind, &jdb.Status, &jdb.Done, &jdb.Total, &jdb.Error, &jdb.HasResult, &jdb.Created, &jdb.Updated)
+	if err == sql.ErrNoRows {
+		return nil, constants.ErrForbidden
+	} else if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"jobId": jobID,
+		}).Error("failed to fetch job")
+		return nil, err
+	}
+
+	if jdb.User != userID {
+		return nil, constants.ErrForbidden
+	}
+
+	job := fromDB(jdb)
+	return &job, nil
+}
+
+// GetAll fetches all jobs of the user in the context, newest first
+func GetAll(c context.Context) ([]Job, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs := []Job{}
+	rows, err := db.Query("SELECT id, user_id, kind, status, done, total, error, result IS NOT NULL, created, updated FROM jobs WHERE user_id = $1 ORDER BY created DESC", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch jobs")
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var jdb jobDB
+		if err := rows.Scan(&jdb.ID, &jdb.User, &jdb.Kind, &jdb.Status, &jdb.Done, &jdb.Total, &jdb.Error, &jdb.HasResult, &jdb.Created, &jdb.Updated); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"userId": userID,
+			}).Error("failed to scan into job")
+			return nil, err
+		}
+
+		jobs = append(jobs, fromDB(jdb))
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to get jobs from rows")
+		return nil, err
+	}
+
+	return jobs, nil
+}
+
+// GetResult fetches the result of a finished job of the user in the context
+func GetResult(c context.Context, jobID int) (*Result, error) {
+	job, err := Get(c, jobID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !job.HasResult {
+		return nil, constants.ErrBadRequest
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{}
+	err = db.QueryRow("SELECT result, result_type FROM jobs WHERE id = $1", jobID).Scan(&result.Content, &result.ContentType)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"jobId": jobID,
+		}).Error("failed to fetch job result")
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Cleanup fails jobs that were interrupted by a restart and deletes old finished jobs along with their results
+func Cleanup(c context.Context) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	// jobs run in goroutines of this process, so any job still running that was
+	// last updated before the process started can never finish
+	_, err = db.Exec("UPDATE jobs SET status = $1, error = $2, updated = now() WHERE status = $3 AND updated < $4", StatusFailed, "interrupted by a server restart", StatusRunning, processStart)
+	if err != nil {
+		logrus.WithError(err).Error("failed to fail interrupted jobs")
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM jobs WHERE status <> $1 AND updated < $2", StatusRunning, time.Now().Add(-retention))
+	if err != nil {
+		logrus.WithError(err).Error("failed to delete old jobs")
+		return err
+	}
+
+	return nil
+}
+
+func fromDB(job jobDB) Job {
+	return Job{
+		ID:        job.ID,
+		User:      job.User,
+		Kind:      job.Kind,
+		Status:    job.Status,
+		Done:      job.Done,
+		Total:     job.Total,
+		Error:     util.FromNullStringNonEmpty(job.Error),
+		HasResult: job.HasResult,
+		Created:   job.Created,
+		Updated:   job.Updated,
+	}
+}
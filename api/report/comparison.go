@@ -0,0 +1,207 @@
+package report
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/api/exchange"
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// Period is a date range, including both ends
+type Period struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// Comparison is what was spent in each category in one period compared to another, in the user's home currency.
+// Amounts are net of money coming into the category, so income categories are negative. The biggest movers are
+// the categories without subcategories that changed the most.
+type Comparison struct {
+	Currency      string               `json:"currency"`
+	Current       Period               `json:"current"`
+	Previous      Period               `json:"previous"`
+	Total         CategoryComparison   `json:"total"`
+	Categories    []CategoryComparison `json:"categories"`
+	BiggestMovers []CategoryComparison `json:"biggestMovers"`
+}
+
+// CategoryComparison is what was spent in a category in the current and previous periods. PercentChange is left out
+// if nothing was spent in the previous period.
+type CategoryComparison struct {
+	Category      string   `json:"category"`
+	Parent        string   `json:"parent,omitempty"`
+	Current       int      `json:"current"`
+	Previous      int      `json:"previous"`
+	Change        int      `json:"change"`
+	PercentChange *float64 `json:"percentChange,omitempty"`
+}
+
+// GetComparison compares what the user in the context spent in each category in two periods.
+// Categories also count towards the categories above them.
+func GetComparison(c context.Context, current, previous Period, filter Filter) (Comparison, error) {
+	if current.End.Before(current.Start) || previous.End.Before(previous.Start) {
+		return Comparison{}, constants.ErrBadRequest
+	}
+
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return Comparison{}, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return Comparison{}, err
+	}
+
+	homeCurrency, err := exchange.HomeCurrency(c)
+	if err != nil {
+		return Comparison{}, err
+	}
+
+	query := fmt.Sprintf(`WITH tx AS (
+	SELECT t.amount, t.amount * fx_rate(a.currency, $2, t.occurred, a.user_id) AS converted, a.currency, t.category,
+		t.occurred BETWEEN $3::date AND $4::date AS in_current, t.occurred BETWEEN $5::date AND $6::date AS in_previous
+	FROM transactions t JOIN accounts a ON a.id = t.account_id
+	WHERE a.user_id = $1 AND (t.occurred BETWEEN $3::date AND $4::date OR t.occurred BETWEEN $5::date AND $6::date) AND %s
+)
+SELECT g.key, g.parent, tx.currency,
+	COALESCE(-SUM(tx.converted) FILTER (WHERE tx.in_current), 0),
+	COALESCE(-SUM(tx.converted) FILTER (WHERE tx.in_previous), 0),
+	COUNT(*) FILTER (WHERE tx.converted IS NULL)
+FROM tx CROSS JOIN LATERAL (%s) g
+GROUP BY 1, 2, 3`, filter.where("$7", "$8"), spendingGroups[constants.GroupByCategory])
+
+	args := append([]interface{}{userID, homeCurrency, current.Start, current.End, previous.Start, previous.End}, filter.args()...)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":    err,
+			"userId":   userID,
+			"current":  current,
+			"previous": previous,
+		}).Error("failed to query comparison")
+		return Comparison{}, err
+	}
+	defer rows.Close()
+
+	// each category comes back once per currency, so categories are merged as they are converted
+	byCategory := map[string]*CategoryComparison{}
+	for rows.Next() {
+		var category, currency string
+		var parent sql.NullString
+		var currentAmount, previousAmount float64
+		var missing int
+		if err := rows.Scan(&category, &parent, &currency, &currentAmount, &previousAmount, &missing); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"userId": userID,
+			}).Error("failed to scan into comparison")
+			return Comparison{}, err
+		}
+
+		if missing > 0 {
+			logrus.WithFields(logrus.Fields{
+				"currency": currency,
+				"home":     homeCurrency,
+			}).Error("no exchange rate to convert comparison")
+			return Comparison{}, constants.ErrMissingExchangeRate
+		}
+
+		if _, ok := byCategory[category]; !ok {
+			byCategory[category] = &CategoryComparison{Category: category, Parent: parent.String}
+		}
+		byCategory[category].Current += exchange.Rescale(currentAmount, currency, homeCurrency)
+		byCategory[category].Previous += exchange.Rescale(previousAmount, currency, homeCurrency)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to get comparison from rows")
+		return Comparison{}, err
+	}
+
+	categories := []CategoryComparison{}
+	for _, category := range byCategory {
+		categories = append(categories, *category)
+	}
+
+	comparison := compareCategories(categories)
+	comparison.Currency = homeCurrency
+	comparison.Current = current
+	comparison.Previous = previous
+	return comparison, nil
+}
+
+// compareCategories works out the changes in each category, the total of the top level categories and the biggest movers
+func compareCategories(categories []CategoryComparison) Comparison {
+	comparison := Comparison{
+		Total:         CategoryComparison{},
+		Categories:    []CategoryComparison{},
+		BiggestMovers: []CategoryComparison{},
+	}
+
+	parents := map[string]bool{}
+	for _, category := range categories {
+		if category.Parent != "" {
+			parents[category.Parent] = true
+		}
+	}
+
+	for _, category := range categories {
+		category.Change, category.PercentChange = change(category.Current, category.Previous)
+		comparison.Categories = append(comparison.Categories, category)
+
+		if category.Parent == "" {
+			comparison.Total.Current += category.Current
+			comparison.Total.Previous += category.Previous
+		}
+
+		if !parents[category.Category] && category.Change != 0 {
+			comparison.BiggestMovers = append(comparison.BiggestMovers, category)
+		}
+	}
+	comparison.Total.Change, comparison.Total.PercentChange = change(comparison.Total.Current, comparison.Total.Previous)
+
+	sort.Slice(comparison.Categories, func(i, j int) bool {
+		return comparison.Categories[i].Category < comparison.Categories[j].Category
+	})
+
+	sort.Slice(comparison.BiggestMovers, func(i, j int) bool {
+		a, b := comparison.BiggestMovers[i], comparison.BiggestMovers[j]
+		if abs(a.Change) != abs(b.Change) {
+			return abs(a.Change) > abs(b.Change)
+		}
+		return a.Category < b.Category
+	})
+	if len(comparison.BiggestMovers) > constants.ComparisonMovers {
+		comparison.BiggestMovers = comparison.BiggestMovers[:constants.ComparisonMovers]
+	}
+
+	return comparison
+}
+
+// change returns the change between two amounts, and the percentage change if there was a previous amount
+func change(current, previous int) (int, *float64) {
+	if previous == 0 {
+		return current - previous, nil
+	}
+
+	percent := math.Round(float64(current-previous)/math.Abs(float64(previous))*10000) / 100
+	return current - previous, &percent
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
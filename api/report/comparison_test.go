@@ -0,0 +1,36 @@
+// +build integration
+
+package report
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareCategories(t *testing.T) {
+	comparison := compareCategories([]CategoryComparison{
+		{Category: "Food", Current: 60000, Previous: 50000},
+		{Category: "Food/Groceries", Parent: "Food", Current: 40000, Previous: 45000},
+		{Category: "Food/Restaurants", Parent: "Food", Current: 20000, Previous: 5000},
+		{Category: "Travel", Current: 0, Previous: 80000},
+		{Category: "Gifts", Current: 10000},
+		{Category: "Rent", Current: 100000, Previous: 100000},
+	})
+
+	require.Equal(t, 170000, comparison.Total.Current, "Subcategories should not be counted twice in the total")
+	require.Equal(t, 230000, comparison.Total.Previous)
+	require.Equal(t, -60000, comparison.Total.Change)
+	require.InDelta(t, -26.09, *comparison.Total.PercentChange, 0.001)
+
+	require.Len(t, comparison.Categories, 6)
+	require.Equal(t, "Food", comparison.Categories[0].Category)
+	require.InDelta(t, 20, *comparison.Categories[0].PercentChange, 0.001)
+
+	movers := []string{}
+	for _, mover := range comparison.BiggestMovers {
+		movers = append(movers, mover.Category)
+	}
+	require.Equal(t, []string{"Travel", "Food/Restaurants", "Gifts", "Food/Groceries"}, movers, "Movers should be the categories without subcategories that changed the most")
+	require.Nil(t, comparison.BiggestMovers[2].PercentChange, "Categories with nothing spent before should have no percent change")
+}
@@ -0,0 +1,277 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+const (
+	// holding periods of gains
+	shortTerm = "short"
+	longTerm  = "long"
+)
+
+// CapitalGains is a user's realized gains from sales, and the unrealized gains on the lots they still hold.
+// Amounts are in minor units of the currency of the account, and are totalled per currency.
+type CapitalGains struct {
+	Year       int                    `json:"year,omitempty"`
+	AccountID  int                    `json:"accountId,omitempty"`
+	Realized   []RealizedGain         `json:"realized"`
+	Unrealized []UnrealizedGain       `json:"unrealized"`
+	Totals     map[string]*GainTotals `json:"totals"`
+}
+
+// RealizedGain is the gain on the part of a sale that sold a single lot
+type RealizedGain struct {
+	SaleID    int       `json:"saleId"`
+	LotID     int       `json:"lotId"`
+	AccountID int       `json:"accountId"`
+	Symbol    string    `json:"symbol"`
+	Name      string    `json:"name"`
+	Currency  string    `json:"currency"`
+	Quantity  float64   `json:"quantity"`
+	Acquired  time.Time `json:"acquired"`
+	Sold      time.Time `json:"sold"`
+	Proceeds  int       `json:"proceeds"`
+	Cost      int       `json:"cost"`
+	Gain      int       `json:"gain"`
+	Term      string    `json:"term"`
+}
+
+// UnrealizedGain is the gain on what is left of a lot, at the latest price of its security.
+// Lots of securities that have never been priced are not priced, and have no market value or gain.
+type UnrealizedGain struct {
+	LotID       int       `json:"lotId"`
+	AccountID   int       `json:"accountId"`
+	Symbol      string    `json:"symbol"`
+	Name        string    `json:"name"`
+	Currency    string    `json:"currency"`
+	Quantity    float64   `json:"quantity"`
+	Acquired    time.Time `json:"acquired"`
+	Cost        int       `json:"cost"`
+	Priced      bool      `json:"priced"`
+	Price       float64   `json:"price"`
+	MarketValue int       `json:"marketValue"`
+	Gain        int       `json:"gain"`
+	Term        string    `json:"term"`
+}
+
+// GainTotals sums the gains in a currency by holding period.
+// Unpriced counts the lots left out of the unrealized totals because their securities have no price.
+type GainTotals struct {
+	ShortTerm           int `json:"shortTerm"`
+	LongTerm            int `json:"longTerm"`
+	UnrealizedShortTerm int `json:"unrealizedShortTerm"`
+	UnrealizedLongTerm  int `json:"unrealizedLongTerm"`
+	Unpriced            int `json:"unpriced"`
+}
+
+// GetCapitalGains lists the realized gains of the sales in a tax year, or of every year if year is 0,
+// along with the current unrealized gains of every lot that is still held.
+// If accountID is not 0, only that account is included.
+func GetCapitalGains(c context.Context, year, accountID int) (CapitalGains, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return CapitalGains{}, err
+	}
+
+	if accountID != 0 {
+		valid, err := util.UserOwnsAccount(c, accountID)
+		if err != nil || !valid {
+			return CapitalGains{}, constants.ErrForbidden
+		}
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return CapitalGains{}, err
+	}
+
+	gains := CapitalGains{
+		Year:       year,
+		AccountID:  accountID,
+		Realized:   []RealizedGain{},
+		Unrealized: []UnrealizedGain{},
+		Totals:     map[string]*GainTotals{},
+	}
+
+	rows, err := db.Query(`SELECT d.sale_id, d.lot_id, sale.account_id, s.symbol, s.name, a.currency, d.quantity, l.acquired, sale.occurred, d.proceeds, d.cost
+FROM lot_disposals d
+JOIN lots l ON l.id = d.lot_id
+JOIN investment_transactions sale ON sale.id = d.sale_id
+JOIN accounts a ON a.id = sale.account_id
+JOIN securities s ON s.id = sale.security_id
+WHERE a.user_id = $1 AND ($2::integer = 0 OR a.id = $2::integer) AND ($3::integer = 0 OR EXTRACT(YEAR FROM sale.occurred) = $3::integer)
+ORDER BY sale.occurred, d.sale_id, l.acquired, d.lot_id`, userID, accountID, year)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"userId":    userID,
+			"accountId": accountID,
+			"year":      year,
+		}).Error("failed to fetch realized gains")
+		return CapitalGains{}, err
+	}
+
+	err = scanRows(rows, func(rows *sql.Rows) error {
+		var gain RealizedGain
+		if err := rows.Scan(&gain.SaleID, &gain.LotID, &gain.AccountID, &gain.Symbol, &gain.Name, &gain.Currency, &gain.Quantity, &gain.Acquired, &gain.Sold, &gain.Proceeds, &gain.Cost); err != nil {
+			return err
+		}
+
+		gain.Gain = gain.Proceeds - gain.Cost
+		gain.Term = holdingPeriod(gain.Acquired, gain.Sold)
+		totals := gains.totals(gain.Currency)
+		if gain.Term == longTerm {
+			totals.LongTerm += gain.Gain
+		} else {
+			totals.ShortTerm += gain.Gain
+		}
+
+		gains.Realized = append(gains.Realized, gain)
+		return nil
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to scan realized gains")
+		return CapitalGains{}, err
+	}
+
+	rows, err = db.Query(`SELECT l.id, l.account_id, s.symbol, s.name, a.currency, l.remaining, l.acquired, l.remaining_cost, security_price(s.id, CURRENT_DATE)
+FROM lots l
+JOIN accounts a ON a.id = l.account_id
+JOIN securities s ON s.id = l.security_id
+WHERE a.user_id = $1 AND ($2::integer = 0 OR a.id = $2::integer) AND l.remaining > 0
+ORDER BY l.acquired, l.id`, userID, accountID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"userId":    userID,
+			"accountId": accountID,
+		}).Error("failed to fetch unrealized gains")
+		return CapitalGains{}, err
+	}
+
+	now := time.Now()
+	err = scanRows(rows, func(rows *sql.Rows) error {
+		var gain UnrealizedGain
+		var price sql.NullFloat64
+		if err := rows.Scan(&gain.LotID, &gain.AccountID, &gain.Symbol, &gain.Name, &gain.Currency, &gain.Quantity, &gain.Acquired, &gain.Cost, &price); err != nil {
+			return err
+		}
+
+		gains.addUnrealized(gain, price, now)
+		return nil
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to scan unrealized gains")
+		return CapitalGains{}, err
+	}
+
+	return gains, nil
+}
+
+// CapitalGainsCSV writes realized gains in the layout of the capital gains schedules, e.g. IRS form 8949,
+// with the short-term sales first and then the long-term sales
+func CapitalGainsCSV(gains CapitalGains) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	w.Write([]string{"Term", "Description", "Date Acquired", "Date Sold", "Proceeds", "Cost Basis", "Adjustment Code", "Adjustment", "Gain or Loss", "Currency"})
+
+	for _, term := range []string{shortTerm, longTerm} {
+		for _, gain := range gains.Realized {
+			if gain.Term != term {
+				continue
+			}
+
+			w.Write([]string{
+				term,
+				fmt.Sprintf("%s sh. %s", strconv.FormatFloat(gain.Quantity, 'f', -1, 64), gain.Symbol),
+				gain.Acquired.Format("01/02/2006"),
+				gain.Sold.Format("01/02/2006"),
+				util.FormatAmount(gain.Proceeds, gain.Currency),
+				util.FormatAmount(gain.Cost, gain.Currency),
+				"",
+				"",
+				util.FormatAmount(gain.Gain, gain.Currency),
+				gain.Currency,
+			})
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		logrus.WithError(err).Error("failed to write capital gains csv")
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (g *CapitalGains) totals(currency string) *GainTotals {
+	if _, ok := g.Totals[currency]; !ok {
+		g.Totals[currency] = &GainTotals{}
+	}
+	return g.Totals[currency]
+}
+
+// addUnrealized values what is left of a lot at a price, and adds its gain to the totals.
+// A lot without a price is listed, but left out of the totals rather than counted as a total loss.
+func (g *CapitalGains) addUnrealized(gain UnrealizedGain, price sql.NullFloat64, now time.Time) {
+	gain.Term = holdingPeriod(gain.Acquired, now)
+	totals := g.totals(gain.Currency)
+	if !price.Valid {
+		totals.Unpriced++
+		g.Unrealized = append(g.Unrealized, gain)
+		return
+	}
+
+	gain.Priced = true
+	gain.Price = price.Float64
+	gain.MarketValue = int(math.Round(gain.Quantity * gain.Price))
+	gain.Gain = gain.MarketValue - gain.Cost
+	if gain.Term == longTerm {
+		totals.UnrealizedLongTerm += gain.Gain
+	} else {
+		totals.UnrealizedShortTerm += gain.Gain
+	}
+
+	g.Unrealized = append(g.Unrealized, gain)
+}
+
+// holdingPeriod is long-term if a lot was held for more than a year, i.e. sold after the anniversary of its acquisition
+func holdingPeriod(acquired, sold time.Time) string {
+	if sold.After(acquired.AddDate(1, 0, 0)) {
+		return longTerm
+	}
+	return shortTerm
+}
+
+// scanRows calls scan on each row, then closes the rows
+func scanRows(rows *sql.Rows, scan func(*sql.Rows) error) error {
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,47 @@
+// +build integration
+
+package report
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHoldingPeriod(t *testing.T) {
+	acquired := time.Date(2016, time.March, 15, 0, 0, 0, 0, time.UTC)
+	require.Equal(t, shortTerm, holdingPeriod(acquired, acquired.AddDate(1, 0, 0)), "Sale on the anniversary should be short-term")
+	require.Equal(t, longTerm, holdingPeriod(acquired, acquired.AddDate(1, 0, 1)), "Sale after the anniversary should be long-term")
+}
+
+func TestCapitalGainsCSV(t *testing.T) {
+	gains := CapitalGains{
+		Realized: []RealizedGain{
+			{Symbol: "VTI", Currency: "USD", Quantity: 2, Acquired: time.Date(2014, time.May, 1, 0, 0, 0, 0, time.UTC), Sold: time.Date(2016, time.June, 1, 0, 0, 0, 0, time.UTC), Proceeds: 25000, Cost: 20000, Gain: 5000, Term: longTerm},
+			{Symbol: "AAPL", Currency: "USD", Quantity: 1.5, Acquired: time.Date(2016, time.January, 4, 0, 0, 0, 0, time.UTC), Sold: time.Date(2016, time.July, 5, 0, 0, 0, 0, time.UTC), Proceeds: 15005, Cost: 16000, Gain: -995, Term: shortTerm},
+		},
+	}
+
+	encoded, err := CapitalGainsCSV(gains)
+	require.NoError(t, err)
+	require.Equal(t, `Term,Description,Date Acquired,Date Sold,Proceeds,Cost Basis,Adjustment Code,Adjustment,Gain or Loss,Currency
+short,1.5 sh. AAPL,01/04/2016,07/05/2016,150.05,160.00,,,-9.95,USD
+long,2 sh. VTI,05/01/2014,06/01/2016,250.00,200.00,,,50.00,USD
+`, string(encoded), "Short-term sales should come before long-term sales")
+}
+
+func TestAddUnrealized(t *testing.T) {
+	now := time.Date(2017, time.June, 1, 0, 0, 0, 0, time.UTC)
+	gains := CapitalGains{Totals: map[string]*GainTotals{}}
+
+	gains.addUnrealized(UnrealizedGain{LotID: 1, Currency: "USD", Quantity: 10, Acquired: now.AddDate(0, -1, 0), Cost: 1000}, sql.NullFloat64{Float64: 150, Valid: true}, now)
+	gains.addUnrealized(UnrealizedGain{LotID: 2, Currency: "USD", Quantity: 5, Acquired: now.AddDate(0, -1, 0), Cost: 2000}, sql.NullFloat64{}, now)
+
+	require.Len(t, gains.Unrealized, 2, "Unpriced lots should still be listed")
+	require.True(t, gains.Unrealized[0].Priced)
+	require.Equal(t, 1500, gains.Unrealized[0].MarketValue)
+	require.False(t, gains.Unrealized[1].Priced, "Lots without a price should be flagged")
+	require.Equal(t, GainTotals{UnrealizedShortTerm: 500, Unpriced: 1}, *gains.Totals["USD"], "Unpriced lots should be left out of the unrealized totals")
+}
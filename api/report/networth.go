@@ -0,0 +1,175 @@
+package report
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/api/account"
+	"github.com/jchorl/financejc/api/exchange"
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// NetWorth is a user's net worth over time, in their home currency
+type NetWorth struct {
+	Currency string          `json:"currency"`
+	Points   []NetWorthPoint `json:"points"`
+}
+
+// NetWorthPoint is the net worth at the end of a period. Liabilities are the amount owed on
+// liability accounts, so net worth is assets minus liabilities.
+type NetWorthPoint struct {
+	Date        time.Time        `json:"date"`
+	NetWorth    int              `json:"netWorth"`
+	Assets      int              `json:"assets"`
+	Liabilities int              `json:"liabilities"`
+	Types       map[string]int   `json:"types"`
+	Accounts    []AccountBalance `json:"accounts"`
+}
+
+// AccountBalance is the balance of an account at the end of a period,
+// in the account's currency and in the user's home currency
+type AccountBalance struct {
+	AccountID        int `json:"accountId"`
+	Balance          int `json:"balance"`
+	ConvertedBalance int `json:"convertedBalance"`
+}
+
+// GetNetWorth computes the balance of every account of the user, including closed accounts,
+// at the end of every period in a date range, and totals them by account type.
+// Balances are converted at the rate on the last day of each period, unless convert is a conversion mode.
+func GetNetWorth(c context.Context, start, end time.Time, granularity, convert string) (NetWorth, error) {
+	if !exchange.ValidMode(convert) {
+		return NetWorth{}, constants.ErrBadRequest
+	}
+
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return NetWorth{}, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return NetWorth{}, err
+	}
+
+	homeCurrency, err := exchange.HomeCurrency(c)
+	if err != nil {
+		return NetWorth{}, err
+	}
+
+	periods, err := util.PeriodSeries(granularity, start, end, "$2", "$3")
+	if err != nil {
+		return NetWorth{}, err
+	}
+
+	// daily holds the total movement of each account on each day, counting opening balances as a movement.
+	// running holds one row per account per day with movements, along with the next such day,
+	// so the balance at the end of a period is the row whose range covers the period end.
+	query := fmt.Sprintf(`WITH periods AS (%[1]s),
+daily AS (
+	SELECT account_id, occurred, SUM(amount) AS amount, SUM(converted) AS converted FROM (
+		SELECT t.account_id, t.occurred, t.amount, t.amount * fx_rate(a.currency, $4, t.occurred, a.user_id) AS converted
+		FROM transactions t JOIN accounts a ON a.id = t.account_id
+		WHERE a.user_id = $1 AND t.occurred <= $3::date
+		UNION ALL
+		SELECT a.id, %[3]s, a.opening_balance, a.opening_balance * fx_rate(a.currency, $4, %[3]s, a.user_id)
+		FROM accounts a
+		WHERE a.user_id = $1 AND a.opening_balance != 0 AND %[3]s <= $3::date
+	) movements
+	GROUP BY account_id, occurred
+),
+running AS (
+	SELECT account_id, occurred, SUM(amount) OVER w AS balance, SUM(converted) OVER w AS converted_balance, LEAD(occurred) OVER w AS next_occurred
+	FROM daily
+	WINDOW w AS (PARTITION BY account_id ORDER BY occurred)
+)
+SELECT p.period_end, a.id, a.currency, a.type, COALESCE(r.balance, 0), COALESCE(r.converted_balance, 0), holdings_value(a.id, p.period_end), fx_rate(a.currency, $4, %[2]s, a.user_id)
+FROM periods p CROSS JOIN accounts a
+LEFT JOIN running r ON r.account_id = a.id AND r.occurred <= p.period_end AND (r.next_occurred IS NULL OR r.next_occurred > p.period_end)
+WHERE a.user_id = $1
+ORDER BY p.period_end, a.id`, periods, exchange.RateDate(convert, "p.period_end"), account.OpeningDate)
+
+	rows, err := db.Query(query, userID, start, end, homeCurrency)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":       err,
+			"userId":      userID,
+			"start":       start,
+			"end":         end,
+			"granularity": granularity,
+		}).Error("failed to query net worth")
+		return NetWorth{}, err
+	}
+	defer rows.Close()
+
+	netWorth := NetWorth{
+		Currency: homeCurrency,
+		Points:   []NetWorthPoint{},
+	}
+	for rows.Next() {
+		var date time.Time
+		var currency, accountType string
+		var balance AccountBalance
+		var converted, holdings float64
+		var rate sql.NullFloat64
+		if err := rows.Scan(&date, &balance.AccountID, &currency, &accountType, &balance.Balance, &converted, &holdings, &rate); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"userId": userID,
+			}).Error("failed to scan into net worth")
+			return NetWorth{}, err
+		}
+
+		// securities are valued at their prices at the end of the period, and converted at the rate the balance uses
+		holdingsValue := int(math.Round(holdings))
+		balance.Balance += holdingsValue
+
+		if !rate.Valid && balance.Balance != 0 {
+			logrus.WithFields(logrus.Fields{
+				"accountId": balance.AccountID,
+				"currency":  currency,
+				"home":      homeCurrency,
+			}).Error("no exchange rate to convert account balance for net worth")
+			return NetWorth{}, constants.ErrMissingExchangeRate
+		}
+
+		if convert == constants.ConvertTransactionDate {
+			balance.ConvertedBalance = exchange.Rescale(converted+holdings*rate.Float64, currency, homeCurrency)
+		} else {
+			balance.ConvertedBalance = exchange.Rescale(float64(balance.Balance)*rate.Float64, currency, homeCurrency)
+		}
+
+		if len(netWorth.Points) == 0 || !netWorth.Points[len(netWorth.Points)-1].Date.Equal(date) {
+			netWorth.Points = append(netWorth.Points, NetWorthPoint{
+				Date:     date,
+				Types:    map[string]int{},
+				Accounts: []AccountBalance{},
+			})
+		}
+
+		point := &netWorth.Points[len(netWorth.Points)-1]
+		point.NetWorth += balance.ConvertedBalance
+		point.Types[accountType] += balance.ConvertedBalance
+		if constants.AccountTypes[accountType] {
+			point.Liabilities -= balance.ConvertedBalance
+		} else {
+			point.Assets += balance.ConvertedBalance
+		}
+		point.Accounts = append(point.Accounts, balance)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to get net worth from rows")
+		return NetWorth{}, err
+	}
+
+	return netWorth, nil
+}
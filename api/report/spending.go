@@ -0,0 +1,232 @@
+package report
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+
+	"github.com/jchorl/financejc/api/exchange"
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// spendingGroups are the sql for the groups each transaction is counted in, keyed by the way of grouping.
+// Categories are counted in the category and every category above it, so "Food/Groceries" also counts towards "Food".
+var spendingGroups = map[string]string{
+	constants.GroupByCategory: `SELECT array_to_string(c.parts[1:n], '/') AS key, CASE WHEN n > 1 THEN array_to_string(c.parts[1:n-1], '/') END AS parent, 0 AS account_id
+		FROM (SELECT CASE WHEN COALESCE(tx.category, '') = '' THEN ARRAY['']::text[] ELSE string_to_array(tx.category, '/') END AS parts) c,
+		generate_series(1, array_length(c.parts, 1)) n`,
+	constants.GroupByPayee:   "SELECT tx.name AS key, NULL::text AS parent, 0 AS account_id",
+	constants.GroupByAccount: "SELECT tx.account_name AS key, NULL::text AS parent, tx.account_id",
+}
+
+// Filter narrows down the transactions that a report counts. Only transactions in AccountIDs are counted,
+// or in every account if it is empty. Transfers between accounts are left out unless IncludeTransfers is set.
+type Filter struct {
+	AccountIDs       []int
+	IncludeTransfers bool
+}
+
+// where returns the sql condition on transactions t in accounts a for a filter, given the placeholders of its args
+func (f Filter) where(accountsParam, transfersParam string) string {
+	// either side of a transfer can point at the other
+	return fmt.Sprintf(`(cardinality(%[1]s::integer[]) = 0 OR a.id = ANY(%[1]s::integer[]))
+		AND (%[2]s OR (t.related_transaction_id IS NULL AND NOT EXISTS (SELECT 1 FROM transactions r WHERE r.related_transaction_id = t.id)))`, accountsParam, transfersParam)
+}
+
+// args returns the args of a filter, in the order of the placeholders passed to where
+func (f Filter) args() []interface{} {
+	accountIDs := f.AccountIDs
+	if accountIDs == nil {
+		accountIDs = []int{}
+	}
+
+	return []interface{}{pq.Array(accountIDs), f.IncludeTransfers}
+}
+
+// Spending is the money that came in and went out in each period of a date range, grouped by category, payee or account,
+// in the user's home currency
+type Spending struct {
+	Currency string           `json:"currency"`
+	GroupBy  string           `json:"groupBy"`
+	Periods  []SpendingPeriod `json:"periods"`
+}
+
+// SpendingPeriod is the money that came in and went out in a period, in total and by group
+type SpendingPeriod struct {
+	Start   time.Time       `json:"start"`
+	End     time.Time       `json:"end"`
+	Income  int             `json:"income"`
+	Expense int             `json:"expense"`
+	Net     int             `json:"net"`
+	Groups  []SpendingGroup `json:"groups"`
+}
+
+// SpendingGroup is the money that came in and went out in a group in a period. Income and expense are totalled per
+// transaction, so a refund is income even in a category that is mostly spent in. Categories have the category above
+// them as their parent, and transactions without a category are grouped under the empty key.
+type SpendingGroup struct {
+	Key       string `json:"key"`
+	Parent    string `json:"parent,omitempty"`
+	AccountID int    `json:"accountId,omitempty"`
+	Income    int    `json:"income"`
+	Expense   int    `json:"expense"`
+	Net       int    `json:"net"`
+}
+
+// GetSpending totals the transactions of the user in the context in every period of a date range, grouped by groupBy.
+// Amounts are converted to the user's home currency at the rate on the date of each transaction.
+func GetSpending(c context.Context, start, end time.Time, granularity, groupBy string, filter Filter) (Spending, error) {
+	groups, ok := spendingGroups[groupBy]
+	if !ok {
+		return Spending{}, constants.ErrBadRequest
+	}
+
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return Spending{}, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return Spending{}, err
+	}
+
+	homeCurrency, err := exchange.HomeCurrency(c)
+	if err != nil {
+		return Spending{}, err
+	}
+
+	periods, err := util.PeriodSeries(granularity, start, end, "$3", "$4")
+	if err != nil {
+		return Spending{}, err
+	}
+
+	query := fmt.Sprintf(`WITH periods AS (%s),
+tx AS (
+	SELECT t.occurred, t.amount, t.amount * fx_rate(a.currency, $2, t.occurred, a.user_id) AS converted, a.currency, t.category, t.name, a.id AS account_id, a.name AS account_name
+	FROM transactions t JOIN accounts a ON a.id = t.account_id
+	WHERE a.user_id = $1 AND t.occurred BETWEEN $3::date AND $4::date AND %s
+)
+SELECT p.period_start, p.period_end, g.key, g.parent, g.account_id, tx.currency,
+	COALESCE(SUM(tx.converted) FILTER (WHERE tx.amount > 0), 0),
+	COALESCE(-SUM(tx.converted) FILTER (WHERE tx.amount < 0), 0),
+	COUNT(tx.amount) FILTER (WHERE tx.converted IS NULL)
+FROM periods p
+LEFT JOIN tx ON tx.occurred BETWEEN p.period_start AND p.period_end
+LEFT JOIN LATERAL (%s) g ON true
+GROUP BY 1, 2, 3, 4, 5, 6
+ORDER BY 1, 3`, periods, filter.where("$5", "$6"), groups)
+
+	args := append([]interface{}{userID, homeCurrency, start, end}, filter.args()...)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":       err,
+			"userId":      userID,
+			"start":       start,
+			"end":         end,
+			"granularity": granularity,
+			"groupBy":     groupBy,
+		}).Error("failed to query spending")
+		return Spending{}, err
+	}
+	defer rows.Close()
+
+	spending := Spending{
+		Currency: homeCurrency,
+		GroupBy:  groupBy,
+		Periods:  []SpendingPeriod{},
+	}
+	// each group comes back once per currency, so groups are merged as they are converted
+	var period *SpendingPeriod
+	groupIndexes := map[string]int{}
+	for rows.Next() {
+		var periodStart, periodEnd time.Time
+		var key, parent, currency sql.NullString
+		var accountID sql.NullInt64
+		var income, expense float64
+		var missing int
+		if err := rows.Scan(&periodStart, &periodEnd, &key, &parent, &accountID, &currency, &income, &expense, &missing); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"userId": userID,
+			}).Error("failed to scan into spending")
+			return Spending{}, err
+		}
+
+		if missing > 0 {
+			logrus.WithFields(logrus.Fields{
+				"currency": currency.String,
+				"home":     homeCurrency,
+				"period":   periodStart,
+			}).Error("no exchange rate to convert spending")
+			return Spending{}, constants.ErrMissingExchangeRate
+		}
+
+		if period == nil || !period.Start.Equal(periodStart) {
+			spending.Periods = append(spending.Periods, SpendingPeriod{
+				Start:  periodStart,
+				End:    periodEnd,
+				Groups: []SpendingGroup{},
+			})
+			period = &spending.Periods[len(spending.Periods)-1]
+			groupIndexes = map[string]int{}
+		}
+
+		// periods without any transactions have a single row without a group
+		if !currency.Valid {
+			continue
+		}
+
+		addSpending(period, groupIndexes, SpendingGroup{
+			Key:       key.String,
+			Parent:    parent.String,
+			AccountID: int(accountID.Int64),
+			Income:    exchange.Rescale(income, currency.String, homeCurrency),
+			Expense:   exchange.Rescale(expense, currency.String, homeCurrency),
+		}, !parent.Valid)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to get spending from rows")
+		return Spending{}, err
+	}
+
+	return spending, nil
+}
+
+// addSpending adds the converted amounts of a group in one currency to a period, merging them into the group if the
+// period already has it from another currency. groupIndexes tracks where each group is in the period. Only top level
+// groups count towards the period totals.
+func addSpending(period *SpendingPeriod, groupIndexes map[string]int, amounts SpendingGroup, topLevel bool) {
+	groupKey := fmt.Sprintf("%s\x00%d", amounts.Key, amounts.AccountID)
+	index, ok := groupIndexes[groupKey]
+	if !ok {
+		period.Groups = append(period.Groups, SpendingGroup{
+			Key:       amounts.Key,
+			Parent:    amounts.Parent,
+			AccountID: amounts.AccountID,
+		})
+		index = len(period.Groups) - 1
+		groupIndexes[groupKey] = index
+	}
+
+	group := &period.Groups[index]
+	group.Income += amounts.Income
+	group.Expense += amounts.Expense
+	group.Net = group.Income - group.Expense
+
+	// subcategories are already counted in their top level category
+	if topLevel {
+		period.Income += amounts.Income
+		period.Expense += amounts.Expense
+		period.Net = period.Income - period.Expense
+	}
+}
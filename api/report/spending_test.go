@@ -0,0 +1,70 @@
+// +build integration
+
+package report
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/financejc/api/transaction"
+	"github.com/jchorl/financejc/constants"
+	"github.com/jchorl/financejc/integration"
+)
+
+func TestAddSpending(t *testing.T) {
+	period := &SpendingPeriod{Groups: []SpendingGroup{}}
+	groupIndexes := map[string]int{}
+
+	addSpending(period, groupIndexes, SpendingGroup{Key: "Food", Income: 1000, Expense: 30000}, true)
+	addSpending(period, groupIndexes, SpendingGroup{Key: "Food/Groceries", Parent: "Food", Expense: 20000}, false)
+	addSpending(period, groupIndexes, SpendingGroup{Key: "Food", Expense: 5000}, true)
+	addSpending(period, groupIndexes, SpendingGroup{Key: "Salary", Income: 100000}, true)
+
+	require.Len(t, period.Groups, 3, "Groups in different currencies should be merged")
+	require.Equal(t, SpendingGroup{Key: "Food", Income: 1000, Expense: 35000, Net: -34000}, period.Groups[0])
+	require.Equal(t, 101000, period.Income)
+	require.Equal(t, 35000, period.Expense, "Subcategories should not be counted twice in the period totals")
+	require.Equal(t, 66000, period.Net)
+}
+
+func TestGetSpending(t *testing.T) {
+	db := integration.FreshDB(t)
+	es := integration.ESConn(t)
+	uid := integration.NewUser(t, integration.ContextWithUserDBES(0, db, es))
+	ctx := integration.ContextWithUserDBES(uid, db, es)
+	acc := integration.NewAccount(t, ctx)
+
+	january := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	transactions := []transaction.Transaction{
+		{Name: "Grocer", Date: january.AddDate(0, 0, 4), Category: "Food/Groceries", Amount: -4000},
+		{Name: "Cafe", Date: january.AddDate(0, 0, 9), Category: "Food/Restaurants/Coffee", Amount: -500},
+		{Name: "Grocer", Date: january.AddDate(0, 0, 19), Category: "Food/Groceries", Amount: 1000},
+		{Name: "Employer", Date: january.AddDate(0, 1, 0), Category: "Salary", Amount: 300000},
+	}
+	for _, tr := range transactions {
+		tr.AccountID = acc.ID
+		_, err := transaction.New(ctx, &tr)
+		require.NoError(t, err, "unable to create transaction")
+	}
+
+	spending, err := GetSpending(ctx, january, january.AddDate(0, 2, -1), constants.GranularityMonthly, constants.GroupByCategory, Filter{})
+	require.NoError(t, err)
+	require.Len(t, spending.Periods, 2)
+
+	groups := map[string]SpendingGroup{}
+	for _, group := range spending.Periods[0].Groups {
+		groups[group.Key] = group
+	}
+	require.Len(t, groups, 4, "Categories should count towards every category above them")
+	require.Equal(t, SpendingGroup{Key: "Food", Income: 1000, Expense: 4500, Net: -3500}, groups["Food"])
+	require.Equal(t, SpendingGroup{Key: "Food/Groceries", Parent: "Food", Income: 1000, Expense: 4000, Net: -3000}, groups["Food/Groceries"])
+	require.Equal(t, 500, groups["Food/Restaurants"].Expense)
+	require.Equal(t, "Food/Restaurants", groups["Food/Restaurants/Coffee"].Parent)
+
+	require.Equal(t, 1000, spending.Periods[0].Income, "Refunds should count as income")
+	require.Equal(t, 4500, spending.Periods[0].Expense, "Subcategories should not be counted twice in the period totals")
+	require.Equal(t, 300000, spending.Periods[1].Income)
+	require.Equal(t, 0, spending.Periods[1].Expense)
+}
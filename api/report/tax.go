@@ -0,0 +1,225 @@
+package report
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/api/exchange"
+	"github.com/jchorl/financejc/api/tax"
+	"github.com/jchorl/financejc/api/user"
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// TaxSummary totals what a user spent in the categories of each of their tax lines in a tax year, in their home currency.
+// A tax year is named after the calendar year it starts in, so with a fiscal year starting in April, 2017 runs from
+// April 1st 2017 to March 31st 2018.
+type TaxSummary struct {
+	Year     int              `json:"year"`
+	Start    time.Time        `json:"start"`
+	End      time.Time        `json:"end"`
+	Currency string           `json:"currency"`
+	Lines    []TaxLineSummary `json:"lines"`
+}
+
+// TaxLineSummary is the total of a tax line, along with the transactions that make it up
+type TaxLineSummary struct {
+	TaxLineID    int              `json:"taxLineId"`
+	Name         string           `json:"name"`
+	Categories   []string         `json:"categories"`
+	Total        int              `json:"total"`
+	Transactions []TaxTransaction `json:"transactions"`
+}
+
+// TaxTransaction is a transaction that counts towards a tax line. Amount is what was spent, in the account's currency,
+// and Converted is that in the user's home currency.
+type TaxTransaction struct {
+	ID        int       `json:"id"`
+	Date      time.Time `json:"date"`
+	Name      string    `json:"name"`
+	Category  string    `json:"category"`
+	AccountID int       `json:"accountId"`
+	Account   string    `json:"account"`
+	Currency  string    `json:"currency"`
+	Amount    int       `json:"amount"`
+	Converted int       `json:"converted"`
+}
+
+// GetTaxSummary totals the transactions in the categories of each tax line of the user in the context in a tax year.
+// A year of 0 is the tax year that today falls in. Transfers between accounts are left out.
+func GetTaxSummary(c context.Context, year int) (TaxSummary, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return TaxSummary{}, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return TaxSummary{}, err
+	}
+
+	u, err := user.Get(c)
+	if err != nil {
+		return TaxSummary{}, err
+	}
+
+	lines, err := tax.Get(c)
+	if err != nil {
+		return TaxSummary{}, err
+	}
+
+	if year == 0 {
+		now := time.Now()
+		year = now.Year()
+		if now.Month() < time.Month(u.FiscalYearStart) {
+			year--
+		}
+	}
+
+	start, end := fiscalYear(year, time.Month(u.FiscalYearStart))
+	summary := TaxSummary{
+		Year:     year,
+		Start:    start,
+		End:      end,
+		Currency: u.HomeCurrency,
+		Lines:    []TaxLineSummary{},
+	}
+	indexes := map[int]int{}
+	for _, line := range lines {
+		indexes[line.ID] = len(summary.Lines)
+		summary.Lines = append(summary.Lines, TaxLineSummary{
+			TaxLineID:    line.ID,
+			Name:         line.Name,
+			Categories:   line.Categories,
+			Transactions: []TaxTransaction{},
+		})
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT l.id, t.id, t.occurred, t.name, t.category, a.id, a.name, a.currency, -t.amount, -t.amount * fx_rate(a.currency, $2, t.occurred, a.user_id)
+FROM tax_lines l
+JOIN transactions t ON EXISTS (SELECT 1 FROM tax_line_categories lc WHERE lc.tax_line_id = l.id AND (t.category = lc.category OR left(t.category, length(lc.category) + 1) = lc.category || '/'))
+JOIN accounts a ON a.id = t.account_id AND a.user_id = l.user_id
+WHERE l.user_id = $1 AND t.occurred BETWEEN $3::date AND $4::date AND %s
+ORDER BY t.occurred, t.id`, Filter{}.where("$5", "$6")), append([]interface{}{userID, u.HomeCurrency, start, end}, Filter{}.args()...)...)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+			"year":   year,
+		}).Error("failed to query tax summary")
+		return TaxSummary{}, err
+	}
+
+	err = scanRows(rows, func(rows *sql.Rows) error {
+		var lineID int
+		var t TaxTransaction
+		var converted sql.NullFloat64
+		if err := rows.Scan(&lineID, &t.ID, &t.Date, &t.Name, &t.Category, &t.AccountID, &t.Account, &t.Currency, &t.Amount, &converted); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"userId": userID,
+			}).Error("failed to scan into tax summary")
+			return err
+		}
+
+		if !converted.Valid {
+			logrus.WithFields(logrus.Fields{
+				"currency": t.Currency,
+				"home":     u.HomeCurrency,
+				"date":     t.Date,
+			}).Error("no exchange rate to convert tax summary")
+			return constants.ErrMissingExchangeRate
+		}
+
+		t.Converted = exchange.Rescale(converted.Float64, t.Currency, u.HomeCurrency)
+		line := &summary.Lines[indexes[lineID]]
+		line.Transactions = append(line.Transactions, t)
+		line.Total += t.Converted
+		return nil
+	})
+	if err != nil {
+		return TaxSummary{}, err
+	}
+
+	return summary, nil
+}
+
+// TaxSummaryCSV encodes a tax summary as a csv of every transaction, with a total row after each tax line
+func TaxSummaryCSV(summary TaxSummary) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	w.Write([]string{"Tax Line", "Date", "Description", "Category", "Account", "Amount", "Currency", "Amount (" + summary.Currency + ")"})
+
+	for _, line := range summary.Lines {
+		for _, t := range line.Transactions {
+			w.Write([]string{
+				line.Name,
+				t.Date.Format("2006-01-02"),
+				t.Name,
+				t.Category,
+				t.Account,
+				util.FormatAmount(t.Amount, t.Currency),
+				t.Currency,
+				util.FormatAmount(t.Converted, summary.Currency),
+			})
+		}
+		w.Write([]string{line.Name, "", "Total", "", "", "", "", util.FormatAmount(line.Total, summary.Currency)})
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		logrus.WithError(err).Error("failed to write tax summary csv")
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// TaxSummaryPDF renders a tax summary as a pdf listing the total of each tax line followed by its transactions
+func TaxSummaryPDF(summary TaxSummary) []byte {
+	lines := []string{
+		fmt.Sprintf("Tax summary for %d", summary.Year),
+		fmt.Sprintf("%s to %s, in %s", summary.Start.Format("2006-01-02"), summary.End.Format("2006-01-02"), summary.Currency),
+		"",
+	}
+
+	for _, line := range summary.Lines {
+		lines = append(lines, fmt.Sprintf("%-60s %14s", truncate(line.Name, 60), util.FormatAmount(line.Total, summary.Currency)))
+	}
+
+	for _, line := range summary.Lines {
+		lines = append(lines, "", line.Name)
+		for _, t := range line.Transactions {
+			lines = append(lines, fmt.Sprintf("  %s  %-30s %-20s %14s", t.Date.Format("2006-01-02"), truncate(t.Name, 30), truncate(t.Account, 20), util.FormatAmount(t.Converted, summary.Currency)))
+		}
+		lines = append(lines, fmt.Sprintf("  %-64s %14s", "Total", util.FormatAmount(line.Total, summary.Currency)))
+	}
+
+	return util.TextPDF(lines)
+}
+
+// fiscalYear returns the first and last days of the tax year named after the calendar year it starts in
+func fiscalYear(year int, startMonth time.Month) (time.Time, time.Time) {
+	if startMonth < time.January || startMonth > time.December {
+		startMonth = time.January
+	}
+
+	start := time.Date(year, startMonth, 1, 0, 0, 0, 0, time.UTC)
+	return start, start.AddDate(1, 0, -1)
+}
+
+// truncate shortens a string to at most n characters
+func truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+
+	return string(runes[:n])
+}
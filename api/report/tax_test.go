@@ -0,0 +1,56 @@
+// +build integration
+
+package report
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFiscalYear(t *testing.T) {
+	start, end := fiscalYear(2017, time.January)
+	require.Equal(t, time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC), start)
+	require.Equal(t, time.Date(2017, time.December, 31, 0, 0, 0, 0, time.UTC), end)
+
+	start, end = fiscalYear(2017, time.April)
+	require.Equal(t, time.Date(2017, time.April, 1, 0, 0, 0, 0, time.UTC), start)
+	require.Equal(t, time.Date(2018, time.March, 31, 0, 0, 0, 0, time.UTC), end, "Tax years should be named after the year they start in")
+
+	start, _ = fiscalYear(2017, 0)
+	require.Equal(t, time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC), start, "Tax years should start in January if no month is set")
+}
+
+func TestTaxSummaryExports(t *testing.T) {
+	date := time.Date(2017, time.March, 4, 0, 0, 0, 0, time.UTC)
+	summary := TaxSummary{
+		Year:     2017,
+		Currency: "USD",
+		Lines: []TaxLineSummary{
+			{
+				Name:  "Charitable donations",
+				Total: 15000,
+				Transactions: []TaxTransaction{
+					{Date: date, Name: "Red Cross", Category: "Giving/Charity", Account: "Chequing", Currency: "USD", Amount: 5000, Converted: 5000},
+					{Date: date, Name: "UNICEF", Category: "Giving", Account: "Savings", Currency: "EUR", Amount: 9000, Converted: 10000},
+				},
+			},
+			{Name: "Medical", Transactions: []TaxTransaction{}},
+		},
+	}
+
+	encoded, err := TaxSummaryCSV(summary)
+	require.NoError(t, err)
+	require.Equal(t, `Tax Line,Date,Description,Category,Account,Amount,Currency,Amount (USD)
+Charitable donations,2017-03-04,Red Cross,Giving/Charity,Chequing,50.00,USD,50.00
+Charitable donations,2017-03-04,UNICEF,Giving,Savings,90.00,EUR,100.00
+Charitable donations,,Total,,,,,150.00
+Medical,,Total,,,,,0.00
+`, string(encoded))
+
+	pdf := TaxSummaryPDF(summary)
+	require.True(t, bytes.HasPrefix(pdf, []byte("%PDF-")))
+	require.Contains(t, string(pdf), "UNICEF")
+}
@@ -0,0 +1,548 @@
+// Package rrule evaluates recurrence rules in the RRULE format of RFC 5545, such as "FREQ=MONTHLY;BYDAY=2TU"
+// for the second Tuesday of every month. Rules recur on dates rather than times, so parts below a day
+// (BYHOUR, BYMINUTE and BYSECOND) and BYWEEKNO are not supported.
+package rrule
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Frequencies of rules
+const (
+	Daily   = "DAILY"
+	Weekly  = "WEEKLY"
+	Monthly = "MONTHLY"
+	Yearly  = "YEARLY"
+)
+
+// maxPeriods is how many periods are searched for an occurrence before a rule is deemed to never occur again,
+// e.g. "FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=30"
+const maxPeriods = 5000
+
+// ErrNoOccurrence is returned when a rule has no occurrence after a date
+var ErrNoOccurrence = errors.New("rule does not occur again")
+
+var weekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// Weekday is a day of the week in BYDAY. N is its ordinal within the month or year, e.g. 2 for the second or
+// -1 for the last, and is 0 for every one of those days.
+type Weekday struct {
+	N   int
+	Day time.Weekday
+}
+
+// Rule is a parsed recurrence rule. Count and Until are 0 and the zero time if the rule recurs forever.
+type Rule struct {
+	Freq       string
+	Interval   int
+	ByDay      []Weekday
+	ByMonthDay []int
+	ByYearDay  []int
+	ByMonth    []time.Month
+	BySetPos   []int
+	Count      int
+	Until      time.Time
+	WeekStart  time.Weekday
+}
+
+// Parse parses an RRULE, with or without the "RRULE:" prefix
+func Parse(s string) (Rule, error) {
+	rule := Rule{Interval: 1, WeekStart: time.Monday}
+	s = strings.TrimPrefix(strings.TrimSpace(s), "RRULE:")
+	if s == "" {
+		return Rule{}, errors.New("empty rule")
+	}
+
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return Rule{}, fmt.Errorf("malformed rule part %q", part)
+		}
+
+		name, value := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+		var err error
+		switch name {
+		case "FREQ":
+			switch value {
+			case Daily, Weekly, Monthly, Yearly:
+				rule.Freq = value
+			default:
+				return Rule{}, fmt.Errorf("unsupported frequency %q", value)
+			}
+		case "INTERVAL":
+			rule.Interval, err = strconv.Atoi(value)
+			if err == nil && rule.Interval < 1 {
+				err = errors.New("interval must be positive")
+			}
+		case "COUNT":
+			rule.Count, err = strconv.Atoi(value)
+			if err == nil && rule.Count < 1 {
+				err = errors.New("count must be positive")
+			}
+		case "UNTIL":
+			rule.Until, err = parseDate(value)
+		case "WKST":
+			day, ok := weekdays[value]
+			if !ok {
+				err = fmt.Errorf("unknown weekday %q", value)
+			}
+			rule.WeekStart = day
+		case "BYDAY":
+			rule.ByDay, err = parseWeekdays(value)
+		case "BYMONTHDAY":
+			rule.ByMonthDay, err = parseInts(value, 1, 31)
+		case "BYYEARDAY":
+			rule.ByYearDay, err = parseInts(value, 1, 366)
+		case "BYMONTH":
+			var months []int
+			months, err = parseInts(value, 1, 12)
+			for _, month := range months {
+				if month < 0 {
+					err = errors.New("months must be positive")
+				}
+				rule.ByMonth = append(rule.ByMonth, time.Month(month))
+			}
+		case "BYSETPOS":
+			rule.BySetPos, err = parseInts(value, 1, 366)
+		default:
+			return Rule{}, fmt.Errorf("unsupported rule part %q", name)
+		}
+		if err != nil {
+			return Rule{}, fmt.Errorf("invalid %s: %s", name, err)
+		}
+	}
+
+	if rule.Freq == "" {
+		return Rule{}, errors.New("rule has no frequency")
+	}
+	if rule.Count != 0 && !rule.Until.IsZero() {
+		return Rule{}, errors.New("rule cannot have both a count and an until date")
+	}
+	for _, day := range rule.ByDay {
+		if day.N != 0 && rule.Freq != Monthly && rule.Freq != Yearly {
+			return Rule{}, errors.New("ordinal weekdays need a monthly or yearly frequency")
+		}
+	}
+	if len(rule.ByYearDay) > 0 && rule.Freq != Yearly {
+		return Rule{}, errors.New("BYYEARDAY needs a yearly frequency")
+	}
+	if len(rule.ByMonthDay) > 0 && rule.Freq == Weekly {
+		return Rule{}, errors.New("BYMONTHDAY cannot be used with a weekly frequency")
+	}
+
+	return rule, nil
+}
+
+// String formats a rule as an RRULE, without the "RRULE:" prefix
+func (r Rule) String() string {
+	parts := []string{"FREQ=" + r.Freq}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.Format("20060102"))
+	}
+	if len(r.ByMonth) > 0 {
+		months := []int{}
+		for _, month := range r.ByMonth {
+			months = append(months, int(month))
+		}
+		parts = append(parts, "BYMONTH="+joinInts(months))
+	}
+	if len(r.ByYearDay) > 0 {
+		parts = append(parts, "BYYEARDAY="+joinInts(r.ByYearDay))
+	}
+	if len(r.ByMonthDay) > 0 {
+		parts = append(parts, "BYMONTHDAY="+joinInts(r.ByMonthDay))
+	}
+	if len(r.ByDay) > 0 {
+		days := []string{}
+		for _, day := range r.ByDay {
+			name := weekdayName(day.Day)
+			if day.N != 0 {
+				name = strconv.Itoa(day.N) + name
+			}
+			days = append(days, name)
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.BySetPos) > 0 {
+		parts = append(parts, "BYSETPOS="+joinInts(r.BySetPos))
+	}
+	if r.WeekStart != time.Monday {
+		parts = append(parts, "WKST="+weekdayName(r.WeekStart))
+	}
+
+	return strings.Join(parts, ";")
+}
+
+// Next returns the first occurrence of a rule starting on dtstart that is after a date, or on it if inclusive is set.
+// Periods of the rule are counted from the one dtstart falls in, and occurrences before dtstart are skipped.
+func (r Rule) Next(dtstart, after time.Time, inclusive bool) (time.Time, error) {
+	dtstart = toDate(dtstart)
+	after = toDate(after)
+
+	count := 0
+	period := periodStart(r, dtstart)
+	for i := 0; i < maxPeriods; i++ {
+		for _, date := range r.occurrencesIn(period, dtstart) {
+			if date.Before(dtstart) {
+				continue
+			}
+			if !r.Until.IsZero() && date.After(r.Until) {
+				return time.Time{}, ErrNoOccurrence
+			}
+
+			count++
+			if r.Count > 0 && count > r.Count {
+				return time.Time{}, ErrNoOccurrence
+			}
+
+			if date.After(after) || inclusive && date.Equal(after) {
+				return date, nil
+			}
+		}
+
+		period = nextPeriod(r, period)
+	}
+
+	return time.Time{}, ErrNoOccurrence
+}
+
+// Between returns every occurrence of a rule starting on dtstart from one date to another, inclusive
+func (r Rule) Between(dtstart, from, to time.Time) []time.Time {
+	occurrences := []time.Time{}
+	next, err := r.Next(dtstart, from, true)
+	for err == nil && !next.After(toDate(to)) {
+		occurrences = append(occurrences, next)
+		next, err = r.Next(dtstart, next, false)
+	}
+
+	return occurrences
+}
+
+// occurrencesIn returns the sorted occurrences of a rule in the period starting on a date
+func (r Rule) occurrencesIn(period, dtstart time.Time) []time.Time {
+	candidates := []time.Time{}
+	switch r.Freq {
+	case Daily:
+		candidates = append(candidates, period)
+	case Weekly:
+		for i := 0; i < 7; i++ {
+			date := period.AddDate(0, 0, i)
+			if len(r.ByDay) > 0 && r.matchesWeekday(date) || len(r.ByDay) == 0 && date.Weekday() == dtstart.Weekday() {
+				candidates = append(candidates, date)
+			}
+		}
+	case Monthly:
+		candidates = r.expandMonth(period.Year(), period.Month(), dtstart)
+	case Yearly:
+		candidates = r.expandYear(period.Year(), dtstart)
+	}
+
+	// the BY parts that do not expand a period limit it
+	filtered := []time.Time{}
+	for _, date := range candidates {
+		if len(r.ByMonth) > 0 && !containsMonth(r.ByMonth, date.Month()) {
+			continue
+		}
+		if r.Freq == Daily && len(r.ByMonthDay) > 0 && !matchesMonthDay(r.ByMonthDay, date) {
+			continue
+		}
+		if r.Freq == Daily && len(r.ByDay) > 0 && !r.matchesWeekday(date) {
+			continue
+		}
+		filtered = append(filtered, date)
+	}
+
+	sort.Slice(filtered, func(i, j int) bool { return filtered[i].Before(filtered[j]) })
+	filtered = unique(filtered)
+	if len(r.BySetPos) == 0 {
+		return filtered
+	}
+
+	selected := []time.Time{}
+	for _, pos := range r.BySetPos {
+		index := pos - 1
+		if pos < 0 {
+			index = len(filtered) + pos
+		}
+		if index >= 0 && index < len(filtered) {
+			selected = append(selected, filtered[index])
+		}
+	}
+	sort.Slice(selected, func(i, j int) bool { return selected[i].Before(selected[j]) })
+	return unique(selected)
+}
+
+// expandMonth returns the candidate days of a rule in a month
+func (r Rule) expandMonth(year int, month time.Month, dtstart time.Time) []time.Time {
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	days := daysIn(year, month)
+
+	candidates := []time.Time{}
+	switch {
+	case len(r.ByMonthDay) > 0:
+		for _, day := range r.ByMonthDay {
+			if day < 0 {
+				day = days + day + 1
+			}
+			if day < 1 || day > days {
+				continue
+			}
+
+			date := first.AddDate(0, 0, day-1)
+			// BYDAY limits BYMONTHDAY
+			if len(r.ByDay) == 0 || r.matchesWeekday(date) {
+				candidates = append(candidates, date)
+			}
+		}
+	case len(r.ByDay) > 0:
+		for _, weekday := range r.ByDay {
+			candidates = append(candidates, nthWeekdays(first, days, weekday)...)
+		}
+	default:
+		if dtstart.Day() <= days {
+			candidates = append(candidates, first.AddDate(0, 0, dtstart.Day()-1))
+		}
+	}
+
+	return candidates
+}
+
+// expandYear returns the candidate days of a rule in a year
+func (r Rule) expandYear(year int, dtstart time.Time) []time.Time {
+	first := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	days := first.AddDate(1, 0, 0).Sub(first).Hours() / 24
+
+	candidates := []time.Time{}
+	switch {
+	case len(r.ByYearDay) > 0:
+		for _, day := range r.ByYearDay {
+			if day < 0 {
+				day = int(days) + day + 1
+			}
+			if day < 1 || day > int(days) {
+				continue
+			}
+
+			date := first.AddDate(0, 0, day-1)
+			if len(r.ByDay) == 0 || r.matchesWeekday(date) {
+				candidates = append(candidates, date)
+			}
+		}
+	case len(r.ByMonth) > 0:
+		for _, month := range r.ByMonth {
+			candidates = append(candidates, r.expandMonth(year, month, dtstart)...)
+		}
+	case len(r.ByMonthDay) > 0:
+		for month := time.January; month <= time.December; month++ {
+			candidates = append(candidates, r.expandMonth(year, month, dtstart)...)
+		}
+	case len(r.ByDay) > 0:
+		for _, weekday := range r.ByDay {
+			candidates = append(candidates, nthWeekdays(first, int(days), weekday)...)
+		}
+	default:
+		if dtstart.Day() <= daysIn(year, dtstart.Month()) {
+			candidates = append(candidates, time.Date(year, dtstart.Month(), dtstart.Day(), 0, 0, 0, 0, time.UTC))
+		}
+	}
+
+	return candidates
+}
+
+// matchesWeekday checks whether a date falls on one of the weekdays in BYDAY, ignoring ordinals
+func (r Rule) matchesWeekday(date time.Time) bool {
+	for _, weekday := range r.ByDay {
+		if weekday.Day == date.Weekday() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nthWeekdays returns the days in a span of days from first that are a weekday, or only the nth of them
+func nthWeekdays(first time.Time, days int, weekday Weekday) []time.Time {
+	matches := []time.Time{}
+	offset := (int(weekday.Day) - int(first.Weekday()) + 7) % 7
+	for day := offset; day < days; day += 7 {
+		matches = append(matches, first.AddDate(0, 0, day))
+	}
+
+	if weekday.N == 0 {
+		return matches
+	}
+
+	index := weekday.N - 1
+	if weekday.N < 0 {
+		index = len(matches) + weekday.N
+	}
+	if index < 0 || index >= len(matches) {
+		return nil
+	}
+
+	return matches[index : index+1]
+}
+
+// periodStart returns the first day of the period of a rule that a date falls in
+func periodStart(r Rule, date time.Time) time.Time {
+	switch r.Freq {
+	case Weekly:
+		return date.AddDate(0, 0, -((int(date.Weekday()) - int(r.WeekStart) + 7) % 7))
+	case Monthly:
+		return time.Date(date.Year(), date.Month(), 1, 0, 0, 0, 0, time.UTC)
+	case Yearly:
+		return time.Date(date.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	return date
+}
+
+// nextPeriod returns the first day of the period a rule's interval after a period
+func nextPeriod(r Rule, period time.Time) time.Time {
+	switch r.Freq {
+	case Weekly:
+		return period.AddDate(0, 0, 7*r.Interval)
+	case Monthly:
+		return period.AddDate(0, r.Interval, 0)
+	case Yearly:
+		return period.AddDate(r.Interval, 0, 0)
+	}
+
+	return period.AddDate(0, 0, r.Interval)
+}
+
+func matchesMonthDay(monthDays []int, date time.Time) bool {
+	days := daysIn(date.Year(), date.Month())
+	for _, day := range monthDays {
+		if day == date.Day() || day < 0 && days+day+1 == date.Day() {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsMonth(months []time.Month, month time.Month) bool {
+	for _, m := range months {
+		if m == month {
+			return true
+		}
+	}
+
+	return false
+}
+
+func unique(dates []time.Time) []time.Time {
+	deduped := []time.Time{}
+	for i, date := range dates {
+		if i == 0 || !date.Equal(dates[i-1]) {
+			deduped = append(deduped, date)
+		}
+	}
+
+	return deduped
+}
+
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
+
+func toDate(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// parseDate parses the date of an UNTIL, which can also have a time
+func parseDate(value string) (time.Time, error) {
+	if len(value) < 8 {
+		return time.Time{}, fmt.Errorf("malformed date %q", value)
+	}
+
+	return time.Parse("20060102", value[:8])
+}
+
+// parseWeekdays parses a list of weekdays with optional ordinals, e.g. "MO,-1FR"
+func parseWeekdays(value string) ([]Weekday, error) {
+	parsed := []Weekday{}
+	for _, part := range strings.Split(value, ",") {
+		if len(part) < 2 {
+			return nil, fmt.Errorf("malformed weekday %q", part)
+		}
+
+		day, ok := weekdays[part[len(part)-2:]]
+		if !ok {
+			return nil, fmt.Errorf("unknown weekday %q", part)
+		}
+
+		weekday := Weekday{Day: day}
+		if ordinal := part[:len(part)-2]; ordinal != "" {
+			n, err := strconv.Atoi(ordinal)
+			if err != nil || n == 0 || n < -53 || n > 53 {
+				return nil, fmt.Errorf("invalid ordinal %q", part)
+			}
+			weekday.N = n
+		}
+		parsed = append(parsed, weekday)
+	}
+
+	return parsed, nil
+}
+
+// parseInts parses a list of non-zero numbers whose magnitude is between min and max
+func parseInts(value string, min, max int) ([]int, error) {
+	parsed := []int{}
+	for _, part := range strings.Split(value, ",") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, err
+		}
+
+		magnitude := n
+		if magnitude < 0 {
+			magnitude = -magnitude
+		}
+		if magnitude < min || magnitude > max {
+			return nil, fmt.Errorf("%d is out of range", n)
+		}
+		parsed = append(parsed, n)
+	}
+
+	return parsed, nil
+}
+
+func joinInts(values []int) string {
+	parts := []string{}
+	for _, value := range values {
+		parts = append(parts, strconv.Itoa(value))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func weekdayName(day time.Weekday) string {
+	for name, weekday := range weekdays {
+		if weekday == day {
+			return name
+		}
+	}
+
+	return ""
+}
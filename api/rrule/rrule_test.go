@@ -0,0 +1,75 @@
+// +build integration
+
+package rrule
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+func TestParse(t *testing.T) {
+	rule, err := Parse("RRULE:FREQ=MONTHLY;INTERVAL=2;BYDAY=2TU,-1FR;BYSETPOS=1")
+	require.NoError(t, err)
+	require.Equal(t, Monthly, rule.Freq)
+	require.Equal(t, 2, rule.Interval)
+	require.Equal(t, []Weekday{{N: 2, Day: time.Tuesday}, {N: -1, Day: time.Friday}}, rule.ByDay)
+	require.Equal(t, []int{1}, rule.BySetPos)
+	require.Equal(t, "FREQ=MONTHLY;INTERVAL=2;BYDAY=2TU,-1FR;BYSETPOS=1", rule.String())
+
+	for _, invalid := range []string{"", "INTERVAL=2", "FREQ=HOURLY", "FREQ=DAILY;BYHOUR=9", "FREQ=WEEKLY;BYDAY=2MO", "FREQ=MONTHLY;BYMONTHDAY=32", "FREQ=DAILY;COUNT=2;UNTIL=20170101"} {
+		_, err := Parse(invalid)
+		require.Error(t, err, "%q should not parse", invalid)
+	}
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		rule      string
+		dtstart   time.Time
+		expected  []time.Time
+		explained string
+	}{
+		{"FREQ=DAILY;INTERVAL=10", date(2017, time.January, 25), []time.Time{date(2017, time.January, 25), date(2017, time.February, 4)}, "intervals of days"},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=TU,TH", date(2017, time.May, 2), []time.Time{date(2017, time.May, 2), date(2017, time.May, 4), date(2017, time.May, 16)}, "every other week on two days"},
+		{"FREQ=MONTHLY;BYDAY=2TU", date(2017, time.January, 1), []time.Time{date(2017, time.January, 10), date(2017, time.February, 14)}, "second tuesday"},
+		{"FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1", date(2017, time.April, 1), []time.Time{date(2017, time.April, 28), date(2017, time.May, 31), date(2017, time.June, 30)}, "last weekday of the month"},
+		{"FREQ=MONTHLY;BYMONTHDAY=28,29,30,31;BYSETPOS=-1", date(2017, time.January, 31), []time.Time{date(2017, time.January, 31), date(2017, time.February, 28), date(2017, time.March, 31)}, "clamped to the end of the month"},
+		{"FREQ=MONTHLY;BYMONTHDAY=31", date(2017, time.January, 31), []time.Time{date(2017, time.January, 31), date(2017, time.March, 31)}, "months without the day are skipped"},
+		{"FREQ=YEARLY;BYMONTH=11;BYDAY=4TH", date(2017, time.January, 1), []time.Time{date(2017, time.November, 23), date(2018, time.November, 22)}, "fourth thursday of november"},
+		{"FREQ=YEARLY", date(2016, time.February, 29), []time.Time{date(2016, time.February, 29), date(2020, time.February, 29)}, "leap days only occur in leap years"},
+	}
+
+	for _, test := range tests {
+		rule, err := Parse(test.rule)
+		require.NoError(t, err)
+
+		next, err := rule.Next(test.dtstart, test.dtstart, true)
+		for _, expected := range test.expected {
+			require.NoError(t, err, test.explained)
+			require.Equal(t, expected, next, test.explained)
+			next, err = rule.Next(test.dtstart, next, false)
+		}
+	}
+}
+
+func TestNextEnds(t *testing.T) {
+	rule, err := Parse("FREQ=WEEKLY;COUNT=2")
+	require.NoError(t, err)
+	require.Equal(t, []time.Time{date(2017, time.May, 1), date(2017, time.May, 8)}, rule.Between(date(2017, time.May, 1), date(2017, time.January, 1), date(2017, time.December, 31)))
+
+	rule, err = Parse("FREQ=DAILY;UNTIL=20170503T000000Z")
+	require.NoError(t, err)
+	_, err = rule.Next(date(2017, time.May, 1), date(2017, time.May, 3), false)
+	require.Equal(t, ErrNoOccurrence, err)
+
+	rule, err = Parse("FREQ=YEARLY;BYMONTH=2;BYMONTHDAY=30")
+	require.NoError(t, err)
+	_, err = rule.Next(date(2017, time.May, 1), date(2017, time.May, 1), true)
+	require.Equal(t, ErrNoOccurrence, err, "A rule that never occurs should not loop forever")
+}
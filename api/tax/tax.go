@@ -0,0 +1,409 @@
+package tax
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// Line is a line of a tax return that a user defines, such as charitable donations or medical expenses,
+// along with the categories whose transactions are totalled into it. A category also covers its subcategories,
+// and can only be mapped to one of a user's tax lines.
+type Line struct {
+	ID         int      `json:"id,omitempty"`
+	User       uint     `json:"user"`
+	Name       string   `json:"name"`
+	Categories []string `json:"categories"`
+}
+
+// Get fetches the tax lines of the user in the context
+func Get(c context.Context) ([]Line, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, name FROM tax_lines WHERE user_id = $1 ORDER BY name", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch tax lines")
+		return nil, err
+	}
+
+	lines, err := scanLines(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("SELECT lc.tax_line_id, lc.category FROM tax_line_categories lc JOIN tax_lines l ON l.id = lc.tax_line_id WHERE l.user_id = $1 ORDER BY lc.category", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch tax line categories")
+		return nil, err
+	}
+
+	return withCategories(lines, rows)
+}
+
+// GetAll queries for all tax lines
+func GetAll(c context.Context) ([]Line, error) {
+	if !util.IsAdminRequest(c) {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, user_id, name FROM tax_lines")
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch all tax lines")
+		return nil, err
+	}
+
+	lines, err := scanLines(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query("SELECT tax_line_id, category FROM tax_line_categories ORDER BY category")
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch all tax line categories")
+		return nil, err
+	}
+
+	return withCategories(lines, rows)
+}
+
+// New creates a new tax line
+func New(c context.Context, line *Line) (*Line, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	line.User = userID
+	if err := validate(c, line); err != nil {
+		return nil, err
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when creating tax line")
+		return nil, err
+	}
+
+	err = txn.QueryRow("INSERT INTO tax_lines(user_id, name) VALUES($1, $2) RETURNING id", line.User, line.Name).Scan(&line.ID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"line":  line,
+		}).Error("failed to insert tax line")
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	if err := insertCategories(txn, *line); err != nil {
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	if err := commit(); err != nil {
+		logrus.WithError(err).Error("unable to commit creating tax line")
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	return line, nil
+}
+
+// Update renames a tax line and replaces its categories
+func Update(c context.Context, line *Line) (*Line, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	line.User = userID
+	if err := validate(c, line); err != nil {
+		return nil, err
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when updating tax line")
+		return nil, err
+	}
+
+	res, err := txn.Exec("UPDATE tax_lines SET name = $1 WHERE id = $2 AND user_id = $3", line.Name, line.ID, userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"line":  line,
+		}).Error("failed to update tax line")
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	if updated, err := res.RowsAffected(); err != nil || updated == 0 {
+		util.RollbackIfOwned(c, txn)
+		return nil, constants.ErrForbidden
+	}
+
+	if _, err := txn.Exec("DELETE FROM tax_line_categories WHERE tax_line_id = $1", line.ID); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"taxLineId": line.ID,
+		}).Error("failed to clear tax line categories")
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	if err := insertCategories(txn, *line); err != nil {
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	if err := commit(); err != nil {
+		logrus.WithError(err).Error("unable to commit updating tax line")
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	return line, nil
+}
+
+// Delete deletes a tax line
+func Delete(c context.Context, lineID int) error {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec("DELETE FROM tax_lines WHERE id = $1 AND user_id = $2", lineID, userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"taxLineId": lineID,
+		}).Error("could not delete tax line")
+		return err
+	}
+
+	if deleted, err := res.RowsAffected(); err != nil || deleted == 0 {
+		return constants.ErrForbidden
+	}
+
+	return nil
+}
+
+// BatchImport batch imports tax lines along with their categories
+func BatchImport(c context.Context, lines []Line) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when batch inserting tax lines")
+		return err
+	}
+
+	stmt, err := txn.Prepare(pq.CopyIn("tax_lines", "id", "user_id", "name"))
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin copy in when batch inserting tax lines")
+		return err
+	}
+
+	for _, line := range lines {
+		_, err = stmt.Exec(line.ID, line.User, line.Name)
+		if err != nil {
+			logrus.WithError(err).Error("unable to exec tax line copy when batch inserting tax lines")
+			return err
+		}
+	}
+
+	_, err = stmt.Exec()
+	if err != nil {
+		logrus.WithError(err).Error("unable to exec batch tax line copy when batch inserting tax lines")
+		return err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		logrus.WithError(err).Error("unable to close tax line copy when batch inserting tax lines")
+		return err
+	}
+
+	stmt, err = txn.Prepare(pq.CopyIn("tax_line_categories", "tax_line_id", "category"))
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin copy in when batch inserting tax line categories")
+		return err
+	}
+
+	for _, line := range lines {
+		for _, category := range line.Categories {
+			_, err = stmt.Exec(line.ID, category)
+			if err != nil {
+				logrus.WithError(err).Error("unable to exec tax line category copy when batch inserting tax line categories")
+				return err
+			}
+		}
+	}
+
+	_, err = stmt.Exec()
+	if err != nil {
+		logrus.WithError(err).Error("unable to exec batch tax line category copy when batch inserting tax line categories")
+		return err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		logrus.WithError(err).Error("unable to close tax line category copy when batch inserting tax line categories")
+		return err
+	}
+
+	err = commit()
+	if err != nil {
+		logrus.WithError(err).Error("unable to commit tax line copy when batch inserting tax lines")
+		return err
+	}
+
+	return nil
+}
+
+// ImportForUser creates tax lines for the user in the context
+func ImportForUser(c context.Context, lines []Line) error {
+	for _, line := range lines {
+		line.ID = 0
+		if _, err := New(c, &line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validate checks a tax line, including that none of its categories are mapped to another of the user's tax lines
+func validate(c context.Context, line *Line) error {
+	if line.Name == "" {
+		return constants.ErrBadRequest
+	}
+
+	if line.Categories == nil {
+		line.Categories = []string{}
+	}
+
+	seen := map[string]bool{}
+	for _, category := range line.Categories {
+		if category == "" || seen[category] {
+			return constants.ErrBadRequest
+		}
+		seen[category] = true
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	var mapped int
+	err = db.QueryRow("SELECT COUNT(*) FROM tax_line_categories lc JOIN tax_lines l ON l.id = lc.tax_line_id WHERE l.user_id = $1 AND l.id != $2 AND lc.category = ANY($3)", line.User, line.ID, pq.Array(line.Categories)).Scan(&mapped)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"line":  line,
+		}).Error("failed to check for categories mapped to other tax lines")
+		return err
+	}
+
+	if mapped > 0 {
+		return constants.ErrBadRequest
+	}
+
+	return nil
+}
+
+func insertCategories(db util.DB, line Line) error {
+	for _, category := range line.Categories {
+		if _, err := db.Exec("INSERT INTO tax_line_categories(tax_line_id, category) VALUES($1, $2)", line.ID, category); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":    err,
+				"line":     line,
+				"category": category,
+			}).Error("failed to insert tax line category")
+			return err
+		}
+	}
+
+	return nil
+}
+
+func scanLines(rows *sql.Rows) ([]Line, error) {
+	defer rows.Close()
+
+	lines := []Line{}
+	for rows.Next() {
+		line := Line{Categories: []string{}}
+		if err := rows.Scan(&line.ID, &line.User, &line.Name); err != nil {
+			logrus.WithError(err).Error("failed to scan into tax line")
+			return nil, err
+		}
+
+		lines = append(lines, line)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get tax lines from rows")
+		return nil, err
+	}
+
+	return lines, nil
+}
+
+// withCategories adds rows of tax line ids and categories to the tax lines they belong to
+func withCategories(lines []Line, rows *sql.Rows) ([]Line, error) {
+	defer rows.Close()
+
+	indexes := map[int]int{}
+	for i, line := range lines {
+		indexes[line.ID] = i
+	}
+
+	for rows.Next() {
+		var lineID int
+		var category string
+		if err := rows.Scan(&lineID, &category); err != nil {
+			logrus.WithError(err).Error("failed to scan into tax line category")
+			return nil, err
+		}
+
+		if i, ok := indexes[lineID]; ok {
+			lines[i].Categories = append(lines[i].Categories, category)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get tax line categories from rows")
+		return nil, err
+	}
+
+	return lines, nil
+}
@@ -0,0 +1,469 @@
+package transaction
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// RecurringException changes a single run of a recurring transaction, on the date the run would otherwise post.
+// The run can be skipped, moved to another date, or post with a different amount, name or note. Skipped runs do not
+// count towards the maximum occurrences, and amounts of loan payments come from the loan, so they cannot be overridden.
+// Moved runs post on their own when their new date comes up, without holding back the runs scheduled after them.
+type RecurringException struct {
+	ID                     int        `json:"id,omitempty"`
+	RecurringTransactionID int        `json:"recurringTransactionId"`
+	Date                   time.Time  `json:"date"`
+	Skip                   bool       `json:"skip"`
+	MoveTo                 *time.Time `json:"moveTo"`
+	Amount                 *int       `json:"amount"`
+	Name                   *string    `json:"name"`
+	Note                   *string    `json:"note"`
+	Posted                 bool       `json:"posted"`
+}
+
+type recurringExceptionDB struct {
+	ID                     int
+	RecurringTransactionID int
+	Date                   time.Time
+	Skip                   bool
+	MoveTo                 pq.NullTime
+	Amount                 sql.NullInt64
+	Name                   sql.NullString
+	Note                   sql.NullString
+	Posted                 bool
+}
+
+// exceptionSet is the exceptions of a recurring transaction, keyed by the date of the run they change
+type exceptionSet map[string]RecurringException
+
+// GetExceptions fetches the exceptions of a recurring transaction, in date order
+func GetExceptions(c context.Context, recurringTransactionID int) ([]RecurringException, error) {
+	valid, err := userOwnsRecurringTransaction(c, recurringTransactionID)
+	if err != nil || !valid {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, recurring_transaction_id, date, skip, move_to, amount, name, note, posted FROM recurring_exceptions WHERE recurring_transaction_id = $1 ORDER BY date", recurringTransactionID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":                  err,
+			"recurringTransactionID": recurringTransactionID,
+		}).Error("failed to fetch recurring exceptions")
+		return nil, err
+	}
+
+	return scanExceptions(rows)
+}
+
+// GetAllExceptions queries for all recurring exceptions
+func GetAllExceptions(c context.Context) ([]RecurringException, error) {
+	if !util.IsAdminRequest(c) {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT id, recurring_transaction_id, date, skip, move_to, amount, name, note, posted FROM recurring_exceptions")
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch all recurring exceptions")
+		return nil, err
+	}
+
+	return scanExceptions(rows)
+}
+
+// GetAllExceptionsForUser queries for all recurring exceptions of the user in the context
+func GetAllExceptionsForUser(c context.Context) ([]RecurringException, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`SELECT e.id, e.recurring_transaction_id, e.date, e.skip, e.move_to, e.amount, e.name, e.note, e.posted
+FROM recurring_exceptions e JOIN recurring_transactions r ON r.id = e.recurring_transaction_id JOIN accounts a ON a.id = r.account_id
+WHERE a.user_id = $1`, userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch all recurring exceptions for user")
+		return nil, err
+	}
+
+	return scanExceptions(rows)
+}
+
+// NewException adds an exception to an upcoming run of a recurring transaction, replacing any exception it already has
+func NewException(c context.Context, exception *RecurringException) (*RecurringException, error) {
+	valid, err := userOwnsRecurringTransaction(c, exception.RecurringTransactionID)
+	if err != nil || !valid {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exception.Skip && exception.MoveTo == nil && exception.Amount == nil && exception.Name == nil && exception.Note == nil {
+		return nil, constants.ErrBadRequest
+	}
+
+	recurring, err := getRecurringByID(db, exception.RecurringTransactionID)
+	if err != nil {
+		return nil, err
+	}
+
+	// loan payments are worked out from what is owed, so their amounts cannot be overridden
+	loan, err := loanForRecurring(db, exception.RecurringTransactionID)
+	if err != nil {
+		return nil, err
+	}
+	if loan != nil && exception.Amount != nil {
+		return nil, constants.ErrBadRequest
+	}
+
+	// runs cannot be moved to before what the recurring transaction has already posted
+	if exception.MoveTo != nil {
+		if exception.MoveTo.IsZero() {
+			return nil, constants.ErrBadRequest
+		}
+
+		var lastPosted pq.NullTime
+		err = db.QueryRow("SELECT MAX(occurred) FROM transactions WHERE recurring_transaction_id = $1", exception.RecurringTransactionID).Scan(&lastPosted)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":                  err,
+				"recurringTransactionID": exception.RecurringTransactionID,
+			}).Error("failed to fetch the last posted run of recurring transaction")
+			return nil, err
+		}
+		if lastPosted.Valid && exception.MoveTo.Before(lastPosted.Time) {
+			return nil, constants.ErrBadRequest
+		}
+	}
+
+	// runs that have been moved and have already posted cannot be changed
+	exceptions, err := exceptionsFor(db, exception.RecurringTransactionID)
+	if err != nil {
+		return nil, err
+	}
+	if exceptions.posted(exception.Date) {
+		return nil, constants.ErrBadRequest
+	}
+
+	cal, err := calendarFor(db, recurring)
+	if err != nil {
+		return nil, err
+	}
+
+	// exceptions can only be made to runs that have yet to post
+	isRun := false
+	err = eachRun(recurring, cal, nil, func(date time.Time, _ Transaction) bool {
+		isRun = date.Equal(exception.Date)
+		return date.Before(exception.Date)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !isRun {
+		return nil, constants.ErrBadRequest
+	}
+
+	edb := exceptionToDB(*exception)
+	err = db.QueryRow(`INSERT INTO recurring_exceptions(recurring_transaction_id, date, skip, move_to, amount, name, note) VALUES($1, $2, $3, $4, $5, $6, $7)
+ON CONFLICT (recurring_transaction_id, date) DO UPDATE SET skip = EXCLUDED.skip, move_to = EXCLUDED.move_to, amount = EXCLUDED.amount, name = EXCLUDED.name, note = EXCLUDED.note
+RETURNING id`, edb.RecurringTransactionID, edb.Date, edb.Skip, edb.MoveTo, edb.Amount, edb.Name, edb.Note).Scan(&exception.ID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"exception": exception,
+		}).Error("failed to insert recurring exception")
+		return nil, err
+	}
+
+	return exception, nil
+}
+
+// DeleteException deletes a recurring exception, so the run it changed posts as usual
+func DeleteException(c context.Context, exceptionID int) error {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	res, err := db.Exec(`DELETE FROM recurring_exceptions e USING recurring_transactions r, accounts a
+WHERE e.id = $1 AND r.id = e.recurring_transaction_id AND a.id = r.account_id AND a.user_id = $2`, exceptionID, userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":       err,
+			"exceptionId": exceptionID,
+		}).Error("could not delete recurring exception")
+		return err
+	}
+
+	if deleted, err := res.RowsAffected(); err != nil || deleted == 0 {
+		return constants.ErrForbidden
+	}
+
+	return nil
+}
+
+// BatchImportExceptions batch imports recurring exceptions
+func BatchImportExceptions(c context.Context, exceptions []RecurringException) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when batch inserting recurring exceptions")
+		return err
+	}
+
+	stmt, err := txn.Prepare(pq.CopyIn("recurring_exceptions", "id", "recurring_transaction_id", "date", "skip", "move_to", "amount", "name", "note", "posted"))
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin copy in when batch inserting recurring exceptions")
+		return err
+	}
+
+	for _, exception := range exceptions {
+		edb := exceptionToDB(exception)
+		_, err = stmt.Exec(edb.ID, edb.RecurringTransactionID, edb.Date, edb.Skip, edb.MoveTo, edb.Amount, edb.Name, edb.Note, edb.Posted)
+		if err != nil {
+			logrus.WithError(err).Error("unable to exec recurring exception copy when batch inserting recurring exceptions")
+			return err
+		}
+	}
+
+	_, err = stmt.Exec()
+	if err != nil {
+		logrus.WithError(err).Error("unable to exec batch recurring exception copy when batch inserting recurring exceptions")
+		return err
+	}
+
+	err = stmt.Close()
+	if err != nil {
+		logrus.WithError(err).Error("unable to close recurring exception copy when batch inserting recurring exceptions")
+		return err
+	}
+
+	err = commit()
+	if err != nil {
+		logrus.WithError(err).Error("unable to commit recurring exception copy when batch inserting recurring exceptions")
+		return err
+	}
+
+	return nil
+}
+
+// ImportExceptionsForUser inserts recurring exceptions for the user in the context, mapping the exported recurring
+// transaction ids to the imported ones
+func ImportExceptionsForUser(c context.Context, exceptions []RecurringException, recurringIDs map[int]int) error {
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	for _, exception := range exceptions {
+		recurringID, ok := recurringIDs[exception.RecurringTransactionID]
+		if !ok {
+			return constants.ErrBadRequest
+		}
+
+		edb := exceptionToDB(exception)
+		_, err := db.Exec("INSERT INTO recurring_exceptions(recurring_transaction_id, date, skip, move_to, amount, name, note, posted) VALUES($1, $2, $3, $4, $5, $6, $7, $8)", recurringID, edb.Date, edb.Skip, edb.MoveTo, edb.Amount, edb.Name, edb.Note, edb.Posted)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":     err,
+				"exception": exception,
+			}).Error("failed to import recurring exception")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// exceptionsFor fetches the exceptions of a recurring transaction
+func exceptionsFor(db util.DB, recurringTransactionID int) (exceptionSet, error) {
+	rows, err := db.Query("SELECT id, recurring_transaction_id, date, skip, move_to, amount, name, note, posted FROM recurring_exceptions WHERE recurring_transaction_id = $1", recurringTransactionID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":                  err,
+			"recurringTransactionID": recurringTransactionID,
+		}).Error("failed to fetch recurring exceptions to generate transactions")
+		return nil, err
+	}
+
+	exceptions, err := scanExceptions(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	return exceptionsByRecurring(exceptions)[recurringTransactionID], nil
+}
+
+// exceptionsByRecurring groups exceptions by the recurring transaction they belong to
+func exceptionsByRecurring(exceptions []RecurringException) map[int]exceptionSet {
+	grouped := map[int]exceptionSet{}
+	for _, exception := range exceptions {
+		if grouped[exception.RecurringTransactionID] == nil {
+			grouped[exception.RecurringTransactionID] = exceptionSet{}
+		}
+		grouped[exception.RecurringTransactionID][exception.Date.Format("2006-01-02")] = exception
+	}
+
+	return grouped
+}
+
+// apply returns the transaction that a run posts, and whether it posts at all
+func (exceptions exceptionSet) apply(run Transaction) (Transaction, bool) {
+	exception, ok := exceptions[run.Date.Format("2006-01-02")]
+	if !ok {
+		return run, true
+	}
+
+	if exception.Skip {
+		return run, false
+	}
+	if exception.MoveTo != nil {
+		run.Date = *exception.MoveTo
+	}
+	if exception.Amount != nil {
+		run.Amount = *exception.Amount
+	}
+	if exception.Name != nil {
+		run.Name = *exception.Name
+	}
+	if exception.Note != nil {
+		run.Note = *exception.Note
+	}
+
+	return run, true
+}
+
+// moved checks whether the run on a date has been moved, so it posts on its own when its new date comes up
+func (exceptions exceptionSet) moved(date time.Time) bool {
+	exception, ok := exceptions[date.Format("2006-01-02")]
+	return ok && !exception.Skip && exception.MoveTo != nil
+}
+
+// posted checks whether the run on a date has been moved and has already posted on its new date
+func (exceptions exceptionSet) posted(date time.Time) bool {
+	return exceptions.moved(date) && exceptions[date.Format("2006-01-02")].Posted
+}
+
+// unposted returns the moved runs that have yet to post, in the order of their new dates
+func (exceptions exceptionSet) unposted() []RecurringException {
+	unposted := []RecurringException{}
+	for _, exception := range exceptions {
+		if !exception.Skip && exception.MoveTo != nil && !exception.Posted {
+			unposted = append(unposted, exception)
+		}
+	}
+
+	sort.Slice(unposted, func(i, j int) bool {
+		return unposted[i].MoveTo.Before(*unposted[j].MoveTo)
+	})
+	return unposted
+}
+
+// markExceptionPosted records that a moved run has posted, so it is not posted again
+func markExceptionPosted(db util.DB, exceptionID int) error {
+	_, err := db.Exec("UPDATE recurring_exceptions SET posted = true WHERE id = $1", exceptionID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":       err,
+			"exceptionId": exceptionID,
+		}).Error("failed to mark recurring exception as posted")
+		return err
+	}
+
+	return nil
+}
+
+func scanExceptions(rows *sql.Rows) ([]RecurringException, error) {
+	defer rows.Close()
+
+	exceptions := []RecurringException{}
+	for rows.Next() {
+		var edb recurringExceptionDB
+		if err := rows.Scan(&edb.ID, &edb.RecurringTransactionID, &edb.Date, &edb.Skip, &edb.MoveTo, &edb.Amount, &edb.Name, &edb.Note, &edb.Posted); err != nil {
+			logrus.WithError(err).Error("failed to scan into recurring exception")
+			return nil, err
+		}
+
+		exceptions = append(exceptions, exceptionFromDB(edb))
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get recurring exceptions from rows")
+		return nil, err
+	}
+
+	return exceptions, nil
+}
+
+func exceptionToDB(exception RecurringException) recurringExceptionDB {
+	moveTo := pq.NullTime{}
+	if exception.MoveTo != nil {
+		moveTo = pq.NullTime{Time: *exception.MoveTo, Valid: true}
+	}
+
+	return recurringExceptionDB{
+		ID:                     exception.ID,
+		RecurringTransactionID: exception.RecurringTransactionID,
+		Date:                   exception.Date,
+		Skip:                   exception.Skip,
+		MoveTo:                 moveTo,
+		Amount:                 util.ToNullInt(exception.Amount),
+		Name:                   util.ToNullString(exception.Name),
+		Note:                   util.ToNullString(exception.Note),
+		Posted:                 exception.Posted,
+	}
+}
+
+func exceptionFromDB(edb recurringExceptionDB) RecurringException {
+	var moveTo *time.Time
+	if edb.MoveTo.Valid {
+		moveTo = &edb.MoveTo.Time
+	}
+
+	return RecurringException{
+		ID:                     edb.ID,
+		RecurringTransactionID: edb.RecurringTransactionID,
+		Date:                   edb.Date,
+		Skip:                   edb.Skip,
+		MoveTo:                 moveTo,
+		Amount:                 util.FromNullInt(edb.Amount),
+		Name:                   util.FromNullString(edb.Name),
+		Note:                   util.FromNullString(edb.Note),
+		Posted:                 edb.Posted,
+	}
+}
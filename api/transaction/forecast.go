@@ -0,0 +1,371 @@
+package transaction
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/api/account"
+	"github.com/jchorl/financejc/api/holiday"
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// Forecast is the projected balance of each open account of a user on every day from today until the end of a horizon
+type Forecast struct {
+	Start     time.Time         `json:"start"`
+	End       time.Time         `json:"end"`
+	Threshold int               `json:"threshold"`
+	Accounts  []AccountForecast `json:"accounts"`
+}
+
+// AccountForecast is the projected daily balance of an account, in its currency. Balances of accounts that are not
+// liabilities are flagged when they are negative or below the threshold, and the first of those dates are pulled out.
+type AccountForecast struct {
+	AccountID           int               `json:"accountId"`
+	Name                string            `json:"name"`
+	Currency            string            `json:"currency"`
+	Balances            []ForecastBalance `json:"balances"`
+	FirstNegative       *time.Time        `json:"firstNegative,omitempty"`
+	FirstBelowThreshold *time.Time        `json:"firstBelowThreshold,omitempty"`
+}
+
+// ForecastBalance is the projected balance of an account at the end of a day
+type ForecastBalance struct {
+	Date           time.Time `json:"date"`
+	Balance        int       `json:"balance"`
+	Negative       bool      `json:"negative,omitempty"`
+	BelowThreshold bool      `json:"belowThreshold,omitempty"`
+}
+
+// GetForecast projects the balances of the open accounts of the user in the context over the next number of days.
+// Balances start from today's, and add transactions already posted for future dates and every future run of the
+// user's recurring transactions. Recurring transactions that are due but not yet posted count today.
+// Loan payments are split into interest and principal as they will be posted.
+func GetForecast(c context.Context, days, threshold int) (Forecast, error) {
+	if days < 1 || days > constants.MaxReportPeriods {
+		return Forecast{}, constants.ErrBadRequest
+	}
+
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return Forecast{}, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return Forecast{}, err
+	}
+
+	now := time.Now()
+	start := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 0, days)
+
+	rows, err := db.Query(fmt.Sprintf(`SELECT a.id, a.name, a.currency, a.type, CASE WHEN %s <= $2::date THEN a.opening_balance ELSE 0 END + COALESCE(SUM(t.amount) FILTER (WHERE t.occurred <= $2::date), 0)
+FROM accounts a LEFT JOIN transactions t ON t.account_id = a.id
+WHERE a.user_id = $1 AND NOT a.closed
+GROUP BY a.id
+ORDER BY a.id`, account.OpeningDate), userID, start)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to query balances to forecast")
+		return Forecast{}, err
+	}
+	defer rows.Close()
+
+	forecast := Forecast{
+		Start:     start,
+		End:       end,
+		Threshold: threshold,
+		Accounts:  []AccountForecast{},
+	}
+	balances := map[int]int{}
+	liabilities := map[int]bool{}
+	for rows.Next() {
+		var accountForecast AccountForecast
+		var accountType string
+		var balance int
+		if err := rows.Scan(&accountForecast.AccountID, &accountForecast.Name, &accountForecast.Currency, &accountType, &balance); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"userId": userID,
+			}).Error("failed to scan into balance to forecast")
+			return Forecast{}, err
+		}
+
+		forecast.Accounts = append(forecast.Accounts, accountForecast)
+		balances[accountForecast.AccountID] = balance
+		liabilities[accountForecast.AccountID] = constants.AccountTypes[accountType]
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to get balances to forecast from rows")
+		return Forecast{}, err
+	}
+
+	// opening balances of accounts that open later are posted like any other transaction
+	rows, err = db.Query(fmt.Sprintf(`SELECT t.account_id, t.occurred, SUM(t.amount) FROM transactions t JOIN accounts a ON a.id = t.account_id
+WHERE a.user_id = $1 AND NOT a.closed AND t.occurred > $2::date AND t.occurred <= $3::date
+GROUP BY 1, 2
+UNION ALL
+SELECT a.id, %s, a.opening_balance FROM accounts a WHERE a.user_id = $1 AND NOT a.closed AND %[1]s > $2::date AND %[1]s <= $3::date`, account.OpeningDate), userID, start, end)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to query future transactions to forecast")
+		return Forecast{}, err
+	}
+	defer rows.Close()
+
+	deltas := newDailyDeltas(start, days)
+	for rows.Next() {
+		var accountID, amount int
+		var occurred time.Time
+		if err := rows.Scan(&accountID, &occurred, &amount); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"userId": userID,
+			}).Error("failed to scan into future transaction to forecast")
+			return Forecast{}, err
+		}
+
+		deltas.add(accountID, occurred, amount)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to get future transactions to forecast from rows")
+		return Forecast{}, err
+	}
+
+	recurringTransactions, err := GetAllRecurringForUser(c)
+	if err != nil {
+		return Forecast{}, err
+	}
+
+	loans, err := GetAllLoansForUser(c)
+	if err != nil {
+		return Forecast{}, err
+	}
+
+	loansByRecurring := map[int]Loan{}
+	for _, loan := range loans {
+		if loan.RecurringTransactionID != 0 {
+			loansByRecurring[loan.RecurringTransactionID] = loan
+		}
+	}
+
+	cal, err := holiday.CalendarForUser(c)
+	if err != nil {
+		return Forecast{}, err
+	}
+
+	exceptions, err := GetAllExceptionsForUser(c)
+	if err != nil {
+		return Forecast{}, err
+	}
+
+	if err := project(deltas, balances, recurringTransactions, loansByRecurring, cal, exceptionsByRecurring(exceptions)); err != nil {
+		return Forecast{}, err
+	}
+
+	for i, accountForecast := range forecast.Accounts {
+		accountForecast.Balances = []ForecastBalance{}
+		balance := balances[accountForecast.AccountID]
+		amounts := deltas.amounts[accountForecast.AccountID]
+		for day := 0; day <= days; day++ {
+			date := start.AddDate(0, 0, day)
+			if amounts != nil {
+				balance += amounts[day]
+			}
+			projected := ForecastBalance{Date: date, Balance: balance}
+			if !liabilities[accountForecast.AccountID] {
+				projected.Negative = balance < 0
+				projected.BelowThreshold = balance < threshold
+			}
+
+			if projected.Negative && accountForecast.FirstNegative == nil {
+				accountForecast.FirstNegative = &projected.Date
+			}
+			if projected.BelowThreshold && accountForecast.FirstBelowThreshold == nil {
+				accountForecast.FirstBelowThreshold = &projected.Date
+			}
+
+			accountForecast.Balances = append(accountForecast.Balances, projected)
+		}
+		forecast.Accounts[i] = accountForecast
+	}
+
+	return forecast, nil
+}
+
+// dailyDeltas are the amounts that move into each account on each day of a forecast.
+// Anything dated before the start of the forecast moves on the first day.
+type dailyDeltas struct {
+	start   time.Time
+	days    int
+	amounts map[int][]int
+}
+
+func newDailyDeltas(start time.Time, days int) dailyDeltas {
+	return dailyDeltas{
+		start:   start,
+		days:    days,
+		amounts: map[int][]int{},
+	}
+}
+
+// add adds an amount to an account on a date, returning false if the date is after the end of the forecast
+func (d dailyDeltas) add(accountID int, date time.Time, amount int) bool {
+	day := d.day(date)
+	if day > d.days {
+		return false
+	}
+
+	if _, ok := d.amounts[accountID]; !ok {
+		d.amounts[accountID] = make([]int, d.days+1)
+	}
+	d.amounts[accountID][day] += amount
+	return true
+}
+
+// balance returns the balance of an account at the end of a date, given its balance before the forecast
+func (d dailyDeltas) balance(accountID int, date time.Time, start int) int {
+	balance := start
+	for day, amount := range d.amounts[accountID] {
+		if day > d.day(date) {
+			break
+		}
+		balance += amount
+	}
+
+	return balance
+}
+
+func (d dailyDeltas) day(date time.Time) int {
+	date = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	if date.Before(d.start) {
+		return 0
+	}
+
+	return int(date.Sub(d.start).Hours() / 24)
+}
+
+// project adds every run of the recurring transactions until the end of the forecast to the daily deltas.
+// Loan payments are projected after everything else, so the interest on each is computed from what will be owed then.
+// Runs are moved to business days of the holiday calendar and changed by their exceptions like they are when they are posted,
+// and moved runs that were scheduled before the next run but have yet to post are projected on their new dates.
+func project(deltas dailyDeltas, balances map[int]int, recurringTransactions []RecurringTransaction, loans map[int]Loan, cal holiday.Calendar, exceptions map[int]exceptionSet) error {
+	loanRecurrings := []RecurringTransaction{}
+	for _, recurring := range recurringTransactions {
+		if _, ok := loans[recurring.ID]; ok {
+			loanRecurrings = append(loanRecurrings, recurring)
+			continue
+		}
+
+		for _, posted := range pending(recurring, exceptions[recurring.ID]) {
+			deltas.add(posted.AccountID, posted.Date, posted.Amount)
+		}
+
+		err := eachRun(recurring, cal, exceptions[recurring.ID], func(date time.Time, posted Transaction) bool {
+			// a run can be moved past the end of the forecast without the runs after it being past the end too
+			deltas.add(posted.AccountID, posted.Date, posted.Amount)
+			return deltas.day(date) <= deltas.days
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, recurring := range loanRecurrings {
+		loan := loans[recurring.ID]
+		pay := func(posted Transaction) bool {
+			date := posted.Date
+			owed := -deltas.balance(loan.AccountID, date, balances[loan.AccountID])
+			if owed <= 0 {
+				return false
+			}
+
+			principal, interest := splitPayment(loan, owed)
+			deltas.add(loan.AccountID, date, principal)
+			return deltas.add(loan.PaymentAccountID, date, -principal-interest) && principal < owed
+		}
+
+		for _, posted := range pending(recurring, exceptions[recurring.ID]) {
+			pay(posted)
+		}
+
+		err := eachRun(recurring, cal, exceptions[recurring.ID], func(_ time.Time, posted Transaction) bool {
+			return pay(posted)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// eachRun calls run with the date of every run of a recurring transaction and the transaction it posts, after any
+// exception, until run returns false or the recurring transaction ends. Skipped runs are passed over, and so are moved
+// runs that have already posted on their new dates, though they still count towards the maximum occurrences.
+func eachRun(recurring RecurringTransaction, cal holiday.Calendar, exceptions exceptionSet, run func(time.Time, Transaction) bool) error {
+	for !ended(recurring) {
+		posted, post := exceptions.apply(recurring.Transaction)
+		if post {
+			if !exceptions.posted(recurring.Transaction.Date) && !run(recurring.Transaction.Date, posted) {
+				return nil
+			}
+			recurring.Occurrences++
+		}
+
+		current := recurring.Transaction.Date
+		if recurring.Scheduled != nil {
+			current = *recurring.Scheduled
+		}
+
+		next, err := getNextRun(&recurring, false, cal)
+		if err != nil {
+			return err
+		}
+
+		// a schedule that does not move forward would never end. runs can be moved onto the same business day,
+		// so it is the dates they were scheduled for that have to move forward.
+		nextScheduled := next
+		if recurring.Scheduled != nil {
+			nextScheduled = *recurring.Scheduled
+		}
+		if !nextScheduled.After(current) {
+			return nil
+		}
+		recurring.Transaction.Date = next
+	}
+
+	return nil
+}
+
+// pending returns the transactions that moved runs of a recurring transaction will post, for the runs that were
+// scheduled before its next run but have yet to post on their new dates
+func pending(recurring RecurringTransaction, exceptions exceptionSet) []Transaction {
+	transactions := []Transaction{}
+	for _, exception := range exceptions.unposted() {
+		if !exception.Date.Before(recurring.Transaction.Date) {
+			continue
+		}
+
+		scheduled := recurring.Transaction
+		scheduled.Date = exception.Date
+		posted, _ := exceptions.apply(scheduled)
+		transactions = append(transactions, posted)
+	}
+
+	return transactions
+}
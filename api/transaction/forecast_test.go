@@ -0,0 +1,132 @@
+// +build integration
+
+package transaction
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/financejc/constants"
+)
+
+func TestProject(t *testing.T) {
+	start := time.Date(2017, time.January, 10, 0, 0, 0, 0, time.UTC)
+	deltas := newDailyDeltas(start, 60)
+	dayOf := 15
+	week := 7 * 24 * 60 * 60
+	recurring := []RecurringTransaction{
+		{
+			ID:           1,
+			Transaction:  Transaction{AccountID: 1, Amount: 100000, Date: time.Date(2017, time.January, 15, 0, 0, 0, 0, time.UTC)},
+			ScheduleType: constants.FixedDayMonth,
+			DayOf:        &dayOf,
+		},
+		{
+			ID:             2,
+			Transaction:    Transaction{AccountID: 1, Amount: -10000, Date: time.Date(2017, time.January, 3, 0, 0, 0, 0, time.UTC)},
+			ScheduleType:   constants.FixedInterval,
+			SecondsBetween: &week,
+		},
+		{
+			ID:           3,
+			Transaction:  Transaction{AccountID: 1, Amount: -30000, Date: time.Date(2017, time.February, 1, 0, 0, 0, 0, time.UTC)},
+			ScheduleType: constants.FixedDayMonth,
+			DayOf:        &dayOf,
+		},
+	}
+	loan := Loan{AccountID: 2, PaymentAccountID: 1, AnnualRate: 12, Frequency: constants.LoanMonthly, Payment: 40000}
+	balances := map[int]int{1: 0, 2: -50000}
+
+	require.NoError(t, project(deltas, balances, recurring, map[int]Loan{3: loan}, nil, nil))
+	require.Equal(t, -20000, deltas.balance(1, start, balances[1]), "Recurring transactions that are due should count on the first day")
+	require.Equal(t, 80000, deltas.balance(1, time.Date(2017, time.January, 15, 0, 0, 0, 0, time.UTC), balances[1]))
+	require.Equal(t, -10500, deltas.balance(2, time.Date(2017, time.February, 1, 0, 0, 0, 0, time.UTC), balances[2]), "Loan payments should pay down principal net of interest")
+	require.Equal(t, 0, deltas.balance(2, time.Date(2017, time.March, 11, 0, 0, 0, 0, time.UTC), balances[2]), "Loan payments should stop once the loan is paid off")
+	lastPayment := deltas.day(time.Date(2017, time.February, 15, 0, 0, 0, 0, time.UTC))
+	require.Equal(t, 10500, deltas.amounts[2][lastPayment])
+	require.Equal(t, 100000-10500-105, deltas.amounts[1][lastPayment], "The last loan payment should only pay what is owed")
+}
+
+func TestEachRunEnds(t *testing.T) {
+	week := 7 * 24 * 60 * 60
+	recurring := RecurringTransaction{
+		Transaction:    Transaction{Date: time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)},
+		ScheduleType:   constants.FixedInterval,
+		SecondsBetween: &week,
+	}
+
+	runs := func(recurring RecurringTransaction) int {
+		count := 0
+		err := eachRun(recurring, nil, nil, func(date time.Time, _ Transaction) bool {
+			count++
+			return count < 100
+		})
+		require.NoError(t, err)
+		return count
+	}
+
+	maxOccurrences := 6
+	counted := recurring
+	counted.MaxOccurrences = &maxOccurrences
+	counted.Occurrences = 2
+	require.Equal(t, 4, runs(counted), "Occurrences already posted should count towards the maximum")
+
+	endDate := time.Date(2017, time.January, 29, 0, 0, 0, 0, time.UTC)
+	dated := recurring
+	dated.EndDate = &endDate
+	require.Equal(t, 5, runs(dated), "A run on the end date should still happen")
+
+	require.Equal(t, 100, runs(recurring))
+}
+
+func TestProjectExceptions(t *testing.T) {
+	start := time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+	deltas := newDailyDeltas(start, 120)
+	dayOf := 15
+	maxOccurrences := 2
+	recurring := RecurringTransaction{
+		ID:             1,
+		Transaction:    Transaction{AccountID: 1, Amount: -1000, Date: time.Date(2017, time.January, 15, 0, 0, 0, 0, time.UTC)},
+		ScheduleType:   constants.FixedDayMonth,
+		DayOf:          &dayOf,
+		MaxOccurrences: &maxOccurrences,
+	}
+
+	moveTo := time.Date(2017, time.February, 20, 0, 0, 0, 0, time.UTC)
+	amount := -2500
+	exceptions := exceptionsByRecurring([]RecurringException{
+		{RecurringTransactionID: 1, Date: time.Date(2017, time.January, 15, 0, 0, 0, 0, time.UTC), Skip: true},
+		{RecurringTransactionID: 1, Date: time.Date(2017, time.February, 15, 0, 0, 0, 0, time.UTC), MoveTo: &moveTo, Amount: &amount},
+	})
+
+	require.NoError(t, project(deltas, map[int]int{1: 0}, []RecurringTransaction{recurring}, nil, nil, exceptions))
+	require.Equal(t, 0, deltas.balance(1, time.Date(2017, time.February, 19, 0, 0, 0, 0, time.UTC), 0), "Skipped runs should not post")
+	require.Equal(t, -2500, deltas.balance(1, time.Date(2017, time.February, 20, 0, 0, 0, 0, time.UTC), 0), "Moved runs should post on the day they are moved to")
+	require.Equal(t, -3500, deltas.balance(1, time.Date(2017, time.April, 30, 0, 0, 0, 0, time.UTC), 0), "Skipped runs should not count towards the maximum occurrences")
+}
+
+func TestProjectMovedRuns(t *testing.T) {
+	start := time.Date(2017, time.February, 1, 0, 0, 0, 0, time.UTC)
+	deltas := newDailyDeltas(start, 60)
+	dayOf := 15
+	recurring := RecurringTransaction{
+		ID:           1,
+		Transaction:  Transaction{AccountID: 1, Amount: -1000, Date: time.Date(2017, time.February, 15, 0, 0, 0, 0, time.UTC)},
+		ScheduleType: constants.FixedDayMonth,
+		DayOf:        &dayOf,
+	}
+
+	pendingMoveTo := time.Date(2017, time.February, 20, 0, 0, 0, 0, time.UTC)
+	postedMoveTo := time.Date(2017, time.January, 30, 0, 0, 0, 0, time.UTC)
+	exceptions := exceptionsByRecurring([]RecurringException{
+		{RecurringTransactionID: 1, Date: time.Date(2017, time.January, 15, 0, 0, 0, 0, time.UTC), MoveTo: &pendingMoveTo},
+		{RecurringTransactionID: 1, Date: time.Date(2017, time.March, 15, 0, 0, 0, 0, time.UTC), MoveTo: &postedMoveTo, Posted: true},
+	})
+
+	require.NoError(t, project(deltas, map[int]int{1: 0}, []RecurringTransaction{recurring}, nil, nil, exceptions))
+	require.Equal(t, -1000, deltas.balance(1, time.Date(2017, time.February, 15, 0, 0, 0, 0, time.UTC), 0), "Runs after a moved run should not be held back")
+	require.Equal(t, -2000, deltas.balance(1, time.Date(2017, time.February, 20, 0, 0, 0, 0, time.UTC), 0), "Moved runs that have yet to post should post on the day they are moved to")
+	require.Equal(t, -2000, deltas.balance(1, time.Date(2017, time.March, 31, 0, 0, 0, 0, time.UTC), 0), "Moved runs that have already posted should not post again")
+}
@@ -0,0 +1,655 @@
+package transaction
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+const loanColumns = "account_id, principal, annual_rate, term_months, frequency, start_date, payment_account_id, interest_category, payment, recurring_transaction_id"
+
+// Loan is the terms of a loan account. The loan is paid off by a recurring transaction in the paying account,
+// which posts each payment as a transfer of principal to the loan account and an interest expense.
+// The annual rate is a percentage, and the first payment is one period after the start date.
+type Loan struct {
+	AccountID              int       `json:"accountId"`
+	Principal              int       `json:"principal"`
+	AnnualRate             float64   `json:"annualRate"`
+	TermMonths             int       `json:"termMonths"`
+	Frequency              string    `json:"frequency"`
+	StartDate              time.Time `json:"startDate"`
+	PaymentAccountID       int       `json:"paymentAccountId"`
+	InterestCategory       string    `json:"interestCategory"`
+	Payment                int       `json:"payment"`
+	RecurringTransactionID int       `json:"recurringTransactionId,omitempty"`
+}
+
+// ScheduledPayment is a payment in an amortization schedule, along with the balance owed after it
+type ScheduledPayment struct {
+	Number    int       `json:"number"`
+	Date      time.Time `json:"date"`
+	Payment   int       `json:"payment"`
+	Principal int       `json:"principal"`
+	Interest  int       `json:"interest"`
+	Balance   int       `json:"balance"`
+}
+
+// Amortization is the schedule of a loan as agreed, and the remaining schedule from what is owed now.
+// Extra principal payments shorten the remaining schedule.
+type Amortization struct {
+	Loan      Loan               `json:"loan"`
+	Owed      int                `json:"owed"`
+	Original  []ScheduledPayment `json:"original"`
+	Remaining []ScheduledPayment `json:"remaining"`
+}
+
+type loanDB struct {
+	AccountID              int
+	Principal              int
+	AnnualRate             float64
+	TermMonths             int
+	Frequency              string
+	StartDate              time.Time
+	PaymentAccountID       int
+	InterestCategory       string
+	Payment                int
+	RecurringTransactionID sql.NullInt64
+}
+
+// GetLoan fetches the terms of a loan account
+func GetLoan(c context.Context, accountID int) (Loan, error) {
+	valid, err := util.UserOwnsAccount(c, accountID)
+	if err != nil || !valid {
+		return Loan{}, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return Loan{}, err
+	}
+
+	loan, err := scanLoan(db.QueryRow("SELECT "+loanColumns+" FROM loans WHERE account_id = $1", accountID))
+	if err == sql.ErrNoRows {
+		return Loan{}, constants.ErrBadRequest
+	} else if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"accountId": accountID,
+		}).Error("failed to fetch loan")
+		return Loan{}, err
+	}
+
+	return loan, nil
+}
+
+// GetAllLoans queries for all loans
+func GetAllLoans(c context.Context) ([]Loan, error) {
+	if !util.IsAdminRequest(c) {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT " + loanColumns + " FROM loans")
+	if err != nil {
+		logrus.WithError(err).Error("failed to fetch all loans")
+		return nil, err
+	}
+
+	return scanLoans(rows)
+}
+
+// GetAllLoansForUser queries for all loans of the user in the context
+func GetAllLoansForUser(c context.Context) ([]Loan, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query("SELECT l."+loanColumns+" FROM loans l JOIN accounts a ON l.account_id = a.id WHERE a.user_id = $1", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch loans for user")
+		return nil, err
+	}
+
+	return scanLoans(rows)
+}
+
+// NewLoan sets the terms of a loan account. The account becomes a loan account that opens owing the principal
+// on the start date, and a recurring transaction is created in the paying account to make the payments.
+func NewLoan(c context.Context, loan *Loan) (*Loan, error) {
+	if err := validateLoan(c, loan); err != nil {
+		return nil, err
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when creating loan")
+		return nil, err
+	}
+	ctx := context.WithValue(c, constants.CtxDB, txn)
+
+	var name string
+	err = txn.QueryRow("UPDATE accounts SET type = $1, opening_balance = $2, opening_date = $3 WHERE id = $4 RETURNING name", constants.AccountLoan, -loan.Principal, loan.StartDate, loan.AccountID).Scan(&name)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"loan":  loan,
+		}).Error("failed to update account of loan")
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	recurring, err := loanRecurring(*loan, name)
+	if err != nil {
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	if _, err := NewRecurring(ctx, &recurring); err != nil {
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+	loan.RecurringTransactionID = recurring.ID
+
+	if err := insertLoan(txn, *loan); err != nil {
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	if err := commit(); err != nil {
+		logrus.WithError(err).Error("unable to commit creating loan")
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	return loan, nil
+}
+
+// DeleteLoan deletes the terms of a loan account along with the recurring transaction that makes its payments.
+// Payments that have already been posted are kept.
+func DeleteLoan(c context.Context, accountID int) error {
+	loan, err := GetLoan(c, accountID)
+	if err != nil {
+		return err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	if _, err := db.Exec("DELETE FROM loans WHERE account_id = $1", accountID); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"accountId": accountID,
+		}).Error("could not delete loan")
+		return err
+	}
+
+	if loan.RecurringTransactionID != 0 {
+		return DeleteRecurring(c, loan.RecurringTransactionID)
+	}
+
+	return nil
+}
+
+// GetAmortization computes the amortization schedule of a loan account
+func GetAmortization(c context.Context, accountID int) (Amortization, error) {
+	loan, err := GetLoan(c, accountID)
+	if err != nil {
+		return Amortization{}, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return Amortization{}, err
+	}
+
+	recurring, err := loanRecurring(loan, "")
+	if err != nil {
+		return Amortization{}, err
+	}
+
+	amortization := Amortization{
+		Loan:      loan,
+		Original:  amortize(loan, loan.Principal, recurring),
+		Remaining: []ScheduledPayment{},
+	}
+
+	amortization.Owed, err = loanOwed(db, accountID, time.Now())
+	if err != nil {
+		return Amortization{}, err
+	}
+
+	// loans without a recurring transaction are not paid automatically any more
+	if loan.RecurringTransactionID == 0 {
+		return amortization, nil
+	}
+
+	// the payments that are left start at the next payment, from whatever is owed by then
+	var next time.Time
+	var completed bool
+	if err := db.QueryRow("SELECT next_occurs, completed FROM recurring_transactions WHERE id = $1", loan.RecurringTransactionID).Scan(&next, &completed); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"loan":  loan,
+		}).Error("failed to fetch next payment of loan")
+		return Amortization{}, err
+	}
+
+	// a completed recurring transaction has made its last payment, usually because the loan was paid off
+	if completed {
+		return amortization, nil
+	}
+
+	owedAtNext, err := loanOwed(db, accountID, next)
+	if err != nil {
+		return Amortization{}, err
+	}
+
+	recurring.Transaction.Date = next
+	amortization.Remaining = amortize(loan, owedAtNext, recurring)
+
+	return amortization, nil
+}
+
+// BatchImportLoans batch imports loans
+func BatchImportLoans(c context.Context, loans []Loan) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when batch inserting loans")
+		return err
+	}
+
+	stmt, err := txn.Prepare(pq.CopyIn("loans", "account_id", "principal", "annual_rate", "term_months", "frequency", "start_date", "payment_account_id", "interest_category", "payment", "recurring_transaction_id"))
+	if err != nil {
+		logrus.WithError(err).Error("unable to prepare statement when batch inserting loans")
+		return err
+	}
+
+	for _, loan := range loans {
+		ldb := loanToDB(loan)
+		_, err = stmt.Exec(ldb.AccountID, ldb.Principal, ldb.AnnualRate, ldb.TermMonths, ldb.Frequency, ldb.StartDate, ldb.PaymentAccountID, ldb.InterestCategory, ldb.Payment, ldb.RecurringTransactionID)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"loan":  loan,
+			}).Error("unable to exec statement when batch inserting loans")
+			return err
+		}
+	}
+
+	if _, err := stmt.Exec(); err != nil {
+		logrus.WithError(err).Error("unable to exec final statement when batch inserting loans")
+		return err
+	}
+
+	if err := stmt.Close(); err != nil {
+		logrus.WithError(err).Error("unable to close statement when batch inserting loans")
+		return err
+	}
+
+	if err := commit(); err != nil {
+		logrus.WithError(err).Error("unable to commit when batch inserting loans")
+		return err
+	}
+
+	return nil
+}
+
+// ImportLoansForUser inserts loans under accounts of the user in the context. accountIDs and recurringIDs map
+// the ids in the import to the ids of the user's accounts and recurring transactions.
+func ImportLoansForUser(c context.Context, loans []Loan, accountIDs, recurringIDs map[int]int) error {
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	for _, loan := range loans {
+		accountID, accountOK := accountIDs[loan.AccountID]
+		paymentAccountID, paymentOK := accountIDs[loan.PaymentAccountID]
+		if !accountOK || !paymentOK {
+			logrus.WithField("loan", loan).Error("imported loan belongs to an account that is not in the import")
+			return constants.ErrBadRequest
+		}
+
+		loan.AccountID = accountID
+		loan.PaymentAccountID = paymentAccountID
+		loan.RecurringTransactionID = recurringIDs[loan.RecurringTransactionID]
+		if err := validateLoan(c, &loan); err != nil {
+			return err
+		}
+
+		if err := insertLoan(db, loan); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loanForRecurring finds the loan that a recurring transaction pays, if any
+func loanForRecurring(db util.DB, recurringID int) (*Loan, error) {
+	loan, err := scanLoan(db.QueryRow("SELECT "+loanColumns+" FROM loans WHERE recurring_transaction_id = $1", recurringID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":                  err,
+			"recurringTransactionId": recurringID,
+		}).Error("failed to fetch loan of recurring transaction")
+		return nil, err
+	}
+
+	return &loan, nil
+}
+
+// postLoanPayment posts a payment of a loan on the date of the recurring transaction that pays it,
+// split into the interest accrued on what is owed and the principal that the rest pays off.
+// It returns whether the loan has been paid off.
+func postLoanPayment(ctx context.Context, loan Loan, recurring RecurringTransaction, userID uint) (bool, error) {
+	db, err := util.DBFromContext(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	owed, err := loanOwed(db, loan.AccountID, recurring.Transaction.Date)
+	if err != nil {
+		return false, err
+	}
+
+	if owed <= 0 {
+		return true, nil
+	}
+
+	principal, interest := splitPayment(loan, owed)
+	payment := recurring.Transaction
+
+	if interest > 0 {
+		payment.Category = loan.InterestCategory
+		payment.Amount = -interest
+		if _, err := newWithoutVerifyingAccountOwnership(ctx, &payment, userID); err != nil {
+			return false, err
+		}
+	}
+
+	if principal > 0 {
+		// the principal is a transfer, so it is recorded in both accounts and the two are related
+		received := payment
+		received.Category = constants.LoanPaymentCategory
+		received.Amount = principal
+		received.AccountID = loan.AccountID
+		if _, err := newWithoutVerifyingAccountOwnership(ctx, &received, userID); err != nil {
+			return false, err
+		}
+
+		paid := payment
+		paid.Category = constants.LoanPaymentCategory
+		paid.Amount = -principal
+		paid.RelatedTransactionID = received.ID
+		if _, err := newWithoutVerifyingAccountOwnership(ctx, &paid, userID); err != nil {
+			return false, err
+		}
+
+		received.RelatedTransactionID = paid.ID
+		if _, err := updateWithoutVerifyingAccountOwnership(ctx, &received, userID); err != nil {
+			return false, err
+		}
+	}
+
+	return principal >= owed, nil
+}
+
+// loanOwed returns what is owed on a loan account on a date
+func loanOwed(db util.DB, accountID int, on time.Time) (int, error) {
+	var owed int
+	err := db.QueryRow("SELECT -(a.opening_balance + COALESCE(SUM(t.amount), 0)) FROM accounts a LEFT JOIN transactions t ON t.account_id = a.id AND t.occurred <= $2 WHERE a.id = $1 GROUP BY a.id", accountID, on).Scan(&owed)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":     err,
+			"accountId": accountID,
+			"on":        on,
+		}).Error("failed to compute balance owed on loan")
+		return 0, err
+	}
+
+	return owed, nil
+}
+
+// amortize schedules the payments that pay off a balance owed on a loan, starting on the date of the recurring
+// transaction that pays it
+func amortize(loan Loan, owed int, recurring RecurringTransaction) []ScheduledPayment {
+	schedule := []ScheduledPayment{}
+	// if the payment does not cover the interest the loan is never paid off, so stop well after the term would have ended
+	maxPayments := 2 * numPayments(loan)
+	for owed > 0 && len(schedule) < maxPayments {
+		principal, interest := splitPayment(loan, owed)
+		owed -= principal
+		schedule = append(schedule, ScheduledPayment{
+			Number:    len(schedule) + 1,
+			Date:      recurring.Transaction.Date,
+			Payment:   principal + interest,
+			Principal: principal,
+			Interest:  interest,
+			Balance:   owed,
+		})
+
+		next, err := getNextRun(&recurring, false, nil)
+		if err != nil {
+			break
+		}
+		recurring.Transaction.Date = next
+	}
+
+	return schedule
+}
+
+// splitPayment splits a payment of a loan into the interest accrued on what is owed and the principal it pays off.
+// The last payment only pays off what is left.
+func splitPayment(loan Loan, owed int) (int, int) {
+	interest := int(math.Round(float64(owed) * periodicRate(loan)))
+	principal := loan.Payment - interest
+	if principal > owed {
+		principal = owed
+	}
+	return principal, interest
+}
+
+// paymentAmount is the fixed payment that pays off a loan over its term, rounded up so that the last payment is never larger
+func paymentAmount(loan Loan) int {
+	n := float64(numPayments(loan))
+	rate := periodicRate(loan)
+	if rate == 0 {
+		return int(math.Ceil(float64(loan.Principal) / n))
+	}
+	return int(math.Ceil(float64(loan.Principal) * rate / (1 - math.Pow(1+rate, -n))))
+}
+
+func periodicRate(loan Loan) float64 {
+	return loan.AnnualRate / 100 / float64(constants.LoanFrequencies[loan.Frequency])
+}
+
+func numPayments(loan Loan) int {
+	return int(math.Ceil(float64(loan.TermMonths*constants.LoanFrequencies[loan.Frequency]) / 12))
+}
+
+// loanRecurring builds the recurring transaction that pays a loan, starting with the first payment
+func loanRecurring(loan Loan, name string) (RecurringTransaction, error) {
+	recurring := RecurringTransaction{
+		Transaction: Transaction{
+			Name:      fmt.Sprintf("Payment for %s", name),
+			Date:      loan.StartDate,
+			Category:  constants.LoanPaymentCategory,
+			Amount:    -loan.Payment,
+			AccountID: loan.PaymentAccountID,
+		},
+	}
+
+	switch loan.Frequency {
+	case constants.LoanMonthly:
+		day := loan.StartDate.Day()
+		recurring.ScheduleType = constants.FixedDayMonth
+		recurring.DayOf = &day
+	case constants.LoanBiweekly, constants.LoanWeekly:
+		weeks := 1
+		if loan.Frequency == constants.LoanBiweekly {
+			weeks = 2
+		}
+		seconds := weeks * int(7*24*time.Hour/time.Second)
+		recurring.ScheduleType = constants.FixedInterval
+		recurring.SecondsBetween = &seconds
+	default:
+		return RecurringTransaction{}, constants.ErrBadRequest
+	}
+
+	first, err := getNextRun(&recurring, false, nil)
+	if err != nil {
+		return RecurringTransaction{}, err
+	}
+	recurring.Transaction.Date = first
+
+	return recurring, nil
+}
+
+// validateLoan checks the terms of a loan and computes its payment
+func validateLoan(c context.Context, loan *Loan) error {
+	if loan.Principal <= 0 || loan.AnnualRate < 0 || loan.TermMonths <= 0 || loan.StartDate.IsZero() || loan.AccountID == loan.PaymentAccountID {
+		return constants.ErrBadRequest
+	}
+
+	if _, valid := constants.LoanFrequencies[loan.Frequency]; !valid {
+		return constants.ErrBadRequest
+	}
+
+	for _, accountID := range []int{loan.AccountID, loan.PaymentAccountID} {
+		valid, err := util.UserOwnsAccount(c, accountID)
+		if err != nil || !valid {
+			return constants.ErrForbidden
+		}
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	var currencies int
+	err = db.QueryRow("SELECT COUNT(DISTINCT currency) FROM accounts WHERE id IN ($1, $2)", loan.AccountID, loan.PaymentAccountID).Scan(&currencies)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"loan":  loan,
+		}).Error("failed to check currencies of loan accounts")
+		return err
+	}
+
+	// payments move the same amount in both accounts
+	if currencies != 1 {
+		return constants.ErrInvalidCurrency
+	}
+
+	if loan.InterestCategory == "" {
+		loan.InterestCategory = constants.DefaultInterestCategory
+	}
+	loan.Payment = paymentAmount(*loan)
+
+	return nil
+}
+
+func insertLoan(db util.DB, loan Loan) error {
+	ldb := loanToDB(loan)
+	_, err := db.Exec("INSERT INTO loans("+loanColumns+") VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)", ldb.AccountID, ldb.Principal, ldb.AnnualRate, ldb.TermMonths, ldb.Frequency, ldb.StartDate, ldb.PaymentAccountID, ldb.InterestCategory, ldb.Payment, ldb.RecurringTransactionID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"loan":  loan,
+		}).Error("failed to insert loan row")
+		return err
+	}
+
+	return nil
+}
+
+func scanLoan(row *sql.Row) (Loan, error) {
+	var ldb loanDB
+	if err := row.Scan(&ldb.AccountID, &ldb.Principal, &ldb.AnnualRate, &ldb.TermMonths, &ldb.Frequency, &ldb.StartDate, &ldb.PaymentAccountID, &ldb.InterestCategory, &ldb.Payment, &ldb.RecurringTransactionID); err != nil {
+		return Loan{}, err
+	}
+
+	return loanFromDB(ldb), nil
+}
+
+func scanLoans(rows *sql.Rows) ([]Loan, error) {
+	defer rows.Close()
+
+	loans := []Loan{}
+	for rows.Next() {
+		var ldb loanDB
+		if err := rows.Scan(&ldb.AccountID, &ldb.Principal, &ldb.AnnualRate, &ldb.TermMonths, &ldb.Frequency, &ldb.StartDate, &ldb.PaymentAccountID, &ldb.InterestCategory, &ldb.Payment, &ldb.RecurringTransactionID); err != nil {
+			logrus.WithError(err).Error("failed to scan into loan")
+			return nil, err
+		}
+
+		loans = append(loans, loanFromDB(ldb))
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("failed to get loans from rows")
+		return nil, err
+	}
+
+	return loans, nil
+}
+
+func loanToDB(loan Loan) loanDB {
+	return loanDB{
+		AccountID:              loan.AccountID,
+		Principal:              loan.Principal,
+		AnnualRate:             loan.AnnualRate,
+		TermMonths:             loan.TermMonths,
+		Frequency:              loan.Frequency,
+		StartDate:              loan.StartDate,
+		PaymentAccountID:       loan.PaymentAccountID,
+		InterestCategory:       loan.InterestCategory,
+		Payment:                loan.Payment,
+		RecurringTransactionID: util.ToNullIntNonZero(loan.RecurringTransactionID),
+	}
+}
+
+func loanFromDB(loan loanDB) Loan {
+	return Loan{
+		AccountID:              loan.AccountID,
+		Principal:              loan.Principal,
+		AnnualRate:             loan.AnnualRate,
+		TermMonths:             loan.TermMonths,
+		Frequency:              loan.Frequency,
+		StartDate:              loan.StartDate,
+		PaymentAccountID:       loan.PaymentAccountID,
+		InterestCategory:       loan.InterestCategory,
+		Payment:                loan.Payment,
+		RecurringTransactionID: util.FromNullIntNonZero(loan.RecurringTransactionID),
+	}
+}
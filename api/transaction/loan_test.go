@@ -0,0 +1,48 @@
+// +build integration
+
+package transaction
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/financejc/constants"
+)
+
+func TestAmortize(t *testing.T) {
+	loan := Loan{
+		Principal:  100000,
+		AnnualRate: 12,
+		TermMonths: 12,
+		Frequency:  constants.LoanMonthly,
+		StartDate:  time.Date(2017, time.January, 31, 0, 0, 0, 0, time.UTC),
+	}
+	loan.Payment = paymentAmount(loan)
+	require.Equal(t, 8885, loan.Payment, "Payment should be rounded up to the cent")
+
+	recurring, err := loanRecurring(loan, "Car")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2017, time.February, 28, 0, 0, 0, 0, time.UTC), recurring.Transaction.Date, "First payment should be a month after the start")
+
+	schedule := amortize(loan, loan.Principal, recurring)
+	require.Len(t, schedule, 12)
+	require.Equal(t, 1000, schedule[0].Interest, "First month should accrue a month of interest on the principal")
+	require.Equal(t, 7885, schedule[0].Principal)
+	require.Equal(t, time.Date(2017, time.March, 31, 0, 0, 0, 0, time.UTC), schedule[1].Date, "Payments should stay on the day of the start")
+
+	last := schedule[len(schedule)-1]
+	require.Equal(t, 0, last.Balance, "Last payment should pay off the loan")
+	require.True(t, last.Payment <= loan.Payment, "Last payment should not be larger than the others")
+
+	principal := 0
+	for _, payment := range schedule {
+		principal += payment.Principal
+	}
+	require.Equal(t, loan.Principal, principal, "Principal payments should add up to the principal")
+
+	// an extra payment of half the principal after the first payment leaves fewer payments
+	remaining := amortize(loan, schedule[0].Balance-50000, recurring)
+	require.Len(t, remaining, 5)
+}
@@ -9,18 +9,30 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/lib/pq"
 
+	"github.com/jchorl/financejc/api/holiday"
+	"github.com/jchorl/financejc/api/rrule"
 	"github.com/jchorl/financejc/api/util"
 	"github.com/jchorl/financejc/constants"
 )
 
-// RecurringTransaction is a template for a transaction that gets automatically generated
+// RecurringTransaction is a template for a transaction that gets automatically generated.
+// It stops generating after its end date or once it has posted its maximum number of occurrences, and is then completed.
+// Runs that fall on a weekend or holiday are moved to a business day by its business day adjustment. Scheduled is
+// the date of the next run before it was moved, which the schedule carries on from.
 type RecurringTransaction struct {
-	ID                  int         `json:"id,omitempty"`
-	Transaction         Transaction `json:"transaction"`
-	ScheduleType        string      `json:"scheduleType"`
-	SecondsBetween      *int        `json:"secondsBetween"`
-	DayOf               *int        `json:"dayOf"`
-	SecondsBeforeToPost int         `json:"secondsBeforeToPost"`
+	ID                    int         `json:"id,omitempty"`
+	Transaction           Transaction `json:"transaction"`
+	ScheduleType          string      `json:"scheduleType"`
+	SecondsBetween        *int        `json:"secondsBetween"`
+	DayOf                 *int        `json:"dayOf"`
+	RRule                 *string     `json:"rrule"`
+	SecondsBeforeToPost   int         `json:"secondsBeforeToPost"`
+	EndDate               *time.Time  `json:"endDate"`
+	MaxOccurrences        *int        `json:"maxOccurrences"`
+	Occurrences           int         `json:"occurrences"`
+	Completed             bool        `json:"completed"`
+	BusinessDayAdjustment string      `json:"businessDayAdjustment"`
+	Scheduled             *time.Time  `json:"scheduled"`
 }
 
 type recurringTransactionDB struct {
@@ -32,10 +44,17 @@ type recurringTransactionDB struct {
 	Note       string
 	AccountID  int
 
-	ScheduleType        string
-	SecondsBetween      sql.NullInt64
-	DayOf               sql.NullInt64
-	SecondsBeforeToPost int
+	ScheduleType          string
+	SecondsBetween        sql.NullInt64
+	DayOf                 sql.NullInt64
+	RRule                 sql.NullString
+	SecondsBeforeToPost   int
+	EndDate               pq.NullTime
+	MaxOccurrences        sql.NullInt64
+	Occurrences           int
+	Completed             bool
+	BusinessDayAdjustment sql.NullString
+	Scheduled             pq.NullTime
 }
 
 // GenRecurringTransactions generates transactions from recurring transactions
@@ -101,7 +120,7 @@ func GetRecurring(c context.Context, accountID int) ([]RecurringTransaction, err
 		return transactions, constants.ErrForbidden
 	}
 
-	rows, err := db.Query("SELECT id, name, next_occurs, category, amount, note, account_id, schedule_type, seconds_between, day_of, seconds_before_to_post FROM recurring_transactions WHERE account_id = $1", accountID)
+	rows, err := db.Query("SELECT id, name, next_occurs, category, amount, note, account_id, schedule_type, seconds_between, day_of, rrule, seconds_before_to_post, end_date, max_occurrences, occurrences, completed, business_day_adjustment, scheduled FROM recurring_transactions WHERE account_id = $1", accountID)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error":     err,
@@ -113,7 +132,7 @@ func GetRecurring(c context.Context, accountID int) ([]RecurringTransaction, err
 
 	for rows.Next() {
 		var transaction recurringTransactionDB
-		if err := rows.Scan(&transaction.ID, &transaction.Name, &transaction.NextOccurs, &transaction.Category, &transaction.Amount, &transaction.Note, &transaction.AccountID, &transaction.ScheduleType, &transaction.SecondsBetween, &transaction.DayOf, &transaction.SecondsBeforeToPost); err != nil {
+		if err := rows.Scan(&transaction.ID, &transaction.Name, &transaction.NextOccurs, &transaction.Category, &transaction.Amount, &transaction.Note, &transaction.AccountID, &transaction.ScheduleType, &transaction.SecondsBetween, &transaction.DayOf, &transaction.RRule, &transaction.SecondsBeforeToPost, &transaction.EndDate, &transaction.MaxOccurrences, &transaction.Occurrences, &transaction.Completed, &transaction.BusinessDayAdjustment, &transaction.Scheduled); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error":     err,
 				"accountId": accountID,
@@ -146,7 +165,7 @@ func GetAllRecurring(c context.Context) ([]RecurringTransaction, error) {
 	}
 
 	recurringTransactions := []RecurringTransaction{}
-	rows, err := db.Query("SELECT id, name, next_occurs, category, amount, note, account_id, schedule_type, seconds_between, day_of, seconds_before_to_post FROM recurring_transactions")
+	rows, err := db.Query("SELECT id, name, next_occurs, category, amount, note, account_id, schedule_type, seconds_between, day_of, rrule, seconds_before_to_post, end_date, max_occurrences, occurrences, completed, business_day_adjustment, scheduled FROM recurring_transactions")
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error": err,
@@ -157,7 +176,7 @@ func GetAllRecurring(c context.Context) ([]RecurringTransaction, error) {
 
 	for rows.Next() {
 		var recurringTransaction recurringTransactionDB
-		if err := rows.Scan(&recurringTransaction.ID, &recurringTransaction.Name, &recurringTransaction.NextOccurs, &recurringTransaction.Category, &recurringTransaction.Amount, &recurringTransaction.Note, &recurringTransaction.AccountID, &recurringTransaction.ScheduleType, &recurringTransaction.SecondsBetween, &recurringTransaction.DayOf, &recurringTransaction.SecondsBeforeToPost); err != nil {
+		if err := rows.Scan(&recurringTransaction.ID, &recurringTransaction.Name, &recurringTransaction.NextOccurs, &recurringTransaction.Category, &recurringTransaction.Amount, &recurringTransaction.Note, &recurringTransaction.AccountID, &recurringTransaction.ScheduleType, &recurringTransaction.SecondsBetween, &recurringTransaction.DayOf, &recurringTransaction.RRule, &recurringTransaction.SecondsBeforeToPost, &recurringTransaction.EndDate, &recurringTransaction.MaxOccurrences, &recurringTransaction.Occurrences, &recurringTransaction.Completed, &recurringTransaction.BusinessDayAdjustment, &recurringTransaction.Scheduled); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
 			}).Error("failed to scan into recurringTransaction")
@@ -176,24 +195,65 @@ func GetAllRecurring(c context.Context) ([]RecurringTransaction, error) {
 	return recurringTransactions, nil
 }
 
+// GetAllRecurringForUser queries for all recurring transactions of the user in the context
+func GetAllRecurringForUser(c context.Context) ([]RecurringTransaction, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	recurringTransactions := []RecurringTransaction{}
+	rows, err := db.Query("SELECT r.id, r.name, r.next_occurs, r.category, r.amount, r.note, r.account_id, r.schedule_type, r.seconds_between, r.day_of, r.rrule, r.seconds_before_to_post, r.end_date, r.max_occurrences, r.occurrences, r.completed, r.business_day_adjustment, r.scheduled FROM recurring_transactions r JOIN accounts a ON r.account_id = a.id WHERE a.user_id = $1", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch all recurringTransactions for user")
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var recurringTransaction recurringTransactionDB
+		if err := rows.Scan(&recurringTransaction.ID, &recurringTransaction.Name, &recurringTransaction.NextOccurs, &recurringTransaction.Category, &recurringTransaction.Amount, &recurringTransaction.Note, &recurringTransaction.AccountID, &recurringTransaction.ScheduleType, &recurringTransaction.SecondsBetween, &recurringTransaction.DayOf, &recurringTransaction.RRule, &recurringTransaction.SecondsBeforeToPost, &recurringTransaction.EndDate, &recurringTransaction.MaxOccurrences, &recurringTransaction.Occurrences, &recurringTransaction.Completed, &recurringTransaction.BusinessDayAdjustment, &recurringTransaction.Scheduled); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"userId": userID,
+			}).Error("failed to scan into recurringTransaction")
+			return nil, err
+		}
+
+		recurringTransactions = append(recurringTransactions, recurringFromDB(recurringTransaction))
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to get all recurringTransactions for user from rows")
+		return nil, err
+	}
+
+	return recurringTransactions, nil
+}
+
 // BatchImportRecurringTransactions batch imports recurring transactions
 func BatchImportRecurringTransactions(c context.Context, recurringTransactions []RecurringTransaction) error {
 	if !util.IsAdminRequest(c) {
 		return constants.ErrForbidden
 	}
 
-	db, err := util.SQLDBFromContext(c)
-	if err != nil {
-		return err
-	}
-
-	txn, err := db.Begin()
+	txn, commit, err := util.TxFromContext(c)
 	if err != nil {
 		logrus.WithError(err).Error("unable to begin transaction when batch inserting recurringTransactions")
 		return err
 	}
 
-	stmt, err := txn.Prepare(pq.CopyIn("recurring_transactions", "id", "name", "next_occurs", "category", "amount", "note", "account_id", "schedule_type", "seconds_between", "day_of", "seconds_before_to_post"))
+	stmt, err := txn.Prepare(pq.CopyIn("recurring_transactions", "id", "name", "next_occurs", "category", "amount", "note", "account_id", "schedule_type", "seconds_between", "day_of", "rrule", "seconds_before_to_post", "end_date", "max_occurrences", "occurrences", "completed", "business_day_adjustment", "scheduled"))
 	if err != nil {
 		logrus.WithError(err).Error("unable to begin copy in when batch inserting recurringTransactions")
 		return err
@@ -201,7 +261,7 @@ func BatchImportRecurringTransactions(c context.Context, recurringTransactions [
 
 	for _, recurringTransaction := range recurringTransactions {
 		rdb := recurringToDB(recurringTransaction)
-		_, err = stmt.Exec(rdb.ID, rdb.Name, rdb.NextOccurs, rdb.Category, rdb.Amount, rdb.Note, rdb.AccountID, rdb.ScheduleType, rdb.SecondsBetween, rdb.DayOf, rdb.SecondsBeforeToPost)
+		_, err = stmt.Exec(rdb.ID, rdb.Name, rdb.NextOccurs, rdb.Category, rdb.Amount, rdb.Note, rdb.AccountID, rdb.ScheduleType, rdb.SecondsBetween, rdb.DayOf, rdb.RRule, rdb.SecondsBeforeToPost, rdb.EndDate, rdb.MaxOccurrences, rdb.Occurrences, rdb.Completed, rdb.BusinessDayAdjustment, rdb.Scheduled)
 		if err != nil {
 			logrus.WithError(err).Error("unable to exec recurringTransaction copy when batch inserting recurringTransactions")
 			return err
@@ -220,7 +280,7 @@ func BatchImportRecurringTransactions(c context.Context, recurringTransactions [
 		return err
 	}
 
-	err = txn.Commit()
+	err = commit()
 	if err != nil {
 		logrus.WithError(err).Error("unable to commit recurringTransaction copy when batch inserting recurringTransactions")
 		return err
@@ -229,6 +289,51 @@ func BatchImportRecurringTransactions(c context.Context, recurringTransactions [
 	return nil
 }
 
+// ImportRecurringForUser inserts recurring transactions under accounts of the user in the context, giving them fresh ids.
+// accountIDs maps the account ids in the import to ids of the user's accounts. It returns a map from the ids in the
+// import to the fresh ids.
+func ImportRecurringForUser(c context.Context, recurringTransactions []RecurringTransaction, accountIDs map[int]int) (map[int]int, error) {
+	for _, accountID := range accountIDs {
+		valid, err := util.UserOwnsAccount(c, accountID)
+		if err != nil || !valid {
+			return nil, constants.ErrForbidden
+		}
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	recurringIDs := map[int]int{}
+
+	for _, recurringTransaction := range recurringTransactions {
+		accountID, ok := accountIDs[recurringTransaction.Transaction.AccountID]
+		if !ok {
+			logrus.WithField("recurringTransaction", recurringTransaction).Error("imported recurring transaction belongs to an account that is not in the import")
+			return nil, constants.ErrBadRequest
+		}
+
+		if err := validateRecurringTransaction(recurringTransaction); err != nil {
+			return nil, err
+		}
+
+		tdb := recurringToDB(recurringTransaction)
+		var id int
+		err = db.QueryRow("INSERT INTO recurring_transactions(name, next_occurs, category, amount, note, account_id, schedule_type, seconds_between, day_of, rrule, seconds_before_to_post, end_date, max_occurrences, occurrences, completed, business_day_adjustment, scheduled) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17) RETURNING id", tdb.Name, tdb.NextOccurs, tdb.Category, tdb.Amount, tdb.Note, accountID, tdb.ScheduleType, tdb.SecondsBetween, tdb.DayOf, tdb.RRule, tdb.SecondsBeforeToPost, tdb.EndDate, tdb.MaxOccurrences, tdb.Occurrences, tdb.Completed, tdb.BusinessDayAdjustment, tdb.Scheduled).Scan(&id)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":                  err,
+				"recurringTransactionDB": tdb,
+			}).Error("failed to insert imported recurring transaction row")
+			return nil, err
+		}
+		recurringIDs[recurringTransaction.ID] = id
+	}
+
+	return recurringIDs, nil
+}
+
 // NewRecurring creates a new recurring transaction
 func NewRecurring(c context.Context, transaction *RecurringTransaction) (*RecurringTransaction, error) {
 	logrus.Debug("calling new recurring")
@@ -246,14 +351,21 @@ func NewRecurring(c context.Context, transaction *RecurringTransaction) (*Recurr
 		return nil, constants.ErrForbidden
 	}
 
-	transaction.Transaction.Date, err = getNextRun(transaction, true)
+	cal, err := calendarFor(db, *transaction)
+	if err != nil {
+		return nil, err
+	}
+
+	transaction.Transaction.Date, err = getNextRun(transaction, true, cal)
 	if err != nil {
 		return nil, err
 	}
+	transaction.Occurrences = 0
+	transaction.Completed = ended(*transaction)
 
 	tdb := recurringToDB(*transaction)
 	var id int
-	err = db.QueryRow("INSERT INTO recurring_transactions(name, next_occurs, category, amount, note, account_id, schedule_type, seconds_between, day_of, seconds_before_to_post) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id", tdb.Name, tdb.NextOccurs, tdb.Category, tdb.Amount, tdb.Note, tdb.AccountID, tdb.ScheduleType, tdb.SecondsBetween, tdb.DayOf, tdb.SecondsBeforeToPost).Scan(&id)
+	err = db.QueryRow("INSERT INTO recurring_transactions(name, next_occurs, category, amount, note, account_id, schedule_type, seconds_between, day_of, rrule, seconds_before_to_post, end_date, max_occurrences, occurrences, completed, business_day_adjustment, scheduled) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17) RETURNING id", tdb.Name, tdb.NextOccurs, tdb.Category, tdb.Amount, tdb.Note, tdb.AccountID, tdb.ScheduleType, tdb.SecondsBetween, tdb.DayOf, tdb.RRule, tdb.SecondsBeforeToPost, tdb.EndDate, tdb.MaxOccurrences, tdb.Occurrences, tdb.Completed, tdb.BusinessDayAdjustment, tdb.Scheduled).Scan(&id)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error":                  err,
@@ -267,24 +379,56 @@ func NewRecurring(c context.Context, transaction *RecurringTransaction) (*Recurr
 	return transaction, nil
 }
 
-// UpdateRecurring updates a recurring transaction
+// UpdateRecurring updates a recurring transaction. How many times it has posted and the date its next run was
+// scheduled for are only changed by posting, so they are kept from the stored recurring transaction.
 func UpdateRecurring(c context.Context, transaction *RecurringTransaction) (*RecurringTransaction, error) {
+	valid, err := userOwnsRecurringTransaction(c, transaction.ID)
+	if err != nil || !valid {
+		return nil, constants.ErrForbidden
+	}
+
+	// the recurring transaction can be moved to another account, as long as the user owns it too
+	valid, err = util.UserOwnsAccount(c, transaction.Transaction.AccountID)
+	if err != nil || !valid {
+		return nil, constants.ErrForbidden
+	}
+
 	db, err := util.DBFromContext(c)
 	if err != nil {
 		return nil, err
 	}
 
-	transaction.Transaction.Date, err = getNextRun(transaction, true)
+	stored, err := getRecurringByID(db, transaction.ID)
 	if err != nil {
 		return nil, err
 	}
+	transaction.Occurrences = stored.Occurrences
+	transaction.Scheduled = stored.Scheduled
 
+	return updateRecurring(db, transaction)
+}
+
+// updateRecurring writes every field of a recurring transaction, after moving it to its next run
+func updateRecurring(db util.DB, transaction *RecurringTransaction) (*RecurringTransaction, error) {
 	if err := validateRecurringTransaction(*transaction); err != nil {
 		return nil, err
 	}
 
+	cal, err := calendarFor(db, *transaction)
+	if err != nil {
+		return nil, err
+	}
+
+	transaction.Transaction.Date, err = getNextRun(transaction, true, cal)
+	if err != nil {
+		return nil, err
+	}
+
+	// a completed recurring transaction picks up again if its end is moved
+	transaction.Completed = ended(*transaction)
+
 	tdb := recurringToDB(*transaction)
-	_, err = db.Exec("UPDATE recurring_transactions SET name = $1, next_occurs = $2, category = $3, amount = $4, note = $5, account_id = $6, schedule_type = $7, seconds_between = $8, day_of = $9, seconds_before_to_post = $10 WHERE id = $11", tdb.Name, tdb.NextOccurs, tdb.Category, tdb.Amount, tdb.Note, tdb.AccountID, tdb.ScheduleType, tdb.SecondsBetween, tdb.DayOf, tdb.SecondsBeforeToPost, tdb.ID)
+	_, err = db.Exec("UPDATE recurring_transactions SET name = $1, next_occurs = $2, category = $3, amount = $4, note = $5, account_id = $6, schedule_type = $7, seconds_between = $8, day_of = $9, rrule = $10, seconds_before_to_post = $11, end_date = $12, max_occurrences = $13, occurrences = $14, completed = $15, business_day_adjustment = $16, scheduled = $17 WHERE id = $18", tdb.Name, tdb.NextOccurs, tdb.Category, tdb.Amount, tdb.Note, tdb.AccountID, tdb.ScheduleType, tdb.SecondsBetween, tdb.DayOf, tdb.RRule, tdb.SecondsBeforeToPost, tdb.EndDate, tdb.MaxOccurrences, tdb.Occurrences, tdb.Completed, tdb.BusinessDayAdjustment, tdb.Scheduled, tdb.ID)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error":                  err,
@@ -321,6 +465,21 @@ func DeleteRecurring(ctx context.Context, transactionID int) error {
 	return nil
 }
 
+// getRecurringByID fetches a recurring transaction
+func getRecurringByID(db util.DB, recurringTransactionID int) (RecurringTransaction, error) {
+	var tdb recurringTransactionDB
+	err := db.QueryRow("SELECT id, name, next_occurs, category, amount, note, account_id, schedule_type, seconds_between, day_of, rrule, seconds_before_to_post, end_date, max_occurrences, occurrences, completed, business_day_adjustment, scheduled FROM recurring_transactions WHERE id = $1", recurringTransactionID).Scan(&tdb.ID, &tdb.Name, &tdb.NextOccurs, &tdb.Category, &tdb.Amount, &tdb.Note, &tdb.AccountID, &tdb.ScheduleType, &tdb.SecondsBetween, &tdb.DayOf, &tdb.RRule, &tdb.SecondsBeforeToPost, &tdb.EndDate, &tdb.MaxOccurrences, &tdb.Occurrences, &tdb.Completed, &tdb.BusinessDayAdjustment, &tdb.Scheduled)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":                  err,
+			"recurringTransactionID": recurringTransactionID,
+		}).Error("failed to fetch recurring transaction")
+		return RecurringTransaction{}, err
+	}
+
+	return recurringFromDB(tdb), nil
+}
+
 func userOwnsRecurringTransaction(c context.Context, recurringTransaction int) (bool, error) {
 	userID, err := util.UserIDFromContext(c)
 	if err != nil {
@@ -347,6 +506,10 @@ func userOwnsRecurringTransaction(c context.Context, recurringTransaction int) (
 }
 
 func validateRecurringTransaction(tr RecurringTransaction) error {
+	if tr.MaxOccurrences != nil && *tr.MaxOccurrences < 1 || tr.Occurrences < 0 || !holiday.ValidAdjustment(tr.BusinessDayAdjustment) {
+		return constants.ErrBadRequest
+	}
+
 	switch tr.ScheduleType {
 	case constants.FixedInterval:
 		if tr.SecondsBetween != nil && *tr.SecondsBetween != 0 {
@@ -356,12 +519,62 @@ func validateRecurringTransaction(tr RecurringTransaction) error {
 		if tr.DayOf != nil {
 			return nil
 		}
+	case constants.RRule:
+		if tr.RRule == nil {
+			break
+		}
+
+		// rules are evaluated from the next run, so a count or until date could not be kept track of.
+		// maxOccurrences and endDate end a recurring transaction instead.
+		rule, err := rrule.Parse(*tr.RRule)
+		if err == nil && rule.Count == 0 && rule.Until.IsZero() {
+			return nil
+		}
 	}
 
 	return constants.ErrBadRequest
 }
 
-func getNextRun(tr *RecurringTransaction, allowSameDay bool) (time.Time, error) {
+// getNextRun returns the date of the run of a recurring transaction after its current one, or on it if allowSameDay
+// is set, moved to a business day of a holiday calendar by the business day adjustment. The schedule carries on from
+// the date the current run was scheduled for rather than the day it was moved to, so it does not drift, and Scheduled
+// is set to the date the next run was scheduled for if it was moved.
+func getNextRun(tr *RecurringTransaction, allowSameDay bool, cal holiday.Calendar) (time.Time, error) {
+	scheduled := *tr
+
+	// the scheduled date only still applies if the run has not been moved to another day since,
+	// even if the adjustment has changed
+	if tr.Scheduled != nil && movedTo(cal, *tr.Scheduled, tr.Transaction.Date) {
+		scheduled.Transaction.Date = *tr.Scheduled
+	}
+
+	next, err := getNextScheduledRun(&scheduled, allowSameDay)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	adjusted := cal.Adjust(next, tr.BusinessDayAdjustment)
+	tr.Scheduled = nil
+	if !adjusted.Equal(next) {
+		tr.Scheduled = &next
+	}
+
+	return adjusted, nil
+}
+
+// movedTo checks whether a business day adjustment moves a scheduled date to a date
+func movedTo(cal holiday.Calendar, scheduled, date time.Time) bool {
+	for _, adjustment := range []string{constants.AdjustPreceding, constants.AdjustFollowing, constants.AdjustModifiedFollowing} {
+		if cal.Adjust(scheduled, adjustment).Equal(date) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getNextScheduledRun returns the date of the run of a recurring transaction by its schedule alone
+func getNextScheduledRun(tr *RecurringTransaction, allowSameDay bool) (time.Time, error) {
 	switch tr.ScheduleType {
 	case constants.FixedInterval:
 		if allowSameDay {
@@ -432,6 +645,26 @@ func getNextRun(tr *RecurringTransaction, allowSameDay bool) (time.Time, error)
 		}
 
 		return newDate.Add(time.Hour * time.Duration(24*(desiredDay-newDate.YearDay()))), nil
+	case constants.RRule:
+		if tr.RRule == nil {
+			return time.Time{}, constants.ErrBadRequest
+		}
+
+		rule, err := rrule.Parse(*tr.RRule)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":                err,
+				"recurringTransaction": tr,
+			}).Error("unable to parse rrule of recurring transaction")
+			return time.Time{}, constants.ErrBadRequest
+		}
+
+		// the rule starts from the current run, so intervals are counted from the period it falls in
+		next, err := rule.Next(tr.Transaction.Date, tr.Transaction.Date, allowSameDay)
+		if err != nil {
+			return time.Time{}, constants.ErrBadRequest
+		}
+		return next, nil
 	}
 
 	err := fmt.Errorf("Unknown schedule type for recurring transaction: %s", tr.ScheduleType)
@@ -443,13 +676,15 @@ func getNextRun(tr *RecurringTransaction, allowSameDay bool) (time.Time, error)
 }
 
 func getRecurringToPost(db util.DB) ([]RecurringTransaction, []uint, error) {
-	// query for all recurring transactions where the next occurrance is within the time period before to post it to the account
+	// query for all recurring transactions where the next occurrance, or a run moved from its scheduled date, is within the time period before to post it to the account
 	rows, err := db.Query(
-		`SELECT r.id, r.name, r.next_occurs, r.category, r.amount, r.note, r.account_id, r.schedule_type, r.seconds_between, r.day_of, r.seconds_before_to_post, u.id
+		`SELECT r.id, r.name, r.next_occurs, r.category, r.amount, r.note, r.account_id, r.schedule_type, r.seconds_between, r.day_of, r.rrule, r.seconds_before_to_post, r.end_date, r.max_occurrences, r.occurrences, r.completed, r.business_day_adjustment, r.scheduled, u.id
 		FROM recurring_transactions r
 		INNER JOIN accounts a ON r.account_id = a.id
 		INNER JOIN users u ON a.user_id = u.id
-		WHERE r.next_occurs - interval '1 second' * r.seconds_before_to_post <= NOW()`,
+		WHERE (NOT r.completed AND r.next_occurs - interval '1 second' * r.seconds_before_to_post <= NOW())
+			OR EXISTS (SELECT 1 FROM recurring_exceptions e WHERE e.recurring_transaction_id = r.id AND NOT e.skip AND NOT e.posted
+				AND e.move_to - interval '1 second' * r.seconds_before_to_post <= NOW() AND (e.date < r.next_occurs OR NOT r.completed))`,
 	)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
@@ -464,7 +699,7 @@ func getRecurringToPost(db util.DB) ([]RecurringTransaction, []uint, error) {
 	for rows.Next() {
 		var transaction recurringTransactionDB
 		var userID uint
-		if err := rows.Scan(&transaction.ID, &transaction.Name, &transaction.NextOccurs, &transaction.Category, &transaction.Amount, &transaction.Note, &transaction.AccountID, &transaction.ScheduleType, &transaction.SecondsBetween, &transaction.DayOf, &transaction.SecondsBeforeToPost, &userID); err != nil {
+		if err := rows.Scan(&transaction.ID, &transaction.Name, &transaction.NextOccurs, &transaction.Category, &transaction.Amount, &transaction.Note, &transaction.AccountID, &transaction.ScheduleType, &transaction.SecondsBetween, &transaction.DayOf, &transaction.RRule, &transaction.SecondsBeforeToPost, &transaction.EndDate, &transaction.MaxOccurrences, &transaction.Occurrences, &transaction.Completed, &transaction.BusinessDayAdjustment, &transaction.Scheduled, &userID); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
 			}).Error("failed to scan into recurring transaction to generate transaction")
@@ -484,28 +719,126 @@ func getRecurringToPost(db util.DB) ([]RecurringTransaction, []uint, error) {
 	return recurringTransactions, userIDs, nil
 }
 
-func generateFromRecurringAndUpdateRecurring(ctx context.Context, recurringTransaction RecurringTransaction, userID uint) error {
-	// keep generating until it is too early to post the next transaction
-	now := time.Now()
-	for recurringTransaction.Transaction.Date.Add(time.Second * time.Duration(-recurringTransaction.SecondsBeforeToPost)).Before(now) {
-		if _, err := newWithoutVerifyingAccountOwnership(ctx, &recurringTransaction.Transaction, userID); err != nil {
+// postRun posts a single run of a recurring transaction, as a loan payment if the recurring transaction pays off a loan.
+// It returns whether the loan has been paid off.
+func postRun(ctx context.Context, loan *Loan, recurringTransaction RecurringTransaction, run Transaction, userID uint) (bool, error) {
+	if loan != nil {
+		payment := recurringTransaction
+		payment.Transaction = run
+		paidOff, err := postLoanPayment(ctx, *loan, payment, userID)
+		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error":                err,
 				"recurringTransaction": recurringTransaction,
-			}).Error("error adding a new transaction for a recurring transaction")
-			return err
+			}).Error("error posting a loan payment for a recurring transaction")
+			return false, err
+		}
+
+		return paidOff, nil
+	}
+
+	if _, err := newWithoutVerifyingAccountOwnership(ctx, &run, userID); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":                err,
+			"recurringTransaction": recurringTransaction,
+		}).Error("error adding a new transaction for a recurring transaction")
+		return false, err
+	}
+
+	return false, nil
+}
+
+func generateFromRecurringAndUpdateRecurring(ctx context.Context, recurringTransaction RecurringTransaction, userID uint) error {
+	db, err := util.DBFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	loan, err := loanForRecurring(db, recurringTransaction.ID)
+	if err != nil {
+		return err
+	}
+
+	cal, err := calendarFor(db, recurringTransaction)
+	if err != nil {
+		return err
+	}
+
+	exceptions, err := exceptionsFor(db, recurringTransaction.ID)
+	if err != nil {
+		return err
+	}
+
+	// generated transactions are linked back to the recurring transaction that posted them
+	recurringTransaction.Transaction.RecurringTransactionID = recurringTransaction.ID
+
+	now := time.Now()
+	due := func(date time.Time) bool {
+		return date.Add(time.Second * time.Duration(-recurringTransaction.SecondsBeforeToPost)).Before(now)
+	}
+
+	// keep generating until it is too early to post the next scheduled run, or the recurring transaction has ended.
+	// runs that have been moved are stepped past, and post on their own when their new date comes up.
+	for !ended(recurringTransaction) && due(recurringTransaction.Transaction.Date) {
+		run, post := exceptions.apply(recurringTransaction.Transaction)
+		if !post {
+			logrus.WithField("recurringTransaction", recurringTransaction).Debug("skipping run of recurring transaction")
+		} else if exceptions.moved(recurringTransaction.Transaction.Date) {
+			recurringTransaction.Occurrences++
+		} else {
+			paidOff, err := postRun(ctx, loan, recurringTransaction, run, userID)
+			if err != nil {
+				return err
+			}
+
+			// nothing is left to pay, so the recurring transaction ends before the payment it would have made
+			if paidOff {
+				endDate := recurringTransaction.Transaction.Date.AddDate(0, 0, -1)
+				recurringTransaction.EndDate = &endDate
+				break
+			}
+			recurringTransaction.Occurrences++
 		}
 
 		// calculate when the transaction should next run
-		var err error
-		recurringTransaction.Transaction.Date, err = getNextRun(&recurringTransaction, false)
+		recurringTransaction.Transaction.Date, err = getNextRun(&recurringTransaction, false, cal)
 		if err != nil {
 			return err
 		}
 	}
 
-	// update the recurring transaction
-	if _, err := UpdateRecurring(ctx, &recurringTransaction); err != nil {
+	// post the moved runs whose new dates have come up, whether or not the runs scheduled around them have posted
+	for _, exception := range exceptions.unposted() {
+		if !due(*exception.MoveTo) {
+			break
+		}
+
+		// runs that have yet to be stepped past do not post if the recurring transaction ends before them
+		upcoming := !exception.Date.Before(recurringTransaction.Transaction.Date)
+		if upcoming && (ended(recurringTransaction) || (recurringTransaction.EndDate != nil && recurringTransaction.EndDate.Before(exception.Date))) {
+			continue
+		}
+
+		scheduled := recurringTransaction.Transaction
+		scheduled.Date = exception.Date
+		run, _ := exceptions.apply(scheduled)
+		paidOff, err := postRun(ctx, loan, recurringTransaction, run, userID)
+		if err != nil {
+			return err
+		}
+
+		if err := markExceptionPosted(db, exception.ID); err != nil {
+			return err
+		}
+
+		if paidOff && !ended(recurringTransaction) {
+			endDate := recurringTransaction.Transaction.Date.AddDate(0, 0, -1)
+			recurringTransaction.EndDate = &endDate
+		}
+	}
+
+	// update the recurring transaction, along with how many times it has posted
+	if _, err := updateRecurring(db, &recurringTransaction); err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error":                err,
 			"recurringTransaction": recurringTransaction,
@@ -516,7 +849,36 @@ func generateFromRecurringAndUpdateRecurring(ctx context.Context, recurringTrans
 	return nil
 }
 
+// calendarFor fetches the holiday calendar that the runs of a recurring transaction are adjusted by, if they are adjusted
+func calendarFor(db util.DB, tr RecurringTransaction) (holiday.Calendar, error) {
+	if tr.BusinessDayAdjustment == "" || tr.BusinessDayAdjustment == constants.AdjustNone {
+		return nil, nil
+	}
+
+	return holiday.CalendarForAccount(db, tr.Transaction.AccountID)
+}
+
+// ended checks whether a recurring transaction has reached its end date or posted its maximum number of occurrences,
+// so its next run should not be posted
+func ended(tr RecurringTransaction) bool {
+	if tr.MaxOccurrences != nil && tr.Occurrences >= *tr.MaxOccurrences {
+		return true
+	}
+
+	return tr.EndDate != nil && tr.Transaction.Date.After(*tr.EndDate)
+}
+
 func recurringToDB(transaction RecurringTransaction) *recurringTransactionDB {
+	endDate := pq.NullTime{}
+	if transaction.EndDate != nil {
+		endDate = pq.NullTime{Time: *transaction.EndDate, Valid: true}
+	}
+
+	scheduled := pq.NullTime{}
+	if transaction.Scheduled != nil {
+		scheduled = pq.NullTime{Time: *transaction.Scheduled, Valid: true}
+	}
+
 	return &recurringTransactionDB{
 		ID:         transaction.ID,
 		Name:       transaction.Transaction.Name,
@@ -526,14 +888,31 @@ func recurringToDB(transaction RecurringTransaction) *recurringTransactionDB {
 		Note:       transaction.Transaction.Note,
 		AccountID:  transaction.Transaction.AccountID,
 
-		ScheduleType:        transaction.ScheduleType,
-		SecondsBetween:      util.ToNullInt(transaction.SecondsBetween),
-		DayOf:               util.ToNullInt(transaction.DayOf),
-		SecondsBeforeToPost: transaction.SecondsBeforeToPost,
+		ScheduleType:          transaction.ScheduleType,
+		SecondsBetween:        util.ToNullInt(transaction.SecondsBetween),
+		DayOf:                 util.ToNullInt(transaction.DayOf),
+		RRule:                 util.ToNullString(transaction.RRule),
+		SecondsBeforeToPost:   transaction.SecondsBeforeToPost,
+		EndDate:               endDate,
+		MaxOccurrences:        util.ToNullInt(transaction.MaxOccurrences),
+		Occurrences:           transaction.Occurrences,
+		Completed:             transaction.Completed,
+		BusinessDayAdjustment: util.ToNullStringNonEmpty(transaction.BusinessDayAdjustment),
+		Scheduled:             scheduled,
 	}
 }
 
 func recurringFromDB(transaction recurringTransactionDB) RecurringTransaction {
+	var endDate *time.Time
+	if transaction.EndDate.Valid {
+		endDate = &transaction.EndDate.Time
+	}
+
+	var scheduled *time.Time
+	if transaction.Scheduled.Valid {
+		scheduled = &transaction.Scheduled.Time
+	}
+
 	return RecurringTransaction{
 		ID: transaction.ID,
 		Transaction: Transaction{
@@ -545,9 +924,16 @@ func recurringFromDB(transaction recurringTransactionDB) RecurringTransaction {
 			AccountID: transaction.AccountID,
 		},
 
-		ScheduleType:        transaction.ScheduleType,
-		SecondsBetween:      util.FromNullInt(transaction.SecondsBetween),
-		DayOf:               util.FromNullInt(transaction.DayOf),
-		SecondsBeforeToPost: transaction.SecondsBeforeToPost,
+		ScheduleType:          transaction.ScheduleType,
+		SecondsBetween:        util.FromNullInt(transaction.SecondsBetween),
+		DayOf:                 util.FromNullInt(transaction.DayOf),
+		RRule:                 util.FromNullString(transaction.RRule),
+		SecondsBeforeToPost:   transaction.SecondsBeforeToPost,
+		EndDate:               endDate,
+		MaxOccurrences:        util.FromNullInt(transaction.MaxOccurrences),
+		Occurrences:           transaction.Occurrences,
+		Completed:             transaction.Completed,
+		BusinessDayAdjustment: util.FromNullStringNonEmpty(transaction.BusinessDayAdjustment),
+		Scheduled:             scheduled,
 	}
 }
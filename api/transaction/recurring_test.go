@@ -4,11 +4,13 @@ package transaction
 
 import (
 	"context"
+	"database/sql"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"gopkg.in/olivere/elastic.v5"
 
 	"github.com/jchorl/financejc/api/util"
 	"github.com/jchorl/financejc/constants"
@@ -18,6 +20,8 @@ import (
 type RecurringTestSuite struct {
 	suite.Suite
 	Ctx context.Context
+	DB  *sql.DB
+	ES  *elastic.Client
 }
 
 func (suite *RecurringTestSuite) SetupTest() {
@@ -26,6 +30,8 @@ func (suite *RecurringTestSuite) SetupTest() {
 	ctx := integration.ContextWithUserDBES(0, db, es)
 	uid := integration.NewUser(suite.T(), ctx)
 	suite.Ctx = integration.ContextWithUserDBES(uid, db, es)
+	suite.DB = db
+	suite.ES = es
 }
 
 func (suite *RecurringTestSuite) TestNewRecurring() {
@@ -44,9 +50,9 @@ func (suite *RecurringTestSuite) TestNewRecurring() {
 				Category:  "fun",
 				Amount:    -500,
 				Note:      "note",
-				AccountId: acc.Id,
+				AccountID: acc.ID,
 			},
-			ScheduleType:        constants.FIXED_INTERVAL,
+			ScheduleType:        constants.FixedInterval,
 			SecondsBetween:      &secondsBetween,
 			SecondsBeforeToPost: 0,
 		},
@@ -57,9 +63,9 @@ func (suite *RecurringTestSuite) TestNewRecurring() {
 				Category:  "fun1",
 				Amount:    -505,
 				Note:      "note1",
-				AccountId: acc.Id,
+				AccountID: acc.ID,
 			},
-			ScheduleType:        constants.FIXED_DAY_WEEK,
+			ScheduleType:        constants.FixedDayWeek,
 			DayOf:               &tuesday,
 			SecondsBeforeToPost: 0,
 		},
@@ -70,9 +76,9 @@ func (suite *RecurringTestSuite) TestNewRecurring() {
 				Category:  "fun2",
 				Amount:    -502,
 				Note:      "note2",
-				AccountId: acc.Id,
+				AccountID: acc.ID,
 			},
-			ScheduleType:        constants.FIXED_INTERVAL,
+			ScheduleType:        constants.FixedInterval,
 			SecondsBetween:      &secondsBetween,
 			SecondsBeforeToPost: 0,
 		},
@@ -83,7 +89,7 @@ func (suite *RecurringTestSuite) TestNewRecurring() {
 		require.NoError(suite.T(), err, "failed to create recurring transaction: %+v", tr)
 	}
 
-	retrieved, err := GetRecurring(suite.Ctx, acc.Id)
+	retrieved, err := GetRecurring(suite.Ctx, acc.ID)
 	require.NoError(suite.T(), err, "unable to retrieve recurring transactions")
 
 	for _, tr := range retrieved {
@@ -118,9 +124,9 @@ func (suite *RecurringTestSuite) TestGenerateFuture() {
 			Category:  "fun1",
 			Amount:    -505,
 			Note:      "note1",
-			AccountId: acc.Id,
+			AccountID: acc.ID,
 		},
-		ScheduleType:        constants.FIXED_DAY_WEEK,
+		ScheduleType:        constants.FixedDayWeek,
 		DayOf:               &currDay,
 		SecondsBeforeToPost: 1,
 	}
@@ -134,9 +140,9 @@ func (suite *RecurringTestSuite) TestGenerateFuture() {
 			Category:  "fun2",
 			Amount:    -503,
 			Note:      "note2",
-			AccountId: acc.Id,
+			AccountID: acc.ID,
 		},
-		ScheduleType:        constants.FIXED_DAY_WEEK,
+		ScheduleType:        constants.FixedDayWeek,
 		DayOf:               &currDay,
 		SecondsBeforeToPost: 60 * 60 * 24 * 7,
 	}
@@ -146,15 +152,15 @@ func (suite *RecurringTestSuite) TestGenerateFuture() {
 	err = GenRecurringTransactions(suite.Ctx)
 	require.NoError(suite.T(), err, "failed to generate recurring transactions")
 
-	retrieved, err := GetFuture(suite.Ctx, acc.Id, &now)
+	retrieved, err := Get(suite.Ctx, acc.ID, "")
 	require.NoError(suite.T(), err, "failed to retrieve transactions after generating")
 
-	require.Len(suite.T(), retrieved, 1, "should be one transaction generated")
-	generated := retrieved[0]
+	require.Len(suite.T(), retrieved.Transactions, 1, "should be one transaction generated")
+	generated := retrieved.Transactions[0]
 	checkTransactionEqual(suite.T(), tr.Transaction, generated, true)
 
 	// verify that the date got shifted forward
-	recurring, err := GetRecurring(suite.Ctx, acc.Id)
+	recurring, err := GetRecurring(suite.Ctx, acc.ID)
 	require.NoError(suite.T(), err, "unable to retrieve recurring transactions")
 
 	for _, rt := range recurring {
@@ -181,9 +187,9 @@ func (suite *RecurringTestSuite) TestGeneratePast() {
 			Category:  "fun",
 			Amount:    -502,
 			Note:      "note",
-			AccountId: acc.Id,
+			AccountID: acc.ID,
 		},
-		ScheduleType:        constants.FIXED_DAY_YEAR,
+		ScheduleType:        constants.FixedDayYear,
 		DayOf:               &yesterdayYearday,
 		SecondsBeforeToPost: 1,
 	}
@@ -193,7 +199,7 @@ func (suite *RecurringTestSuite) TestGeneratePast() {
 	err = GenRecurringTransactions(suite.Ctx)
 	require.NoError(suite.T(), err, "failed to generate recurring transactions")
 
-	retrieved, err := Get(suite.Ctx, acc.Id, "")
+	retrieved, err := Get(suite.Ctx, acc.ID, "")
 	require.NoError(suite.T(), err, "failed to retrieve transactions after generating")
 
 	// verify that three correct transactions were generated
@@ -207,7 +213,7 @@ func (suite *RecurringTestSuite) TestGeneratePast() {
 	}
 
 	// verify that the date got shifted forward
-	recurring, err := GetRecurring(suite.Ctx, acc.Id)
+	recurring, err := GetRecurring(suite.Ctx, acc.ID)
 	require.NoError(suite.T(), err, "unable to retrieve recurring transactions")
 	only := recurring[0]
 
@@ -216,13 +222,97 @@ func (suite *RecurringTestSuite) TestGeneratePast() {
 	require.Equal(suite.T(), now.AddDate(1, 0, -1).Year(), only.Transaction.Date.Year(), "recurring transaction should have a date one year from yesterday (+/- 1 day)")
 }
 
+func (suite *RecurringTestSuite) TestGenerateStopsAtMaxOccurrences() {
+	// create account
+	acc := integration.NewAccount(suite.T(), suite.Ctx)
+
+	day := 60 * 60 * 24
+	maxOccurrences := 3
+	tr := RecurringTransaction{
+		Transaction: Transaction{
+			Name:      "installments",
+			Date:      time.Now().AddDate(0, 0, -5),
+			Category:  "fun",
+			Amount:    -1000,
+			AccountID: acc.ID,
+		},
+		ScheduleType:        constants.FixedInterval,
+		SecondsBetween:      &day,
+		SecondsBeforeToPost: 0,
+		MaxOccurrences:      &maxOccurrences,
+	}
+	_, err := NewRecurring(suite.Ctx, &tr)
+	require.NoError(suite.T(), err, "failed to create recurring transaction: %+v", tr)
+
+	err = GenRecurringTransactions(suite.Ctx)
+	require.NoError(suite.T(), err, "failed to generate recurring transactions")
+
+	retrieved, err := Get(suite.Ctx, acc.ID, "")
+	require.NoError(suite.T(), err, "failed to retrieve transactions after generating")
+	require.Len(suite.T(), retrieved.Transactions, 3, "should stop generating at the maximum occurrences")
+
+	recurring, err := GetRecurring(suite.Ctx, acc.ID)
+	require.NoError(suite.T(), err, "unable to retrieve recurring transactions")
+	only := recurring[0]
+	require.Equal(suite.T(), 3, only.Occurrences, "occurrences should count the generated transactions")
+	require.True(suite.T(), only.Completed, "recurring transaction should be completed once it reaches its maximum occurrences")
+
+	// updates cannot reset how many times the recurring transaction has posted
+	only.Occurrences = 0
+	only.Completed = false
+	updated, err := UpdateRecurring(suite.Ctx, &only)
+	require.NoError(suite.T(), err, "unable to update recurring transaction")
+	require.Equal(suite.T(), 3, updated.Occurrences, "occurrences should be kept from the stored recurring transaction")
+	require.True(suite.T(), updated.Completed, "recurring transaction should still be completed")
+
+	err = GenRecurringTransactions(suite.Ctx)
+	require.NoError(suite.T(), err, "failed to generate recurring transactions")
+
+	retrieved, err = Get(suite.Ctx, acc.ID, "")
+	require.NoError(suite.T(), err, "failed to retrieve transactions after generating")
+	require.Len(suite.T(), retrieved.Transactions, 3, "completed recurring transactions should not generate more transactions")
+}
+
+func (suite *RecurringTestSuite) TestUpdateToForeignAccount() {
+	// create account
+	acc := integration.NewAccount(suite.T(), suite.Ctx)
+
+	// create another user with their own account
+	otherCtx := integration.ContextWithUserDBES(integration.NewUser(suite.T(), suite.Ctx), suite.DB, suite.ES)
+	otherAcc := integration.NewAccount(suite.T(), otherCtx)
+
+	day := 60 * 60 * 24
+	tr := RecurringTransaction{
+		Transaction: Transaction{
+			Name:      "mine",
+			Date:      time.Now().AddDate(0, 0, 1),
+			Category:  "fun",
+			Amount:    -1000,
+			AccountID: acc.ID,
+		},
+		ScheduleType:   constants.FixedInterval,
+		SecondsBetween: &day,
+	}
+	created, err := NewRecurring(suite.Ctx, &tr)
+	require.NoError(suite.T(), err, "failed to create recurring transaction: %+v", tr)
+
+	moved := *created
+	moved.Transaction.AccountID = otherAcc.ID
+	_, err = UpdateRecurring(suite.Ctx, &moved)
+	require.Equal(suite.T(), constants.ErrForbidden, err, "recurring transactions should not be moved to another user's account")
+
+	recurring, err := GetRecurring(suite.Ctx, acc.ID)
+	require.NoError(suite.T(), err, "unable to retrieve recurring transactions")
+	require.Len(suite.T(), recurring, 1, "recurring transaction should stay in its account")
+}
+
 func TestRecurringTestSuite(t *testing.T) {
 	suite.Run(t, new(RecurringTestSuite))
 }
 
 func checkTransactionEqual(t *testing.T, expected, actual Transaction, checkDate bool) {
 	require.Equal(t, expected.Name, actual.Name, "actual name should be same as expected")
-	require.Equal(t, expected.AccountId, actual.AccountId, "actual account id should be same as expected")
+	require.Equal(t, expected.AccountID, actual.AccountID, "actual account id should be same as expected")
 	require.Equal(t, expected.Amount, actual.Amount, "actual amount should be same as expected")
 	require.Equal(t, expected.Category, actual.Category, "actual category should be same as expected")
 	require.Equal(t, expected.Note, actual.Note, "actual note should be same as expected")
@@ -235,7 +325,7 @@ func checkTransactionEqual(t *testing.T, expected, actual Transaction, checkDate
 }
 
 func checkRecurringTransactionEqual(t *testing.T, expected, actual RecurringTransaction, checkDate bool) {
-	require.Equal(t, expected.Transaction.AccountId, actual.Transaction.AccountId, "expected account id should be same as expected")
+	require.Equal(t, expected.Transaction.AccountID, actual.Transaction.AccountID, "expected account id should be same as expected")
 	require.Equal(t, expected.Transaction.Amount, actual.Transaction.Amount, "expected amount should be same as expected")
 	require.Equal(t, expected.Transaction.Category, actual.Transaction.Category, "expected category should be same as expected")
 	require.Equal(t, expected.Transaction.Note, actual.Transaction.Note, "expected note should be same as expected")
@@ -251,3 +341,123 @@ func checkRecurringTransactionEqual(t *testing.T, expected, actual RecurringTran
 		require.Equal(t, expected.Transaction.Date.Day(), actual.Transaction.Date.Day(), "expected day should be same as expected")
 	}
 }
+
+func (suite *RecurringTestSuite) TestGenerateMovedPastNextRun() {
+	// create account
+	acc := integration.NewAccount(suite.T(), suite.Ctx)
+
+	week := 60 * 60 * 24 * 7
+	tr := RecurringTransaction{
+		Transaction: Transaction{
+			Name:      "rent",
+			Date:      time.Now().AddDate(0, 0, -10),
+			Category:  "home",
+			Amount:    -1000,
+			AccountID: acc.ID,
+		},
+		ScheduleType:        constants.FixedInterval,
+		SecondsBetween:      &week,
+		SecondsBeforeToPost: 0,
+	}
+	_, err := NewRecurring(suite.Ctx, &tr)
+	require.NoError(suite.T(), err, "failed to create recurring transaction: %+v", tr)
+
+	recurring, err := GetRecurring(suite.Ctx, acc.ID)
+	require.NoError(suite.T(), err, "unable to retrieve recurring transactions")
+	first := recurring[0].Transaction.Date
+
+	// move the first run past the run scheduled after it
+	_, err = suite.DB.Exec("INSERT INTO recurring_exceptions(recurring_transaction_id, date, move_to) VALUES($1, $2, $3)", recurring[0].ID, first, time.Now().AddDate(0, 0, 5))
+	require.NoError(suite.T(), err, "failed to insert recurring exception")
+
+	err = GenRecurringTransactions(suite.Ctx)
+	require.NoError(suite.T(), err, "failed to generate recurring transactions")
+
+	retrieved, err := Get(suite.Ctx, acc.ID, "")
+	require.NoError(suite.T(), err, "failed to retrieve transactions after generating")
+	require.Len(suite.T(), retrieved.Transactions, 1, "the run after the moved run should post without waiting for it")
+
+	recurring, err = GetRecurring(suite.Ctx, acc.ID)
+	require.NoError(suite.T(), err, "unable to retrieve recurring transactions")
+	require.Equal(suite.T(), 2, recurring[0].Occurrences, "the moved run should be stepped past")
+	require.True(suite.T(), recurring[0].Transaction.Date.After(time.Now()), "the next run should be upcoming")
+
+	// the moved run posts once its new date comes up
+	moveTo := time.Now().AddDate(0, 0, -1)
+	_, err = suite.DB.Exec("UPDATE recurring_exceptions SET move_to = $1 WHERE recurring_transaction_id = $2", moveTo, recurring[0].ID)
+	require.NoError(suite.T(), err, "failed to update recurring exception")
+
+	for i := 0; i < 2; i++ {
+		err = GenRecurringTransactions(suite.Ctx)
+		require.NoError(suite.T(), err, "failed to generate recurring transactions")
+	}
+
+	retrieved, err = Get(suite.Ctx, acc.ID, "")
+	require.NoError(suite.T(), err, "failed to retrieve transactions after generating")
+	require.Len(suite.T(), retrieved.Transactions, 2, "the moved run should post once, on its new date")
+
+	exceptions, err := GetExceptions(suite.Ctx, recurring[0].ID)
+	require.NoError(suite.T(), err, "unable to retrieve recurring exceptions")
+	require.True(suite.T(), exceptions[0].Posted, "the moved run should be marked as posted")
+}
+
+func (suite *RecurringTestSuite) TestNewExceptionValidation() {
+	// create account
+	acc := integration.NewAccount(suite.T(), suite.Ctx)
+
+	week := 60 * 60 * 24 * 7
+	tr := RecurringTransaction{
+		Transaction: Transaction{
+			Name:      "rent",
+			Date:      time.Now().AddDate(0, 0, -3),
+			Category:  "home",
+			Amount:    -1000,
+			AccountID: acc.ID,
+		},
+		ScheduleType:        constants.FixedInterval,
+		SecondsBetween:      &week,
+		SecondsBeforeToPost: 0,
+	}
+	_, err := NewRecurring(suite.Ctx, &tr)
+	require.NoError(suite.T(), err, "failed to create recurring transaction: %+v", tr)
+
+	err = GenRecurringTransactions(suite.Ctx)
+	require.NoError(suite.T(), err, "failed to generate recurring transactions")
+
+	recurring, err := GetRecurring(suite.Ctx, acc.ID)
+	require.NoError(suite.T(), err, "unable to retrieve recurring transactions")
+	next := recurring[0].Transaction.Date
+
+	zero := time.Time{}
+	_, err = NewException(suite.Ctx, &RecurringException{RecurringTransactionID: recurring[0].ID, Date: next, MoveTo: &zero})
+	require.Equal(suite.T(), constants.ErrBadRequest, err, "runs should not be moved to a zero date")
+
+	beforePosted := time.Now().AddDate(0, 0, -10)
+	_, err = NewException(suite.Ctx, &RecurringException{RecurringTransactionID: recurring[0].ID, Date: next, MoveTo: &beforePosted})
+	require.Equal(suite.T(), constants.ErrBadRequest, err, "runs should not be moved to before the last posted run")
+
+	later := next.AddDate(0, 0, 2)
+	_, err = NewException(suite.Ctx, &RecurringException{RecurringTransactionID: recurring[0].ID, Date: next, MoveTo: &later})
+	require.NoError(suite.T(), err, "runs should be able to move to after the last posted run")
+
+	// loan payments are worked out from what is owed
+	loanAcc := integration.NewAccount(suite.T(), suite.Ctx)
+	loan := Loan{
+		AccountID:        loanAcc.ID,
+		Principal:        100000,
+		AnnualRate:       5,
+		TermMonths:       12,
+		Frequency:        constants.LoanMonthly,
+		StartDate:        time.Now(),
+		PaymentAccountID: acc.ID,
+	}
+	_, err = NewLoan(suite.Ctx, &loan)
+	require.NoError(suite.T(), err, "failed to create loan: %+v", loan)
+
+	payment, err := getRecurringByID(suite.DB, loan.RecurringTransactionID)
+	require.NoError(suite.T(), err, "unable to retrieve loan payments")
+
+	amount := -500
+	_, err = NewException(suite.Ctx, &RecurringException{RecurringTransactionID: loan.RecurringTransactionID, Date: payment.Transaction.Date, Amount: &amount})
+	require.Equal(suite.T(), constants.ErrBadRequest, err, "amounts of loan payments should not be overridden")
+}
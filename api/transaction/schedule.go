@@ -0,0 +1,102 @@
+package transaction
+
+import (
+	"context"
+	"time"
+
+	"github.com/jchorl/financejc/api/rrule"
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// secondsPerDay is the length of a day in a fixed interval
+const secondsPerDay = 24 * 60 * 60
+
+// ToRRule returns the rule that runs on the same days as the schedule of a recurring transaction. Days of the month or
+// year that do not exist in every month or year run on the last day that does, like they do in the fixed schedules.
+func ToRRule(tr RecurringTransaction) (string, error) {
+	if err := validateRecurringTransaction(tr); err != nil {
+		return "", err
+	}
+
+	rule := rrule.Rule{Interval: 1, WeekStart: time.Monday}
+	switch tr.ScheduleType {
+	case constants.RRule:
+		return *tr.RRule, nil
+	case constants.FixedInterval:
+		// rules recur on dates, so only intervals of whole days can be converted
+		if *tr.SecondsBetween < 0 || *tr.SecondsBetween%secondsPerDay != 0 {
+			return "", constants.ErrBadRequest
+		}
+		rule.Freq = rrule.Daily
+		rule.Interval = *tr.SecondsBetween / secondsPerDay
+	case constants.FixedDayWeek:
+		if *tr.DayOf < 0 || *tr.DayOf > 6 {
+			return "", constants.ErrBadRequest
+		}
+		rule.Freq = rrule.Weekly
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if util.WeekdayToInt(day) == *tr.DayOf {
+				rule.ByDay = []rrule.Weekday{{Day: day}}
+			}
+		}
+	case constants.FixedDayMonth:
+		if *tr.DayOf < 1 || *tr.DayOf > 31 {
+			return "", constants.ErrBadRequest
+		}
+		rule.Freq = rrule.Monthly
+		rule.ByMonthDay, rule.BySetPos = lastOfDays(28, *tr.DayOf)
+	case constants.FixedDayYear:
+		if *tr.DayOf < 1 || *tr.DayOf > 366 {
+			return "", constants.ErrBadRequest
+		}
+		rule.Freq = rrule.Yearly
+		rule.ByYearDay, rule.BySetPos = lastOfDays(365, *tr.DayOf)
+	}
+
+	return rule.String(), nil
+}
+
+// ConvertToRRule switches the schedule of a recurring transaction to the equivalent rule, keeping its next run
+func ConvertToRRule(c context.Context, recurringTransactionID int) (*RecurringTransaction, error) {
+	valid, err := userOwnsRecurringTransaction(c, recurringTransactionID)
+	if err != nil || !valid {
+		return nil, constants.ErrForbidden
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	recurring, err := getRecurringByID(db, recurringTransactionID)
+	if err != nil {
+		return nil, err
+	}
+
+	converted, err := ToRRule(recurring)
+	if err != nil {
+		return nil, err
+	}
+
+	recurring.ScheduleType = constants.RRule
+	recurring.RRule = &converted
+	recurring.SecondsBetween = nil
+	recurring.DayOf = nil
+
+	return UpdateRecurring(c, &recurring)
+}
+
+// lastOfDays returns the days from min to day, of which the last that exists is picked, or just the day if it always exists
+func lastOfDays(min, day int) ([]int, []int) {
+	if day <= min {
+		return []int{day}, nil
+	}
+
+	days := []int{}
+	for d := min; d <= day; d++ {
+		days = append(days, d)
+	}
+
+	return days, []int{-1}
+}
@@ -0,0 +1,93 @@
+// +build integration
+
+package transaction
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/financejc/constants"
+)
+
+func TestToRRule(t *testing.T) {
+	intPtr := func(i int) *int { return &i }
+
+	tests := []struct {
+		recurring RecurringTransaction
+		expected  string
+	}{
+		{RecurringTransaction{ScheduleType: constants.FixedInterval, SecondsBetween: intPtr(14 * secondsPerDay)}, "FREQ=DAILY;INTERVAL=14"},
+		{RecurringTransaction{ScheduleType: constants.FixedDayWeek, DayOf: intPtr(5)}, "FREQ=WEEKLY;BYDAY=FR"},
+		{RecurringTransaction{ScheduleType: constants.FixedDayMonth, DayOf: intPtr(15)}, "FREQ=MONTHLY;BYMONTHDAY=15"},
+		{RecurringTransaction{ScheduleType: constants.FixedDayMonth, DayOf: intPtr(30)}, "FREQ=MONTHLY;BYMONTHDAY=28,29,30;BYSETPOS=-1"},
+		{RecurringTransaction{ScheduleType: constants.FixedDayYear, DayOf: intPtr(100)}, "FREQ=YEARLY;BYYEARDAY=100"},
+	}
+
+	for _, test := range tests {
+		converted, err := ToRRule(test.recurring)
+		require.NoError(t, err)
+		require.Equal(t, test.expected, converted)
+	}
+
+	_, err := ToRRule(RecurringTransaction{ScheduleType: constants.FixedInterval, SecondsBetween: intPtr(60 * 60)})
+	require.Equal(t, constants.ErrBadRequest, err, "Intervals of part of a day cannot be converted")
+}
+
+func TestConvertedScheduleRunsOnSameDays(t *testing.T) {
+	dayOf := 31
+	fixed := RecurringTransaction{
+		Transaction:  Transaction{Date: time.Date(2017, time.January, 31, 0, 0, 0, 0, time.UTC)},
+		ScheduleType: constants.FixedDayMonth,
+		DayOf:        &dayOf,
+	}
+
+	converted, err := ToRRule(fixed)
+	require.NoError(t, err)
+	rule := fixed
+	rule.ScheduleType = constants.RRule
+	rule.RRule = &converted
+	rule.DayOf = nil
+
+	for i := 0; i < 24; i++ {
+		fixedNext, err := getNextRun(&fixed, false, nil)
+		require.NoError(t, err)
+		ruleNext, err := getNextRun(&rule, false, nil)
+		require.NoError(t, err)
+		require.Equal(t, fixedNext, ruleNext)
+
+		fixed.Transaction.Date = fixedNext
+		rule.Transaction.Date = ruleNext
+	}
+}
+
+func TestAdjustedRunsDoNotDrift(t *testing.T) {
+	dayOf := 1
+	// the 1st of july 2017 is a saturday, and the 1st of october is a sunday
+	recurring := RecurringTransaction{
+		Transaction:           Transaction{Date: time.Date(2017, time.June, 1, 0, 0, 0, 0, time.UTC)},
+		ScheduleType:          constants.FixedDayMonth,
+		DayOf:                 &dayOf,
+		BusinessDayAdjustment: constants.AdjustPreceding,
+	}
+
+	expected := []time.Time{
+		time.Date(2017, time.June, 30, 0, 0, 0, 0, time.UTC),
+		time.Date(2017, time.August, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2017, time.September, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2017, time.September, 29, 0, 0, 0, 0, time.UTC),
+	}
+	for _, date := range expected {
+		next, err := getNextRun(&recurring, false, nil)
+		require.NoError(t, err)
+		require.Equal(t, date, next)
+		recurring.Transaction.Date = next
+	}
+
+	// a run that was moved to a different day by hand no longer carries on from when it was scheduled
+	recurring.Transaction.Date = time.Date(2017, time.October, 3, 0, 0, 0, 0, time.UTC)
+	next, err := getNextRun(&recurring, true, nil)
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2017, time.November, 1, 0, 0, 0, 0, time.UTC), next)
+}
@@ -0,0 +1,271 @@
+package transaction
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/lib/pq"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// Proposal is a recurring transaction inferred from past transactions that were never set up as one.
+// The recurring transaction runs next after the latest match. Accepting a proposal creates the recurring
+// transaction and links the matches to it.
+type Proposal struct {
+	RecurringTransaction RecurringTransaction `json:"recurringTransaction"`
+	TransactionIDs       []int                `json:"transactionIds"`
+	LastDate             time.Time            `json:"lastDate"`
+}
+
+// cadence is a schedule that recurring charges can follow, with the range of days allowed between consecutive charges
+type cadence struct {
+	scheduleType   string
+	interval       int
+	minGap, maxGap int
+	minMatches     int
+}
+
+// cadences are checked in order, so the first one that every gap fits is proposed
+var cadences = []cadence{
+	{scheduleType: constants.FixedDayWeek, minGap: 6, maxGap: 8, minMatches: constants.SubscriptionMinMatches},
+	{scheduleType: constants.FixedInterval, interval: 14, minGap: 12, maxGap: 16, minMatches: constants.SubscriptionMinMatches},
+	{scheduleType: constants.FixedDayMonth, minGap: 25, maxGap: 35, minMatches: constants.SubscriptionMinMatches},
+	{scheduleType: constants.FixedDayYear, minGap: 358, maxGap: 372, minMatches: constants.SubscriptionMinYearlyMatches},
+}
+
+// GetProposals looks through the transactions of the user in the context for payees that are charged, or pay, a stable
+// amount on a regular cadence in the same account, and proposes a recurring transaction for each. Transfers, transactions
+// already linked to a recurring transaction and payees that already have a recurring transaction in the account are skipped.
+func GetProposals(c context.Context) ([]Proposal, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	rows, err := db.Query(`SELECT t.id, t.name, t.occurred, t.category, t.amount, t.note, t.related_transaction_id, t.recurring_transaction_id, t.account_id
+FROM transactions t JOIN accounts a ON a.id = t.account_id
+WHERE a.user_id = $1 AND NOT a.closed AND t.occurred > $2::date AND t.occurred <= $3::date AND t.recurring_transaction_id IS NULL
+	AND t.related_transaction_id IS NULL AND NOT EXISTS (SELECT 1 FROM transactions r WHERE r.related_transaction_id = t.id)
+	AND NOT EXISTS (SELECT 1 FROM recurring_transactions rt WHERE rt.account_id = t.account_id AND rt.name = t.name)
+ORDER BY t.account_id, t.name, t.occurred, t.id`, userID, today.AddDate(0, 0, -constants.SubscriptionHistoryDays), today)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to query transactions to propose recurring transactions")
+		return nil, err
+	}
+	defer rows.Close()
+
+	proposals := []Proposal{}
+	group := []Transaction{}
+	for rows.Next() {
+		var tdb transactionDB
+		if err := rows.Scan(&tdb.ID, &tdb.Name, &tdb.Occurred, &tdb.Category, &tdb.Amount, &tdb.Note, &tdb.RelatedTransactionID, &tdb.RecurringTransactionID, &tdb.AccountID); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"userId": userID,
+			}).Error("failed to scan into transaction to propose recurring transactions")
+			return nil, err
+		}
+
+		transaction := fromDB(tdb)
+		if len(group) > 0 && (group[0].AccountID != transaction.AccountID || group[0].Name != transaction.Name) {
+			if proposal, ok := propose(group, today); ok {
+				proposals = append(proposals, proposal)
+			}
+			group = []Transaction{}
+		}
+		group = append(group, transaction)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to get transactions to propose recurring transactions from rows")
+		return nil, err
+	}
+
+	if proposal, ok := propose(group, today); ok {
+		proposals = append(proposals, proposal)
+	}
+
+	return proposals, nil
+}
+
+// AcceptProposal creates the recurring transaction of a proposal, which can be edited before it is accepted,
+// and links the transactions it matched to the new recurring transaction
+func AcceptProposal(c context.Context, proposal Proposal) (*RecurringTransaction, error) {
+	if len(proposal.TransactionIDs) == 0 {
+		return nil, constants.ErrBadRequest
+	}
+
+	txn, commit, err := util.TxFromContext(c)
+	if err != nil {
+		logrus.WithError(err).Error("unable to begin transaction when accepting recurring transaction proposal")
+		return nil, err
+	}
+	txCtx := context.WithValue(c, constants.CtxDB, txn)
+
+	recurring := proposal.RecurringTransaction
+	recurring.ID = 0
+	created, err := NewRecurring(txCtx, &recurring)
+	if err != nil {
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	// only unlinked transactions in the account of the recurring transaction can be linked to it
+	res, err := txn.Exec("UPDATE transactions SET recurring_transaction_id = $1 WHERE id = ANY($2) AND account_id = $3 AND recurring_transaction_id IS NULL", created.ID, pq.Array(proposal.TransactionIDs), created.Transaction.AccountID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":    err,
+			"proposal": proposal,
+		}).Error("failed to link transactions to accepted recurring transaction")
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	if linked, err := res.RowsAffected(); err != nil || int(linked) != len(proposal.TransactionIDs) {
+		util.RollbackIfOwned(c, txn)
+		return nil, constants.ErrBadRequest
+	}
+
+	if err := commit(); err != nil {
+		logrus.WithError(err).Error("unable to commit accepting recurring transaction proposal")
+		util.RollbackIfOwned(c, txn)
+		return nil, err
+	}
+
+	return created, nil
+}
+
+// propose infers a recurring transaction from the transactions of a payee in an account, oldest first. The latest
+// transactions are matched while every gap between them fits the same cadence. There have to be enough of them,
+// every amount has to be close to the typical amount, and the latest one cannot be overdue by more than half a gap.
+func propose(transactions []Transaction, today time.Time) (Proposal, bool) {
+	if len(transactions) == 0 {
+		return Proposal{}, false
+	}
+
+	last := transactions[len(transactions)-1]
+	for _, cad := range cadences {
+		matches := recentRun(transactions, cad)
+		if len(matches) < cad.minMatches {
+			continue
+		}
+
+		if daysBetween(last.Date, today) > cad.maxGap+cad.maxGap/2 || !stableAmounts(matches) {
+			return Proposal{}, false
+		}
+
+		recurring := RecurringTransaction{
+			Transaction: Transaction{
+				Name:      last.Name,
+				Date:      last.Date,
+				Category:  last.Category,
+				Amount:    last.Amount,
+				AccountID: last.AccountID,
+			},
+			ScheduleType: cad.scheduleType,
+		}
+
+		switch cad.scheduleType {
+		case constants.FixedInterval:
+			seconds := cad.interval * 24 * 60 * 60
+			recurring.SecondsBetween = &seconds
+		case constants.FixedDayWeek:
+			dayOf := util.WeekdayToInt(last.Date.Weekday())
+			recurring.DayOf = &dayOf
+		case constants.FixedDayMonth:
+			dayOf := usualDayOfMonth(matches)
+			recurring.DayOf = &dayOf
+		case constants.FixedDayYear:
+			dayOf := last.Date.YearDay()
+			recurring.DayOf = &dayOf
+		}
+
+		next, err := getNextRun(&recurring, false, nil)
+		if err != nil {
+			return Proposal{}, false
+		}
+		recurring.Transaction.Date = next
+
+		proposal := Proposal{
+			RecurringTransaction: recurring,
+			TransactionIDs:       []int{},
+			LastDate:             last.Date,
+		}
+		for _, match := range matches {
+			proposal.TransactionIDs = append(proposal.TransactionIDs, match.ID)
+		}
+
+		return proposal, true
+	}
+
+	return Proposal{}, false
+}
+
+// recentRun returns the latest transactions whose gaps all fit a cadence
+func recentRun(transactions []Transaction, cad cadence) []Transaction {
+	start := len(transactions) - 1
+	for start > 0 {
+		gap := daysBetween(transactions[start-1].Date, transactions[start].Date)
+		if gap < cad.minGap || gap > cad.maxGap {
+			break
+		}
+		start--
+	}
+
+	return transactions[start:]
+}
+
+// stableAmounts checks that every amount is within a tolerance of the median amount
+func stableAmounts(transactions []Transaction) bool {
+	amounts := []int{}
+	for _, transaction := range transactions {
+		amounts = append(amounts, transaction.Amount)
+	}
+	sort.Ints(amounts)
+	median := float64(amounts[len(amounts)/2])
+
+	for _, amount := range amounts {
+		if math.Abs(float64(amount)-median) > math.Abs(median)*constants.SubscriptionAmountTolerance {
+			return false
+		}
+	}
+
+	return true
+}
+
+// usualDayOfMonth returns the day of the month that the transactions most often fall on, preferring later ones on a tie
+func usualDayOfMonth(transactions []Transaction) int {
+	counts := map[int]int{}
+	usual := 0
+	for _, transaction := range transactions {
+		day := transaction.Date.Day()
+		counts[day]++
+		if counts[day] >= counts[usual] {
+			usual = day
+		}
+	}
+
+	return usual
+}
+
+// daysBetween returns the number of days from one date to a later one
+func daysBetween(from, to time.Time) int {
+	return int(math.Round(to.Sub(from).Hours() / 24))
+}
@@ -0,0 +1,68 @@
+// +build integration
+
+package transaction
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/jchorl/financejc/constants"
+)
+
+func charges(amount int, dates ...time.Time) []Transaction {
+	transactions := []Transaction{}
+	for i, date := range dates {
+		transactions = append(transactions, Transaction{ID: i + 1, Name: "Payee", AccountID: 1, Amount: amount, Date: date})
+	}
+	return transactions
+}
+
+func day(month time.Month, d int) time.Time {
+	return time.Date(2017, month, d, 0, 0, 0, 0, time.UTC)
+}
+
+func TestPropose(t *testing.T) {
+	today := day(time.May, 20)
+
+	// a one-off charge long before the subscription started should not stop it from being found
+	monthly := charges(-999, day(time.January, 2), day(time.February, 3), day(time.March, 3), day(time.April, 3), day(time.May, 3))
+	monthly = append([]Transaction{{ID: 99, Name: "Payee", AccountID: 1, Amount: -5000, Date: time.Date(2016, time.June, 20, 0, 0, 0, 0, time.UTC)}}, monthly...)
+	proposal, ok := propose(monthly, today)
+	require.True(t, ok)
+	require.Equal(t, constants.FixedDayMonth, proposal.RecurringTransaction.ScheduleType)
+	require.Equal(t, 3, *proposal.RecurringTransaction.DayOf, "The usual day of the month should be proposed")
+	require.Equal(t, day(time.June, 3), proposal.RecurringTransaction.Transaction.Date)
+	require.Equal(t, -999, proposal.RecurringTransaction.Transaction.Amount)
+	require.Equal(t, []int{1, 2, 3, 4, 5}, proposal.TransactionIDs)
+
+	weekly := charges(-2000, day(time.April, 26), day(time.May, 3), day(time.May, 10), day(time.May, 17))
+	proposal, ok = propose(weekly, today)
+	require.True(t, ok)
+	require.Equal(t, constants.FixedDayWeek, proposal.RecurringTransaction.ScheduleType)
+	require.Equal(t, day(time.May, 24), proposal.RecurringTransaction.Transaction.Date)
+
+	biweekly := charges(250000, day(time.April, 7), day(time.April, 21), day(time.May, 5), day(time.May, 19))
+	proposal, ok = propose(biweekly, today)
+	require.True(t, ok)
+	require.Equal(t, constants.FixedInterval, proposal.RecurringTransaction.ScheduleType)
+	require.Equal(t, 14*24*60*60, *proposal.RecurringTransaction.SecondsBetween)
+	require.Equal(t, day(time.June, 2), proposal.RecurringTransaction.Transaction.Date)
+
+	yearly := charges(-9900, time.Date(2015, time.June, 1, 0, 0, 0, 0, time.UTC), time.Date(2016, time.June, 1, 0, 0, 0, 0, time.UTC))
+	proposal, ok = propose(yearly, today)
+	require.True(t, ok)
+	require.Equal(t, constants.FixedDayYear, proposal.RecurringTransaction.ScheduleType)
+
+	_, ok = propose(charges(-999, day(time.March, 3), day(time.April, 3)), today)
+	require.False(t, ok, "Two monthly charges should not be enough")
+
+	unstable := charges(-999, day(time.February, 3), day(time.March, 3), day(time.April, 3), day(time.May, 3))
+	unstable[2].Amount = -1500
+	_, ok = propose(unstable, today)
+	require.False(t, ok, "Amounts that vary too much should not be proposed")
+
+	_, ok = propose(charges(-999, day(time.January, 3), day(time.February, 3), day(time.March, 3)), today)
+	require.False(t, ok, "Charges that stopped should not be proposed")
+}
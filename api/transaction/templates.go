@@ -79,12 +79,7 @@ func BatchImportTemplates(c context.Context, templates []Template) error {
 		return constants.ErrForbidden
 	}
 
-	db, err := util.SQLDBFromContext(c)
-	if err != nil {
-		return err
-	}
-
-	txn, err := db.Begin()
+	txn, commit, err := util.TxFromContext(c)
 	if err != nil {
 		logrus.WithError(err).Error("unable to begin transaction when batch inserting templates")
 		return err
@@ -117,7 +112,7 @@ func BatchImportTemplates(c context.Context, templates []Template) error {
 		return err
 	}
 
-	err = txn.Commit()
+	err = commit()
 	if err != nil {
 		logrus.WithError(err).Error("unable to commit template copy when batch inserting templates")
 		return err
@@ -168,6 +163,88 @@ func GetAllTemplates(c context.Context) ([]Template, error) {
 	return templates, nil
 }
 
+// GetAllTemplatesForUser queries for all templates of the user in the context
+func GetAllTemplatesForUser(c context.Context) ([]Template, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	templates := []Template{}
+	rows, err := db.Query("SELECT t.id, t.template_name, t.name, t.category, t.amount, t.note, t.account_id FROM templates t JOIN accounts a ON t.account_id = a.id WHERE a.user_id = $1", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch all templates for user")
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var template templateDB
+		if err := rows.Scan(&template.ID, &template.TemplateName, &template.Name, &template.Category, &template.Amount, &template.Note, &template.AccountID); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"userId": userID,
+			}).Error("failed to scan into template")
+			return nil, err
+		}
+
+		templates = append(templates, templateFromDB(template))
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to get all templates for user from rows")
+		return nil, err
+	}
+
+	return templates, nil
+}
+
+// ImportTemplatesForUser inserts templates under accounts of the user in the context, giving them fresh ids.
+// accountIDs maps the account ids in the import to ids of the user's accounts.
+func ImportTemplatesForUser(c context.Context, templates []Template, accountIDs map[int]int) error {
+	for _, accountID := range accountIDs {
+		valid, err := util.UserOwnsAccount(c, accountID)
+		if err != nil || !valid {
+			return constants.ErrForbidden
+		}
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	for _, template := range templates {
+		accountID, ok := accountIDs[template.AccountID]
+		if !ok {
+			logrus.WithField("template", template).Error("imported template belongs to an account that is not in the import")
+			return constants.ErrBadRequest
+		}
+
+		tdb := templateToDB(template)
+		_, err = db.Exec("INSERT INTO templates(template_name, name, category, amount, note, account_id) VALUES($1, $2, $3, $4, $5, $6)", tdb.TemplateName, tdb.Name, tdb.Category, tdb.Amount, tdb.Note, accountID)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":      err,
+				"templateDB": tdb,
+			}).Error("failed to insert imported template row")
+			return err
+		}
+	}
+
+	return nil
+}
+
 // NewTemplate creates a new template
 func NewTemplate(c context.Context, transaction *Template) (*Template, error) {
 	db, err := util.DBFromContext(c)
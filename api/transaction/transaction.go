@@ -5,12 +5,15 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"strconv"
 	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/lib/pq"
 
+	"github.com/jchorl/financejc/api/exchange"
+	"github.com/jchorl/financejc/api/job"
 	"github.com/jchorl/financejc/api/util"
 	"github.com/jchorl/financejc/constants"
 	"gopkg.in/olivere/elastic.v5"
@@ -37,6 +40,12 @@ type Transaction struct {
 	Note                 string    `json:"note"`
 	RelatedTransactionID int       `json:"relatedTransactionId,omitempty"`
 	AccountID            int       `json:"accountId"`
+
+	// RecurringTransactionID is the recurring transaction that the transaction was posted by or matched to, if any
+	RecurringTransactionID int `json:"recurringTransactionId,omitempty"`
+
+	// ConvertedAmount is the amount in the user's home currency, if a conversion was requested
+	ConvertedAmount *int `json:"convertedAmount,omitempty"`
 }
 
 // Query holds params to query transactions by a specific field/value pair
@@ -47,26 +56,28 @@ type Query struct {
 }
 
 type transactionDB struct {
-	ID                   int
-	Name                 string
-	Occurred             time.Time
-	Category             sql.NullString
-	Amount               int
-	Note                 sql.NullString
-	RelatedTransactionID sql.NullInt64
-	AccountID            int
+	ID                     int
+	Name                   string
+	Occurred               time.Time
+	Category               sql.NullString
+	Amount                 int
+	Note                   sql.NullString
+	RelatedTransactionID   sql.NullInt64
+	RecurringTransactionID sql.NullInt64
+	AccountID              int
 }
 
 type transactionES struct {
-	ID                   int       `json:"id,omitempty"`
-	Name                 string    `json:"name"`
-	Date                 time.Time `json:"date"`
-	Category             string    `json:"category"`
-	Amount               int       `json:"amount"`
-	Note                 string    `json:"note"`
-	RelatedTransactionID int       `json:"relatedTransactionId,omitempty"`
-	AccountID            int       `json:"accountId"`
-	UserID               uint      `json:"userId"`
+	ID                     int       `json:"id,omitempty"`
+	Name                   string    `json:"name"`
+	Date                   time.Time `json:"date"`
+	Category               string    `json:"category"`
+	Amount                 int       `json:"amount"`
+	Note                   string    `json:"note"`
+	RelatedTransactionID   int       `json:"relatedTransactionId,omitempty"`
+	RecurringTransactionID int       `json:"recurringTransactionId,omitempty"`
+	AccountID              int       `json:"accountId"`
+	UserID                 uint      `json:"userId"`
 }
 
 type nextPageParams struct {
@@ -223,9 +234,9 @@ func Get(c context.Context, accountID int, previousNextPageEncoded string) (Tran
 			return Transactions{}, err
 		}
 
-		rows, err = db.Query("SELECT id, name, occurred, category, amount, note, related_transaction_id, account_id FROM transactions WHERE account_id = $1 AND occurred < $2 ORDER BY occurred DESC, id LIMIT $3 OFFSET $4", accountID, nextPage.Reference, limitPerQuery, nextPage.Offset)
+		rows, err = db.Query("SELECT id, name, occurred, category, amount, note, related_transaction_id, recurring_transaction_id, account_id FROM transactions WHERE account_id = $1 AND occurred < $2 ORDER BY occurred DESC, id LIMIT $3 OFFSET $4", accountID, nextPage.Reference, limitPerQuery, nextPage.Offset)
 	} else {
-		rows, err = db.Query("SELECT id, name, occurred, category, amount, note, related_transaction_id, account_id FROM transactions WHERE account_id = $1 ORDER BY occurred DESC, id LIMIT $2", accountID, limitPerQuery)
+		rows, err = db.Query("SELECT id, name, occurred, category, amount, note, related_transaction_id, recurring_transaction_id, account_id FROM transactions WHERE account_id = $1 ORDER BY occurred DESC, id LIMIT $2", accountID, limitPerQuery)
 	}
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
@@ -239,7 +250,7 @@ func Get(c context.Context, accountID int, previousNextPageEncoded string) (Tran
 
 	for rows.Next() {
 		var transaction transactionDB
-		if err := rows.Scan(&transaction.ID, &transaction.Name, &transaction.Occurred, &transaction.Category, &transaction.Amount, &transaction.Note, &transaction.RelatedTransactionID, &transaction.AccountID); err != nil {
+		if err := rows.Scan(&transaction.ID, &transaction.Name, &transaction.Occurred, &transaction.Category, &transaction.Amount, &transaction.Note, &transaction.RelatedTransactionID, &transaction.RecurringTransactionID, &transaction.AccountID); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error":     err,
 				"accountId": accountID,
@@ -278,8 +289,13 @@ func Get(c context.Context, accountID int, previousNextPageEncoded string) (Tran
 	return transactions, nil
 }
 
-// Summary returns all transactions for a user since a given timestamp
-func Summary(ctx context.Context, since time.Time) ([]Transaction, error) {
+// Summary returns all transactions for a user since a given timestamp. If convert is a conversion mode,
+// amounts are also converted to the user's home currency.
+func Summary(ctx context.Context, since time.Time, convert string) ([]Transaction, error) {
+	if !exchange.ValidMode(convert) {
+		return nil, constants.ErrBadRequest
+	}
+
 	userID, err := util.UserIDFromContext(ctx)
 	if err != nil {
 		return nil, err
@@ -290,8 +306,21 @@ func Summary(ctx context.Context, since time.Time) ([]Transaction, error) {
 		return nil, err
 	}
 
+	homeCurrency := ""
+	rate := "NULL::double precision"
+	args := []interface{}{userID, since}
+	if convert != "" {
+		homeCurrency, err = exchange.HomeCurrency(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		rate = fmt.Sprintf("fx_rate(a.currency, $3, %s, a.user_id)", exchange.RateDate(convert, "t.occurred"))
+		args = append(args, homeCurrency)
+	}
+
 	transactions := []Transaction{}
-	rows, err := db.Query("SELECT t.id, t.name, t.occurred, t.category, t.amount, t.note, t.related_transaction_id, t.account_id FROM transactions t JOIN accounts a ON t.account_id = a.id WHERE a.user_id = $1 AND t.occurred >= $2 AND t.occurred <= CURRENT_DATE ORDER BY t.occurred DESC", userID, since)
+	rows, err := db.Query(fmt.Sprintf("SELECT t.id, t.name, t.occurred, t.category, t.amount, t.note, t.related_transaction_id, t.recurring_transaction_id, t.account_id, a.currency, %s FROM transactions t JOIN accounts a ON t.account_id = a.id WHERE a.user_id = $1 AND t.occurred >= $2 AND t.occurred <= CURRENT_DATE ORDER BY t.occurred DESC", rate), args...)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error":  err,
@@ -304,7 +333,9 @@ func Summary(ctx context.Context, since time.Time) ([]Transaction, error) {
 
 	for rows.Next() {
 		var transaction transactionDB
-		if err := rows.Scan(&transaction.ID, &transaction.Name, &transaction.Occurred, &transaction.Category, &transaction.Amount, &transaction.Note, &transaction.RelatedTransactionID, &transaction.AccountID); err != nil {
+		var currency string
+		var rate sql.NullFloat64
+		if err := rows.Scan(&transaction.ID, &transaction.Name, &transaction.Occurred, &transaction.Category, &transaction.Amount, &transaction.Note, &transaction.RelatedTransactionID, &transaction.RecurringTransactionID, &transaction.AccountID, &currency, &rate); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error":  err,
 				"userID": userID,
@@ -313,7 +344,22 @@ func Summary(ctx context.Context, since time.Time) ([]Transaction, error) {
 			return nil, err
 		}
 
-		transactions = append(transactions, fromDB(transaction))
+		t := fromDB(transaction)
+		if convert != "" {
+			if !rate.Valid {
+				logrus.WithFields(logrus.Fields{
+					"transactionId": t.ID,
+					"currency":      currency,
+					"home":          homeCurrency,
+				}).Error("no exchange rate to convert transaction when finding summary")
+				return nil, constants.ErrMissingExchangeRate
+			}
+
+			converted := exchange.Rescale(float64(t.Amount)*rate.Float64, currency, homeCurrency)
+			t.ConvertedAmount = &converted
+		}
+
+		transactions = append(transactions, t)
 	}
 	if err := rows.Err(); err != nil {
 		logrus.WithFields(logrus.Fields{
@@ -333,18 +379,13 @@ func BatchImport(c context.Context, transactions []Transaction) error {
 		return constants.ErrForbidden
 	}
 
-	db, err := util.SQLDBFromContext(c)
-	if err != nil {
-		return err
-	}
-
-	txn, err := db.Begin()
+	txn, commit, err := util.TxFromContext(c)
 	if err != nil {
 		logrus.WithError(err).Error("unable to begin transaction when batch inserting transactions")
 		return err
 	}
 
-	stmt, err := txn.Prepare(pq.CopyIn("transactions", "id", "name", "occurred", "category", "amount", "note", "related_transaction_id", "account_id"))
+	stmt, err := txn.Prepare(pq.CopyIn("transactions", "id", "name", "occurred", "category", "amount", "note", "related_transaction_id", "recurring_transaction_id", "account_id"))
 	if err != nil {
 		logrus.WithError(err).Error("unable to begin copy in when batch inserting transactions")
 		return err
@@ -352,7 +393,7 @@ func BatchImport(c context.Context, transactions []Transaction) error {
 
 	for _, transaction := range transactions {
 		tdb := toDB(transaction)
-		_, err = stmt.Exec(tdb.ID, tdb.Name, tdb.Occurred, tdb.Category, tdb.Amount, tdb.Note, tdb.RelatedTransactionID, tdb.AccountID)
+		_, err = stmt.Exec(tdb.ID, tdb.Name, tdb.Occurred, tdb.Category, tdb.Amount, tdb.Note, tdb.RelatedTransactionID, tdb.RecurringTransactionID, tdb.AccountID)
 		if err != nil {
 			logrus.WithError(err).Error("unable to exec transaction copy when batch inserting transactions")
 			return err
@@ -371,7 +412,7 @@ func BatchImport(c context.Context, transactions []Transaction) error {
 		return err
 	}
 
-	err = txn.Commit()
+	err = commit()
 	if err != nil {
 		logrus.WithError(err).Error("unable to commit transaction copy when batch inserting transactions")
 		return err
@@ -380,6 +421,105 @@ func BatchImport(c context.Context, transactions []Transaction) error {
 	return nil
 }
 
+// ImportForUser inserts transactions under accounts of the user in the context, giving them fresh ids.
+// accountIDs maps the account ids in the import to ids of the user's accounts, and related transaction ids
+// are remapped to the fresh transaction ids. The mapping of imported to fresh transaction ids is returned.
+// Transactions are not indexed in elasticsearch, so call PushToESForUser once the import is committed.
+func ImportForUser(c context.Context, transactions []Transaction, accountIDs map[int]int) (map[int]int, error) {
+	for _, accountID := range accountIDs {
+		valid, err := util.UserOwnsAccount(c, accountID)
+		if err != nil || !valid {
+			return nil, constants.ErrForbidden
+		}
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	insert, err := db.Prepare("INSERT INTO transactions(name, occurred, category, amount, note, account_id) VALUES($1, $2, $3, $4, $5, $6) RETURNING id")
+	if err != nil {
+		logrus.WithError(err).Error("unable to prepare insert when importing transactions")
+		return nil, err
+	}
+	defer insert.Close()
+
+	transactionIDs := map[int]int{}
+	for _, transaction := range transactions {
+		accountID, ok := accountIDs[transaction.AccountID]
+		if !ok {
+			logrus.WithField("transaction", transaction).Error("imported transaction belongs to an account that is not in the import")
+			return nil, constants.ErrBadRequest
+		}
+
+		tdb := toDB(transaction)
+		var id int
+		if err := insert.QueryRow(tdb.Name, tdb.Occurred, tdb.Category, tdb.Amount, tdb.Note, accountID).Scan(&id); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":       err,
+				"transaction": transaction,
+			}).Error("failed to insert imported transaction row")
+			return nil, err
+		}
+		transactionIDs[transaction.ID] = id
+	}
+
+	// related transactions can only be linked once every transaction has its fresh id
+	for _, transaction := range transactions {
+		if transaction.RelatedTransactionID == 0 {
+			continue
+		}
+
+		relatedID, ok := transactionIDs[transaction.RelatedTransactionID]
+		if !ok {
+			logrus.WithField("transaction", transaction).Error("imported transaction is related to a transaction that is not in the import")
+			return nil, constants.ErrBadRequest
+		}
+
+		if _, err := db.Exec("UPDATE transactions SET related_transaction_id = $1 WHERE id = $2", relatedID, transactionIDs[transaction.ID]); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":       err,
+				"transaction": transaction,
+			}).Error("failed to link imported related transactions")
+			return nil, err
+		}
+	}
+
+	return transactionIDs, nil
+}
+
+// LinkImportedToRecurring links transactions imported with ImportForUser to the recurring transactions they were
+// linked to in the import, given the mappings of imported to fresh transaction and recurring transaction ids
+func LinkImportedToRecurring(c context.Context, transactions []Transaction, transactionIDs, recurringIDs map[int]int) error {
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	for _, transaction := range transactions {
+		if transaction.RecurringTransactionID == 0 {
+			continue
+		}
+
+		recurringID, ok := recurringIDs[transaction.RecurringTransactionID]
+		if !ok {
+			logrus.WithField("transaction", transaction).Error("imported transaction is linked to a recurring transaction that is not in the import")
+			return constants.ErrBadRequest
+		}
+
+		if _, err := db.Exec("UPDATE transactions SET recurring_transaction_id = $1 WHERE id = $2", recurringID, transactionIDs[transaction.ID]); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":       err,
+				"transaction": transaction,
+			}).Error("failed to link imported transaction to recurring transaction")
+			return err
+		}
+	}
+
+	return nil
+}
+
 // GetAll queries for all transactions
 func GetAll(c context.Context) ([]Transaction, error) {
 	if !util.IsAdminRequest(c) {
@@ -392,7 +532,7 @@ func GetAll(c context.Context) ([]Transaction, error) {
 	}
 
 	transactions := []Transaction{}
-	rows, err := db.Query("SELECT id, name, occurred, category, amount, note, related_transaction_id, account_id FROM transactions")
+	rows, err := db.Query("SELECT id, name, occurred, category, amount, note, related_transaction_id, recurring_transaction_id, account_id FROM transactions")
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error": err,
@@ -403,7 +543,7 @@ func GetAll(c context.Context) ([]Transaction, error) {
 
 	for rows.Next() {
 		var transaction transactionDB
-		if err := rows.Scan(&transaction.ID, &transaction.Name, &transaction.Occurred, &transaction.Category, &transaction.Amount, &transaction.Note, &transaction.RelatedTransactionID, &transaction.AccountID); err != nil {
+		if err := rows.Scan(&transaction.ID, &transaction.Name, &transaction.Occurred, &transaction.Category, &transaction.Amount, &transaction.Note, &transaction.RelatedTransactionID, &transaction.RecurringTransactionID, &transaction.AccountID); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
 			}).Error("failed to scan into transaction")
@@ -422,6 +562,52 @@ func GetAll(c context.Context) ([]Transaction, error) {
 	return transactions, nil
 }
 
+// GetAllForUser queries for all transactions of the user in the context
+func GetAllForUser(c context.Context) ([]Transaction, error) {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return nil, err
+	}
+
+	transactions := []Transaction{}
+	rows, err := db.Query("SELECT t.id, t.name, t.occurred, t.category, t.amount, t.note, t.related_transaction_id, t.recurring_transaction_id, t.account_id FROM transactions t JOIN accounts a ON t.account_id = a.id WHERE a.user_id = $1", userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to fetch all transactions for user")
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var transaction transactionDB
+		if err := rows.Scan(&transaction.ID, &transaction.Name, &transaction.Occurred, &transaction.Category, &transaction.Amount, &transaction.Note, &transaction.RelatedTransactionID, &transaction.RecurringTransactionID, &transaction.AccountID); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"userId": userID,
+			}).Error("failed to scan into transaction")
+			return nil, err
+		}
+
+		transactions = append(transactions, fromDB(transaction))
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to get all transactions for user from rows")
+		return nil, err
+	}
+
+	return transactions, nil
+}
+
 // SearchES does a general search over all fields in ES
 func SearchES(ctx context.Context, value string) ([]Transaction, error) {
 	userID, err := util.UserIDFromContext(ctx)
@@ -570,7 +756,7 @@ func newWithoutVerifyingAccountOwnership(ctx context.Context, transaction *Trans
 
 	tdb := toDB(*transaction)
 	var id int
-	err = db.QueryRow("INSERT INTO transactions(name, occurred, category, amount, note, related_transaction_id, account_id) VALUES($1, $2, $3, $4, $5, $6, $7) RETURNING id", tdb.Name, tdb.Occurred, tdb.Category, tdb.Amount, tdb.Note, tdb.RelatedTransactionID, tdb.AccountID).Scan(&id)
+	err = db.QueryRow("INSERT INTO transactions(name, occurred, category, amount, note, related_transaction_id, recurring_transaction_id, account_id) VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id", tdb.Name, tdb.Occurred, tdb.Category, tdb.Amount, tdb.Note, tdb.RelatedTransactionID, tdb.RecurringTransactionID, tdb.AccountID).Scan(&id)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error":         err,
@@ -606,17 +792,27 @@ func newWithoutVerifyingAccountOwnership(ctx context.Context, transaction *Trans
 
 // Update updates a transaction
 func Update(ctx context.Context, transaction *Transaction) (*Transaction, error) {
-	db, err := util.DBFromContext(ctx)
-	if err != nil {
-		return nil, err
-	}
-
 	// Check account ownership instead of transaction in case transactions can be moved between accounts in the future
 	valid, err := util.UserOwnsAccount(ctx, transaction.AccountID)
 	if err != nil || !valid {
 		return nil, constants.ErrForbidden
 	}
 
+	userID, err := util.UserIDFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return updateWithoutVerifyingAccountOwnership(ctx, transaction, userID)
+}
+
+// updateWithoutVerifyingAccountOwnership updates a transaction without checking that the context has the owner of the account
+func updateWithoutVerifyingAccountOwnership(ctx context.Context, transaction *Transaction, userID uint) (*Transaction, error) {
+	db, err := util.DBFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
 	tdb := toDB(*transaction)
 	_, err = db.Exec("UPDATE transactions SET name = $1, occurred = $2, category = $3, amount = $4, note = $5, related_transaction_id = $6 WHERE id = $7", tdb.Name, tdb.Occurred, tdb.Category, tdb.Amount, tdb.Note, tdb.RelatedTransactionID, tdb.ID)
 	if err != nil {
@@ -633,11 +829,6 @@ func Update(ctx context.Context, transaction *Transaction) (*Transaction, error)
 		return nil, err
 	}
 
-	userID, err := util.UserIDFromContext(ctx)
-	if err != nil {
-		return nil, err
-	}
-
 	// indexing a doc with the same id will replace and bump the version number
 	_, err = es.Index().
 		Index(constants.ESIndex).
@@ -730,7 +921,13 @@ func PushAllToES(c context.Context) error {
 
 	esBulkReq := es.Bulk().Index(constants.ESIndex).Type(esType)
 
-	rows, err := db.Query("SELECT t.id, t.name, t.occurred, t.category, t.amount, t.note, t.related_transaction_id, t.account_id, a.user_id FROM transactions t JOIN accounts a on t.account_id = a.id")
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM transactions").Scan(&total); err != nil {
+		logrus.WithError(err).Error("failed to count all transactions")
+		return err
+	}
+
+	rows, err := db.Query("SELECT t.id, t.name, t.occurred, t.category, t.amount, t.note, t.related_transaction_id, t.recurring_transaction_id, t.account_id, a.user_id FROM transactions t JOIN accounts a on t.account_id = a.id")
 	if err != nil {
 		logrus.WithError(err).Error("failed to fetch all transactions")
 		return err
@@ -740,7 +937,7 @@ func PushAllToES(c context.Context) error {
 	for rows.Next() {
 		var transaction transactionDB
 		var userID uint
-		if err := rows.Scan(&transaction.ID, &transaction.Name, &transaction.Occurred, &transaction.Category, &transaction.Amount, &transaction.Note, &transaction.RelatedTransactionID, &transaction.AccountID, &userID); err != nil {
+		if err := rows.Scan(&transaction.ID, &transaction.Name, &transaction.Occurred, &transaction.Category, &transaction.Amount, &transaction.Note, &transaction.RelatedTransactionID, &transaction.RecurringTransactionID, &transaction.AccountID, &userID); err != nil {
 			logrus.WithError(err).Error("failed to scan into transaction")
 			return err
 		}
@@ -749,6 +946,7 @@ func PushAllToES(c context.Context) error {
 		esBulkReq.Add(
 			elastic.NewBulkIndexRequest().Id(strconv.Itoa(transaction.ID)).Doc(toES(&parsed, userID)),
 		)
+		job.Progress(c, esBulkReq.NumberOfActions(), total)
 	}
 	if err := rows.Err(); err != nil {
 		logrus.WithError(err).Error("failed to get transactions from rows")
@@ -764,6 +962,68 @@ func PushAllToES(c context.Context) error {
 	return nil
 }
 
+// PushToESForUser indexes all transactions of the user in the context in elasticsearch
+func PushToESForUser(c context.Context) error {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	transactions, err := GetAllForUser(c)
+	if err != nil {
+		return err
+	}
+
+	if len(transactions) == 0 {
+		return nil
+	}
+
+	es, err := util.ESFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	esBulkReq := es.Bulk().Index(constants.ESIndex).Type(esType)
+	for i := range transactions {
+		esBulkReq.Add(
+			elastic.NewBulkIndexRequest().Id(strconv.Itoa(transactions[i].ID)).Doc(toES(&transactions[i], userID)),
+		)
+	}
+
+	_, err = esBulkReq.Do(context.Background())
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to bulk post transactions of user to es")
+		return err
+	}
+
+	return nil
+}
+
+// DeleteAllFromESForUser removes every transaction of a user from elasticsearch
+func DeleteAllFromESForUser(c context.Context, userID uint) error {
+	es, err := util.ESFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = es.DeleteByQuery(constants.ESIndex).
+		Type(esType).
+		Query(elastic.NewTermQuery("userId", userID)).
+		Do(context.Background())
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+		}).Error("failed to delete transactions of user from elasticsearch")
+		return err
+	}
+
+	return nil
+}
+
 func encodeNextPage(decoded nextPageParams) (string, error) {
 	bts, err := json.Marshal(decoded)
 	if err != nil {
@@ -793,53 +1053,57 @@ func decodeNextPage(encoded string) (nextPageParams, error) {
 
 func toDB(transaction Transaction) *transactionDB {
 	return &transactionDB{
-		ID:                   transaction.ID,
-		Name:                 transaction.Name,
-		Occurred:             transaction.Date,
-		Category:             util.ToNullStringNonEmpty(transaction.Category),
-		Amount:               transaction.Amount,
-		Note:                 util.ToNullStringNonEmpty(transaction.Note),
-		RelatedTransactionID: util.ToNullIntNonZero(transaction.RelatedTransactionID),
-		AccountID:            transaction.AccountID,
+		ID:                     transaction.ID,
+		Name:                   transaction.Name,
+		Occurred:               transaction.Date,
+		Category:               util.ToNullStringNonEmpty(transaction.Category),
+		Amount:                 transaction.Amount,
+		Note:                   util.ToNullStringNonEmpty(transaction.Note),
+		RelatedTransactionID:   util.ToNullIntNonZero(transaction.RelatedTransactionID),
+		RecurringTransactionID: util.ToNullIntNonZero(transaction.RecurringTransactionID),
+		AccountID:              transaction.AccountID,
 	}
 }
 
 func fromDB(transaction transactionDB) Transaction {
 	return Transaction{
-		ID:                   transaction.ID,
-		Name:                 transaction.Name,
-		Date:                 transaction.Occurred,
-		Category:             util.FromNullStringNonEmpty(transaction.Category),
-		Amount:               transaction.Amount,
-		Note:                 util.FromNullStringNonEmpty(transaction.Note),
-		RelatedTransactionID: util.FromNullIntNonZero(transaction.RelatedTransactionID),
-		AccountID:            transaction.AccountID,
+		ID:                     transaction.ID,
+		Name:                   transaction.Name,
+		Date:                   transaction.Occurred,
+		Category:               util.FromNullStringNonEmpty(transaction.Category),
+		Amount:                 transaction.Amount,
+		Note:                   util.FromNullStringNonEmpty(transaction.Note),
+		RelatedTransactionID:   util.FromNullIntNonZero(transaction.RelatedTransactionID),
+		RecurringTransactionID: util.FromNullIntNonZero(transaction.RecurringTransactionID),
+		AccountID:              transaction.AccountID,
 	}
 }
 
 func toES(transaction *Transaction, userID uint) transactionES {
 	return transactionES{
-		ID:                   transaction.ID,
-		Name:                 transaction.Name,
-		Date:                 transaction.Date,
-		Category:             transaction.Category,
-		Amount:               transaction.Amount,
-		Note:                 transaction.Note,
-		RelatedTransactionID: transaction.RelatedTransactionID,
-		AccountID:            transaction.AccountID,
-		UserID:               userID,
+		ID:                     transaction.ID,
+		Name:                   transaction.Name,
+		Date:                   transaction.Date,
+		Category:               transaction.Category,
+		Amount:                 transaction.Amount,
+		Note:                   transaction.Note,
+		RelatedTransactionID:   transaction.RelatedTransactionID,
+		RecurringTransactionID: transaction.RecurringTransactionID,
+		AccountID:              transaction.AccountID,
+		UserID:                 userID,
 	}
 }
 
 func fromES(transaction transactionES) Transaction {
 	return Transaction{
-		ID:                   transaction.ID,
-		Name:                 transaction.Name,
-		Date:                 transaction.Date,
-		Category:             transaction.Category,
-		Amount:               transaction.Amount,
-		Note:                 transaction.Note,
-		RelatedTransactionID: transaction.RelatedTransactionID,
-		AccountID:            transaction.AccountID,
+		ID:                     transaction.ID,
+		Name:                   transaction.Name,
+		Date:                   transaction.Date,
+		Category:               transaction.Category,
+		Amount:                 transaction.Amount,
+		Note:                   transaction.Note,
+		RelatedTransactionID:   transaction.RelatedTransactionID,
+		RecurringTransactionID: transaction.RecurringTransactionID,
+		AccountID:              transaction.AccountID,
 	}
 }
@@ -0,0 +1,239 @@
+package batchTransfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/Sirupsen/logrus"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+
+	"github.com/jchorl/financejc/api/job"
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+const (
+	manifestObject  = "manifest.json"
+	backupExtension = ".json.gz.enc"
+)
+
+// manifest lists every backup that is managed by the retention policy
+type manifest struct {
+	Backups []Backup `json:"backups"`
+}
+
+// Backup describes a single backup object in the bucket, along with
+// the row counts and per-account checksums needed to verify a restore of it
+type Backup struct {
+	Name             string         `json:"name"`
+	Created          time.Time      `json:"created"`
+	Size             int            `json:"size"`
+	SHA256           string         `json:"sha256"`
+	RowCounts        map[string]int `json:"rowCounts,omitempty"`
+	AccountChecksums map[int]string `json:"accountChecksums,omitempty"`
+}
+
+// BackupToGCS exports all app data, compresses and encrypts it, pushes it to a GCS bucket
+// and then prunes backups that fall outside of the retention policy
+func BackupToGCS(c context.Context) error {
+	logrus.Debug("starting regular backup to GCS")
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	gctx := context.Background()
+	bucket, err := backupBucket(gctx)
+	if err != nil {
+		return err
+	}
+
+	// progress is reported per stage of the backup rather than per table of the export
+	allData, err := exportData(context.WithValue(c, constants.CtxJob, nil))
+	if err != nil {
+		logrus.WithError(err).Error("failed to generate export for periodic backup")
+		return err
+	}
+	job.Progress(c, 1, 4)
+
+	content, err := encode(allData)
+	if err != nil {
+		return err
+	}
+
+	sealed, err := seal([]byte(content))
+	if err != nil {
+		return err
+	}
+	job.Progress(c, 2, 4)
+
+	created := time.Now().UTC()
+	entry := Backup{
+		Name:    created.Format("20060102T150405") + backupExtension,
+		Created: created,
+		Size:    len(sealed),
+		SHA256:  checksum(sealed),
+
+		RowCounts:        rowCounts(allData),
+		AccountChecksums: accountChecksums(allData),
+	}
+
+	w := bucket.Object(entry.Name).NewWriter(gctx)
+	if _, err := w.Write(sealed); err != nil {
+		logrus.WithError(err).Error("unable to write to object when creating backup")
+		return err
+	}
+	if err := w.Close(); err != nil {
+		logrus.WithError(err).Error("unable to close writer when creating backup")
+		return err
+	}
+	job.Progress(c, 3, 4)
+
+	m, err := readManifest(gctx, bucket)
+	if err != nil {
+		return err
+	}
+	m.Backups = append(m.Backups, entry)
+
+	pruned := backupsToPrune(m.Backups, constants.BackupKeepDaily, constants.BackupKeepWeekly, constants.BackupKeepMonthly)
+	m.Backups = removeEntries(m.Backups, pruned)
+
+	// write the manifest before deleting objects so that it never references a missing backup
+	if err := writeManifest(gctx, bucket, m); err != nil {
+		return err
+	}
+
+	for _, p := range pruned {
+		if err := bucket.Object(p.Name).Delete(gctx); err != nil && err != storage.ErrObjectNotExist {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"backup": p.Name,
+			}).Error("unable to prune backup")
+			return err
+		}
+		logrus.Debugf("pruned backup: %s", p.Name)
+	}
+
+	job.Progress(c, 4, 4)
+	logrus.Debugf("backup finished successfully with filename: %s", entry.Name)
+	return nil
+}
+
+// backupBucket connects to GCS and returns the backup bucket, creating it if it does not exist
+func backupBucket(gctx context.Context) (*storage.BucketHandle, error) {
+	conf, err := google.JWTConfigFromJSON([]byte(constants.GcsAccountJSON), storage.ScopeReadWrite)
+	if err != nil {
+		logrus.WithError(err).Error("failed to create jwt config from json")
+		return nil, err
+	}
+
+	client, err := storage.NewClient(
+		gctx,
+		option.WithTokenSource(conf.TokenSource(gctx)),
+	)
+	if err != nil {
+		logrus.WithError(err).Error("unable to create storage client")
+		return nil, err
+	}
+
+	backupsBucketExists := false
+	bucketIter := client.Buckets(gctx, constants.GoogleProjectID)
+	for {
+		bucketAttrs, err := bucketIter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			logrus.WithError(err).Error("error iterating gcs buckets")
+			return nil, err
+		}
+
+		if bucketAttrs.Name == constants.GcsBackupBucket {
+			backupsBucketExists = true
+		}
+	}
+
+	bucket := client.Bucket(constants.GcsBackupBucket)
+	if !backupsBucketExists {
+		if err := bucket.Create(gctx, constants.GoogleProjectID, &storage.BucketAttrs{StorageClass: "REGIONAL", Location: "us-central1"}); err != nil {
+			logrus.WithError(err).Error("error creating backup bucket")
+			return nil, err
+		}
+	}
+
+	return bucket, nil
+}
+
+// readManifest fetches the manifest from the bucket, returning an empty manifest if there is none yet
+func readManifest(gctx context.Context, bucket *storage.BucketHandle) (manifest, error) {
+	m := manifest{}
+	r, err := bucket.Object(manifestObject).NewReader(gctx)
+	if err == storage.ErrObjectNotExist {
+		return m, nil
+	} else if err != nil {
+		logrus.WithError(err).Error("unable to open backup manifest")
+		return m, err
+	}
+	defer r.Close()
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		logrus.WithError(err).Error("unable to read backup manifest")
+		return m, err
+	}
+
+	if err := json.Unmarshal(content, &m); err != nil {
+		logrus.WithError(err).Error("unable to decode backup manifest")
+		return m, err
+	}
+
+	return m, nil
+}
+
+func writeManifest(gctx context.Context, bucket *storage.BucketHandle, m manifest) error {
+	content, err := json.Marshal(m)
+	if err != nil {
+		logrus.WithError(err).Error("unable to encode backup manifest")
+		return err
+	}
+
+	w := bucket.Object(manifestObject).NewWriter(gctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(content); err != nil {
+		logrus.WithError(err).Error("unable to write backup manifest")
+		return err
+	}
+	if err := w.Close(); err != nil {
+		logrus.WithError(err).Error("unable to close writer when writing backup manifest")
+		return err
+	}
+
+	return nil
+}
+
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func removeEntries(entries, toRemove []Backup) []Backup {
+	removed := map[string]bool{}
+	for _, entry := range toRemove {
+		removed[entry.Name] = true
+	}
+
+	kept := []Backup{}
+	for _, entry := range entries {
+		if !removed[entry.Name] {
+			kept = append(kept, entry)
+		}
+	}
+
+	return kept
+}
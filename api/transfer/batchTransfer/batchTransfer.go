@@ -4,15 +4,19 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"time"
 
-	"cloud.google.com/go/storage"
 	"github.com/Sirupsen/logrus"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
 
 	"github.com/jchorl/financejc/api/account"
+	"github.com/jchorl/financejc/api/anomaly"
+	"github.com/jchorl/financejc/api/audit"
+	"github.com/jchorl/financejc/api/budget"
+	"github.com/jchorl/financejc/api/exchange"
+	"github.com/jchorl/financejc/api/goal"
+	"github.com/jchorl/financejc/api/holiday"
+	"github.com/jchorl/financejc/api/investment"
+	"github.com/jchorl/financejc/api/job"
+	"github.com/jchorl/financejc/api/tax"
 	"github.com/jchorl/financejc/api/transaction"
 	"github.com/jchorl/financejc/api/user"
 	"github.com/jchorl/financejc/api/util"
@@ -20,121 +24,186 @@ import (
 )
 
 type fjcData struct {
-	Users                 []user.User                        `json:"users"`
-	Accounts              []account.Account                  `json:"accounts"`
-	Transactions          []transaction.Transaction          `json:"transactions"`
-	RecurringTransactions []transaction.RecurringTransaction `json:"recurringTransactions"`
-	Templates             []transaction.Template             `json:"templates"`
+	Users                  []user.User                        `json:"users"`
+	Accounts               []account.Account                  `json:"accounts"`
+	Transactions           []transaction.Transaction          `json:"transactions"`
+	RecurringTransactions  []transaction.RecurringTransaction `json:"recurringTransactions"`
+	Templates              []transaction.Template             `json:"templates"`
+	Loans                  []transaction.Loan                 `json:"loans"`
+	Budgets                []budget.Budget                    `json:"budgets"`
+	EnvelopeAssignments    []budget.Assignment                `json:"envelopeAssignments"`
+	IncomeCategories       []budget.IncomeCategory            `json:"incomeCategories"`
+	Goals                  []goal.Goal                        `json:"goals"`
+	TaxLines               []tax.Line                         `json:"taxLines"`
+	Anomalies              []anomaly.Anomaly                  `json:"anomalies"`
+	Holidays               []holiday.Holiday                  `json:"holidays"`
+	RecurringExceptions    []transaction.RecurringException   `json:"recurringExceptions"`
+	ExchangeRates          []exchange.Rate                    `json:"exchangeRates"`
+	Securities             []investment.Security              `json:"securities"`
+	SecurityPrices         []investment.Price                 `json:"securityPrices"`
+	InvestmentTransactions []investment.Transaction           `json:"investmentTransactions"`
+	AuditLog               []audit.Entry                      `json:"auditLog"`
 }
 
-// BackupToGCS exports all app data and pushes it to a GCS bucket
-func BackupToGCS(c context.Context) error {
-	logrus.Debug("starting regular backup to GCS")
+// Export queries for all data, packages it up and exports it
+func Export(c context.Context) (string, error) {
+	allData, err := exportData(c)
+	if err != nil {
+		return "", err
+	}
+
+	return encode(allData)
+}
+
+func exportData(c context.Context) (fjcData, error) {
 	if !util.IsAdminRequest(c) {
-		return constants.ErrForbidden
+		return fjcData{}, constants.ErrForbidden
 	}
 
-	conf, err := google.JWTConfigFromJSON([]byte(constants.GcsAccountJSON), storage.ScopeReadWrite)
+	// exported counts the backed up tables that have been exported, for the progress of the export job
+	exported := 0
+	progress := func(tables int) {
+		exported += tables
+		job.Progress(c, exported, len(backedUpTables))
+	}
+
+	allData := fjcData{}
+	users, err := user.GetAll(c)
 	if err != nil {
-		logrus.WithError(err).Error("failed to create jwt config from json")
-		return err
+		return fjcData{}, err
 	}
+	allData.Users = users
+	progress(1)
 
-	gctx := context.Background()
-	client, err := storage.NewClient(
-		gctx,
-		option.WithTokenSource(conf.TokenSource(gctx)),
-	)
+	accounts, err := account.GetAll(c)
 	if err != nil {
-		logrus.WithError(err).Error("unable to create storage client")
-		return err
+		return fjcData{}, err
 	}
+	allData.Accounts = accounts
+	progress(1)
 
-	backupsBucketExists := false
-	bucketIter := client.Buckets(gctx, constants.GoogleProjectID)
-	for {
-		bucketAttrs, err := bucketIter.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			logrus.WithError(err).Error("error iterating gcs buckets")
-			return err
-		}
+	transactions, err := transaction.GetAll(c)
+	if err != nil {
+		return fjcData{}, err
+	}
+	allData.Transactions = transactions
+	progress(1)
 
-		if bucketAttrs.Name == constants.GcsBackupBucket {
-			backupsBucketExists = true
-		}
+	templates, err := transaction.GetAllTemplates(c)
+	if err != nil {
+		return fjcData{}, err
 	}
+	allData.Templates = templates
+	progress(1)
 
-	bucket := client.Bucket(constants.GcsBackupBucket)
-	if !backupsBucketExists {
-		if err := bucket.Create(gctx, constants.GoogleProjectID, &storage.BucketAttrs{StorageClass: "REGIONAL", Location: "us-central1"}); err != nil {
-			logrus.WithError(err).Error("error creating backup bucket")
-			return err
-		}
+	recurringTransactions, err := transaction.GetAllRecurring(c)
+	if err != nil {
+		return fjcData{}, err
 	}
+	allData.RecurringTransactions = recurringTransactions
+	progress(1)
 
-	content, err := Export(c)
+	loans, err := transaction.GetAllLoans(c)
 	if err != nil {
-		logrus.WithError(err).Error("failed to generate export for periodic backup")
-		return err
+		return fjcData{}, err
 	}
+	allData.Loans = loans
+	progress(1)
 
-	filename := time.Now().Format("20060102T150405")
-	obj := bucket.Object(filename)
-	w := obj.NewWriter(gctx)
-	if _, err := fmt.Fprint(w, content); err != nil {
-		logrus.WithError(err).Error("unable to write to object when creating backup")
-		return err
+	budgets, err := budget.GetAll(c)
+	if err != nil {
+		return fjcData{}, err
 	}
-	if err := w.Close(); err != nil {
-		logrus.WithError(err).Error("unable to close writer when creating backup")
-		return err
+	allData.Budgets = budgets
+	progress(1)
+
+	assignments, err := budget.GetAllAssignments(c)
+	if err != nil {
+		return fjcData{}, err
 	}
+	allData.EnvelopeAssignments = assignments
+	progress(1)
 
-	logrus.Debugf("backup finished successfully with filename: %s", filename)
-	return nil
-}
+	incomeCategories, err := budget.GetAllIncomeCategories(c)
+	if err != nil {
+		return fjcData{}, err
+	}
+	allData.IncomeCategories = incomeCategories
+	progress(1)
 
-// Export queries for all data, packages it up and exports it
-func Export(c context.Context) (string, error) {
-	if !util.IsAdminRequest(c) {
-		return "", constants.ErrForbidden
+	goals, err := goal.GetAll(c)
+	if err != nil {
+		return fjcData{}, err
 	}
+	allData.Goals = goals
+	progress(1)
 
-	allData := fjcData{}
-	users, err := user.GetAll(c)
+	taxLines, err := tax.GetAll(c)
 	if err != nil {
-		return "", err
+		return fjcData{}, err
 	}
-	allData.Users = users
+	allData.TaxLines = taxLines
+	// tax line categories are exported with their tax lines
+	progress(2)
 
-	accounts, err := account.GetAll(c)
+	anomalies, err := anomaly.GetAll(c)
 	if err != nil {
-		return "", err
+		return fjcData{}, err
 	}
-	allData.Accounts = accounts
+	allData.Anomalies = anomalies
+	progress(1)
 
-	transactions, err := transaction.GetAll(c)
+	holidays, err := holiday.GetAll(c)
 	if err != nil {
-		return "", err
+		return fjcData{}, err
 	}
-	allData.Transactions = transactions
+	allData.Holidays = holidays
+	progress(1)
 
-	templates, err := transaction.GetAllTemplates(c)
+	exceptions, err := transaction.GetAllExceptions(c)
 	if err != nil {
-		return "", err
+		return fjcData{}, err
 	}
-	allData.Templates = templates
+	allData.RecurringExceptions = exceptions
+	progress(1)
 
-	recurringTransactions, err := transaction.GetAllRecurring(c)
+	rates, err := exchange.GetAll(c)
 	if err != nil {
-		return "", err
+		return fjcData{}, err
 	}
-	allData.RecurringTransactions = recurringTransactions
+	allData.ExchangeRates = rates
+	progress(1)
 
-	return encode(allData)
+	securities, err := investment.GetAllSecurities(c)
+	if err != nil {
+		return fjcData{}, err
+	}
+	allData.Securities = securities
+	progress(1)
+
+	prices, err := investment.GetAllPrices(c)
+	if err != nil {
+		return fjcData{}, err
+	}
+	allData.SecurityPrices = prices
+	progress(1)
+
+	// lot selections are exported with the sales that make them
+	investmentTransactions, err := investment.GetAll(c)
+	if err != nil {
+		return fjcData{}, err
+	}
+	allData.InvestmentTransactions = investmentTransactions
+	progress(2)
+
+	auditLog, err := audit.GetAll(c)
+	if err != nil {
+		return fjcData{}, err
+	}
+	allData.AuditLog = auditLog
+	progress(1)
+
+	return allData, nil
 }
 
 // Import batch imports the result of an export
@@ -148,59 +217,146 @@ func Import(c context.Context, encoded string) error {
 		return err
 	}
 
-	if err = user.BatchImport(c, allData.Users); err != nil {
+	return importData(c, allData)
+}
+
+func importData(c context.Context, allData fjcData) error {
+	if err := batchImportData(c, allData); err != nil {
 		return err
 	}
 
-	if err = account.BatchImport(c, allData.Accounts); err != nil {
+	// update all the auto-increment sequences
+	db, err := util.DBFromContext(c)
+	if err != nil {
 		return err
 	}
 
-	if err = transaction.BatchImport(c, allData.Transactions); err != nil {
+	if err := resetSequences(db); err != nil {
 		return err
 	}
 
-	if err = transaction.BatchImportTemplates(c, allData.Templates); err != nil {
+	// lots are derived from the investment transactions, so they are not backed up
+	if err := investment.RebuildAllLots(c); err != nil {
 		return err
 	}
 
-	if err = transaction.BatchImportRecurringTransactions(c, allData.RecurringTransactions); err != nil {
+	return nil
+}
+
+// resetSequences moves the id sequence of every backed up table that has one past the largest id in the table
+func resetSequences(db util.DB) error {
+	rows, err := db.Query("SELECT table_name FROM information_schema.columns WHERE table_schema = current_schema() AND column_name = 'id' AND column_default LIKE 'nextval%'")
+	if err != nil {
+		logrus.WithError(err).Error("unable to query for tables with id sequences")
 		return err
 	}
+	defer rows.Close()
 
-	// update all the auto-increment sequences
-	db, err := util.DBFromContext(c)
-	if err != nil {
+	sequenced := map[string]bool{}
+	for rows.Next() {
+		var table string
+		if err := rows.Scan(&table); err != nil {
+			logrus.WithError(err).Error("unable to scan table with an id sequence")
+			return err
+		}
+		sequenced[table] = true
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("unable to get tables with id sequences from rows")
 		return err
 	}
 
-	_, err = db.Query(`SELECT setval('users_id_seq', (SELECT MAX(id) from "users"));`)
-	if err != nil {
-		logrus.WithError(err).Error("unable to update the users sequence")
+	for _, table := range backedUpTables {
+		if !sequenced[table] {
+			continue
+		}
+
+		// table names cannot be parameterized, but they all come from backedUpTables
+		_, err := db.Exec(fmt.Sprintf(`SELECT setval(pg_get_serial_sequence('%[1]s', 'id'), MAX(id)) FROM "%[1]s"`, table))
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"table": table,
+			}).Error("unable to update the id sequence of table")
+			return err
+		}
+	}
+
+	return nil
+}
+
+// batchImportData copies every row of allData into the tables of the db in the context, keeping ids
+func batchImportData(c context.Context, allData fjcData) error {
+	if err := user.BatchImport(c, allData.Users); err != nil {
 		return err
 	}
 
-	_, err = db.Query(`SELECT setval('accounts_id_seq', (SELECT MAX(id) from "accounts"));`)
-	if err != nil {
-		logrus.WithError(err).Error("unable to update the accounts sequence")
+	if err := account.BatchImport(c, allData.Accounts); err != nil {
 		return err
 	}
 
-	_, err = db.Query(`SELECT setval('transactions_id_seq', (SELECT MAX(id) from "transactions"));`)
-	if err != nil {
-		logrus.WithError(err).Error("unable to update the transactions sequence")
+	// transactions can point at the recurring transactions that posted them
+	if err := transaction.BatchImportRecurringTransactions(c, allData.RecurringTransactions); err != nil {
 		return err
 	}
 
-	_, err = db.Query(`SELECT setval('recurring_transactions_id_seq', (SELECT MAX(id) from "recurring_transactions"));`)
-	if err != nil {
-		logrus.WithError(err).Error("unable to update the recurring_transactions sequence")
+	if err := transaction.BatchImport(c, allData.Transactions); err != nil {
 		return err
 	}
 
-	_, err = db.Query(`SELECT setval('templates_id_seq', (SELECT MAX(id) from "templates"));`)
-	if err != nil {
-		logrus.WithError(err).Error("unable to update the templates sequence")
+	if err := transaction.BatchImportTemplates(c, allData.Templates); err != nil {
+		return err
+	}
+
+	if err := transaction.BatchImportLoans(c, allData.Loans); err != nil {
+		return err
+	}
+
+	if err := budget.BatchImport(c, allData.Budgets); err != nil {
+		return err
+	}
+
+	if err := budget.BatchImportEnvelopes(c, allData.EnvelopeAssignments, allData.IncomeCategories); err != nil {
+		return err
+	}
+
+	if err := goal.BatchImport(c, allData.Goals); err != nil {
+		return err
+	}
+
+	if err := tax.BatchImport(c, allData.TaxLines); err != nil {
+		return err
+	}
+
+	if err := anomaly.BatchImport(c, allData.Anomalies); err != nil {
+		return err
+	}
+
+	if err := holiday.BatchImport(c, allData.Holidays); err != nil {
+		return err
+	}
+
+	if err := transaction.BatchImportExceptions(c, allData.RecurringExceptions); err != nil {
+		return err
+	}
+
+	if err := exchange.BatchImport(c, allData.ExchangeRates); err != nil {
+		return err
+	}
+
+	if err := investment.BatchImportSecurities(c, allData.Securities); err != nil {
+		return err
+	}
+
+	if err := investment.BatchImportPrices(c, allData.SecurityPrices); err != nil {
+		return err
+	}
+
+	if err := investment.BatchImport(c, allData.InvestmentTransactions); err != nil {
+		return err
+	}
+
+	if err := audit.BatchImport(c, allData.AuditLog); err != nil {
 		return err
 	}
 
@@ -0,0 +1,124 @@
+package batchTransfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/constants"
+)
+
+// sealedMagic prefixes every sealed backup so the format can be versioned
+var sealedMagic = []byte("FJC1")
+
+// seal gzips plaintext and encrypts it with AES-256-GCM using the configured backup key.
+// The output is the magic bytes, followed by the nonce, followed by the ciphertext.
+func seal(plaintext []byte) ([]byte, error) {
+	gcm, err := backupCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	if _, err := zw.Write(plaintext); err != nil {
+		logrus.WithError(err).Error("unable to compress backup")
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		logrus.WithError(err).Error("unable to close gzip writer when compressing backup")
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		logrus.WithError(err).Error("unable to generate nonce to encrypt backup")
+		return nil, err
+	}
+
+	sealed := append([]byte{}, sealedMagic...)
+	sealed = append(sealed, nonce...)
+	return gcm.Seal(sealed, nonce, compressed.Bytes(), sealedMagic), nil
+}
+
+// open reverses seal, decrypting and decompressing a backup
+func open(sealed []byte) ([]byte, error) {
+	gcm, err := backupCipher()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < len(sealedMagic)+gcm.NonceSize() || !bytes.Equal(sealed[:len(sealedMagic)], sealedMagic) {
+		logrus.Error("backup is not in a recognized sealed format")
+		return nil, errors.New("backup is not in a recognized sealed format")
+	}
+
+	sealed = sealed[len(sealedMagic):]
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	compressed, err := gcm.Open(nil, nonce, ciphertext, sealedMagic)
+	if err != nil {
+		logrus.WithError(err).Error("unable to decrypt backup")
+		return nil, err
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		logrus.WithError(err).Error("unable to open gzip reader when decompressing backup")
+		return nil, err
+	}
+	defer zr.Close()
+
+	plaintext, err := ioutil.ReadAll(zr)
+	if err != nil {
+		logrus.WithError(err).Error("unable to decompress backup")
+		return nil, err
+	}
+
+	return plaintext, nil
+}
+
+func backupCipher() (cipher.AEAD, error) {
+	if constants.BackupKeyFile == "" {
+		logrus.Error("BACKUP_KEY_FILE is not configured, refusing to handle unencrypted backups")
+		return nil, errors.New("no backup encryption key is configured")
+	}
+
+	encoded, err := ioutil.ReadFile(constants.BackupKeyFile)
+	if err != nil {
+		logrus.WithError(err).Error("unable to read backup key file")
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil {
+		logrus.WithError(err).Error("backup key file does not contain a hex encoded key")
+		return nil, err
+	}
+	if len(key) != 32 {
+		logrus.WithField("length", len(key)).Error("backup key must be 32 bytes")
+		return nil, errors.New("backup key must be 32 bytes")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		logrus.WithError(err).Error("unable to create cipher from backup key")
+		return nil, err
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		logrus.WithError(err).Error("unable to create gcm from backup cipher")
+		return nil, err
+	}
+
+	return gcm, nil
+}
@@ -0,0 +1,447 @@
+package batchTransfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// backedUpTables are the tables that make up a backup. Lots and lot disposals are rebuilt from the investment
+// transactions, jobs only hold the progress and results of work in flight, and anomaly checks only record how far
+// anomaly detection has got, which starts over from recent transactions after a restore.
+var backedUpTables = []string{
+	"users",
+	"accounts",
+	"transactions",
+	"templates",
+	"recurring_transactions",
+	"loans",
+	"budgets",
+	"envelope_assignments",
+	"income_categories",
+	"goals",
+	"tax_lines",
+	"tax_line_categories",
+	"anomalies",
+	"holidays",
+	"recurring_exceptions",
+	"exchange_rates",
+	"securities",
+	"security_prices",
+	"investment_transactions",
+	"lot_selections",
+	"audit_log",
+}
+
+// Verification is the outcome of test restoring a backup
+type Verification struct {
+	Backup     Backup   `json:"backup"`
+	Restorable bool     `json:"restorable"`
+	Problems   []string `json:"problems"`
+}
+
+// ListBackups lists the backups in the backup bucket, newest first
+func ListBackups(c context.Context) ([]Backup, error) {
+	if !util.IsAdminRequest(c) {
+		return nil, constants.ErrForbidden
+	}
+
+	gctx := context.Background()
+	bucket, err := backupBucket(gctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := readManifest(gctx, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	backups := append([]Backup{}, m.Backups...)
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Created.After(backups[j].Created)
+	})
+
+	return backups, nil
+}
+
+// Restore fetches and decrypts a backup and imports it. Like Import, this only works into an empty database.
+func Restore(c context.Context, name string) error {
+	if !util.IsAdminRequest(c) {
+		return constants.ErrForbidden
+	}
+
+	allData, _, err := fetchBackup(name)
+	if err != nil {
+		return err
+	}
+
+	return importData(c, allData)
+}
+
+// VerifyBackup restores a backup into a scratch schema that is thrown away afterwards,
+// and compares the restored row counts and per-account balance checksums to the manifest
+func VerifyBackup(c context.Context, name string) (Verification, error) {
+	if !util.IsAdminRequest(c) {
+		return Verification{}, constants.ErrForbidden
+	}
+
+	allData, backup, err := fetchBackup(name)
+	if err != nil {
+		return Verification{}, err
+	}
+
+	verification := Verification{
+		Backup:   backup,
+		Problems: []string{},
+	}
+
+	db, err := util.SQLDBFromContext(c)
+	if err != nil {
+		return Verification{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logrus.WithError(err).Error("could not begin transaction to verify backup")
+		return Verification{}, err
+	}
+	// DDL is transactional in postgres, so rolling back drops the scratch schema along with everything in it
+	defer tx.Rollback()
+
+	schema := fmt.Sprintf("restore_verify_%d", time.Now().UnixNano())
+	statements := []string{
+		"CREATE SCHEMA " + schema,
+		"SET LOCAL search_path TO " + schema,
+	}
+	for _, table := range backedUpTables {
+		statements = append(statements, fmt.Sprintf("CREATE TABLE %s (LIKE public.%s INCLUDING ALL)", table, table))
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":     err,
+				"statement": statement,
+			}).Error("could not create scratch schema to verify backup")
+			return Verification{}, err
+		}
+	}
+
+	// the scratch schema starts empty, so the admin check has to be skipped for the batch imports
+	loadCtx := context.WithValue(context.WithValue(c, constants.CtxDB, tx), constants.CtxInternalReq, true)
+	if err := batchImportData(loadCtx, allData); err != nil {
+		verification.Problems = append(verification.Problems, fmt.Sprintf("backup could not be loaded: %s", err))
+		return verification, nil
+	}
+
+	counts, err := restoredRowCounts(tx)
+	if err != nil {
+		return Verification{}, err
+	}
+
+	// user.BatchImport skips the admin because they already exist in a fresh db
+	for _, u := range allData.Users {
+		if u.Email == constants.AdminEmail {
+			counts["users"]++
+		}
+	}
+
+	checksums, err := restoredAccountChecksums(tx)
+	if err != nil {
+		return Verification{}, err
+	}
+
+	orphans, err := restoredOrphans(tx)
+	if err != nil {
+		return Verification{}, err
+	}
+
+	verification.Problems = append(verification.Problems, orphans...)
+	verification.Problems = append(verification.Problems, compareToManifest(backup, counts, checksums)...)
+	verification.Restorable = len(verification.Problems) == 0
+	return verification, nil
+}
+
+// BackupDrill verifies that the newest backup restores cleanly
+func BackupDrill(c context.Context) (Verification, error) {
+	logrus.Debug("starting backup drill")
+	backups, err := ListBackups(c)
+	if err != nil {
+		return Verification{}, err
+	}
+
+	if len(backups) == 0 {
+		logrus.Error("backup drill failed, there are no backups")
+		return Verification{}, errors.New("there are no backups to verify")
+	}
+
+	verification, err := VerifyBackup(c, backups[0].Name)
+	if err != nil {
+		logrus.WithError(err).Error("backup drill failed to run")
+		return Verification{}, err
+	}
+
+	if !verification.Restorable {
+		logrus.WithFields(logrus.Fields{
+			"backup":   verification.Backup.Name,
+			"problems": verification.Problems,
+		}).Error("backup drill failed, latest backup does not restore cleanly")
+	} else {
+		logrus.Infof("backup drill passed for backup: %s", verification.Backup.Name)
+	}
+
+	return verification, nil
+}
+
+// fetchBackup downloads a backup listed in the manifest, checks it against the manifest checksum,
+// then decrypts and decodes it
+func fetchBackup(name string) (fjcData, Backup, error) {
+	gctx := context.Background()
+	bucket, err := backupBucket(gctx)
+	if err != nil {
+		return fjcData{}, Backup{}, err
+	}
+
+	m, err := readManifest(gctx, bucket)
+	if err != nil {
+		return fjcData{}, Backup{}, err
+	}
+
+	var backup Backup
+	found := false
+	for _, b := range m.Backups {
+		if b.Name == name {
+			backup = b
+			found = true
+		}
+	}
+	if !found {
+		logrus.WithField("backup", name).Error("backup is not in the manifest")
+		return fjcData{}, Backup{}, constants.ErrBadRequest
+	}
+
+	r, err := bucket.Object(backup.Name).NewReader(gctx)
+	if err == storage.ErrObjectNotExist {
+		logrus.WithField("backup", name).Error("backup in the manifest does not exist in the bucket")
+		return fjcData{}, Backup{}, err
+	} else if err != nil {
+		logrus.WithError(err).Error("unable to open backup")
+		return fjcData{}, Backup{}, err
+	}
+	defer r.Close()
+
+	sealed, err := ioutil.ReadAll(r)
+	if err != nil {
+		logrus.WithError(err).Error("unable to read backup")
+		return fjcData{}, Backup{}, err
+	}
+
+	if sum := checksum(sealed); sum != backup.SHA256 {
+		logrus.WithFields(logrus.Fields{
+			"backup":   name,
+			"expected": backup.SHA256,
+			"actual":   sum,
+		}).Error("backup checksum does not match the manifest")
+		return fjcData{}, Backup{}, errors.New("backup checksum does not match the manifest")
+	}
+
+	plaintext, err := open(sealed)
+	if err != nil {
+		return fjcData{}, Backup{}, err
+	}
+
+	allData, err := decode(string(plaintext))
+	if err != nil {
+		return fjcData{}, Backup{}, err
+	}
+
+	return allData, backup, nil
+}
+
+func rowCounts(data fjcData) map[string]int {
+	lotSelections := 0
+	for _, t := range data.InvestmentTransactions {
+		lotSelections += len(t.Lots)
+	}
+
+	taxLineCategories := 0
+	for _, line := range data.TaxLines {
+		taxLineCategories += len(line.Categories)
+	}
+
+	return map[string]int{
+		"users":                   len(data.Users),
+		"accounts":                len(data.Accounts),
+		"transactions":            len(data.Transactions),
+		"templates":               len(data.Templates),
+		"recurring_transactions":  len(data.RecurringTransactions),
+		"loans":                   len(data.Loans),
+		"budgets":                 len(data.Budgets),
+		"envelope_assignments":    len(data.EnvelopeAssignments),
+		"goals":                   len(data.Goals),
+		"income_categories":       len(data.IncomeCategories),
+		"tax_lines":               len(data.TaxLines),
+		"tax_line_categories":     taxLineCategories,
+		"anomalies":               len(data.Anomalies),
+		"holidays":                len(data.Holidays),
+		"recurring_exceptions":    len(data.RecurringExceptions),
+		"exchange_rates":          len(data.ExchangeRates),
+		"securities":              len(data.Securities),
+		"security_prices":         len(data.SecurityPrices),
+		"investment_transactions": len(data.InvestmentTransactions),
+		"lot_selections":          lotSelections,
+		"audit_log":               len(data.AuditLog),
+	}
+}
+
+func accountChecksums(data fjcData) map[int]string {
+	balances := map[int]int{}
+	counts := map[int]int{}
+	for _, a := range data.Accounts {
+		balances[a.ID] = 0
+	}
+	for _, t := range data.Transactions {
+		balances[t.AccountID] += t.Amount
+		counts[t.AccountID]++
+	}
+
+	checksums := map[int]string{}
+	for accountID, balance := range balances {
+		checksums[accountID] = accountChecksum(accountID, balance, counts[accountID])
+	}
+
+	return checksums
+}
+
+// accountChecksum hashes an account's balance so that the manifest does not hold balances in the clear
+func accountChecksum(accountID, balance, transactions int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d:%d:%d", accountID, balance, transactions)))
+	return hex.EncodeToString(sum[:8])
+}
+
+func restoredRowCounts(db util.DB) (map[string]int, error) {
+	counts := map[string]int{}
+	for _, table := range backedUpTables {
+		var count int
+		// table names cannot be parameterized, but they all come from backedUpTables
+		if err := db.QueryRow(fmt.Sprintf("SELECT COUNT(*) FROM %s", table)).Scan(&count); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"table": table,
+			}).Error("unable to count restored rows")
+			return nil, err
+		}
+		counts[table] = count
+	}
+
+	return counts, nil
+}
+
+func restoredAccountChecksums(db util.DB) (map[int]string, error) {
+	rows, err := db.Query("SELECT a.id, COALESCE(SUM(t.amount), 0), COUNT(t.id) FROM accounts a LEFT JOIN transactions t ON t.account_id = a.id GROUP BY a.id")
+	if err != nil {
+		logrus.WithError(err).Error("unable to query restored account balances")
+		return nil, err
+	}
+	defer rows.Close()
+
+	checksums := map[int]string{}
+	for rows.Next() {
+		var accountID, balance, count int
+		if err := rows.Scan(&accountID, &balance, &count); err != nil {
+			logrus.WithError(err).Error("unable to scan restored account balance")
+			return nil, err
+		}
+		checksums[accountID] = accountChecksum(accountID, balance, count)
+	}
+	if err := rows.Err(); err != nil {
+		logrus.WithError(err).Error("unable to get restored account balances from rows")
+		return nil, err
+	}
+
+	return checksums, nil
+}
+
+// restoredOrphans finds rows that reference rows missing from the backup.
+// The scratch tables do not carry foreign keys, so these are checked by hand.
+func restoredOrphans(db util.DB) ([]string, error) {
+	checks := map[string]string{
+		"accounts reference missing users":                              "SELECT COUNT(*) FROM accounts a LEFT JOIN users u ON a.user_id = u.id WHERE u.id IS NULL",
+		"transactions reference missing accounts":                       "SELECT COUNT(*) FROM transactions t LEFT JOIN accounts a ON t.account_id = a.id WHERE a.id IS NULL",
+		"transactions reference missing transactions":                   "SELECT COUNT(*) FROM transactions t LEFT JOIN transactions r ON t.related_transaction_id = r.id WHERE t.related_transaction_id IS NOT NULL AND r.id IS NULL",
+		"transactions reference missing recurring transactions":         "SELECT COUNT(*) FROM transactions t LEFT JOIN recurring_transactions r ON t.recurring_transaction_id = r.id WHERE t.recurring_transaction_id IS NOT NULL AND r.id IS NULL",
+		"templates reference missing accounts":                          "SELECT COUNT(*) FROM templates t LEFT JOIN accounts a ON t.account_id = a.id WHERE a.id IS NULL",
+		"recurring transactions reference missing accounts":             "SELECT COUNT(*) FROM recurring_transactions t LEFT JOIN accounts a ON t.account_id = a.id WHERE a.id IS NULL",
+		"loans reference missing accounts":                              "SELECT COUNT(*) FROM loans l LEFT JOIN accounts a ON l.account_id = a.id LEFT JOIN accounts p ON l.payment_account_id = p.id WHERE a.id IS NULL OR p.id IS NULL",
+		"budgets reference missing users":                               "SELECT COUNT(*) FROM budgets b LEFT JOIN users u ON b.user_id = u.id WHERE u.id IS NULL",
+		"envelope assignments reference missing users":                  "SELECT COUNT(*) FROM envelope_assignments e LEFT JOIN users u ON e.user_id = u.id WHERE u.id IS NULL",
+		"goals reference missing accounts":                              "SELECT COUNT(*) FROM goals g LEFT JOIN accounts a ON g.account_id = a.id WHERE g.account_id IS NOT NULL AND a.id IS NULL",
+		"tax lines reference missing users":                             "SELECT COUNT(*) FROM tax_lines l LEFT JOIN users u ON l.user_id = u.id WHERE u.id IS NULL",
+		"tax line categories reference missing tax lines":               "SELECT COUNT(*) FROM tax_line_categories c LEFT JOIN tax_lines l ON c.tax_line_id = l.id WHERE l.id IS NULL",
+		"anomalies reference missing transactions":                      "SELECT COUNT(*) FROM anomalies n LEFT JOIN transactions t ON n.transaction_id = t.id WHERE t.id IS NULL",
+		"holidays reference missing users":                              "SELECT COUNT(*) FROM holidays h LEFT JOIN users u ON h.user_id = u.id WHERE u.id IS NULL",
+		"exchange rate overrides reference missing users":               "SELECT COUNT(*) FROM exchange_rates r LEFT JOIN users u ON r.user_id = u.id WHERE r.user_id IS NOT NULL AND u.id IS NULL",
+		"recurring exceptions reference missing recurring transactions": "SELECT COUNT(*) FROM recurring_exceptions e LEFT JOIN recurring_transactions r ON e.recurring_transaction_id = r.id WHERE r.id IS NULL",
+		"investment transactions reference missing accounts":            "SELECT COUNT(*) FROM investment_transactions t LEFT JOIN accounts a ON t.account_id = a.id WHERE a.id IS NULL",
+		"investment transactions reference missing securities":          "SELECT COUNT(*) FROM investment_transactions t LEFT JOIN securities s ON t.security_id = s.id WHERE s.id IS NULL",
+	}
+
+	problems := []string{}
+	for description, query := range checks {
+		var count int
+		if err := db.QueryRow(query).Scan(&count); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"check": description,
+			}).Error("unable to check restored rows for orphans")
+			return nil, err
+		}
+		if count > 0 {
+			problems = append(problems, fmt.Sprintf("%d %s", count, description))
+		}
+	}
+
+	sort.Strings(problems)
+	return problems, nil
+}
+
+func compareToManifest(backup Backup, counts map[string]int, checksums map[int]string) []string {
+	problems := []string{}
+	if backup.RowCounts == nil || backup.AccountChecksums == nil {
+		return append(problems, "manifest does not record row counts and checksums for this backup")
+	}
+
+	for _, table := range backedUpTables {
+		if backup.RowCounts[table] != counts[table] {
+			problems = append(problems, fmt.Sprintf("%s: manifest has %d rows but %d were restored", table, backup.RowCounts[table], counts[table]))
+		}
+	}
+
+	for accountID, expected := range backup.AccountChecksums {
+		actual, ok := checksums[accountID]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("account %d is missing from the restore", accountID))
+		} else if actual != expected {
+			problems = append(problems, fmt.Sprintf("account %d balance checksum does not match the manifest", accountID))
+		}
+	}
+
+	for accountID := range checksums {
+		if _, ok := backup.AccountChecksums[accountID]; !ok {
+			problems = append(problems, fmt.Sprintf("account %d is not in the manifest", accountID))
+		}
+	}
+
+	return problems
+}
@@ -0,0 +1,58 @@
+package batchTransfer
+
+import (
+	"fmt"
+	"sort"
+)
+
+// backupsToPrune applies a grandfather-father-son retention policy to backups.
+// The newest backup from each of the newest `daily` days, `weekly` ISO weeks and
+// `monthly` months that have backups are kept, everything else is returned to be pruned.
+// The newest backup is always kept.
+func backupsToPrune(backups []Backup, daily, weekly, monthly int) []Backup {
+	sorted := append([]Backup{}, backups...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Created.After(sorted[j].Created)
+	})
+
+	keep := map[string]bool{}
+	if len(sorted) > 0 {
+		keep[sorted[0].Name] = true
+	}
+
+	keepNewestPerPeriod := func(limit int, period func(Backup) string) {
+		seen := map[string]bool{}
+		for _, backup := range sorted {
+			if len(seen) >= limit {
+				return
+			}
+
+			p := period(backup)
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			keep[backup.Name] = true
+		}
+	}
+
+	keepNewestPerPeriod(daily, func(b Backup) string {
+		return b.Created.UTC().Format("2006-01-02")
+	})
+	keepNewestPerPeriod(weekly, func(b Backup) string {
+		year, week := b.Created.UTC().ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	})
+	keepNewestPerPeriod(monthly, func(b Backup) string {
+		return b.Created.UTC().Format("2006-01")
+	})
+
+	pruned := []Backup{}
+	for _, backup := range sorted {
+		if !keep[backup.Name] {
+			pruned = append(pruned, backup)
+		}
+	}
+
+	return pruned
+}
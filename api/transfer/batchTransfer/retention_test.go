@@ -0,0 +1,61 @@
+// +build integration
+
+package batchTransfer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupsToPrune(t *testing.T) {
+	// one backup a day for 100 days, newest first
+	newest := time.Date(2017, time.June, 30, 3, 0, 0, 0, time.UTC)
+	backups := []Backup{}
+	for i := 0; i < 100; i++ {
+		created := newest.AddDate(0, 0, -i)
+		backups = append(backups, Backup{
+			Name:    created.Format("20060102T150405") + backupExtension,
+			Created: created,
+		})
+	}
+
+	pruned := backupsToPrune(backups, 7, 4, 3)
+	kept := removeEntries(backups, pruned)
+
+	keptNames := map[string]bool{}
+	for _, b := range kept {
+		keptNames[b.Created.Format("2006-01-02")] = true
+	}
+
+	// the last 7 days
+	for i := 0; i < 7; i++ {
+		require.True(t, keptNames[newest.AddDate(0, 0, -i).Format("2006-01-02")], "backup from %d days ago should be kept", i)
+	}
+
+	// newest of each of the last 4 ISO weeks, 2017-06-30 is a friday
+	require.True(t, keptNames["2017-06-25"], "newest backup of week 25 should be kept")
+	require.True(t, keptNames["2017-06-18"], "newest backup of week 24 should be kept")
+	require.True(t, keptNames["2017-06-11"], "newest backup of week 23 should be kept")
+
+	// newest of each of the last 3 months
+	require.True(t, keptNames["2017-05-31"], "newest backup of may should be kept")
+	require.True(t, keptNames["2017-04-30"], "newest backup of april should be kept")
+
+	require.False(t, keptNames["2017-04-29"], "backup that is not the newest of any period should be pruned")
+	require.Len(t, kept, 7+2+2, "unexpected number of kept backups")
+	require.Len(t, pruned, 100-len(kept), "every backup should either be kept or pruned")
+}
+
+func TestBackupsToPruneAlwaysKeepsNewest(t *testing.T) {
+	now := time.Now()
+	backups := []Backup{
+		{Name: "old", Created: now.AddDate(0, 0, -1)},
+		{Name: "new", Created: now},
+	}
+
+	pruned := backupsToPrune(backups, 0, 0, 0)
+	require.Len(t, pruned, 1, "all but the newest backup should be pruned")
+	require.Equal(t, "old", pruned[0].Name, "the older backup should be pruned")
+}
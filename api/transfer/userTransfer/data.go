@@ -0,0 +1,282 @@
+package userTransfer
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/jchorl/financejc/api/account"
+	"github.com/jchorl/financejc/api/anomaly"
+	"github.com/jchorl/financejc/api/budget"
+	"github.com/jchorl/financejc/api/exchange"
+	"github.com/jchorl/financejc/api/goal"
+	"github.com/jchorl/financejc/api/holiday"
+	"github.com/jchorl/financejc/api/investment"
+	"github.com/jchorl/financejc/api/tax"
+	"github.com/jchorl/financejc/api/transaction"
+	"github.com/jchorl/financejc/api/user"
+	"github.com/jchorl/financejc/api/util"
+	"github.com/jchorl/financejc/constants"
+)
+
+// userData is a full export of the data owned by a single user
+type userData struct {
+	User                   user.User                          `json:"user"`
+	Accounts               []account.Account                  `json:"accounts"`
+	Transactions           []transaction.Transaction          `json:"transactions"`
+	RecurringTransactions  []transaction.RecurringTransaction `json:"recurringTransactions"`
+	Templates              []transaction.Template             `json:"templates"`
+	Loans                  []transaction.Loan                 `json:"loans"`
+	Budgets                []budget.Budget                    `json:"budgets"`
+	EnvelopeAssignments    []budget.Assignment                `json:"envelopeAssignments"`
+	IncomeCategories       []string                           `json:"incomeCategories"`
+	Goals                  []goal.Goal                        `json:"goals"`
+	TaxLines               []tax.Line                         `json:"taxLines"`
+	Anomalies              []anomaly.Anomaly                  `json:"anomalies"`
+	Holidays               []holiday.Holiday                  `json:"holidays"`
+	ExchangeRates          []exchange.Rate                    `json:"exchangeRates"`
+	RecurringExceptions    []transaction.RecurringException   `json:"recurringExceptions"`
+	Securities             []investment.Security              `json:"securities"`
+	SecurityPrices         []investment.Price                 `json:"securityPrices"`
+	InvestmentTransactions []investment.Transaction           `json:"investmentTransactions"`
+}
+
+// Export queries for all data of the user in the context, packages it up and exports it
+func Export(c context.Context) (string, error) {
+	data := userData{}
+	u, err := user.Get(c)
+	if err != nil {
+		return "", err
+	}
+	data.User = u
+
+	accounts, err := account.GetAllForUser(c)
+	if err != nil {
+		return "", err
+	}
+	data.Accounts = accounts
+
+	transactions, err := transaction.GetAllForUser(c)
+	if err != nil {
+		return "", err
+	}
+	data.Transactions = transactions
+
+	recurringTransactions, err := transaction.GetAllRecurringForUser(c)
+	if err != nil {
+		return "", err
+	}
+	data.RecurringTransactions = recurringTransactions
+
+	templates, err := transaction.GetAllTemplatesForUser(c)
+	if err != nil {
+		return "", err
+	}
+	data.Templates = templates
+
+	loans, err := transaction.GetAllLoansForUser(c)
+	if err != nil {
+		return "", err
+	}
+	data.Loans = loans
+
+	budgets, err := budget.GetAllForUser(c)
+	if err != nil {
+		return "", err
+	}
+	data.Budgets = budgets
+
+	assignments, err := budget.GetAllAssignmentsForUser(c)
+	if err != nil {
+		return "", err
+	}
+	data.EnvelopeAssignments = assignments
+
+	incomeCategories, err := budget.GetIncomeCategories(c)
+	if err != nil {
+		return "", err
+	}
+	data.IncomeCategories = incomeCategories
+
+	goals, err := goal.Get(c)
+	if err != nil {
+		return "", err
+	}
+	data.Goals = goals
+
+	taxLines, err := tax.Get(c)
+	if err != nil {
+		return "", err
+	}
+	data.TaxLines = taxLines
+
+	anomalies, err := anomaly.Get(c, true)
+	if err != nil {
+		return "", err
+	}
+	data.Anomalies = anomalies
+
+	holidays, err := holiday.Get(c)
+	if err != nil {
+		return "", err
+	}
+	data.Holidays = holidays
+
+	rates, err := exchange.GetOverrides(c, "")
+	if err != nil {
+		return "", err
+	}
+	data.ExchangeRates = rates
+
+	exceptions, err := transaction.GetAllExceptionsForUser(c)
+	if err != nil {
+		return "", err
+	}
+	data.RecurringExceptions = exceptions
+
+	securities, err := investment.GetSecurities(c)
+	if err != nil {
+		return "", err
+	}
+	data.Securities = securities
+
+	prices, err := investment.GetPricesForUser(c)
+	if err != nil {
+		return "", err
+	}
+	data.SecurityPrices = prices
+
+	investmentTransactions, err := investment.GetAllForUser(c)
+	if err != nil {
+		return "", err
+	}
+	data.InvestmentTransactions = investmentTransactions
+
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		logrus.WithError(err).Error("error encoding user data")
+		return "", err
+	}
+
+	return string(encoded), nil
+}
+
+// Delete deletes the user in the context and all of their data, including their transactions in elasticsearch.
+// The user's email must be passed as confirmation.
+func Delete(c context.Context, confirmEmail string) error {
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	if err := user.Delete(c, confirmEmail); err != nil {
+		return err
+	}
+
+	return transaction.DeleteAllFromESForUser(c, userID)
+}
+
+// ImportData imports the result of Export under the user in the context. Everything is inserted with
+// fresh ids, so the data can come from another instance or another user and be merged with existing data.
+func ImportData(c context.Context, encoded string) error {
+	data := userData{}
+	if err := json.Unmarshal([]byte(encoded), &data); err != nil {
+		logrus.WithError(err).Error("error decoding user data")
+		return constants.ErrBadRequest
+	}
+
+	db, err := util.SQLDBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logrus.WithError(err).Error("could not begin transaction to import user data")
+		return err
+	}
+
+	txCtx := context.WithValue(c, constants.CtxDB, tx)
+	if err := importData(txCtx, data); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithError(err).Error("could not commit user data import")
+		tx.Rollback()
+		return err
+	}
+
+	return transaction.PushToESForUser(c)
+}
+
+func importData(c context.Context, data userData) error {
+	accountIDs := map[int]int{}
+	for _, acc := range data.Accounts {
+		importedID := acc.ID
+		acc.ID = 0
+		created, err := account.New(c, &acc)
+		if err != nil {
+			return err
+		}
+		accountIDs[importedID] = created.ID
+	}
+
+	transactionIDs, err := transaction.ImportForUser(c, data.Transactions, accountIDs)
+	if err != nil {
+		return err
+	}
+
+	recurringIDs, err := transaction.ImportRecurringForUser(c, data.RecurringTransactions, accountIDs)
+	if err != nil {
+		return err
+	}
+
+	if err := transaction.LinkImportedToRecurring(c, data.Transactions, transactionIDs, recurringIDs); err != nil {
+		return err
+	}
+
+	if err := transaction.ImportLoansForUser(c, data.Loans, accountIDs, recurringIDs); err != nil {
+		return err
+	}
+
+	if err := budget.ImportForUser(c, data.Budgets); err != nil {
+		return err
+	}
+
+	if err := budget.ImportEnvelopesForUser(c, data.EnvelopeAssignments, data.IncomeCategories); err != nil {
+		return err
+	}
+
+	if err := goal.ImportForUser(c, data.Goals, accountIDs); err != nil {
+		return err
+	}
+
+	if err := tax.ImportForUser(c, data.TaxLines); err != nil {
+		return err
+	}
+
+	if err := anomaly.ImportForUser(c, data.Anomalies, transactionIDs); err != nil {
+		return err
+	}
+
+	if err := holiday.ImportForUser(c, data.Holidays); err != nil {
+		return err
+	}
+
+	if err := exchange.ImportForUser(c, data.ExchangeRates); err != nil {
+		return err
+	}
+
+	if err := transaction.ImportExceptionsForUser(c, data.RecurringExceptions, recurringIDs); err != nil {
+		return err
+	}
+
+	if err := transaction.ImportTemplatesForUser(c, data.Templates, accountIDs); err != nil {
+		return err
+	}
+
+	return investment.ImportForUser(c, data.Securities, data.SecurityPrices, data.InvestmentTransactions, accountIDs, transactionIDs)
+}
@@ -3,6 +3,7 @@ package userTransfer
 import (
 	"bufio"
 	"context"
+	"fmt"
 	"io"
 	"math"
 	"regexp"
@@ -13,6 +14,7 @@ import (
 	"github.com/Sirupsen/logrus"
 
 	"github.com/jchorl/financejc/api/account"
+	"github.com/jchorl/financejc/api/investment"
 	"github.com/jchorl/financejc/api/transaction"
 	"github.com/jchorl/financejc/api/util"
 	"github.com/jchorl/financejc/constants"
@@ -25,10 +27,67 @@ const (
 	// states while parsing QIF
 	accountState     = "ACCOUNT"
 	transactionState = "TRANSACTION"
+	investmentState  = "INVESTMENT"
+	securityState    = "SECURITY"
 	noneState        = ""
 	optionState      = "OPTION"
 )
 
+// qifAccountTypes maps the account types of QIF account blocks to account types
+var qifAccountTypes = map[string]string{
+	"Bank":  constants.AccountChecking,
+	"Cash":  constants.AccountCash,
+	"CCard": constants.AccountCreditCard,
+	"Invst": constants.AccountInvestment,
+	"Oth A": constants.AccountAsset,
+	"Oth L": constants.AccountLoan,
+}
+
+// qifInvestmentActions maps the actions of QIF investment records to investment actions.
+// Actions ending in X and share transfers move their cash in another account.
+var qifInvestmentActions = map[string]string{
+	"Buy":      constants.InvestmentBuy,
+	"BuyX":     constants.InvestmentBuy,
+	"ShrsIn":   constants.InvestmentBuy,
+	"Sell":     constants.InvestmentSell,
+	"SellX":    constants.InvestmentSell,
+	"ShrsOut":  constants.InvestmentSell,
+	"Div":      constants.InvestmentDividend,
+	"DivX":     constants.InvestmentDividend,
+	"IntInc":   constants.InvestmentDividend,
+	"IntIncX":  constants.InvestmentDividend,
+	"CGLong":   constants.InvestmentDividend,
+	"CGLongX":  constants.InvestmentDividend,
+	"CGShort":  constants.InvestmentDividend,
+	"CGShortX": constants.InvestmentDividend,
+	"ReinvDiv": constants.InvestmentReinvest,
+	"ReinvInt": constants.InvestmentReinvest,
+	"ReinvLg":  constants.InvestmentReinvest,
+	"ReinvSh":  constants.InvestmentReinvest,
+	"StkSplit": constants.InvestmentSplit,
+}
+
+// qifCashActions are the QIF investment actions that only move cash, mapped to the sign of the cash movement
+var qifCashActions = map[string]int{
+	"XIn":     1,
+	"XOut":    -1,
+	"MiscInc": 1,
+	"MiscExp": -1,
+	"Cash":    1,
+}
+
+// qifInvestment is an investment record of a QIF !Type:Invst block
+type qifInvestment struct {
+	date     time.Time
+	action   string
+	security string
+	price    float64
+	quantity float64
+	amount   float64
+	fees     float64
+	memo     string
+}
+
 func round(a float64) int {
 	if a < 0 {
 		return int(a - 0.5)
@@ -56,6 +115,10 @@ func transferQIF(c context.Context, file io.Reader) error {
 	acc := &account.Account{}
 	tr := &transaction.Transaction{}
 	uncategorized := make([]*transaction.Transaction, 0)
+	sec := investment.Security{}
+	inv := qifInvestment{}
+	// securities are referred to by name in investment records
+	securitySymbols := map[string]string{}
 
 	scanner := bufio.NewScanner(file)
 
@@ -85,8 +148,12 @@ func transferQIF(c context.Context, file io.Reader) error {
 			acc = &account.Account{
 				Currency: defaultCurrency,
 			}
-		} else if strings.HasPrefix(line, "!Type:Cat") {
+		} else if strings.HasPrefix(line, "!Type:Cat") || strings.HasPrefix(line, "!Type:Prices") {
 			state = noneState
+		} else if strings.HasPrefix(line, "!Type:Invst") {
+			state = investmentState
+		} else if strings.HasPrefix(line, "!Type:Security") {
+			state = securityState
 		} else if strings.HasPrefix(line, "!Type") {
 			state = transactionState
 		}
@@ -96,6 +163,8 @@ func transferQIF(c context.Context, file io.Reader) error {
 			switch line[0] {
 			case 'N':
 				acc.Name = line[1:]
+			case 'T':
+				acc.Type = qifAccountTypes[line[1:]]
 			case '^':
 				acc.User = userID
 				acc, err = account.New(c, acc)
@@ -153,6 +222,46 @@ func transferQIF(c context.Context, file io.Reader) error {
 				}
 				tr = &transaction.Transaction{}
 			}
+		case securityState:
+			switch line[0] {
+			case 'N':
+				sec.Name = line[1:]
+			case 'S':
+				sec.Symbol = line[1:]
+			case '^':
+				securitySymbols[sec.Name] = sec.Symbol
+				sec = investment.Security{}
+			}
+		case investmentState:
+			var err error
+			switch line[0] {
+			case 'D':
+				inv.date, err = time.Parse("2006-01-02", line[1:])
+			case 'N':
+				inv.action = line[1:]
+			case 'Y':
+				inv.security = line[1:]
+			case 'I':
+				inv.price, err = parseQIFNumber(line[1:])
+			case 'Q':
+				inv.quantity, err = parseQIFNumber(line[1:])
+			case 'T', 'U':
+				inv.amount, err = parseQIFNumber(line[1:])
+			case 'O':
+				inv.fees, err = parseQIFNumber(line[1:])
+			case 'M':
+				inv.memo = line[1:]
+			case '^':
+				err = importQIFInvestment(c, acc, securitySymbols, inv)
+				inv = qifInvestment{}
+			}
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"error": err,
+					"line":  line,
+				}).Error("could not import investment record from QIF")
+				return err
+			}
 		}
 
 		if err := scanner.Err(); err != nil {
@@ -205,3 +314,96 @@ func transferQIF(c context.Context, file io.Reader) error {
 
 	return nil
 }
+
+// importQIFInvestment records an investment record from a QIF file in the account it belongs to
+func importQIFInvestment(c context.Context, acc *account.Account, securitySymbols map[string]string, record qifInvestment) error {
+	digits := math.Pow10(constants.CurrencyInfo[acc.Currency].DigitsAfterDecimal)
+
+	sign, ok := qifCashActions[record.action]
+	if record.security == "" && qifInvestmentActions[record.action] == constants.InvestmentDividend {
+		// interest and distributions that are not from a security are plain income
+		sign, ok = 1, true
+	}
+	if ok {
+		name := record.memo
+		if name == "" {
+			name = record.action
+		}
+		_, err := transaction.New(c, &transaction.Transaction{
+			AccountID: acc.ID,
+			Name:      name,
+			Date:      record.date,
+			Amount:    sign * round(record.amount*digits),
+		})
+		return err
+	}
+
+	action, ok := qifInvestmentActions[record.action]
+	if !ok {
+		logrus.WithField("action", record.action).Warn("skipping QIF investment record with unsupported action")
+		return nil
+	}
+
+	// QIF files only reference securities by name, and securities without a symbol are keyed by their name
+	symbol := securitySymbols[record.security]
+	if symbol == "" {
+		symbol = record.security
+	}
+	if len(symbol) > 20 {
+		symbol = symbol[:20]
+	}
+	security, err := investment.FindOrCreateSecurity(c, symbol, record.security, acc.Currency)
+	if err != nil {
+		return err
+	}
+
+	t := &investment.Transaction{
+		AccountID:  acc.ID,
+		SecurityID: security.ID,
+		Date:       record.date,
+		Action:     action,
+		Quantity:   record.quantity,
+		Price:      record.price * digits,
+		Fees:       round(record.fees * digits),
+		Amount:     round(record.amount * digits),
+	}
+
+	if action == constants.InvestmentSplit {
+		// QIF stores split ratios multiplied by ten, e.g. 20 for a 2 for 1 split
+		t.Quantity = record.quantity / 10
+	} else if t.Price == 0 && t.Quantity > 0 && (action == constants.InvestmentBuy || action == constants.InvestmentSell) {
+		// the total includes the commission, and buys pay it while sales deduct it
+		paid := t.Amount - t.Fees
+		if action == constants.InvestmentSell {
+			paid = t.Amount + t.Fees
+		}
+		t.Price = float64(paid) / t.Quantity
+	}
+
+	t, err = investment.New(c, t)
+	if err != nil {
+		return err
+	}
+
+	// the cash of transfers and X actions moved in another account, so it is offset in this one
+	if t.TransactionID == 0 || (!strings.HasSuffix(record.action, "X") && !strings.HasPrefix(record.action, "Shrs")) {
+		return nil
+	}
+
+	offset := t.Amount
+	if action != constants.InvestmentBuy {
+		offset = -offset
+	}
+	_, err = transaction.New(c, &transaction.Transaction{
+		AccountID: acc.ID,
+		Name:      fmt.Sprintf("Transfer for %s %s", record.action, symbol),
+		Date:      record.date,
+		Amount:    offset,
+	})
+	return err
+}
+
+// parseQIFNumber parses a QIF amount, price or quantity, which may have thousands separators
+func parseQIFNumber(value string) (float64, error) {
+	return strconv.ParseFloat(strings.Replace(value, ",", "", -1), 64)
+}
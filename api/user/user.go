@@ -3,25 +3,34 @@ package user
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/lib/pq"
 
+	"github.com/jchorl/financejc/api/audit"
 	"github.com/jchorl/financejc/api/util"
 	"github.com/jchorl/financejc/constants"
 )
 
-// User represents a user
+// User represents a user. FiscalYearStart is the month that their tax year starts in, from 1 for January to 12.
 type User struct {
-	ID       uint   `json:"id"`
-	Email    string `json:"email"`
-	GoogleID string `json:"-"`
+	ID              uint   `json:"id"`
+	Email           string `json:"email"`
+	GoogleID        string `json:"-"`
+	HomeCurrency    string `json:"homeCurrency"`
+	BudgetMode      string `json:"budgetMode"`
+	FiscalYearStart int    `json:"fiscalYearStart"`
 }
 
 type userDB struct {
-	ID       uint
-	Email    string
-	GoogleID sql.NullString
+	ID              uint
+	Email           string
+	GoogleID        sql.NullString
+	HomeCurrency    string
+	BudgetMode      string
+	FiscalYearStart int
 }
 
 // Get gets a user from the ID baked into the context
@@ -36,8 +45,9 @@ func Get(c context.Context) (User, error) {
 		return User{}, err
 	}
 
-	var email, googleID string
-	err = db.QueryRow("SELECT email, google_id FROM users WHERE id = $1", userID).Scan(&email, &googleID)
+	var email, googleID, homeCurrency, budgetMode string
+	var fiscalYearStart int
+	err = db.QueryRow("SELECT email, google_id, home_currency, budget_mode, fiscal_year_start FROM users WHERE id = $1", userID).Scan(&email, &googleID, &homeCurrency, &budgetMode, &fiscalYearStart)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error":    err,
@@ -47,12 +57,53 @@ func Get(c context.Context) (User, error) {
 	}
 
 	return User{
-		ID:       userID,
-		Email:    email,
-		GoogleID: googleID,
+		ID:              userID,
+		Email:           email,
+		GoogleID:        googleID,
+		HomeCurrency:    homeCurrency,
+		BudgetMode:      budgetMode,
+		FiscalYearStart: fiscalYearStart,
 	}, nil
 }
 
+// Update updates the settings of the user in the context. Only the home currency, budget mode and fiscal year start
+// can be changed. The budget mode and fiscal year start are left alone if they are not set.
+func Update(c context.Context, user User) (User, error) {
+	db, err := util.DBFromContext(c)
+	if err != nil {
+		return User{}, err
+	}
+
+	userID, err := util.UserIDFromContext(c)
+	if err != nil {
+		return User{}, err
+	}
+
+	if _, valid := constants.CurrencyInfo[user.HomeCurrency]; !valid {
+		return User{}, constants.ErrInvalidCurrency
+	}
+
+	if user.BudgetMode != "" && user.BudgetMode != constants.BudgetModeCategory && user.BudgetMode != constants.BudgetModeEnvelope {
+		return User{}, constants.ErrBadRequest
+	}
+
+	if user.FiscalYearStart < 0 || user.FiscalYearStart > 12 {
+		return User{}, constants.ErrBadRequest
+	}
+
+	_, err = db.Exec("UPDATE users SET home_currency = $1, budget_mode = COALESCE(NULLIF($2, ''), budget_mode), fiscal_year_start = COALESCE(NULLIF($3, 0), fiscal_year_start) WHERE id = $4", user.HomeCurrency, user.BudgetMode, user.FiscalYearStart, userID)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error":  err,
+			"userId": userID,
+			"user":   user,
+		}).Error("failed to update user row")
+		return User{}, err
+	}
+
+	return Get(c)
+}
+
 // GetAll queries for all users
 func GetAll(c context.Context) ([]User, error) {
 	if !util.IsAdminRequest(c) {
@@ -65,7 +116,7 @@ func GetAll(c context.Context) ([]User, error) {
 	}
 
 	users := []User{}
-	rows, err := db.Query("SELECT id, google_id, email FROM users")
+	rows, err := db.Query("SELECT id, google_id, email, home_currency, budget_mode, fiscal_year_start FROM users")
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error": err,
@@ -76,7 +127,7 @@ func GetAll(c context.Context) ([]User, error) {
 
 	for rows.Next() {
 		var user userDB
-		if err := rows.Scan(&user.ID, &user.GoogleID, &user.Email); err != nil {
+		if err := rows.Scan(&user.ID, &user.GoogleID, &user.Email, &user.HomeCurrency, &user.BudgetMode, &user.FiscalYearStart); err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
 			}).Error("failed to scan into user")
@@ -101,18 +152,13 @@ func BatchImport(c context.Context, users []User) error {
 		return constants.ErrForbidden
 	}
 
-	db, err := util.SQLDBFromContext(c)
-	if err != nil {
-		return err
-	}
-
-	txn, err := db.Begin()
+	txn, commit, err := util.TxFromContext(c)
 	if err != nil {
 		logrus.WithError(err).Error("unable to begin transaction when batch inserting users")
 		return err
 	}
 
-	stmt, err := txn.Prepare(pq.CopyIn("users", "id", "google_id", "email"))
+	stmt, err := txn.Prepare(pq.CopyIn("users", "id", "google_id", "email", "home_currency", "budget_mode", "fiscal_year_start"))
 	if err != nil {
 		logrus.WithError(err).Error("unable to begin copy in when batch inserting users")
 		return err
@@ -124,7 +170,7 @@ func BatchImport(c context.Context, users []User) error {
 			continue
 		}
 		udb := toDB(user)
-		_, err = stmt.Exec(udb.ID, udb.GoogleID, udb.Email)
+		_, err = stmt.Exec(udb.ID, udb.GoogleID, udb.Email, udb.HomeCurrency, udb.BudgetMode, udb.FiscalYearStart)
 		if err != nil {
 			logrus.WithError(err).Error("unable to exec user copy when batch inserting users")
 			return err
@@ -143,7 +189,7 @@ func BatchImport(c context.Context, users []User) error {
 		return err
 	}
 
-	err = txn.Commit()
+	err = commit()
 	if err != nil {
 		logrus.WithError(err).Error("unable to commit user copy when batch inserting users")
 		return err
@@ -160,7 +206,9 @@ func FindOrCreateByGoogleID(c context.Context, googleID, email string) (User, er
 	}
 
 	var id uint
-	err = db.QueryRow("SELECT id FROM users WHERE google_id = $1", googleID).Scan(&id)
+	var homeCurrency, budgetMode string
+	var fiscalYearStart int
+	err = db.QueryRow("SELECT id, home_currency, budget_mode, fiscal_year_start FROM users WHERE google_id = $1", googleID).Scan(&id, &homeCurrency, &budgetMode, &fiscalYearStart)
 	if err != nil && err != sql.ErrNoRows {
 		logrus.WithFields(logrus.Fields{
 			"error":    err,
@@ -169,18 +217,24 @@ func FindOrCreateByGoogleID(c context.Context, googleID, email string) (User, er
 		return User{}, err
 	} else if err == nil {
 		return User{
-			ID:       id,
-			Email:    email,
-			GoogleID: googleID,
+			ID:              id,
+			Email:           email,
+			GoogleID:        googleID,
+			HomeCurrency:    homeCurrency,
+			BudgetMode:      budgetMode,
+			FiscalYearStart: fiscalYearStart,
 		}, nil
 	}
 
 	user := User{
-		Email:    email,
-		GoogleID: googleID,
+		Email:           email,
+		GoogleID:        googleID,
+		HomeCurrency:    constants.DefaultHomeCurrency,
+		BudgetMode:      constants.BudgetModeCategory,
+		FiscalYearStart: int(time.January),
 	}
 	udb := toDB(user)
-	err = db.QueryRow("INSERT INTO users (google_id, email) VALUES($1, $2) RETURNING id", udb.GoogleID, udb.Email).Scan(&id)
+	err = db.QueryRow("INSERT INTO users (google_id, email, home_currency) VALUES($1, $2, $3) RETURNING id", udb.GoogleID, udb.Email, udb.HomeCurrency).Scan(&id)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error":    err,
@@ -195,18 +249,137 @@ func FindOrCreateByGoogleID(c context.Context, googleID, email string) (User, er
 	return user, nil
 }
 
+// Delete deletes the user in the context along with every row they own, leaving an audit record of the deletion.
+// The user's email must be passed as confirmation. Their elasticsearch documents are left for the caller to remove.
+func Delete(c context.Context, confirmEmail string) error {
+	u, err := Get(c)
+	if err != nil {
+		return err
+	}
+
+	if confirmEmail != u.Email {
+		logrus.WithField("userId", u.ID).Error("email did not match when confirming user deletion")
+		return constants.ErrBadRequest
+	}
+
+	db, err := util.SQLDBFromContext(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		logrus.WithError(err).Error("could not begin transaction to delete user")
+		return err
+	}
+
+	// order does not matter as foreign keys are deferred, but delete dependents first for clarity
+	deletes := []struct {
+		table string
+		query string
+	}{
+		{"lot_disposals", "DELETE FROM lot_disposals WHERE lot_id IN (SELECT id FROM lots WHERE account_id IN (SELECT id FROM accounts WHERE user_id = $1))"},
+		{"lots", "DELETE FROM lots WHERE account_id IN (SELECT id FROM accounts WHERE user_id = $1)"},
+		{"lot_selections", "DELETE FROM lot_selections WHERE sale_id IN (SELECT id FROM investment_transactions WHERE account_id IN (SELECT id FROM accounts WHERE user_id = $1))"},
+		{"investment_transactions", "DELETE FROM investment_transactions WHERE account_id IN (SELECT id FROM accounts WHERE user_id = $1)"},
+		{"security_prices", "DELETE FROM security_prices WHERE security_id IN (SELECT id FROM securities WHERE user_id = $1)"},
+		{"securities", "DELETE FROM securities WHERE user_id = $1"},
+		{"holidays", "DELETE FROM holidays WHERE user_id = $1"},
+		{"exchange_rates", "DELETE FROM exchange_rates WHERE user_id = $1"},
+		{"anomalies", "DELETE FROM anomalies WHERE user_id = $1"},
+		{"tax_line_categories", "DELETE FROM tax_line_categories WHERE tax_line_id IN (SELECT id FROM tax_lines WHERE user_id = $1)"},
+		{"tax_lines", "DELETE FROM tax_lines WHERE user_id = $1"},
+		{"goals", "DELETE FROM goals WHERE user_id = $1"},
+		{"loans", "DELETE FROM loans WHERE account_id IN (SELECT id FROM accounts WHERE user_id = $1)"},
+		{"recurring_exceptions", "DELETE FROM recurring_exceptions WHERE recurring_transaction_id IN (SELECT id FROM recurring_transactions WHERE account_id IN (SELECT id FROM accounts WHERE user_id = $1))"},
+		{"templates", "DELETE FROM templates WHERE account_id IN (SELECT id FROM accounts WHERE user_id = $1)"},
+		{"recurring_transactions", "DELETE FROM recurring_transactions WHERE account_id IN (SELECT id FROM accounts WHERE user_id = $1)"},
+		{"transactions", "DELETE FROM transactions WHERE account_id IN (SELECT id FROM accounts WHERE user_id = $1)"},
+		{"accounts", "DELETE FROM accounts WHERE user_id = $1"},
+		{"budgets", "DELETE FROM budgets WHERE user_id = $1"},
+		{"envelope_assignments", "DELETE FROM envelope_assignments WHERE user_id = $1"},
+		{"income_categories", "DELETE FROM income_categories WHERE user_id = $1"},
+		{"jobs", "DELETE FROM jobs WHERE user_id = $1"},
+		{"users", "DELETE FROM users WHERE id = $1"},
+	}
+
+	deleted := map[string]int64{}
+	for _, d := range deletes {
+		res, err := tx.Exec(d.query, u.ID)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error":  err,
+				"userId": u.ID,
+				"table":  d.table,
+			}).Error("could not delete rows of user")
+			tx.Rollback()
+			return err
+		}
+
+		deleted[d.table], err = res.RowsAffected()
+		if err != nil {
+			logrus.WithError(err).Error("could not get number of deleted rows")
+			tx.Rollback()
+			return err
+		}
+	}
+
+	detail, err := json.Marshal(deleted)
+	if err != nil {
+		logrus.WithError(err).Error("could not encode deleted row counts for audit log")
+		tx.Rollback()
+		return err
+	}
+
+	if err := audit.Record(context.WithValue(c, constants.CtxDB, tx), u.ID, audit.ActionUserDeleted, string(detail)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		logrus.WithError(err).Error("could not commit deleting user")
+		tx.Rollback()
+		return err
+	}
+
+	return nil
+}
+
 func toDB(user User) *userDB {
+	// exports from before home currencies existed do not have one
+	homeCurrency := user.HomeCurrency
+	if homeCurrency == "" {
+		homeCurrency = constants.DefaultHomeCurrency
+	}
+
+	// nor do exports from before budget modes existed
+	budgetMode := user.BudgetMode
+	if budgetMode == "" {
+		budgetMode = constants.BudgetModeCategory
+	}
+
+	fiscalYearStart := user.FiscalYearStart
+	if fiscalYearStart == 0 {
+		fiscalYearStart = int(time.January)
+	}
+
 	return &userDB{
-		ID:       user.ID,
-		Email:    user.Email,
-		GoogleID: util.ToNullStringNonEmpty(user.GoogleID),
+		ID:              user.ID,
+		Email:           user.Email,
+		GoogleID:        util.ToNullStringNonEmpty(user.GoogleID),
+		HomeCurrency:    homeCurrency,
+		BudgetMode:      budgetMode,
+		FiscalYearStart: fiscalYearStart,
 	}
 }
 
 func fromDB(user userDB) User {
 	return User{
-		ID:       user.ID,
-		Email:    user.Email,
-		GoogleID: util.FromNullStringNonEmpty(user.GoogleID),
+		ID:              user.ID,
+		Email:           user.Email,
+		GoogleID:        util.FromNullStringNonEmpty(user.GoogleID),
+		HomeCurrency:    user.HomeCurrency,
+		BudgetMode:      user.BudgetMode,
+		FiscalYearStart: user.FiscalYearStart,
 	}
 }
@@ -4,6 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
+	"math"
+	"strconv"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -200,6 +203,79 @@ func SQLDBFromContext(c context.Context) (*sql.DB, error) {
 	return db, nil
 }
 
+// TxFromContext returns a transaction to do work in along with a func to commit it.
+// If the context already holds a *sql.Tx, that transaction is returned and the commit
+// func is a no-op, leaving the caller that began the transaction in charge of committing.
+func TxFromContext(c context.Context) (*sql.Tx, func() error, error) {
+	if tx, ok := c.Value(constants.CtxDB).(*sql.Tx); ok {
+		return tx, func() error { return nil }, nil
+	}
+
+	db, err := SQLDBFromContext(c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return tx, tx.Commit, nil
+}
+
+// RollbackIfOwned rolls back a transaction from TxFromContext, unless it belongs to a caller further up
+func RollbackIfOwned(c context.Context, tx *sql.Tx) {
+	if _, ok := c.Value(constants.CtxDB).(*sql.Tx); ok {
+		return
+	}
+
+	if err := tx.Rollback(); err != nil {
+		logrus.WithError(err).Error("unable to roll back transaction")
+	}
+}
+
+// PeriodSeries returns a sql query of every period of a granularity that overlaps a date range, as
+// period_start and period_end columns clipped to the range. startParam and endParam are the query
+// placeholders that the start and end dates will be passed as, e.g. "$2".
+func PeriodSeries(granularity string, start, end time.Time, startParam, endParam string) (string, error) {
+	var trunc string
+	var days int
+	switch granularity {
+	case constants.GranularityDaily:
+		trunc, days = "day", 1
+	case constants.GranularityWeekly:
+		trunc, days = "week", 7
+	case constants.GranularityMonthly:
+		trunc, days = "month", 28
+	case constants.GranularityQuarterly:
+		trunc, days = "quarter", 90
+	case constants.GranularityYearly:
+		trunc, days = "year", 365
+	default:
+		logrus.WithField("granularity", granularity).Error("unrecognized granularity")
+		return "", constants.ErrBadRequest
+	}
+
+	if end.Before(start) || int(end.Sub(start).Hours()/24)/days >= constants.MaxReportPeriods {
+		logrus.WithFields(logrus.Fields{
+			"start":       start,
+			"end":         end,
+			"granularity": granularity,
+		}).Error("date range is backwards or has too many periods")
+		return "", constants.ErrBadRequest
+	}
+
+	interval := fmt.Sprintf("interval '1 %s'", trunc)
+	return fmt.Sprintf("SELECT GREATEST(p::date, %[2]s::date) AS period_start, LEAST((p + %[4]s - interval '1 day')::date, %[3]s::date) AS period_end FROM generate_series(date_trunc('%[1]s', %[2]s::date::timestamp), %[3]s::date::timestamp, %[4]s) p", trunc, startParam, endParam, interval), nil
+}
+
+// FormatAmount formats an amount in minor units of a currency in major units, e.g. 1050 USD as 10.50
+func FormatAmount(amount int, currency string) string {
+	digits := constants.CurrencyInfo[currency].DigitsAfterDecimal
+	return strconv.FormatFloat(float64(amount)/math.Pow10(digits), 'f', digits, 64)
+}
+
 // Min returns the min of two ints
 func Min(a, b int) int {
 	if a < b {
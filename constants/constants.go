@@ -17,6 +17,15 @@ const AdminEmail = "josh@joshchorlton.com"
 // GcsBackupBucket is the name of the bucket to backup to
 const GcsBackupBucket = "financejcbackups"
 
+// Retention policy for backups. After each successful backup, the newest backup
+// of each of the last BackupKeepDaily days, BackupKeepWeekly weeks and
+// BackupKeepMonthly months is kept and all other backups are pruned.
+const (
+	BackupKeepDaily   = 7
+	BackupKeepWeekly  = 4
+	BackupKeepMonthly = 12
+)
+
 /************************************
 ******** GENERAL CONSTANTS **********
 ************************************/
@@ -27,6 +36,7 @@ const (
 	CtxES          = "elasticsearch"
 	CtxUserID      = "user"
 	CtxInternalReq = "internal_request"
+	CtxJob         = "job"
 )
 
 // ESIndex is the primary elasticsearch index used
@@ -38,8 +48,153 @@ const (
 	FixedDayWeek  = "fixedDayWeek"
 	FixedDayMonth = "fixedDayMonth"
 	FixedDayYear  = "fixedDayYear"
+	RRule         = "rrule"
+)
+
+// Business day adjustments for recurring transactions that fall on a weekend or holiday
+const (
+	AdjustNone              = "none"
+	AdjustPreceding         = "preceding"
+	AdjustFollowing         = "following"
+	AdjustModifiedFollowing = "modifiedFollowing"
+)
+
+// HolidayRecurYears is how many years of a recurring holiday in an imported calendar are added
+const HolidayRecurYears = 10
+
+// Types of accounts
+const (
+	AccountChecking   = "checking"
+	AccountSavings    = "savings"
+	AccountCreditCard = "creditCard"
+	AccountLoan       = "loan"
+	AccountCash       = "cash"
+	AccountInvestment = "investment"
+	AccountAsset      = "asset"
 )
 
+// AccountTypes maps every account type to whether accounts of that type are liabilities
+var AccountTypes = map[string]bool{
+	AccountChecking:   false,
+	AccountSavings:    false,
+	AccountCreditCard: true,
+	AccountLoan:       true,
+	AccountCash:       false,
+	AccountInvestment: false,
+	AccountAsset:      false,
+}
+
+// LoanFrequencies maps the payment frequencies of loans to the number of payments in a year
+var LoanFrequencies = map[string]int{
+	LoanMonthly:  12,
+	LoanBiweekly: 26,
+	LoanWeekly:   52,
+}
+
+// Payment frequencies of loans
+const (
+	LoanMonthly  = "monthly"
+	LoanBiweekly = "biweekly"
+	LoanWeekly   = "weekly"
+)
+
+// Categories of the transactions that loan payments post
+const (
+	LoanPaymentCategory     = "Loan Payment"
+	DefaultInterestCategory = "Interest"
+)
+
+// Actions of investment transactions
+const (
+	InvestmentBuy      = "buy"
+	InvestmentSell     = "sell"
+	InvestmentDividend = "dividend"
+	InvestmentSplit    = "split"
+	InvestmentReinvest = "reinvest"
+)
+
+// Methods of choosing the lots that a sale of a security sells from
+const (
+	LotsFIFO       = "fifo"
+	LotsSpecificID = "specificId"
+)
+
+// ExchangeRateBase is the currency that exchange rates are quoted against
+const ExchangeRateBase = "EUR"
+
+// DefaultHomeCurrency is the home currency of new users
+const DefaultHomeCurrency = "USD"
+
+// Budgeting modes. In category mode, each category gets an amount to spend each month. In envelope mode,
+// all income is assigned to envelopes, which carry their balances from month to month.
+const (
+	BudgetModeCategory = "category"
+	BudgetModeEnvelope = "envelope"
+)
+
+// GoalRecentMonths is how many months of recent contributions to a goal are averaged to check whether it is on track
+const GoalRecentMonths = 3
+
+// ComparisonMovers is how many categories a comparison report lists as the biggest movers
+const ComparisonMovers = 5
+
+// Kinds of anomalies found in transactions
+const (
+	AnomalyDuplicate       = "duplicate"
+	AnomalyPriceIncrease   = "priceIncrease"
+	AnomalyUnusualPayee    = "unusualPayee"
+	AnomalyUnusualCategory = "unusualCategory"
+)
+
+// Anomaly detection checks each transaction once, starting from those of the last AnomalyLookbackDays days the first
+// time it runs, and compares each to the AnomalyHistoryDays days before it. Charges of the same amount to the same payee in the same account within
+// AnomalyDuplicateDays days are duplicates. A charge is an increase in price if the last AnomalyPriceRuns charges
+// to the payee were all the same smaller amount. A charge is unusual if it is more than AnomalyStdDevs standard
+// deviations above the average of at least AnomalyMinHistory charges to the same payee or category.
+const (
+	AnomalyLookbackDays  = 30
+	AnomalyHistoryDays   = 365
+	AnomalyDuplicateDays = 3
+	AnomalyPriceRuns     = 3
+	AnomalyMinHistory    = 5
+	AnomalyStdDevs       = 3
+)
+
+// Recurring transactions are proposed from the last SubscriptionHistoryDays days of transactions. A proposal needs
+// SubscriptionMinMatches transactions in a row on the same cadence, or SubscriptionMinYearlyMatches for yearly ones,
+// with every amount within SubscriptionAmountTolerance of the typical amount.
+const (
+	SubscriptionHistoryDays      = 3 * 365
+	SubscriptionMinMatches       = 3
+	SubscriptionMinYearlyMatches = 2
+	SubscriptionAmountTolerance  = 0.1
+)
+
+// Modes for converting amounts to a user's home currency
+const (
+	ConvertTransactionDate = "transactionDate"
+	ConvertLatest          = "latest"
+)
+
+// Granularities of reports over time
+const (
+	GranularityDaily     = "daily"
+	GranularityWeekly    = "weekly"
+	GranularityMonthly   = "monthly"
+	GranularityQuarterly = "quarterly"
+	GranularityYearly    = "yearly"
+)
+
+// Ways of grouping transactions in a spending report
+const (
+	GroupByCategory = "category"
+	GroupByPayee    = "payee"
+	GroupByAccount  = "account"
+)
+
+// MaxReportPeriods is the most periods a report over time can be broken into
+const MaxReportPeriods = 1000
+
 // CtxKeys keeps track of all context keys for easy iteration
 var CtxKeys = [...]string{
 	CtxDB,
@@ -53,6 +208,8 @@ var (
 	ErrNotLoggedIn     = errors.New("user is not logged in")
 	ErrBadRequest      = errors.New("request contains malformed data")
 	ErrInvalidCurrency = errors.New("the specified currency is not recognized")
+
+	ErrMissingExchangeRate = errors.New("there is no exchange rate for a currency that needs converting")
 )
 
 type currency struct {
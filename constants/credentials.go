@@ -20,6 +20,9 @@ var (
 
 	// GcsAccountJSON is a json service account credentials generated by google's api credentials
 	GcsAccountJSON = os.Getenv("GCS_ACCOUNT_JSON")
+
+	// BackupKeyFile is the path to a file holding the hex encoded 256 bit key used to encrypt backups
+	BackupKeyFile = os.Getenv("BACKUP_KEY_FILE")
 )
 
 func firstNonEmpty(vals ...string) string {
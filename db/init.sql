@@ -1,14 +1,23 @@
 CREATE TABLE users (
     id serial PRIMARY KEY,
     google_id varchar(40) UNIQUE,
-    email varchar(40) UNIQUE
+    email varchar(40) UNIQUE,
+    home_currency varchar(3) NOT NULL DEFAULT 'USD',
+    budget_mode varchar(20) NOT NULL DEFAULT 'category',
+    fiscal_year_start smallint NOT NULL DEFAULT 1
 );
 
 CREATE TABLE accounts (
     id serial PRIMARY KEY,
     name varchar(100) NOT NULL,
     currency varchar(3) NOT NULL,
-    user_id integer NOT NULL references users(id) DEFERRABLE INITIALLY DEFERRED
+    user_id integer NOT NULL references users(id) DEFERRABLE INITIALLY DEFERRED,
+    type varchar(20) NOT NULL DEFAULT 'checking',
+    opening_balance integer NOT NULL DEFAULT 0,
+    opening_date date,
+    institution varchar(100),
+    masked_number varchar(20),
+    closed boolean NOT NULL DEFAULT false
 );
 
 CREATE TABLE transactions (
@@ -19,6 +28,7 @@ CREATE TABLE transactions (
     amount integer NOT NULL,
     note varchar(256),
     related_transaction_id integer references transactions(id) DEFERRABLE INITIALLY DEFERRED,
+    recurring_transaction_id integer,
     account_id integer NOT NULL references accounts(id) DEFERRABLE INITIALLY DEFERRED
 );
 
@@ -34,7 +44,31 @@ CREATE TABLE recurring_transactions (
     schedule_type varchar(20) NOT NULL,
     seconds_between integer,
     day_of integer,
-    seconds_before_to_post integer NOT NULL
+    rrule varchar(256),
+    seconds_before_to_post integer NOT NULL,
+    end_date date,
+    max_occurrences integer,
+    occurrences integer NOT NULL DEFAULT 0,
+    completed boolean NOT NULL DEFAULT false,
+    business_day_adjustment varchar(20),
+    scheduled date
+);
+
+-- transactions link to the recurring transaction that posted them or that they were matched to
+ALTER TABLE transactions ADD FOREIGN KEY (recurring_transaction_id) references recurring_transactions(id) ON DELETE SET NULL DEFERRABLE INITIALLY DEFERRED;
+
+-- loans are the terms of loan accounts, whose payments are posted by a recurring transaction in the paying account
+CREATE TABLE loans (
+    account_id integer PRIMARY KEY references accounts(id) DEFERRABLE INITIALLY DEFERRED,
+    principal integer NOT NULL,
+    annual_rate double precision NOT NULL,
+    term_months integer NOT NULL,
+    frequency varchar(20) NOT NULL,
+    start_date date NOT NULL,
+    payment_account_id integer NOT NULL references accounts(id) DEFERRABLE INITIALLY DEFERRED,
+    interest_category varchar(100) NOT NULL,
+    payment integer NOT NULL,
+    recurring_transaction_id integer references recurring_transactions(id) ON DELETE SET NULL DEFERRABLE INITIALLY DEFERRED
 );
 
 CREATE TABLE templates (
@@ -47,9 +81,248 @@ CREATE TABLE templates (
     account_id integer NOT NULL references accounts(id) DEFERRABLE INITIALLY DEFERRED
 );
 
+-- budgets are amounts in the user's home currency that they plan to spend in a category in a month
+CREATE TABLE budgets (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL references users(id) DEFERRABLE INITIALLY DEFERRED,
+    category varchar(100) NOT NULL,
+    month date NOT NULL,
+    amount integer NOT NULL,
+    rollover boolean NOT NULL DEFAULT false,
+    UNIQUE (user_id, category, month)
+);
+
+-- envelope_assignments are amounts of income in the user's home currency assigned to a category's envelope in a month
+CREATE TABLE envelope_assignments (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL references users(id) DEFERRABLE INITIALLY DEFERRED,
+    category varchar(100) NOT NULL,
+    month date NOT NULL,
+    amount integer NOT NULL,
+    UNIQUE (user_id, category, month)
+);
+
+-- income_categories are the categories whose transactions fund the pool of money to assign to envelopes
+CREATE TABLE income_categories (
+    user_id integer NOT NULL references users(id) DEFERRABLE INITIALLY DEFERRED,
+    category varchar(100) NOT NULL,
+    PRIMARY KEY (user_id, category)
+);
+
+-- goals are amounts a user is saving towards by a date, tracked by the balance of an account or the money put into a category
+CREATE TABLE goals (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL references users(id) DEFERRABLE INITIALLY DEFERRED,
+    name varchar(100) NOT NULL,
+    target_amount integer NOT NULL,
+    target_date date NOT NULL,
+    start_date date NOT NULL,
+    account_id integer references accounts(id) ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED,
+    category varchar(100),
+    CHECK ((account_id IS NULL) != (category IS NULL))
+);
+
+-- tax_lines are lines of a tax return, such as charitable donations, that a user totals categories into
+CREATE TABLE tax_lines (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL references users(id) DEFERRABLE INITIALLY DEFERRED,
+    name varchar(100) NOT NULL,
+    UNIQUE (user_id, name)
+);
+
+CREATE TABLE tax_line_categories (
+    tax_line_id integer NOT NULL references tax_lines(id) ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED,
+    category varchar(100) NOT NULL,
+    PRIMARY KEY (tax_line_id, category)
+);
+
+-- anomalies are transactions that look off compared to the user's history, kept until the user dismisses them
+CREATE TABLE anomalies (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL references users(id) DEFERRABLE INITIALLY DEFERRED,
+    transaction_id integer NOT NULL references transactions(id) ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED,
+    kind varchar(20) NOT NULL,
+    explanation varchar(256) NOT NULL,
+    detected date NOT NULL,
+    dismissed boolean NOT NULL DEFAULT false,
+    UNIQUE (transaction_id, kind)
+);
+
+-- anomaly_checks holds the newest transaction that anomaly detection has checked, so each transaction is checked once
+CREATE TABLE anomaly_checks (
+    id integer PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+    last_transaction_id integer NOT NULL
+);
+
+-- holidays are days a user's bank is closed, which recurring transactions can be moved off of
+CREATE TABLE holidays (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL references users(id) DEFERRABLE INITIALLY DEFERRED,
+    date date NOT NULL,
+    name varchar(100) NOT NULL,
+    UNIQUE (user_id, date)
+);
+
+-- recurring exceptions skip, move or change a single run of a recurring transaction, keyed by the date it would run.
+-- moved runs post on their own when their new date comes up, and are marked as posted.
+CREATE TABLE recurring_exceptions (
+    id serial PRIMARY KEY,
+    recurring_transaction_id integer NOT NULL references recurring_transactions(id) ON DELETE CASCADE DEFERRABLE INITIALLY DEFERRED,
+    date date NOT NULL,
+    skip boolean NOT NULL DEFAULT false,
+    move_to date,
+    amount integer,
+    name varchar(100),
+    note varchar(256),
+    posted boolean NOT NULL DEFAULT false,
+    UNIQUE (recurring_transaction_id, date)
+);
+
+CREATE TABLE audit_log (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL,
+    action varchar(40) NOT NULL,
+    detail text,
+    occurred timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE jobs (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL references users(id) DEFERRABLE INITIALLY DEFERRED,
+    kind varchar(20) NOT NULL,
+    status varchar(20) NOT NULL,
+    done integer NOT NULL DEFAULT 0,
+    total integer NOT NULL DEFAULT 0,
+    error text,
+    result bytea,
+    result_type varchar(100),
+    created timestamp with time zone NOT NULL DEFAULT now(),
+    updated timestamp with time zone NOT NULL DEFAULT now()
+);
+
+-- exchange rates are quoted as units of currency per one unit of the EUR base currency, like the ECB reference rates.
+-- rates without a user are shared by everyone, and users can override them with rates of their own.
+CREATE TABLE exchange_rates (
+    user_id integer references users(id) DEFERRABLE INITIALLY DEFERRED,
+    currency varchar(3) NOT NULL,
+    effective date NOT NULL,
+    rate double precision NOT NULL
+);
+CREATE UNIQUE INDEX exchange_rates_user_currency_effective ON exchange_rates ((COALESCE(user_id, 0)), currency, effective);
+
+-- fx_base_rate returns the rate of a currency against the base currency on a date, for a user.
+-- The user's own newest rate on or before the date is used, then the newest shared rate,
+-- falling back to the oldest rates for dates before the rate history starts. Returns NULL if there are no rates.
+CREATE FUNCTION fx_base_rate(cur varchar, on_date date, uid integer) RETURNS double precision AS $$
+    SELECT CASE WHEN cur = 'EUR' THEN 1.0 ELSE COALESCE(
+        (SELECT rate FROM exchange_rates WHERE user_id = uid AND currency = cur AND effective <= on_date ORDER BY effective DESC LIMIT 1),
+        (SELECT rate FROM exchange_rates WHERE user_id IS NULL AND currency = cur AND effective <= on_date ORDER BY effective DESC LIMIT 1),
+        (SELECT rate FROM exchange_rates WHERE user_id = uid AND currency = cur ORDER BY effective LIMIT 1),
+        (SELECT rate FROM exchange_rates WHERE user_id IS NULL AND currency = cur ORDER BY effective LIMIT 1)
+    ) END
+$$ LANGUAGE SQL STABLE;
+
+-- fx_rate returns how many units of to_currency one unit of from_currency is worth on a date, for a user.
+-- Amounts are in minor units, so callers still need to rescale by the difference in decimal digits.
+CREATE FUNCTION fx_rate(from_currency varchar, to_currency varchar, on_date date, uid integer) RETURNS double precision AS $$
+    SELECT CASE WHEN from_currency = to_currency THEN 1.0
+        ELSE fx_base_rate(to_currency, on_date, uid) / fx_base_rate(from_currency, on_date, uid) END
+$$ LANGUAGE SQL STABLE;
+
+CREATE TABLE securities (
+    id serial PRIMARY KEY,
+    user_id integer NOT NULL references users(id) DEFERRABLE INITIALLY DEFERRED,
+    symbol varchar(20) NOT NULL,
+    name varchar(100) NOT NULL,
+    currency varchar(3) NOT NULL,
+    UNIQUE (user_id, symbol)
+);
+
+-- prices are per unit of a security, in minor units of its currency
+CREATE TABLE security_prices (
+    security_id integer NOT NULL references securities(id) DEFERRABLE INITIALLY DEFERRED,
+    effective date NOT NULL,
+    price double precision NOT NULL,
+    PRIMARY KEY (security_id, effective)
+);
+
+CREATE TABLE investment_transactions (
+    id serial PRIMARY KEY,
+    account_id integer NOT NULL references accounts(id) DEFERRABLE INITIALLY DEFERRED,
+    security_id integer NOT NULL references securities(id) DEFERRABLE INITIALLY DEFERRED,
+    occurred date NOT NULL,
+    action varchar(20) NOT NULL,
+    quantity double precision NOT NULL DEFAULT 0,
+    price double precision NOT NULL DEFAULT 0,
+    fees integer NOT NULL DEFAULT 0,
+    amount integer NOT NULL DEFAULT 0,
+    lot_method varchar(20),
+    transaction_id integer references transactions(id) ON DELETE SET NULL DEFERRABLE INITIALLY DEFERRED,
+    -- the change in units held, derived when lots are rebuilt so that holdings on a date are a simple sum
+    quantity_delta double precision NOT NULL DEFAULT 0
+);
+
+-- lot_selections are the lots a sale sells from when it uses specific identification.
+-- Lots are identified by the buy or reinvestment that opened them.
+CREATE TABLE lot_selections (
+    sale_id integer NOT NULL references investment_transactions(id) DEFERRABLE INITIALLY DEFERRED,
+    lot_id integer NOT NULL references investment_transactions(id) DEFERRABLE INITIALLY DEFERRED,
+    quantity double precision NOT NULL,
+    PRIMARY KEY (sale_id, lot_id)
+);
+
+-- lots and lot_disposals are derived from investment_transactions, and are rebuilt whenever
+-- the investment transactions of an account and security change
+CREATE TABLE lots (
+    id integer PRIMARY KEY references investment_transactions(id) DEFERRABLE INITIALLY DEFERRED,
+    account_id integer NOT NULL references accounts(id) DEFERRABLE INITIALLY DEFERRED,
+    security_id integer NOT NULL references securities(id) DEFERRABLE INITIALLY DEFERRED,
+    acquired date NOT NULL,
+    quantity double precision NOT NULL,
+    remaining double precision NOT NULL,
+    cost integer NOT NULL,
+    remaining_cost integer NOT NULL
+);
+
+CREATE TABLE lot_disposals (
+    sale_id integer NOT NULL references investment_transactions(id) DEFERRABLE INITIALLY DEFERRED,
+    lot_id integer NOT NULL references lots(id) DEFERRABLE INITIALLY DEFERRED,
+    quantity double precision NOT NULL,
+    cost integer NOT NULL,
+    proceeds integer NOT NULL,
+    PRIMARY KEY (sale_id, lot_id)
+);
+
+-- security_price returns the price of a security on a date, from the newest uploaded price or trade on or before the date
+CREATE FUNCTION security_price(sec integer, on_date date) RETURNS double precision AS $$
+    SELECT price FROM (
+        SELECT effective AS priced, price FROM security_prices WHERE security_id = sec AND effective <= on_date
+        UNION ALL
+        SELECT occurred, price FROM investment_transactions WHERE security_id = sec AND action IN ('buy', 'sell') AND price > 0 AND occurred <= on_date
+    ) prices ORDER BY priced DESC LIMIT 1
+$$ LANGUAGE SQL STABLE;
+
+-- holdings_value returns the market value of the securities held in an account on a date, in minor units
+CREATE FUNCTION holdings_value(acct integer, on_date date) RETURNS double precision AS $$
+    SELECT COALESCE(SUM(held.quantity * COALESCE(security_price(held.security_id, on_date), 0)), 0) FROM (
+        SELECT security_id, SUM(quantity_delta) AS quantity FROM investment_transactions
+        WHERE account_id = acct AND occurred <= on_date
+        GROUP BY security_id
+    ) held
+$$ LANGUAGE SQL STABLE;
+
 CREATE INDEX ON users(google_id);
 CREATE INDEX ON accounts(user_id);
 CREATE INDEX ON transactions(account_id, occurred DESC, id);
+CREATE INDEX ON transactions(recurring_transaction_id);
 CREATE INDEX ON recurring_transactions(account_id);
 CREATE INDEX ON recurring_transactions((next_occurs - interval '1 second' * seconds_before_to_post));
 CREATE INDEX ON templates(account_id);
+CREATE INDEX ON loans(recurring_transaction_id);
+CREATE INDEX ON goals(user_id);
+CREATE INDEX ON anomalies(user_id);
+CREATE INDEX ON securities(user_id);
+CREATE INDEX ON investment_transactions(account_id, security_id, occurred);
+CREATE INDEX ON lots(account_id, security_id);
+CREATE INDEX ON audit_log(user_id);
+CREATE INDEX ON jobs(user_id, created DESC);
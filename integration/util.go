@@ -56,7 +56,7 @@ func ESConn(t *testing.T) *elastic.Client {
 }
 
 func ContextWithUserDBES(uid uint, db *sql.DB, es *elastic.Client) context.Context {
-	return context.WithValue(context.WithValue(context.WithValue(context.Background(), constants.CTX_USER_ID, uid), constants.CTX_DB, db), constants.CTX_ES, es)
+	return context.WithValue(context.WithValue(context.WithValue(context.Background(), constants.CtxUserID, uid), constants.CtxDB, db), constants.CtxES, es)
 }
 
 func NewUser(t *testing.T, ctx context.Context) uint {
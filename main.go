@@ -12,7 +12,9 @@ import (
 	"gopkg.in/olivere/elastic.v5"
 	"gopkg.in/robfig/cron.v2"
 
+	"github.com/jchorl/financejc/api/anomaly"
 	"github.com/jchorl/financejc/api/handlers"
+	"github.com/jchorl/financejc/api/job"
 	"github.com/jchorl/financejc/api/transaction"
 	"github.com/jchorl/financejc/api/transfer/batchTransfer"
 	"github.com/jchorl/financejc/constants"
@@ -42,10 +44,22 @@ func main() {
 		// ignore the error because it should already be logged in GenRecurringTransactions
 		transaction.GenRecurringTransactions(ctx)
 	})
+	c.AddFunc("@daily", func() {
+		// ignore the error because it should already be logged in Detect
+		anomaly.Detect(ctx)
+	})
 	c.AddFunc("@daily", func() {
 		// ignore the error because it should already be logged in BackupToGCS
 		batchTransfer.BackupToGCS(ctx)
 	})
+	c.AddFunc("@hourly", func() {
+		// ignore the error because it should already be logged in Cleanup
+		job.Cleanup(ctx)
+	})
+	c.AddFunc("@weekly", func() {
+		// ignore the error because the outcome of the drill is logged in BackupDrill
+		batchTransfer.BackupDrill(ctx)
+	})
 	c.Start()
 
 	e := echo.New()